@@ -0,0 +1,119 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CreateAPIKeyReq(keys services.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expiresInDays"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Key name is required"})
+			return
+		}
+		if len(req.Scopes) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !slices.Contains(services.APIKeyScopes, scope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+				return
+			}
+		}
+		if req.ExpiresInDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiresInDays must not be negative"})
+			return
+		}
+
+		key, id, secretHash, err := middlware.NewAPIKey()
+		if err != nil {
+			log.Printf("Failed to generate API key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		now := time.Now()
+		apiKey := services.APIKey{
+			ID:         id,
+			UserID:     claims.ID,
+			Name:       req.Name,
+			Scopes:     slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+			SecretHash: secretHash,
+			CreatedAt:  now.Unix(),
+		}
+		if req.ExpiresInDays > 0 {
+			apiKey.ExpiresAt = now.AddDate(0, 0, req.ExpiresInDays).Unix()
+		}
+
+		if err := keys.Create(apiKey); err != nil {
+			log.Printf("Failed to store API key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "API key created. Copy it now, it will not be shown again.",
+			"key":     key,
+			"apiKey":  apiKey,
+		})
+	}
+}
+
+func ListAPIKeysReq(keys services.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		list, err := keys.ListByUser(claims.ID)
+		if err != nil {
+			log.Printf("Failed to list API keys: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+			return
+		}
+		if list == nil {
+			list = []services.APIKey{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"apiKeys": list})
+	}
+}
+
+func DeleteAPIKeyReq(keys services.APIKeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		err := keys.Delete(c.Param("id"), claims.ID)
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete API key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+	}
+}
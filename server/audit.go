@@ -0,0 +1,84 @@
+package server
+
+import (
+	"congenial-goggles/server/services"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditDefaultRange = 7 * 24 * time.Hour
+	// auditMaxDayScan bounds unfiltered queries, which read one partition per day.
+	auditMaxDayScan = 31 * 24 * time.Hour
+	auditMaxLimit   = 1000
+)
+
+// ListAuditEventsReq serves GET /admin/audit. Filters: actor, event, from and to (RFC 3339,
+// default the last 7 days), limit, and before (the "next" value of the previous page).
+func ListAuditEventsReq(client *dynamodb.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := services.AuditQuery{
+			ActorID: c.Query("actor"),
+			Event:   c.Query("event"),
+			Before:  c.Query("before"),
+			To:      time.Now(),
+			Limit:   100,
+		}
+
+		if to := c.Query("to"); to != "" {
+			t, err := time.Parse(time.RFC3339, to)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+				return
+			}
+			q.To = t
+		}
+		q.From = q.To.Add(-auditDefaultRange)
+		if from := c.Query("from"); from != "" {
+			t, err := time.Parse(time.RFC3339, from)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+				return
+			}
+			q.From = t
+		}
+		if q.From.After(q.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+			return
+		}
+		if q.ActorID == "" && q.Event == "" && q.To.Sub(q.From) > auditMaxDayScan {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Without an actor or event filter the time range can be at most 31 days"})
+			return
+		}
+
+		if limit := c.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 || n > auditMaxLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+				return
+			}
+			q.Limit = n
+		}
+
+		events, err := services.QueryAuditEvents(client, "AuditLog", q)
+		if err != nil {
+			log.Printf("Failed to query audit log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+			return
+		}
+		if events == nil {
+			events = []services.AuditEvent{}
+		}
+
+		response := gin.H{"events": events}
+		if len(events) == q.Limit {
+			response["next"] = events[len(events)-1].TS
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var avatarSizes = []int{64, 256, 512}
+
+const (
+	defaultAvatarSize = 256
+	maxAvatarPixels   = 40_000_000
+)
+
+// avatarMaxBytes is the upload limit, AVATAR_MAX_BYTES or 5 MiB.
+func avatarMaxBytes() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("AVATAR_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return 5 << 20
+}
+
+// avatarPrefix is where every avatar a user uploads is kept, each under its own prefix.
+func avatarPrefix(userID string) string {
+	return "avatars/" + userID + "/"
+}
+
+// avatarObjectKey names one thumbnail under the avatar prefix stored on the user.
+func avatarObjectKey(prefix string, size int) string {
+	return fmt.Sprintf("%s/%d.png", prefix, size)
+}
+
+// decodeAvatar accepts PNG, JPEG and WebP, checking dimensions before decoding pixels.
+func decodeAvatar(data []byte) (image.Image, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !slices.Contains([]string{"png", "jpeg", "webp"}, format) {
+		return nil, errors.New("avatar must be a PNG, JPEG or WebP image")
+	}
+	if cfg.Width == 0 || cfg.Height == 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, errors.New("avatar dimensions are too large")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("avatar image could not be decoded")
+	}
+	return img, nil
+}
+
+// squareThumbnail centre-crops src to a square and scales it to size×size.
+func squareThumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2))
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+func UploadAvatarReq(users services.UserRepository, blobs services.BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		maxBytes := avatarMaxBytes()
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+1<<20)
+
+		file, header, err := c.Request.FormFile("avatar")
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar must be smaller than %d bytes", maxBytes)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to retrieve avatar"})
+			return
+		}
+		defer file.Close()
+
+		if header.Size > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar must be smaller than %d bytes", maxBytes)})
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read avatar"})
+			return
+		}
+		if int64(len(data)) > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar must be smaller than %d bytes", maxBytes)})
+			return
+		}
+
+		img, err := decodeAvatar(data)
+		if err != nil {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		// Each upload gets a new prefix so cached URLs for the old avatar never show the new one.
+		prefix := fmt.Sprintf("%s%d", avatarPrefix(user.ID), time.Now().UnixNano())
+		for _, size := range avatarSizes {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, squareThumbnail(img, size)); err != nil {
+				log.Printf("Failed to encode avatar: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process avatar"})
+				return
+			}
+			if err := blobs.Put(avatarObjectKey(prefix, size), "image/png", &buf); err != nil {
+				log.Printf("Failed to store avatar: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+				return
+			}
+		}
+
+		if err := users.SetAttributes(user.ID, map[string]interface{}{"avatarKey": prefix}); err != nil {
+			log.Printf("Failed to record avatar: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+			return
+		}
+
+		if user.AvatarKey != "" {
+			for _, size := range avatarSizes {
+				if err := blobs.Delete(avatarObjectKey(user.AvatarKey, size)); err != nil {
+					log.Printf("Failed to delete old avatar: %v", err)
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":   "Avatar updated",
+			"avatarKey": prefix,
+			"sizes":     avatarSizes,
+		})
+	}
+}
+
+// sharesOrg reports whether two users belong to at least one organization together.
+func sharesOrg(members services.OrgMemberRepository, userID, otherID string) (bool, error) {
+	mine, err := members.ListByUser(userID)
+	if err != nil {
+		return false, err
+	}
+	theirs, err := members.ListByUser(otherID)
+	if err != nil {
+		return false, err
+	}
+	for _, member := range mine {
+		if slices.ContainsFunc(theirs, func(m services.OrgMember) bool { return m.OrgID == member.OrgID }) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetAvatarReq redirects to a short-lived presigned URL for the requested size (64, 256 or
+// 512). Users see their own avatar and those of people in their organizations; admins see
+// everyone's. Anyone else gets a 404, as if there were no avatar.
+func GetAvatarReq(users services.UserRepository, members services.OrgMemberRepository, blobs services.BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		if claims.ID != c.Param("id") && !claims.IsAdmin() {
+			shared, err := sharesOrg(members, claims.ID, c.Param("id"))
+			if err != nil {
+				log.Printf("Failed to list org memberships: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch avatar"})
+				return
+			}
+			if !shared {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+				return
+			}
+		}
+
+		size := defaultAvatarSize
+		if v := c.Query("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || !slices.Contains(avatarSizes, n) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "size must be one of 64, 256 or 512"})
+				return
+			}
+			size = n
+		}
+
+		user, err := users.Get(c.Param("id"))
+		if err != nil {
+			log.Printf("Failed to load user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch avatar"})
+			return
+		}
+		if user == nil || user.AvatarKey == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+			return
+		}
+
+		url, err := blobs.SignedURL(avatarObjectKey(user.AvatarKey, size), services.DefaultURLExpiry)
+		if err != nil {
+			log.Printf("Failed to presign avatar URL: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch avatar"})
+			return
+		}
+
+		c.Header("Cache-Control", "private, max-age=240")
+		c.Redirect(http.StatusFound, url)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newAvatarTestApp adds the avatar routes.
+func newAvatarTestApp(t *testing.T) *testApp {
+	t.Helper()
+	app := newTestApp(t)
+	auth := app.r.Group("/", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions))
+	auth.PUT("/users/me/avatar", UploadAvatarReq(app.users, app.blobs))
+	auth.GET("/users/:id/avatar", GetAvatarReq(app.users, app.members, app.blobs))
+	return app
+}
+
+func (app *testApp) uploadAvatar(t *testing.T, token string) {
+	t.Helper()
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 30)))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("avatar", "me.png")
+	part.Write(img.Bytes())
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPut, "/users/me/avatar", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if w := app.serve(req, token); w.Code != http.StatusOK {
+		t.Fatalf("upload avatar: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetAvatarAccess(t *testing.T) {
+	app := newAvatarTestApp(t)
+	ann := app.addUser(t, "u_ann", "ann@example.com", "")
+	bob := app.addUser(t, "u_bob", "bob@example.com", "")
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+	app.uploadAvatar(t, ann.AccessToken)
+
+	getAvatar := func(token string) int {
+		return app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann/avatar?size=64", nil), token).Code
+	}
+	if code := getAvatar(ann.AccessToken); code != http.StatusFound {
+		t.Errorf("own avatar: status = %d, want 302", code)
+	}
+	if code := getAvatar(admin.AccessToken); code != http.StatusFound {
+		t.Errorf("avatar as admin: status = %d, want 302", code)
+	}
+	if code := getAvatar(bob.AccessToken); code != http.StatusNotFound {
+		t.Errorf("avatar of a stranger: status = %d, want 404", code)
+	}
+
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_ann", Role: services.OrgRoleOwner})
+	app.members.Put(services.OrgMember{OrgID: "o_other", UserID: "u_bob", Role: services.OrgRoleViewer})
+	if code := getAvatar(bob.AccessToken); code != http.StatusNotFound {
+		t.Errorf("avatar of someone in another org: status = %d, want 404", code)
+	}
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_bob", Role: services.OrgRoleViewer})
+	if code := getAvatar(bob.AccessToken); code != http.StatusFound {
+		t.Errorf("avatar of someone in the same org: status = %d, want 302", code)
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_bob/avatar", nil), admin.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("user without an avatar: status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"congenial-goggles/server/services"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newObjectKey picks the key for a new upload of file id. Keys are unique per upload, so
+// writing one never touches the contents an existing record is served from.
+func newObjectKey(id, org string) string {
+	if org != "" {
+		return "orgs/" + org + "/files/" + id + "/" + ShortUUID()
+	}
+	return "files/" + id + "/" + ShortUUID()
+}
+
+// checkFileOwner loads the record an upload of id would replace. It responds and returns
+// false if that record belongs to another user.
+func checkFileOwner(files services.FileRepository, c *gin.Context, id, userID string) (*services.File, bool) {
+	existing, err := files.Get(id)
+	if err != nil {
+		log.Printf("Failed to retrieve file metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file metadata"})
+		return nil, false
+	}
+	if existing != nil && existing.User != userID {
+		c.JSON(http.StatusConflict, gin.H{"error": "This file name and secret are already in use"})
+		return nil, false
+	}
+	return existing, true
+}
+
+// saveFile stores file and then deletes the contents of the record it replaced. Files
+// from before per-file keys are left alone, since others may share their object.
+func saveFile(files services.FileRepository, blobs services.BlobStore, previous *services.File, file services.File) error {
+	if err := files.Create(file); err != nil {
+		return err
+	}
+	if previous != nil && previous.ObjectKey != "" && previous.ObjectKey != file.ObjectKey {
+		if err := blobs.Delete(previous.ObjectKey); err != nil {
+			log.Printf("Failed to delete replaced contents of file %s: %v", file.ID, err)
+		}
+	}
+	return nil
+}
+
+// errBlobChanged means the object was replaced while a download was reading it.
+var errBlobChanged = errors.New("object changed during download")
+
+// blobReader is an io.ReadSeeker over a stored object. It only fetches from the store when
+// read, starting at the current offset and stopping at the end of the requested range that
+// holds it, so http.ServeContent pulls just the bytes it sends.
+type blobReader struct {
+	blobs  services.BlobStore
+	key    string
+	info   *services.BlobInfo
+	ranges []byteRange
+	offset int64
+	body   io.ReadCloser
+	// err is the first failed read, which ServeContent would otherwise swallow.
+	err error
+}
+
+// byteRange is the bytes from start up to, but not including, end.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange reads the ranges of a Range header for an object of size bytes. It returns
+// nil for a header it cannot use; the reader then fetches to the end of the object, and
+// ServeContent still decides what to send.
+func parseRange(header string, size int64) []byteRange {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil
+	}
+
+	var ranges []byteRange
+	for _, part := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil
+		}
+		var rg byteRange
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil
+			}
+			rg = byteRange{start: max(size-n, 0), end: size}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil
+			}
+			rg = byteRange{start: start, end: size}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil
+				}
+				rg.end = min(end+1, size)
+			}
+		}
+		ranges = append(ranges, rg)
+	}
+	return ranges
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		length := int64(-1)
+		for _, rg := range r.ranges {
+			if r.offset >= rg.start && r.offset < rg.end {
+				length = rg.end - r.offset
+				break
+			}
+		}
+		body, info, err := r.blobs.GetRange(r.key, r.offset, length)
+		if err == nil && info.ETag != r.info.ETag {
+			body.Close()
+			err = errBlobChanged
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.info.Size {
+		// The fetched range is done but ServeContent wants more, as it does when If-Range
+		// turns a range request into a full one; the next read fetches from here.
+		r.Close()
+		err = nil
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	if offset != r.offset {
+		r.Close()
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// streamBlob sends a stored object as an attachment. It answers Range requests (including
+// multi-range and If-Range) with 206, reading only the requested bytes from the store, and
+// conditional requests on ETag and Last-Modified with 304.
+func streamBlob(c *gin.Context, blobs services.BlobStore, key, fileName string) error {
+	info, err := blobs.Head(key)
+	if err != nil {
+		return err
+	}
+
+	content := &blobReader{blobs: blobs, key: key, info: info, ranges: parseRange(c.GetHeader("Range"), info.Size)}
+	defer content.Close()
+
+	// Without a Content-Type, ServeContent sniffs one by reading from the start of the
+	// object, which would fetch all of it whatever range was asked for.
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	c.Header("Content-Type", contentType)
+	if info.ETag != "" {
+		c.Header("ETag", info.ETag)
+	}
+
+	// Downloads are POSTed to keep the secrets out of URLs, but they are still reads, and
+	// ServeContent only answers If-None-Match and If-Modified-Since with 304 for GET.
+	req := c.Request
+	if req.Method == http.MethodPost {
+		req = req.Clone(req.Context())
+		req.Method = http.MethodGet
+	}
+	http.ServeContent(c.Writer, req, "", info.LastModified, content)
+
+	if content.err != nil {
+		log.Println("Error streaming blob:", content.err)
+		return fmt.Errorf("failed to stream file")
+	}
+	return nil
+}
+
+// LocalBlobReq serves objects from the local-disk store to holders of a signed URL.
+func LocalBlobReq(store *services.LocalBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		if !store.VerifySignature(key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+			return
+		}
+
+		body, info, err := store.Get(key)
+		if errors.Is(err, services.ErrBlobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to open blob %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer body.Close()
+
+		// The local store hands back the open file for whole-object reads.
+		file, ok := body.(*os.File)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+
+		c.Header("Content-Type", info.ContentType)
+		if info.ETag != "" {
+			c.Header("ETag", info.ETag)
+		}
+		http.ServeContent(c.Writer, c.Request, "", info.LastModified, file)
+	}
+}
+
+// LocalBlobUploadReq accepts uploads to URLs from the local store's SignedPutURL and
+// SignedPartURL, the way S3 accepts presigned PUTs. A body that doesn't have the signed
+// checksum is thrown away.
+func LocalBlobUploadReq(store *services.LocalBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		uploadID, partNumber := c.Query("uploadId"), c.Query("partNumber")
+		checksum := c.GetHeader(services.LocalChecksumHeader)
+		contentType := ""
+		if uploadID == "" {
+			contentType = c.GetHeader("Content-Type")
+		}
+		if !store.VerifyUploadSignature(key, uploadID, partNumber, contentType, checksum, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+			return
+		}
+
+		var err error
+		if uploadID == "" {
+			err = store.PutChecksummed(key, contentType, checksum, c.Request.Body)
+		} else {
+			var number int
+			number, err = strconv.Atoi(partNumber)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partNumber"})
+				return
+			}
+			var part services.BlobPart
+			part, err = store.UploadChecksummedPart(key, uploadID, int32(number), checksum, c.Request.Body)
+			if err == nil {
+				c.Header("ETag", part.ETag)
+			}
+		}
+		if errors.Is(err, services.ErrChecksumMismatch) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Uploaded checksum does not match"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to store upload of %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/services"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rangeRecorder notes every read the handler makes from the store. With noContentType set
+// it reports objects as having no content type.
+type rangeRecorder struct {
+	services.BlobStore
+	reads         []byteRange
+	noContentType bool
+}
+
+func (r *rangeRecorder) Head(key string) (*services.BlobInfo, error) {
+	info, err := r.BlobStore.Head(key)
+	if err == nil && r.noContentType {
+		info.ContentType = ""
+	}
+	return info, err
+}
+
+func (r *rangeRecorder) GetRange(key string, offset, length int64) (io.ReadCloser, *services.BlobInfo, error) {
+	end := int64(-1)
+	if length >= 0 {
+		end = offset + length
+	}
+	r.reads = append(r.reads, byteRange{start: offset, end: end})
+	return r.BlobStore.GetRange(key, offset, length)
+}
+
+func newStreamTest(t *testing.T) (*gin.Engine, *rangeRecorder, []byte, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	local, err := services.NewLocalBlobStore(t.TempDir(), []byte("secret"), "http://files.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	if err := local.Put("files/f/1", "text/plain", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := local.Head("files/f/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &rangeRecorder{BlobStore: local}
+	r := gin.New()
+	r.POST("/download", func(c *gin.Context) {
+		if err := streamBlob(c, store, "files/f/1", "f.txt"); err != nil {
+			t.Errorf("streamBlob: %v", err)
+		}
+	})
+	return r, store, content, info.ETag
+}
+
+func download(r *gin.Engine, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/download", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestStreamBlobWhole(t *testing.T) {
+	r, _, content, etag := newStreamTest(t)
+
+	w := download(r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Error("body does not match the object")
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag = %q, want %q", got, etag)
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, "f.txt") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestStreamBlobRange(t *testing.T) {
+	r, store, content, _ := newStreamTest(t)
+
+	w := download(r, map[string]string{"Range": "bytes=100-199"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content[100:200]) {
+		t.Errorf("body = %q, want bytes 100-199", w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 100-199/1000" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if len(store.reads) != 1 || store.reads[0] != (byteRange{start: 100, end: 200}) {
+		t.Errorf("store reads = %v, want just bytes 100-199", store.reads)
+	}
+}
+
+func TestStreamBlobRangeWithoutContentType(t *testing.T) {
+	r, store, content, _ := newStreamTest(t)
+	store.noContentType = true
+
+	w := download(r, map[string]string{"Range": "bytes=100-199"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content[100:200]) {
+		t.Errorf("body = %q, want bytes 100-199", w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type = %q, want application/octet-stream", got)
+	}
+	if len(store.reads) != 1 || store.reads[0] != (byteRange{start: 100, end: 200}) {
+		t.Errorf("store reads = %v, want just bytes 100-199", store.reads)
+	}
+}
+
+func TestStreamBlobMultipleRanges(t *testing.T) {
+	r, store, content, _ := newStreamTest(t)
+
+	w := download(r, map[string]string{"Range": "bytes=0-9,-10"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+
+	parts := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range [][]byte{content[:10], content[990:]} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(part)
+		if !bytes.Equal(got, want) {
+			t.Errorf("part = %q, want %q", got, want)
+		}
+	}
+	for _, read := range store.reads {
+		if read.end < 0 {
+			t.Errorf("store reads = %v, want each bounded to its range", store.reads)
+		}
+	}
+}
+
+func TestStreamBlobIfRange(t *testing.T) {
+	r, store, content, etag := newStreamTest(t)
+
+	w := download(r, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[:10]) {
+		t.Errorf("matching If-Range: status = %d, body = %q, want 206 with bytes 0-9", w.Code, w.Body.String())
+	}
+
+	store.reads = nil
+	w = download(r, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("stale If-Range: status = %d, want 200", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("stale If-Range: got %d bytes, want the whole object", w.Body.Len())
+	}
+}
+
+func TestStreamBlobNotModified(t *testing.T) {
+	r, store, _, etag := newStreamTest(t)
+
+	w := download(r, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", w.Code)
+	}
+	if w.Body.Len() != 0 || len(store.reads) != 0 {
+		t.Errorf("304 read %v from the store and sent %d bytes", store.reads, w.Body.Len())
+	}
+
+	w = download(r, map[string]string{"If-None-Match": `"other"`})
+	if w.Code != http.StatusOK {
+		t.Errorf("changed ETag: status = %d, want 200", w.Code)
+	}
+}
+
+func TestStreamBlobUnsatisfiableRange(t *testing.T) {
+	r, store, _, _ := newStreamTest(t)
+
+	w := download(r, map[string]string{"Range": "bytes=5000-"})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status = %d, want 416", w.Code)
+	}
+	if len(store.reads) != 0 {
+		t.Errorf("store reads = %v, want none", store.reads)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+	}{
+		{"bytes=0-99", []byteRange{{0, 100}}},
+		{"bytes=900-", []byteRange{{900, 1000}}},
+		{"bytes=-100", []byteRange{{900, 1000}}},
+		{"bytes=-5000", []byteRange{{0, 1000}}},
+		{"bytes=990-2000", []byteRange{{990, 1000}}},
+		{"bytes=0-0, 10-19", []byteRange{{0, 1}, {10, 20}}},
+		{"", nil},
+		{"items=0-1", nil},
+		{"bytes=9-1", nil},
+		{"bytes=a-b", nil},
+	}
+	for _, tt := range tests {
+		got := parseRange(tt.header, 1000)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package server
+
+import (
+	"archive/zip"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+// erasureJobRetention is how long the status of a finished erasure can be looked up.
+const erasureJobRetention = 30 * 24 * time.Hour
+
+// userExport is everything stored about a user, apart from file contents.
+type userExport struct {
+	Profile  services.User
+	Files    []services.File
+	Sessions []services.Session
+	Passkeys []services.Passkey
+	APIKeys  []services.APIKey
+	Orgs     []services.OrgMember
+	Posts    []services.BlogPost
+}
+
+// accountData is where a user's data is kept, for exporting and erasing it.
+type accountData struct {
+	users    services.UserRepository
+	files    services.FileRepository
+	passkeys services.PasskeyRepository
+	apiKeys  services.APIKeyRepository
+	posts    services.PostRepository
+	sessions services.SessionRepository
+	members  services.OrgMemberRepository
+	attempts services.LoginAttemptRepository
+	audit    services.AuditRepository
+	erasures services.ErasureJobRepository
+}
+
+func collectUserExport(data accountData, user *services.User) (*userExport, error) {
+	export := &userExport{Profile: *user}
+	export.Profile.Password = ""
+
+	var err error
+	if export.Files, err = data.files.ListByUser(user.ID); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = data.sessions.ListByUser(user.ID); err != nil {
+		return nil, err
+	}
+	if export.Passkeys, err = data.passkeys.ListByUser(user.ID); err != nil {
+		return nil, err
+	}
+	if export.APIKeys, err = data.apiKeys.ListByUser(user.ID); err != nil {
+		return nil, err
+	}
+	if export.Orgs, err = data.members.ListByUser(user.ID); err != nil {
+		return nil, err
+	}
+	if export.Posts, err = data.posts.ListByAuthor(user.ID); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func copyObjectToZip(zw *zip.Writer, blobs services.BlobStore, key, name string) error {
+	body, _, err := blobs.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// sharesLegacyObject reports whether another file is stored at the same uploads/<fileName>
+// key as file, from before files had keys of their own. Such contents can't be told apart,
+// so they are neither exported nor deleted on one user's behalf.
+func sharesLegacyObject(files services.FileRepository, file services.File) (bool, error) {
+	if file.ObjectKey != "" {
+		return false, nil
+	}
+	others, err := files.ListLegacyByName(file.FileName)
+	if err != nil {
+		return false, err
+	}
+	for _, other := range others {
+		if other.ID != file.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ExportUserDataReq streams a ZIP of the caller's profile, metadata and uploaded files.
+// Files that can't be read are listed in errors.txt rather than failing the whole export.
+func ExportUserDataReq(data accountData, blobs services.BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		user, err := data.users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		export, err := collectUserExport(data, user)
+		if err != nil {
+			log.Printf("Failed to collect export for %s: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data"})
+			return
+		}
+
+		middlware.Audit(data.audit, c, services.AuditEvent{Event: services.AuditDataExport, Outcome: services.AuditSuccess, Target: user.ID})
+
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.zip"`, user.ID))
+		c.Status(http.StatusOK)
+
+		zw := zip.NewWriter(c.Writer)
+		var problems []string
+		for _, entry := range []struct {
+			name string
+			v    any
+		}{
+			{"profile.json", export.Profile},
+			{"files.json", export.Files},
+			{"sessions.json", export.Sessions},
+			{"passkeys.json", export.Passkeys},
+			{"api-keys.json", export.APIKeys},
+			{"organizations.json", export.Orgs},
+			{"posts.json", export.Posts},
+		} {
+			if err := writeZipJSON(zw, entry.name, entry.v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", entry.name, err))
+			}
+		}
+
+		for _, file := range export.Files {
+			if !file.Active() {
+				continue
+			}
+			shared, err := sharesLegacyObject(data.files, file)
+			if err != nil || shared {
+				problems = append(problems, fmt.Sprintf("%s: contents could not be attributed to this file", file.FileName))
+				continue
+			}
+			name := "files/" + file.ID[:min(len(file.ID), 12)] + "-" + path.Base(file.FileName)
+			if err := copyObjectToZip(zw, blobs, file.BlobKey(), name); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", file.FileName, err))
+			}
+		}
+		if user.AvatarKey != "" {
+			size := avatarSizes[len(avatarSizes)-1]
+			if err := copyObjectToZip(zw, blobs, avatarObjectKey(user.AvatarKey, size), "avatar.png"); err != nil {
+				problems = append(problems, fmt.Sprintf("avatar: %v", err))
+			}
+		}
+
+		if len(problems) > 0 {
+			log.Printf("Export for %s was incomplete: %s", user.ID, strings.Join(problems, "; "))
+			if w, err := zw.Create("errors.txt"); err == nil {
+				io.WriteString(w, strings.Join(problems, "\n")+"\n")
+			}
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("Failed to finish export for %s: %v", user.ID, err)
+		}
+	}
+}
+
+// startErasure disables the account straight away, signs it out everywhere and deletes its
+// data in the background. It returns the token for checking on the job.
+func startErasure(data accountData, blobs services.BlobStore, resendClient *resend.Client, c *gin.Context, user *services.User) (string, error) {
+	token, err := middlware.NewOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := data.users.SetAttributes(user.ID, map[string]interface{}{"disabled": true}); err != nil {
+		return "", err
+	}
+	if _, err := revokeUserSessions(data.sessions, user.ID, ""); err != nil {
+		log.Printf("Failed to revoke sessions before erasure of %s: %v", user.ID, err)
+	}
+
+	now := time.Now()
+	job := services.ErasureJob{
+		ID:        middlware.HashToken(token),
+		UserID:    user.ID,
+		Status:    services.ErasurePending,
+		Deleted:   map[string]int{},
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(erasureJobRetention).Unix(),
+	}
+	if err := data.erasures.Save(job); err != nil {
+		return "", err
+	}
+
+	middlware.Audit(data.audit, c, services.AuditEvent{Event: services.AuditUserErase, Outcome: services.AuditSuccess, Target: user.ID})
+
+	go runErasure(data, blobs, resendClient, job, *user)
+	return token, nil
+}
+
+// runErasure deletes everything the user owns. The Users row goes last, and only if every
+// other step worked, so a failed job leaves a disabled account that can be erased again.
+func runErasure(data accountData, blobs services.BlobStore, resendClient *resend.Client, job services.ErasureJob, user services.User) {
+	job.Status = services.ErasureRunning
+	if err := data.erasures.Save(job); err != nil {
+		log.Printf("Failed to update erasure job for %s: %v", user.ID, err)
+	}
+
+	record := func(kind string, err error) {
+		if err != nil {
+			job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", kind, err))
+			return
+		}
+		job.Deleted[kind]++
+	}
+	listFailed := func(kind string, err error) bool {
+		if err != nil {
+			job.Errors = append(job.Errors, fmt.Sprintf("listing %s: %v", kind, err))
+		}
+		return err != nil
+	}
+
+	if files, err := data.files.ListByUser(user.ID); !listFailed("files", err) {
+		for _, file := range files {
+			// Files shared with an org belong to the org; they stay, without the uploader.
+			if file.Org != "" && file.Active() {
+				record("orgFilesDisowned", data.files.Disown(file.ID))
+				continue
+			}
+
+			if multipart, ok := blobs.(services.MultipartBlobStore); ok && file.UploadID != "" {
+				if err := multipart.AbortMultipart(file.BlobKey(), file.UploadID); err != nil {
+					record("objects", err)
+					continue
+				}
+			}
+			shared, err := sharesLegacyObject(data.files, file)
+			if err != nil {
+				record("objects", err)
+				continue
+			}
+			if !shared {
+				if err := blobs.Delete(file.BlobKey()); err != nil {
+					record("objects", err)
+					continue
+				}
+				record("objects", nil)
+			}
+			record("files", data.files.Delete(file.ID))
+		}
+	}
+
+	// Deleting the whole prefix also catches avatars an earlier upload failed to clean up.
+	if store, ok := blobs.(services.PrefixBlobStore); ok {
+		n, err := store.DeletePrefix(avatarPrefix(user.ID))
+		job.Deleted["objects"] += n
+		if err != nil {
+			record("objects", err)
+		}
+	} else if user.AvatarKey != "" {
+		for _, size := range avatarSizes {
+			record("objects", blobs.Delete(avatarObjectKey(user.AvatarKey, size)))
+		}
+	}
+
+	// ListByAuthor may return one page at a time, so keep going until a pass finds nothing
+	// or deletes nothing.
+	for {
+		posts, err := data.posts.ListByAuthor(user.ID)
+		if listFailed("posts", err) {
+			break
+		}
+		deleted := 0
+		for _, post := range posts {
+			err := data.posts.Delete(post.ID)
+			if err == nil {
+				deleted++
+			}
+			record("posts", err)
+		}
+		if deleted == 0 {
+			break
+		}
+	}
+
+	if sessions, err := data.sessions.ListByUser(user.ID); !listFailed("sessions", err) {
+		for _, session := range sessions {
+			record("sessions", data.sessions.Delete(session.ID))
+		}
+	}
+
+	if passkeys, err := data.passkeys.ListByUser(user.ID); !listFailed("passkeys", err) {
+		for _, passkey := range passkeys {
+			record("passkeys", data.passkeys.Delete(passkey.ID, user.ID))
+		}
+	}
+
+	if keys, err := data.apiKeys.ListByUser(user.ID); !listFailed("apiKeys", err) {
+		for _, key := range keys {
+			record("apiKeys", data.apiKeys.Delete(key.ID, user.ID))
+		}
+	}
+
+	if memberships, err := data.members.ListByUser(user.ID); !listFailed("orgMemberships", err) {
+		for _, member := range memberships {
+			record("orgMemberships", data.members.Delete(member.OrgID, user.ID))
+		}
+	}
+
+	// Failed sign-ins are keyed on a hash of the email rather than the address itself, and
+	// the audit log names the user only by ID, so neither holds the email once the account
+	// is gone. The counter is cleared anyway; the audit log is kept as the security record.
+	if err := data.attempts.Clear(accountAttemptKey(user.Email)); err != nil {
+		record("loginAttempts", err)
+	}
+
+	job.Status = services.ErasureCompleted
+	if len(job.Errors) == 0 {
+		record("users", data.users.Delete(user.ID))
+	}
+	if len(job.Errors) > 0 {
+		job.Status = services.ErasureFailed
+		log.Printf("Erasure of %s failed: %s", user.ID, strings.Join(job.Errors, "; "))
+	}
+
+	job.FinishedAt = time.Now().Unix()
+	if err := data.erasures.Save(job); err != nil {
+		log.Printf("Failed to update erasure job for %s: %v", user.ID, err)
+	}
+
+	if err := services.SendErasureComplete(resendClient, user.Email, job); err != nil {
+		log.Printf("Failed to send erasure email: %v", err)
+	}
+}
+
+// soleOwnedOrgs lists the organizations that would be left without an owner if the user
+// were erased.
+func soleOwnedOrgs(members services.OrgMemberRepository, userID string) ([]string, error) {
+	memberships, err := members.ListByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	var orgs []string
+	for _, member := range memberships {
+		if member.Role != services.OrgRoleOwner {
+			continue
+		}
+		last, err := isLastOwner(members, member.OrgID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			orgs = append(orgs, member.OrgID)
+		}
+	}
+	return orgs, nil
+}
+
+// refuseSoleOwnerErasure turns the request away, and returns true, while the user is the
+// only owner of an organization. Ownership has to be handed over first so the org's files
+// and members aren't stranded.
+func refuseSoleOwnerErasure(members services.OrgMemberRepository, c *gin.Context, userID string) bool {
+	orgs, err := soleOwnedOrgs(members, userID)
+	if err != nil {
+		log.Printf("Failed to check org ownership of %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return true
+	}
+	if len(orgs) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "The account is the only owner of an organization. Transfer ownership or delete the organization first.",
+			"orgs":  orgs,
+		})
+		return true
+	}
+	return false
+}
+
+func EraseMyAccountReq(data accountData, blobs services.BlobStore, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+			return
+		}
+
+		user, err := data.users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if !middlware.CheckPasswordHash(req.Password, user.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+			return
+		}
+		if refuseSoleOwnerErasure(data.members, c, user.ID) {
+			return
+		}
+
+		respondErasureStarted(data, blobs, resendClient, c, user)
+	}
+}
+
+func respondErasureStarted(data accountData, blobs services.BlobStore, resendClient *resend.Client, c *gin.Context, user *services.User) {
+	token, err := startErasure(data, blobs, resendClient, c, user)
+	if err != nil {
+		log.Printf("Failed to start erasure of %s: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   "Account disabled. Your data is being deleted and you will get an email when it is done.",
+		"jobId":     token,
+		"statusUrl": AppURL() + "/erasure-jobs/" + token,
+	})
+}
+
+func ErasureJobStatusReq(erasures services.ErasureJobRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := erasures.Get(middlware.HashToken(c.Param("id")))
+		if err != nil {
+			log.Printf("Failed to load erasure job: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load job"})
+			return
+		}
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
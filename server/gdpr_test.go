@@ -0,0 +1,183 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type erasureTestApp struct {
+	*testApp
+	data accountData
+}
+
+func newErasureTestApp(t *testing.T) *erasureTestApp {
+	t.Helper()
+	base := newTestApp(t)
+	app := &erasureTestApp{testApp: base, data: accountData{
+		users:    base.users,
+		files:    base.files,
+		passkeys: services.NewMemoryPasskeyRepository(),
+		apiKeys:  base.apiKeys,
+		posts:    services.NewMemoryPostRepository(),
+		sessions: base.sessions,
+		members:  base.members,
+		attempts: base.attempts,
+		audit:    base.audit,
+		erasures: services.NewMemoryErasureJobRepository(),
+	}}
+
+	r := app.r
+	r.GET("/erasure-jobs/:id", ErasureJobStatusReq(app.data.erasures))
+	auth := r.Group("/", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions))
+	auth.DELETE("/users/me", EraseMyAccountReq(app.data, app.blobs, app.mail))
+	auth.DELETE("/users/:id", middlware.RequireRole(services.RoleAdmin), DeleteUserReq(app.data, app.blobs, app.mail))
+	return app
+}
+
+// waitForErasure polls the job until it finishes and returns its final state.
+func (app *erasureTestApp) waitForErasure(t *testing.T, w *httptest.ResponseRecorder) services.ErasureJob {
+	t.Helper()
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("erase: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var started struct {
+		JobID string `json:"jobId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &started)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job services.ErasureJob
+		w := app.serve(httptest.NewRequest(http.MethodGet, "/erasure-jobs/"+started.JobID, nil), "")
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Status == services.ErasureCompleted || job.Status == services.ErasureFailed {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("erasure job still %q: %s", job.Status, w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEraseMyAccount(t *testing.T) {
+	app := newErasureTestApp(t)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	app.apiKeys.Create(services.APIKey{ID: "k1", UserID: "u_ann"})
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_ann", Role: services.OrgRoleViewer})
+	app.attempts.RecordFailure(accountAttemptKey("ann@example.com"), loginAttemptWindow)
+
+	// The current avatar, one an earlier upload failed to delete, and someone else's.
+	avatars := []string{"avatars/u_ann/2/64.png", "avatars/u_ann/1/512.png", "avatars/u_annie/1/64.png"}
+	for _, key := range avatars {
+		app.blobs.Put(key, "image/png", strings.NewReader("png"))
+	}
+	app.users.SetAttributes("u_ann", map[string]interface{}{"avatarKey": "avatars/u_ann/2"})
+
+	if w := app.serveJSON(http.MethodDelete, "/users/me", tokens.AccessToken, gin.H{"password": "wrong"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("erase with the wrong password: status = %d, want 401", w.Code)
+	}
+
+	job := app.waitForErasure(t, app.serveJSON(http.MethodDelete, "/users/me", tokens.AccessToken, gin.H{"password": testPassword}))
+	if job.Status != services.ErasureCompleted {
+		t.Fatalf("job = %+v, want completed", job)
+	}
+
+	if user, _ := app.users.Get("u_ann"); user != nil {
+		t.Error("user survived erasure")
+	}
+	if sessions, _ := app.sessions.ListByUser("u_ann"); len(sessions) != 0 {
+		t.Errorf("%d sessions survived erasure", len(sessions))
+	}
+	if keys, _ := app.apiKeys.ListByUser("u_ann"); len(keys) != 0 {
+		t.Errorf("%d API keys survived erasure", len(keys))
+	}
+	if memberships, _ := app.members.ListByUser("u_ann"); len(memberships) != 0 {
+		t.Errorf("%d memberships survived erasure", len(memberships))
+	}
+	if attempt, _ := app.attempts.Get(accountAttemptKey("ann@example.com")); attempt != nil {
+		t.Errorf("login attempts survived erasure: %+v", attempt)
+	}
+	for _, key := range avatars[:2] {
+		if _, err := app.blobs.Head(key); !errors.Is(err, services.ErrBlobNotFound) {
+			t.Errorf("avatar %s survived erasure: %v", key, err)
+		}
+	}
+	if _, err := app.blobs.Head(avatars[2]); err != nil {
+		t.Errorf("erasure deleted another user's avatar: %v", err)
+	}
+	if job.Deleted["objects"] != 2 {
+		t.Errorf("job counted %d deleted objects, want 2", job.Deleted["objects"])
+	}
+	if n := len(app.outbox.to("ann@example.com")); n != 1 {
+		t.Errorf("sent %d erasure emails, want 1", n)
+	}
+}
+
+func TestEraseSoleOrgOwnerRefused(t *testing.T) {
+	app := newErasureTestApp(t)
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_ann", Role: services.OrgRoleOwner})
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_bob", Role: services.OrgRoleAdmin})
+
+	w := app.serveJSON(http.MethodDelete, "/users/me", tokens.AccessToken, gin.H{"password": testPassword})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("erasing a sole owner: status = %d, want 409", w.Code)
+	}
+	var refused struct {
+		Orgs []string `json:"orgs"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &refused); len(refused.Orgs) != 1 || refused.Orgs[0] != "o_team" {
+		t.Errorf("refusal = %s, want it to name o_team", w.Body.String())
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_ann", nil), admin.AccessToken); w.Code != http.StatusConflict {
+		t.Errorf("admin deleting a sole owner: status = %d, want 409", w.Code)
+	}
+	if user, _ := app.users.Get("u_ann"); user == nil || user.Disabled {
+		t.Errorf("refused erasure still touched the account: %+v", user)
+	}
+
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_bob", Role: services.OrgRoleOwner})
+	job := app.waitForErasure(t, app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_ann", nil), admin.AccessToken))
+	if job.Status != services.ErasureCompleted {
+		t.Errorf("job after ownership was shared = %+v, want completed", job)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	app := newErasureTestApp(t)
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+	ann := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	app.addUser(t, "u_bob", "bob@example.com", services.RoleUser)
+
+	if w := app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_bob", nil), ann.AccessToken); w.Code != http.StatusForbidden {
+		t.Errorf("deleting a user as a regular user: status = %d, want 403", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_admin", nil), admin.AccessToken); w.Code != http.StatusBadRequest {
+		t.Errorf("admin deleting themselves without a password: status = %d, want 400", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_nobody", nil), admin.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing user: status = %d, want 404", w.Code)
+	}
+
+	job := app.waitForErasure(t, app.serve(httptest.NewRequest(http.MethodDelete, "/users/u_bob", nil), admin.AccessToken))
+	if job.Status != services.ErasureCompleted || job.UserID != "u_bob" {
+		t.Errorf("job = %+v, want u_bob erased", job)
+	}
+	if user, _ := app.users.Get("u_bob"); user != nil {
+		t.Error("user survived deletion")
+	}
+	if n := app.auditCount(services.AuditUserDelete, services.AuditSuccess); n != 1 {
+		t.Errorf("recorded %d user deletions, want 1", n)
+	}
+}
@@ -4,26 +4,23 @@ import (
 	"bytes"
 	"congenial-goggles/server/middlware"
 	"congenial-goggles/server/services"
-	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image/png"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/resend/resend-go/v2"
 	qrcode "github.com/skip2/go-qrcode"
@@ -73,6 +70,17 @@ func Hello() gin.HandlerFunc {
 	}
 }
 
+func JWKSReq() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middlware.Keys == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No public signing keys are configured"})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, middlware.Keys.JWKS())
+	}
+}
+
 func ShortUUID() string {
 	u := uuid.New()
 	return strings.TrimRight(
@@ -82,9 +90,36 @@ func ShortUUID() string {
 	)
 }
 
-func CreateNewUserReq(client *dynamodb.Client) gin.HandlerFunc {
+func sendVerificationEmail(resendClient *resend.Client, userID, email string) {
+	token, err := middlware.NewEmailVerificationToken(userID, email)
+	if err != nil {
+		log.Printf("Failed to create verification token: %v", err)
+		return
+	}
+
+	verifyURL := AppURL() + "/verify-email?token=" + url.QueryEscape(token)
+	if err := services.SendEmailVerification(resendClient, email, verifyURL); err != nil {
+		log.Printf("Failed to send verification email: %v", err)
+	}
+}
+
+// initialRole makes accounts listed in ADMIN_EMAILS admins, so a fresh deployment can be bootstrapped.
+func initialRole(email string) string {
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), email) {
+			return services.RoleAdmin
+		}
+	}
+	return services.RoleUser
+}
+
+func CreateNewUserReq(invites services.InviteCodeRepository, users services.UserRepository, sessions services.SessionRepository, resendClient *resend.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var user services.User
+		var user struct {
+			services.User
+			Password   string `json:"password"`
+			InviteCode string `json:"inviteCode"`
+		}
 		if err := c.ShouldBindJSON(&user); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 			return
@@ -92,53 +127,75 @@ func CreateNewUserReq(client *dynamodb.Client) gin.HandlerFunc {
 
 		id := ShortUUID()
 
-		email := strings.ToLower(user.Email)
+		user.Name = strings.TrimSpace(user.Name)
+		email := strings.ToLower(strings.TrimSpace(user.Email))
 		userId := fmt.Sprintf("u_%s", id)
 
+		var fields []middlware.FieldError
+		if user.Name == "" {
+			fields = append(fields, middlware.FieldError{Field: "name", Code: "required", Message: "Name is required"})
+		}
+		if !strings.Contains(email, "@") {
+			fields = append(fields, middlware.FieldError{Field: "email", Code: "invalid", Message: "A valid email address is required"})
+		}
+		fields = append(fields, middlware.Passwords.Validate("password", user.Password, middlware.PasswordOwner{Name: user.Name, Email: email})...)
+		if user.InviteCode == "" && registrationMode() == RegistrationInvite {
+			fields = append(fields, middlware.FieldError{Field: "inviteCode", Code: "required", Message: "An invite code is required to register"})
+		}
+		if len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+
 		hashedPassword, err := middlware.HashedPassword(user.Password)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
 			return
 		}
 
-		newUser := map[string]types.AttributeValue{
-			"id":       &types.AttributeValueMemberS{Value: userId},
-			"name":     &types.AttributeValueMemberS{Value: user.Name},
-			"email":    &types.AttributeValueMemberS{Value: email},
-			"password": &types.AttributeValueMemberS{Value: hashedPassword},
-		}
-
-		if err := services.CreateUser(client, "Users", newUser); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		role := initialRole(email)
+		var invite *services.InviteCode
+		if user.InviteCode != "" {
+			var fieldErr *middlware.FieldError
+			invite, fieldErr, err = redeemInviteCode(invites, user.InviteCode, email)
+			if err != nil {
+				log.Printf("Failed to redeem invite code: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check invite code"})
+				return
+			}
+			if fieldErr != nil {
+				respondFieldErrors(c, []middlware.FieldError{*fieldErr})
+				return
+			}
+			if role != services.RoleAdmin {
+				role = invite.Role
+			}
 		}
 
-		claims := middlware.UserClaims{
-			ID:        user.ID,
-			Name:      user.Name,
-			Email:     email,
-			TokenType: "access",
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(middlware.AccessTokenTTL).Unix(),
-				IssuedAt:  time.Now().Unix(),
-				Subject:   user.ID,
-			},
+		newUser := services.User{
+			ID:       userId,
+			Name:     user.Name,
+			Email:    email,
+			Password: hashedPassword,
+			Role:     role,
 		}
 
-		accessToken, err := middlware.NewAccessToken(claims)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access token"})
+		if err := users.Create(newUser); err != nil {
+			if invite != nil {
+				if err := invites.Release(invite.ID); err != nil {
+					log.Printf("Failed to release invite code: %v", err)
+				}
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		refreshClaims := jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(middlware.RefreshTokenTTL).Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Subject:   user.ID,
-		}
-		refreshToken, err := middlware.NewRefreshToken(refreshClaims)
+		sendVerificationEmail(resendClient, userId, email)
+
+		accessToken, refreshToken, err := middlware.NewSessionTokens(sessions, c, newUser)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create refresh token"})
+			log.Printf("Token creation failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tokens"})
 			return
 		}
 
@@ -151,7 +208,12 @@ func CreateNewUserReq(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func AuthUserReq(client *dynamodb.Client) gin.HandlerFunc {
+// respondFieldErrors reports validation problems as a list of per-field errors.
+func respondFieldErrors(c *gin.Context, fields []middlware.FieldError) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "fields": fields})
+}
+
+func AuthUserReq(users services.UserRepository, sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository, resendClient *resend.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
 			Email    string `json:"email"`
@@ -167,114 +229,132 @@ func AuthUserReq(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		user, err := services.GetUserByEmail(client, "Users", req.Email)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No user found with that email"})
+		if remaining := loginLockRemaining(attempts, req.Email, c.ClientIP()); remaining > 0 {
+			respondLoginLocked(c, remaining)
 			return
 		}
 
-		if user.Password == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "User record missing password"})
+		user, err := users.GetByEmail(req.Email)
+		if err != nil {
+			log.Printf("Failed to look up user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
 			return
 		}
 
-		if !middlware.CheckPasswordHash(req.Password, user.Password) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+		if !checkLoginPassword(user, req.Password) {
+			recordLoginFailure(attempts, audit, resendClient, c, req.Email, user)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
 			return
 		}
 
-		claims := middlware.UserClaims{
-			ID:        user.ID,
-			Name:      user.Name,
-			Email:     user.Email,
-			TokenType: "access",
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(middlware.AccessTokenTTL).Unix(),
-				IssuedAt:  time.Now().Unix(),
-				Subject:   user.ID,
-			},
-		}
+		upgradePasswordHash(users, user, req.Password)
+		completeLogin(sessions, attempts, audit, c, user)
+	}
+}
 
-		accessToken, err := middlware.NewAccessToken(claims)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access token"})
-			return
-		}
+// upgradePasswordHash re-hashes a just-verified password when its stored hash uses an older
+// algorithm or weaker parameters. Failures are only logged; the old hash keeps working.
+func upgradePasswordHash(users services.UserRepository, user *services.User, password string) {
+	if !middlware.NeedsRehash(user.Password) {
+		return
+	}
 
-		refreshClaims := jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(middlware.RefreshTokenTTL).Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Subject:   user.ID,
-		}
+	newHash, err := middlware.HashedPassword(password)
+	if err != nil {
+		log.Printf("Failed to re-hash password: %v", err)
+		return
+	}
 
-		refreshToken, err := middlware.NewRefreshToken(refreshClaims)
+	if err := users.ReplacePasswordHash(user.ID, user.Password, newHash); err != nil {
+		log.Printf("Failed to store re-hashed password: %v", err)
+		return
+	}
+	user.Password = newHash
+}
+
+// completeLogin finishes a first-factor sign-in: it either issues the MFA challenge or
+// starts a session and returns the token pair.
+func completeLogin(sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository, c *gin.Context, user *services.User) {
+	if user.Disabled {
+		respondAccountDisabled(c)
+		return
+	}
+	if user.TOTPEnabled {
+		mfaToken, err := middlware.NewMFAToken(user.ID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create refresh token"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MFA challenge"})
 			return
 		}
-
 		c.JSON(http.StatusOK, gin.H{
-			"message":      "Login successful",
-			"accessToken":  accessToken,
-			"refreshToken": refreshToken,
-			"user":         user,
+			"message":     "Second factor required",
+			"mfaRequired": true,
+			"mfaToken":    mfaToken,
 		})
+		return
 	}
+
+	clearLoginFailures(attempts, user.Email)
+	respondWithSession(sessions, audit, c, user)
+}
+
+// respondWithSession starts a session for a fully authenticated user and returns the token
+// pair. Callers that checked a password or code clear the login failures themselves.
+func respondWithSession(sessions services.SessionRepository, audit services.AuditRepository, c *gin.Context, user *services.User) {
+	if user.Disabled {
+		respondAccountDisabled(c)
+		return
+	}
+
+	accessToken, refreshToken, err := middlware.NewSessionTokens(sessions, c, *user)
+	if err != nil {
+		log.Printf("Token creation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tokens"})
+		return
+	}
+
+	middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditLogin, Outcome: services.AuditSuccess, ActorID: user.ID, Target: user.ID})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Login successful",
+		"accessToken":  accessToken,
+		"refreshToken": refreshToken,
+		"user":         user,
+	})
+}
+
+// respondAccountDisabled rejects sign-ins to accounts deactivated by an admin or the IdP.
+func respondAccountDisabled(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "This account has been disabled"})
 }
-func GetAllUsersReq(client *dynamodb.Client) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-		if token == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid token"})
-			return
-		}
-		if middlware.ParseAccessToken(token) == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
-			return
-		}
 
-		resp, err := services.GetAllUsers(client, "Users")
+func GetAllUsersReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		all, err := users.List()
 		if err != nil {
+			log.Printf("Failed to list users: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get users"})
 			return
 		}
 
-		var users []services.User
-		for _, item := range resp {
-			var user services.User
-			if err := attributevalue.UnmarshalMap(item, &user); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode users"})
-				return
-			}
-			users = append(users, user)
-		}
-
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Users Found!",
-			"users":   users,
+			"users":   all,
 		})
 	}
 }
 
-func GetUserByIDReq(client *dynamodb.Client) gin.HandlerFunc {
+func GetUserByIDReq(users services.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-		if token == "" || middlware.ParseAccessToken(token) == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
-			return
-		}
-
-		resp, err := services.GetUserById(client, "Users", id)
+		user, err := users.Get(id)
 		if err != nil {
+			log.Printf("Failed to load user: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
 			return
 		}
-
-		var user services.User
-		if err := attributevalue.UnmarshalMap(resp, &user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode user"})
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
@@ -285,38 +365,104 @@ func GetUserByIDReq(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func UpdateUserReq(client *dynamodb.Client) gin.HandlerFunc {
+func UpdateUserReq(audit services.AuditRepository, users services.UserRepository, resendClient *resend.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-		if token == "" || middlware.ParseAccessToken(token) == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
-			return
-		}
-
 		var user services.User
 		if err := c.ShouldBindJSON(&user); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 			return
 		}
 
-		if err := services.UpdateUser(client, "Users", user); err != nil {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		if user.ID == "" {
+			user.ID = claims.ID
+		}
+		if user.ID != claims.ID && !claims.IsAdmin() {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUserUpdate, Outcome: services.AuditDenied, Target: user.ID})
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only update your own account"})
+			return
+		}
+
+		existing, err := users.Get(user.ID)
+		if err != nil || existing == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if err := users.Update(user); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 			return
 		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUserUpdate, Outcome: services.AuditSuccess, Target: user.ID})
+
+		newEmail := strings.ToLower(user.Email)
+		if newEmail != "" && newEmail != existing.Email {
+			sendVerificationEmail(resendClient, existing.ID, newEmail)
+			c.JSON(http.StatusOK, gin.H{"message": "User Updated! Check your inbox to verify the new email address"})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "User Updated!"})
 	}
 }
 
-func UpdatePasswordReq(client *dynamodb.Client) gin.HandlerFunc {
+func VerifyEmailReq(users services.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-		claims := middlware.ParseAccessToken(token)
-		if token == "" || claims == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
+		claims := middlware.ParseEmailVerificationToken(c.Query("token"))
+		if claims == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+			return
+		}
+
+		user, err := users.Get(claims.Subject)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if user.Email != claims.Email {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This link was issued for a different email address"})
 			return
 		}
 
+		if user.Verified {
+			c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+			return
+		}
+
+		if err := users.SetAttributes(user.ID, map[string]interface{}{"verified": true}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+	}
+}
+
+func ResendVerificationReq(users services.UserRepository, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if user.Verified {
+			c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+			return
+		}
+
+		sendVerificationEmail(resendClient, user.ID, user.Email)
+		c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+	}
+}
+
+func UpdatePasswordReq(sessions services.SessionRepository, audit services.AuditRepository, users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
 		var req struct {
 			CurrentPassword string `json:"currentPassword"`
 			NewPassword     string `json:"newPassword"`
@@ -332,31 +478,25 @@ func UpdatePasswordReq(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String("Users"),
-			Key: map[string]types.AttributeValue{
-				"id": &types.AttributeValueMemberS{Value: claims.ID},
-			},
-		})
-
+		user, err := users.Get(claims.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
 			return
 		}
 
-		if out.Item == nil {
+		if user == nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
-		var user services.User
-		if err := attributevalue.UnmarshalMap(out.Item, &user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse user record"})
+		if !middlware.CheckPasswordHash(req.CurrentPassword, user.Password) {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditPasswordChange, Outcome: services.AuditFailure, Target: user.ID, Detail: "incorrect current password"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
 			return
 		}
 
-		if !middlware.CheckPasswordHash(req.CurrentPassword, user.Password) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		if fields := middlware.Passwords.Validate("newPassword", req.NewPassword, middlware.PasswordOwner{Name: user.Name, Email: user.Email}); len(fields) > 0 {
+			respondFieldErrors(c, fields)
 			return
 		}
 
@@ -366,32 +506,222 @@ func UpdatePasswordReq(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		user.Password = hashedPassword
-		if err := services.UpdatePassword(client, "Users", user); err != nil {
+		if err := users.UpdatePassword(user.ID, hashedPassword); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 			return
 		}
 
+		if _, err := revokeUserSessions(sessions, user.ID, claims.SessionID); err != nil {
+			log.Printf("Failed to revoke sessions after password change: %v", err)
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditPasswordChange, Outcome: services.AuditSuccess, Target: user.ID})
+
 		c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
 	}
 }
 
-func DeleteUserReq(client *dynamodb.Client) gin.HandlerFunc {
+// AppURL is the public base URL used when building links for emails.
+func AppURL() string {
+	if base := os.Getenv("APP_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// FrontendURL is where the pages behind emailed links live (FRONTEND_URL), such as the
+// password reset form. It defaults to AppURL for deployments that serve them from here.
+func FrontendURL() string {
+	if base := os.Getenv("FRONTEND_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return AppURL()
+}
+
+func ForgotPasswordReq(users services.UserRepository, resendClient *resend.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := c.Param("id")
+		var req struct {
+			Email string `json:"email"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+			return
+		}
+
+		// Always answer the same way so the endpoint cannot be used to discover accounts.
+		response := gin.H{"message": "If an account exists for that email, a reset link has been sent"}
+
+		user, err := users.GetByEmail(req.Email)
+		if err != nil || user == nil {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
+		token, tokenHash, err := middlware.NewUserToken(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+			return
+		}
+
+		err = users.SetAttributes(user.ID, map[string]interface{}{
+			"resetTokenHash":    tokenHash,
+			"resetTokenExpires": time.Now().Add(middlware.PasswordResetTTL).Unix(),
+		})
+		if err != nil {
+			log.Printf("Failed to store reset token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+			return
+		}
 
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
-		if token == "" || middlware.ParseAccessToken(token) == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
+		resetURL := FrontendURL() + "/password/reset?token=" + url.QueryEscape(token)
+		if err := services.SendPasswordReset(resendClient, user.Email, resetURL, middlware.PasswordResetTTL); err != nil {
+			log.Printf("Failed to send reset email: %v", err)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func ResetPasswordReq(sessions services.SessionRepository, audit services.AuditRepository, users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"newPassword"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		if req.Token == "" || req.NewPassword == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token or new password"})
+			return
+		}
+
+		userID, tokenHash, ok := middlware.SplitUserToken(req.Token)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		}
+
+		owner, err := users.Get(userID)
+		if err != nil {
+			log.Printf("Failed to load user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+		// Check the token before anything that depends on the account, so a guessed ID
+		// learns nothing about whether it exists or what its name and email are.
+		if owner == nil || owner.ResetTokenExpires <= time.Now().Unix() ||
+			subtle.ConstantTimeCompare([]byte(owner.ResetTokenHash), []byte(tokenHash)) != 1 {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditPasswordReset, Outcome: services.AuditFailure, Target: userID, Detail: "invalid reset token"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		}
+
+		if fields := middlware.Passwords.Validate("newPassword", req.NewPassword, middlware.PasswordOwner{Name: owner.Name, Email: owner.Email}); len(fields) > 0 {
+			respondFieldErrors(c, fields)
+			return
+		}
+
+		hashedPassword, err := middlware.HashedPassword(req.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash new password"})
+			return
+		}
+
+		err = users.ConsumeToken(userID, "resetTokenHash", "resetTokenExpires", tokenHash)
+		if errors.Is(err, services.ErrInvalidToken) {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditPasswordReset, Outcome: services.AuditFailure, Target: userID, Detail: "invalid reset token"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to consume reset token: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+			return
+		}
+
+		if err := users.UpdatePassword(userID, hashedPassword); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+			return
+		}
+
+		if _, err := revokeUserSessions(sessions, userID, ""); err != nil {
+			log.Printf("Failed to revoke sessions after password reset: %v", err)
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditPasswordReset, Outcome: services.AuditSuccess, ActorID: userID, Target: userID})
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+	}
+}
+
+// DeleteUserReq lets an admin erase another account and everything it owns; see
+// startErasure. Users delete their own account through EraseMyAccountReq, which asks for
+// their password.
+func DeleteUserReq(data accountData, blobs services.BlobStore, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		if id == claims.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Use DELETE /users/me, with your password, to delete your own account"})
 			return
 		}
 
-		if err := services.DeleteUser(client, "Users", id); err != nil {
+		user, err := data.users.Get(id)
+		if err != nil {
+			log.Printf("Failed to load user: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 			return
 		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if refuseSoleOwnerErasure(data.members, c, user.ID) {
+			return
+		}
+
+		middlware.Audit(data.audit, c, services.AuditEvent{Event: services.AuditUserDelete, Outcome: services.AuditSuccess, Target: id})
+		respondErasureStarted(data, blobs, resendClient, c, user)
+	}
+}
+
+func SetUserRoleReq(sessions services.SessionRepository, audit services.AuditRepository, users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if req.Role != services.RoleAdmin && req.Role != services.RoleUser {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin or user"})
+			return
+		}
+
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		if id == claims.ID && req.Role != services.RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot demote themselves"})
+			return
+		}
+
+		if err := users.SetAttributes(id, map[string]interface{}{"role": req.Role}); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		// Existing access tokens carry the old role, so make the user sign in again.
+		if _, err := revokeUserSessions(sessions, id, ""); err != nil {
+			log.Printf("Failed to revoke sessions after role change for %s: %v", id, err)
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUserRole, Outcome: services.AuditSuccess, Target: id, Detail: req.Role})
 
-		c.JSON(http.StatusOK, gin.H{"message": "User Deleted!"})
+		c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
 	}
 }
 
@@ -407,7 +737,36 @@ func RemoveFileExtension(filename string) string {
 	return filename[:len(filename)-len(filepath.Ext(filename))]
 }
 
-func Upload(client *s3.Client) gin.HandlerFunc {
+// fileID is the ID of an uploaded file: an HMAC of its name keyed with the shared secret,
+// so only holders of the secret can prove they may download it.
+func fileID(secret, fileName string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fileName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkUploadOrg makes sure the user may share a file with org, which needs at least member
+// access to it. It responds and returns false if not. An empty org is always allowed.
+func checkUploadOrg(members services.OrgMemberRepository, audit services.AuditRepository, c *gin.Context, org, userID, id string) bool {
+	if org == "" {
+		return true
+	}
+
+	member, err := members.Get(org, userID)
+	if err != nil {
+		log.Printf("Failed to check org membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization membership"})
+		return false
+	}
+	if member == nil || services.OrgRoleRank(member.Role) < services.OrgRoleRank(services.OrgRoleMember) {
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUpload, Outcome: services.AuditDenied, Target: id, Detail: "org " + org})
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot upload files to this organization"})
+		return false
+	}
+	return true
+}
+
+func Upload(members services.OrgMemberRepository, audit services.AuditRepository, files services.FileRepository, blobs services.BlobStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method != http.MethodPost {
 			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
@@ -441,40 +800,43 @@ func Upload(client *s3.Client) gin.HandlerFunc {
 		}
 		defer file.Close()
 
-		mac := hmac.New(sha256.New, []byte(secret))
-		mac.Write([]byte(header.Filename))
-		id := hex.EncodeToString(mac.Sum(nil))
+		id := fileID(secret, header.Filename)
 
-		err = services.StreamUploadFile(client, header.Filename, file)
-		if err != nil {
-			log.Printf("Upload failed: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		org := c.PostForm("org")
+		if !checkUploadOrg(members, audit, c, org, userId, id) {
+			return
+		}
+		existing, ok := checkFileOwner(files, c, id, userId)
+		if !ok {
 			return
 		}
 
-		dynamoClient, err := services.ConnectDB()
+		key := newObjectKey(id, org)
+		err = blobs.Put(key, header.Header.Get("Content-Type"), file)
 		if err != nil {
-			log.Printf("DynamoDB connection failed: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
+			log.Printf("Upload failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
 			return
 		}
 
-		err = services.CreateFile(dynamoClient, "Files", id, filepath.Base(header.Filename), userId)
+		err = saveFile(files, blobs, existing, services.File{ID: id, FileName: filepath.Base(header.Filename), User: userId, Org: org, ObjectKey: key})
 		if err != nil {
 			log.Printf("Failed to save metadata: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
 			return
 		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUpload, Outcome: services.AuditSuccess, Target: id, Detail: filepath.Base(header.Filename)})
 
 		c.JSON(http.StatusOK, gin.H{
 			"message": "File uploaded successfully",
 			"fileId":  id,
 			"userId":  userId,
+			"org":     org,
 		})
 	}
 }
 
-func Download(client *s3.Client) gin.HandlerFunc {
+func Download(audit services.AuditRepository, files services.FileRepository, blobs services.BlobStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method != http.MethodPost {
 			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
@@ -490,53 +852,48 @@ func Download(client *s3.Client) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "missing secret"})
 			return
 		}
-		dynamoClient, err := services.ConnectDB()
-		if err != nil {
-			log.Printf("DynamoDB connection failed: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-			return
-		}
-		result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String("Files"),
-			Key: map[string]types.AttributeValue{
-				"id": &types.AttributeValueMemberS{Value: hashedSecret},
-			},
-		})
+		file, err := files.Get(hashedSecret)
 		if err != nil {
 			log.Printf("Failed to retrieve file metadata: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file metadata"})
 			return
 		}
-		if result.Item == nil {
+		if file == nil || !file.Active() {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownload, Outcome: services.AuditFailure, Target: hashedSecret, Detail: "file not found"})
 			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 			return
 		}
-		storedFilenameAttr, ok := result.Item["fileName"].(*types.AttributeValueMemberS)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid file metadata format"})
-			return
-		}
-		storedFilename := storedFilenameAttr.Value
+		storedFilename := file.FileName
 
 		mac := hmac.New(sha256.New, []byte(sharedSecret))
 		mac.Write([]byte(storedFilename))
 		hashedSecretVerification := hex.EncodeToString(mac.Sum(nil))
 
 		if hashedSecretVerification != hashedSecret {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownload, Outcome: services.AuditDenied, Target: hashedSecret, Detail: "invalid secret"})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid secret"})
 			return
 		}
 
-		err = services.StreamDownloadFile(c, client, hashedSecret)
+		err = streamBlob(c, blobs, file.BlobKey(), storedFilename)
+		if errors.Is(err, services.ErrBlobNotFound) {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownload, Outcome: services.AuditFailure, Target: hashedSecret, Detail: "object missing"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
 		if err != nil {
-			log.Printf("Failed to stream file: %v", hashedSecret)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stream file"})
+			log.Printf("Failed to stream file %v: %v", hashedSecret, err)
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownload, Outcome: services.AuditFailure, Target: hashedSecret, Detail: "stream failed"})
+			if !c.Writer.Written() {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stream file"})
+			}
 			return
 		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownload, Outcome: services.AuditSuccess, Target: hashedSecret, Detail: storedFilename})
 	}
 }
 
-func DownloadURL(client *s3.Client) gin.HandlerFunc {
+func DownloadURL(audit services.AuditRepository, files services.FileRepository, blobs services.BlobStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method != http.MethodPost {
 			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
@@ -552,48 +909,34 @@ func DownloadURL(client *s3.Client) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "missing shared_secret"})
 			return
 		}
-		dynamoClient, err := services.ConnectDB()
-		if err != nil {
-			log.Printf("DynamoDB connection failed: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-			return
-		}
-		result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String("Files"),
-			Key: map[string]types.AttributeValue{
-				"id": &types.AttributeValueMemberS{Value: hashedSecret},
-			},
-		})
+		file, err := files.Get(hashedSecret)
 		if err != nil {
 			log.Printf("Failed to retrieve file metadata: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file metadata"})
 			return
 		}
-		if result.Item == nil {
+		if file == nil || !file.Active() {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadURL, Outcome: services.AuditFailure, Target: hashedSecret, Detail: "file not found"})
 			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 			return
 		}
-		storedFilenameAttr, ok := result.Item["fileName"].(*types.AttributeValueMemberS)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid file metadata format"})
-			return
-		}
-		storedFilename := storedFilenameAttr.Value
+		storedFilename := file.FileName
 		mac := hmac.New(sha256.New, []byte(sharedSecret))
 		mac.Write([]byte(storedFilename))
 		expectedHash := hex.EncodeToString(mac.Sum(nil))
 
 		if expectedHash != hashedSecret {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadURL, Outcome: services.AuditDenied, Target: hashedSecret, Detail: "invalid secret"})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid secret"})
 			return
 		}
-		fileKey := "uploads/" + storedFilename
-		url, err := services.GeneratePresignedDownloadURL(client, fileKey)
+		url, err := blobs.SignedURL(file.BlobKey(), services.DefaultURLExpiry)
 		if err != nil {
 			log.Printf("Failed to generate presigned URL for %v: %v", storedFilename, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate presigned URL"})
 			return
 		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadURL, Outcome: services.AuditSuccess, Target: hashedSecret, Detail: storedFilename})
 		c.JSON(http.StatusOK, gin.H{
 			"message":        "Presigned download URL generated",
 			"file_name":      storedFilename,
@@ -603,7 +946,7 @@ func DownloadURL(client *s3.Client) gin.HandlerFunc {
 	}
 }
 
-func DownloadQR(client *s3.Client) gin.HandlerFunc {
+func DownloadQR(audit services.AuditRepository, files services.FileRepository, blobs services.BlobStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.Method != http.MethodPost {
 			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
@@ -615,39 +958,24 @@ func DownloadQR(client *s3.Client) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "missing secret"})
 			return
 		}
-		dynamoClient, err := services.ConnectDB()
-		if err != nil {
-			log.Printf("DynamoDB connection failed: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-			return
-		}
-		result, err := dynamoClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String("Files"),
-			Key: map[string]types.AttributeValue{
-				"id": &types.AttributeValueMemberS{Value: hashedSecret},
-			},
-		})
-		if err != nil || result.Item == nil {
+		file, err := files.Get(hashedSecret)
+		if err != nil || file == nil || !file.Active() {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadQR, Outcome: services.AuditFailure, Target: hashedSecret, Detail: "file not found"})
 			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 			return
 		}
-		storedFilenameAttr, ok := result.Item["fileName"].(*types.AttributeValueMemberS)
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid file metadata format"})
-			return
-		}
-		storedFilename := storedFilenameAttr.Value
+		storedFilename := file.FileName
 
 		mac := hmac.New(sha256.New, []byte(sharedSecret))
 		mac.Write([]byte(storedFilename))
 		hashedSecretVerification := hex.EncodeToString(mac.Sum(nil))
 
 		if hashedSecretVerification != hashedSecret {
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadQR, Outcome: services.AuditDenied, Target: hashedSecret, Detail: "invalid secret"})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid secret"})
 			return
 		}
-		fileKey := "uploads/" + storedFilename
-		presignedURL, err := services.GeneratePresignedDownloadURL(client, fileKey)
+		presignedURL, err := blobs.SignedURL(file.BlobKey(), services.DefaultURLExpiry)
 		if err != nil {
 			log.Printf("Failed to generate presigned URL: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate presigned URL"})
@@ -663,6 +991,7 @@ func DownloadQR(client *s3.Client) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode QR image"})
 			return
 		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadQR, Outcome: services.AuditSuccess, Target: hashedSecret, Detail: storedFilename})
 		c.Header("Content-Type", "image/png")
 		c.Header("Content-Disposition", "inline; filename=\"download_qr.png\"")
 		c.Writer.Write(buf.Bytes())
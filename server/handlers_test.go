@@ -0,0 +1,706 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/json"
+	"html"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+const testPassword = "Correct-Horse-42"
+
+// testApp wires the handlers to in-memory repositories and a local blob store.
+type testApp struct {
+	r        *gin.Engine
+	users    *services.MemoryUserRepository
+	files    *services.MemoryFileRepository
+	sessions *services.MemorySessionRepository
+	members  *services.MemoryOrgMemberRepository
+	attempts *services.MemoryLoginAttemptRepository
+	audit    *services.MemoryAuditRepository
+	apiKeys  *services.MemoryAPIKeyRepository
+	invites  *services.MemoryInviteCodeRepository
+	blobs    *services.LocalBlobStore
+	mail     *resend.Client
+	outbox   *testOutbox
+}
+
+// useTestSecrets signs tokens with fixed HS256 secrets for the length of the test.
+func useTestSecrets(t *testing.T) {
+	t.Helper()
+	access, refresh, email, keys := middlware.AccessTokenSecret, middlware.RefreshTokenSecret, middlware.EmailTokenSecret, middlware.Keys
+	middlware.AccessTokenSecret = "test-access-secret"
+	middlware.RefreshTokenSecret = "test-refresh-secret"
+	middlware.EmailTokenSecret = "test-email-secret"
+	middlware.Keys = nil
+	t.Cleanup(func() {
+		middlware.AccessTokenSecret, middlware.RefreshTokenSecret, middlware.EmailTokenSecret, middlware.Keys = access, refresh, email, keys
+	})
+}
+
+// testOutbox keeps every email sent through a test mailer.
+type testOutbox struct {
+	mu   sync.Mutex
+	sent []resend.SendEmailRequest
+}
+
+// to returns the emails sent to addr, oldest first.
+func (o *testOutbox) to(addr string) []resend.SendEmailRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var sent []resend.SendEmailRequest
+	for _, email := range o.sent {
+		for _, to := range email.To {
+			if to == addr {
+				sent = append(sent, email)
+			}
+		}
+	}
+	return sent
+}
+
+var emailedToken = regexp.MustCompile(`token=([^"&]+)`)
+
+// lastToken returns the token in the link of the latest email sent to addr.
+func (o *testOutbox) lastToken(t *testing.T, addr string) string {
+	t.Helper()
+	sent := o.to(addr)
+	if len(sent) == 0 {
+		t.Fatalf("no email sent to %s", addr)
+	}
+	match := emailedToken.FindStringSubmatch(sent[len(sent)-1].Html)
+	if match == nil {
+		t.Fatalf("no token in the email to %s: %s", addr, sent[len(sent)-1].Html)
+	}
+	token, err := url.QueryUnescape(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newTestMailer returns a Resend client that delivers to a local server accepting
+// everything, and the outbox it delivers to.
+func newTestMailer(t *testing.T) (*resend.Client, *testOutbox) {
+	t.Helper()
+	outbox := &testOutbox{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var email resend.SendEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&email); err == nil {
+			outbox.mu.Lock()
+			outbox.sent = append(outbox.sent, email)
+			outbox.mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"test-email"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client := resend.NewClient("test")
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	return client, outbox
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	useTestSecrets(t)
+
+	blobs, err := services.NewLocalBlobStore(t.TempDir(), []byte("secret"), "http://files.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &testApp{
+		r:        gin.New(),
+		users:    services.NewMemoryUserRepository(),
+		files:    services.NewMemoryFileRepository(),
+		sessions: services.NewMemorySessionRepository(),
+		members:  services.NewMemoryOrgMemberRepository(),
+		attempts: services.NewMemoryLoginAttemptRepository(),
+		audit:    services.NewMemoryAuditRepository(),
+		apiKeys:  services.NewMemoryAPIKeyRepository(),
+		invites:  services.NewMemoryInviteCodeRepository(),
+		blobs:    blobs,
+	}
+	app.mail, app.outbox = newTestMailer(t)
+
+	r := app.r
+	r.POST("/register", CreateNewUserReq(app.invites, app.users, app.sessions, app.mail))
+	r.POST("/login", AuthUserReq(app.users, app.sessions, app.attempts, app.audit, app.mail))
+	r.POST("/refresh-token", middlware.RefreshTokenHandler(app.users, app.sessions, app.audit))
+	r.POST("/password/forgot", ForgotPasswordReq(app.users, app.mail))
+	r.POST("/password/reset", ResetPasswordReq(app.sessions, app.audit, app.users))
+	r.GET("/verify-email", VerifyEmailReq(app.users))
+
+	auth := r.Group("/", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions))
+	auth.GET("/users", middlware.RequireScope(services.ScopeUsersRead), middlware.RequireRole(services.RoleAdmin), GetAllUsersReq(app.users))
+	auth.GET("/users/:id", middlware.RequireScope(services.ScopeUsersRead), middlware.RequireSelfOrAdmin("id"), GetUserByIDReq(app.users))
+	auth.PUT("/users", UpdateUserReq(app.audit, app.users, app.mail))
+	auth.PUT("/users/password", UpdatePasswordReq(app.sessions, app.audit, app.users))
+	auth.PUT("/users/:id/role", middlware.RequireRole(services.RoleAdmin), SetUserRoleReq(app.sessions, app.audit, app.users))
+	auth.POST("/upload", Upload(app.members, app.audit, app.files, blobs))
+	auth.POST("/download/direct", Download(app.audit, app.files, blobs))
+	auth.POST("/download/url", DownloadURL(app.audit, app.files, blobs))
+	auth.POST("/download/qr", DownloadQR(app.audit, app.files, blobs))
+	interactive := auth.Group("/", middlware.RequireInteractive())
+	interactive.POST("/api-keys", CreateAPIKeyReq(app.apiKeys))
+	interactive.GET("/api-keys", ListAPIKeysReq(app.apiKeys))
+	interactive.DELETE("/api-keys/:id", DeleteAPIKeyReq(app.apiKeys))
+	interactive.POST("/admin/invites", middlware.RequireRole(services.RoleAdmin), CreateInviteCodeReq(app.invites, app.mail))
+	interactive.GET("/admin/invites", middlware.RequireRole(services.RoleAdmin), ListInviteCodesReq(app.invites))
+	interactive.DELETE("/admin/invites/:id", middlware.RequireRole(services.RoleAdmin), DeleteInviteCodeReq(app.invites))
+	return app
+}
+
+func (app *testApp) serve(req *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.r.ServeHTTP(w, req)
+	return w
+}
+
+func (app *testApp) serveJSON(method, path, token string, body any) *httptest.ResponseRecorder {
+	encoded, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	return app.serve(req, token)
+}
+
+func (app *testApp) serveForm(path, token string, fields map[string]string, fileName string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if fileName != "" {
+		part, _ := form.CreateFormFile("file", fileName)
+		part.Write(content)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return app.serve(req, token)
+}
+
+// tokenPair is the body of a successful registration, sign-in or refresh.
+type tokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) tokenPair {
+	t.Helper()
+	var tokens tokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("no tokens in %d response %s", w.Code, w.Body.String())
+	}
+	return tokens
+}
+
+// addUser stores a user with testPassword and signs them in.
+func (app *testApp) addUser(t *testing.T, id, email, role string) tokenPair {
+	t.Helper()
+	hash, err := middlware.HashedPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.users.Create(services.User{ID: id, Name: "Test " + id, Email: email, Password: hash, Verified: true, Role: role}); err != nil {
+		t.Fatal(err)
+	}
+	return app.login(t, email, testPassword)
+}
+
+func (app *testApp) login(t *testing.T, email, password string) tokenPair {
+	t.Helper()
+	w := app.serveJSON(http.MethodPost, "/login", "", gin.H{"email": email, "password": password})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login as %s: status = %d, body = %s", email, w.Code, w.Body.String())
+	}
+	return decodeTokens(t, w)
+}
+
+// auditCount counts the recorded events matching event and outcome.
+func (app *testApp) auditCount(event, outcome string) int {
+	n := 0
+	for _, e := range app.audit.Events() {
+		if e.Event == event && e.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegisterAndSignIn(t *testing.T) {
+	app := newTestApp(t)
+
+	w := app.serveJSON(http.MethodPost, "/register", "", gin.H{"name": "Ann", "email": "Ann@Example.com", "password": testPassword})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	registered := decodeTokens(t, w)
+
+	user, _ := app.users.GetByEmail("ann@example.com")
+	if user == nil || user.Role != services.RoleUser || user.Verified {
+		t.Fatalf("stored user = %+v, want an unverified regular user", user)
+	}
+	if sessions, _ := app.sessions.ListByUser(user.ID); len(sessions) != 1 {
+		t.Errorf("register started %d sessions, want 1", len(sessions))
+	}
+
+	w = app.serveJSON(http.MethodPost, "/register", "", gin.H{"name": "Ann", "email": "ann@example.com", "password": testPassword})
+	if w.Code == http.StatusCreated {
+		t.Error("registered the same email twice")
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/"+user.ID, nil), registered.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("GET own user: status = %d", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users", nil), registered.AccessToken); w.Code != http.StatusForbidden {
+		t.Errorf("GET /users as a regular user: status = %d, want 403", w.Code)
+	}
+
+	w = app.serveJSON(http.MethodPost, "/login", "", gin.H{"email": "ann@example.com", "password": testPassword})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		User map[string]any `json:"user"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.User["id"] != user.ID {
+		t.Fatalf("login body = %s", w.Body.String())
+	}
+	if _, ok := body.User["password"]; ok {
+		t.Error("login returned the password hash")
+	}
+	if n := app.auditCount(services.AuditLogin, services.AuditSuccess); n != 1 {
+		t.Errorf("recorded %d successful logins, want 1", n)
+	}
+}
+
+func TestSignInLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	for i := 0; i < accountFailuresBeforeLock; i++ {
+		w := app.serveJSON(http.MethodPost, "/login", "", gin.H{"email": "ann@example.com", "password": "wrong password"})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want 401", i+1, w.Code)
+		}
+	}
+
+	w := app.serveJSON(http.MethodPost, "/login", "", gin.H{"email": "ann@example.com", "password": testPassword})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("correct password while locked: status = %d, Retry-After = %q; want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := app.auditCount(services.AuditLogin, services.AuditFailure); n != accountFailuresBeforeLock {
+		t.Errorf("recorded %d failed logins, want %d", n, accountFailuresBeforeLock)
+	}
+
+	if n := len(app.outbox.to("ann@example.com")); n != 1 {
+		t.Errorf("sent %d lockout emails, want 1", n)
+	}
+
+	// Once the lock runs out, another failure locks the account for longer without
+	// emailing the owner again.
+	app.attempts.Lock(accountAttemptKey("ann@example.com"), time.Now())
+	w = app.serveJSON(http.MethodPost, "/login", "", gin.H{"email": "ann@example.com", "password": "wrong password"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("failure after the lock ran out: status = %d, want 401", w.Code)
+	}
+	if remaining := loginLockRemaining(app.attempts, "ann@example.com", ""); remaining <= loginLockBase {
+		t.Errorf("lock after another failure = %s, want longer than %s", remaining, loginLockBase)
+	}
+	if n := len(app.outbox.to("ann@example.com")); n != 1 {
+		t.Errorf("sent %d lockout emails, want 1", n)
+	}
+
+	app.attempts.Clear(accountAttemptKey("ann@example.com"))
+	app.login(t, "ann@example.com", testPassword)
+	if attempt, _ := app.attempts.Get(accountAttemptKey("ann@example.com")); attempt != nil {
+		t.Errorf("a successful login left %+v behind", attempt)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app := newTestApp(t)
+	first := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	w := app.serveJSON(http.MethodPost, "/refresh-token", "", gin.H{"refreshToken": first.RefreshToken})
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	second := decodeTokens(t, w)
+
+	w = app.serveJSON(http.MethodPost, "/refresh-token", "", gin.H{"refreshToken": first.RefreshToken})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status = %d, want 401", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), second.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("access token after reuse was detected: status = %d, want 401", w.Code)
+	}
+}
+
+func TestUpdatePasswordSignsOutOtherSessions(t *testing.T) {
+	app := newTestApp(t)
+	current := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	other := app.login(t, "ann@example.com", testPassword)
+
+	w := app.serveJSON(http.MethodPut, "/users/password", current.AccessToken, gin.H{"currentPassword": "wrong", "newPassword": "Another-Secret-77"})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong current password: status = %d, want 401", w.Code)
+	}
+
+	w = app.serveJSON(http.MethodPut, "/users/password", current.AccessToken, gin.H{"currentPassword": testPassword, "newPassword": "Another-Secret-77"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("change password: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), other.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("other session after password change: status = %d, want 401", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), current.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("current session after password change: status = %d, want 200", w.Code)
+	}
+	app.login(t, "ann@example.com", "Another-Secret-77")
+
+	if n := app.auditCount(services.AuditPasswordChange, services.AuditFailure); n != 1 {
+		t.Errorf("recorded %d failed password changes, want 1", n)
+	}
+}
+
+func TestSetUserRoleSignsUserOut(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+	user := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	if w := app.serveJSON(http.MethodPut, "/users/u_admin/role", user.AccessToken, gin.H{"role": "admin"}); w.Code != http.StatusForbidden {
+		t.Fatalf("promoting yourself: status = %d, want 403", w.Code)
+	}
+
+	w := app.serveJSON(http.MethodPut, "/users/u_ann/role", admin.AccessToken, gin.H{"role": services.RoleAdmin})
+	if w.Code != http.StatusOK {
+		t.Fatalf("set role: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if stored, _ := app.users.Get("u_ann"); stored.Role != services.RoleAdmin {
+		t.Errorf("role = %q, want admin", stored.Role)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), user.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("token issued before the role change: status = %d, want 401", w.Code)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	app := newTestApp(t)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	content := []byte("quarterly numbers")
+
+	w := app.serveForm("/upload", tokens.AccessToken, map[string]string{"shared_secret": "s3cret"}, "report.txt", content)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var uploaded struct {
+		FileID string `json:"fileId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &uploaded)
+	if file, _ := app.files.Get(uploaded.FileID); file == nil || file.User != "u_ann" || file.ObjectKey == "" {
+		t.Fatalf("stored file = %+v", file)
+	}
+
+	w = app.serveForm("/download/direct", tokens.AccessToken, map[string]string{"hashed_secret": uploaded.FileID, "shared_secret": "s3cret"}, "", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("download: status = %d, body = %q", w.Code, w.Body.String())
+	}
+
+	w = app.serveForm("/download/direct", tokens.AccessToken, map[string]string{"hashed_secret": uploaded.FileID, "shared_secret": "guess"}, "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("download with the wrong secret: status = %d, want 401", w.Code)
+	}
+
+	for _, want := range []struct{ event, outcome string }{
+		{services.AuditUpload, services.AuditSuccess},
+		{services.AuditDownload, services.AuditSuccess},
+		{services.AuditDownload, services.AuditDenied},
+	} {
+		if app.auditCount(want.event, want.outcome) != 1 {
+			t.Errorf("no %s %s audit event in %+v", want.event, want.outcome, app.audit.Events())
+		}
+	}
+}
+
+func TestUploadToOrgNeedsMembership(t *testing.T) {
+	app := newTestApp(t)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	fields := map[string]string{"shared_secret": "s3cret", "org": "o_team"}
+
+	w := app.serveForm("/upload", tokens.AccessToken, fields, "plan.txt", []byte("plan"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("upload to an org you are not in: status = %d, want 403", w.Code)
+	}
+	if app.auditCount(services.AuditUpload, services.AuditDenied) != 1 {
+		t.Errorf("the refused upload was not audited: %+v", app.audit.Events())
+	}
+
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_ann", Role: services.OrgRoleViewer})
+	if w := app.serveForm("/upload", tokens.AccessToken, fields, "plan.txt", []byte("plan")); w.Code != http.StatusForbidden {
+		t.Errorf("upload as a viewer: status = %d, want 403", w.Code)
+	}
+
+	app.members.Put(services.OrgMember{OrgID: "o_team", UserID: "u_ann", Role: services.OrgRoleMember})
+	if w := app.serveForm("/upload", tokens.AccessToken, fields, "plan.txt", []byte("plan")); w.Code != http.StatusOK {
+		t.Fatalf("upload as a member: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if list, _ := app.files.ListByOrg("o_team"); len(list) != 1 {
+		t.Errorf("org has %d files, want 1", len(list))
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	app := newTestApp(t)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	w := app.serveJSON(http.MethodPost, "/api-keys", tokens.AccessToken, gin.H{"name": "ci", "scopes": []string{services.ScopeUsersRead}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Key    string          `json:"key"`
+		APIKey services.APIKey `json:"apiKey"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), created.Key); w.Code != http.StatusOK {
+		t.Fatalf("GET own user with a key: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if key, _ := app.apiKeys.Get(created.APIKey.ID); key == nil || key.LastUsedAt == 0 {
+		t.Errorf("stored key after use = %+v, want it touched", key)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/api-keys", nil), created.Key); w.Code != http.StatusForbidden {
+		t.Errorf("managing keys with a key: status = %d, want 403", w.Code)
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodDelete, "/api-keys/"+created.APIKey.ID, nil), tokens.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("revoke key: status = %d", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), created.Key); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d, want 401", w.Code)
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	t.Setenv("REGISTRATION_MODE", RegistrationInvite)
+	app := newTestApp(t)
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+
+	register := func(email, code string) *httptest.ResponseRecorder {
+		return app.serveJSON(http.MethodPost, "/register", "", gin.H{"name": "Ann", "email": email, "password": testPassword, "inviteCode": code})
+	}
+	if w := register("ann@example.com", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("register without a code: status = %d, want 400", w.Code)
+	}
+
+	w := app.serveJSON(http.MethodPost, "/admin/invites", admin.AccessToken, gin.H{"email": "ann@example.com"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create invite: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Code    string `json:"code"`
+		Emailed bool   `json:"emailed"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if !created.Emailed || len(app.outbox.to("ann@example.com")) != 1 {
+		t.Errorf("invite for an address was not emailed: %s", w.Body.String())
+	}
+
+	if w := register("bob@example.com", created.Code); w.Code != http.StatusBadRequest {
+		t.Errorf("register with someone else's code: status = %d, want 400", w.Code)
+	}
+	if w := register("ann@example.com", created.Code); w.Code != http.StatusCreated {
+		t.Fatalf("register with the code: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := register("ann2@example.com", created.Code); w.Code != http.StatusBadRequest {
+		t.Errorf("register with a used-up code: status = %d, want 400", w.Code)
+	}
+	if list, _ := app.invites.List(); len(list) != 1 || list[0].Uses != 1 {
+		t.Errorf("invites after registering = %+v, want one use taken", list)
+	}
+}
+
+func TestGetUserByID(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.addUser(t, "u_admin", "admin@example.com", services.RoleAdmin)
+	ann := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	app.addUser(t, "u_bob", "bob@example.com", services.RoleUser)
+
+	w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), ann.AccessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET own user: status = %d", w.Code)
+	}
+	var body struct {
+		User map[string]any `json:"user"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &body); body.User["email"] != "ann@example.com" {
+		t.Errorf("GET own user: body = %s", w.Body.String())
+	}
+	if _, ok := body.User["password"]; ok {
+		t.Error("GET own user returned the password hash")
+	}
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_bob", nil), ann.AccessToken); w.Code != http.StatusForbidden {
+		t.Errorf("GET another user: status = %d, want 403", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_bob", nil), admin.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("GET another user as an admin: status = %d, want 200", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_nobody", nil), admin.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("GET a missing user: status = %d, want 404", w.Code)
+	}
+}
+
+func TestUpdateUserAndVerifyEmail(t *testing.T) {
+	app := newTestApp(t)
+	ann := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+	app.addUser(t, "u_bob", "bob@example.com", services.RoleUser)
+
+	if w := app.serveJSON(http.MethodPut, "/users", ann.AccessToken, gin.H{"id": "u_bob", "name": "Mallory"}); w.Code != http.StatusForbidden {
+		t.Errorf("updating another user: status = %d, want 403", w.Code)
+	}
+	if bob, _ := app.users.Get("u_bob"); bob.Name == "Mallory" {
+		t.Error("a refused update changed the user")
+	}
+
+	w := app.serveJSON(http.MethodPut, "/users", ann.AccessToken, gin.H{"name": "Ann B", "email": "ann@new.example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if user, _ := app.users.Get("u_ann"); user.Name != "Ann B" || user.Email != "ann@new.example.com" || user.Verified {
+		t.Fatalf("after update: %+v, want the new name and an unverified new email", user)
+	}
+	token := app.outbox.lastToken(t, "ann@new.example.com")
+
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token+"x"), nil), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("tampered verification token: status = %d, want 400", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil), ""); w.Code != http.StatusOK {
+		t.Fatalf("verify: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if user, _ := app.users.Get("u_ann"); !user.Verified {
+		t.Error("email still unverified after following the link")
+	}
+
+	// A link for an address the account has since moved away from no longer works.
+	app.serveJSON(http.MethodPut, "/users", ann.AccessToken, gin.H{"email": "ann@third.example.com"})
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/verify-email?token="+url.QueryEscape(token), nil), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("link for a previous address: status = %d, want 400", w.Code)
+	}
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	app := newTestApp(t)
+	before := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	if w := app.serveJSON(http.MethodPost, "/password/forgot", "", gin.H{"email": "nobody@example.com"}); w.Code != http.StatusOK {
+		t.Errorf("forgot for an unknown email: status = %d, want 200", w.Code)
+	}
+	if w := app.serveJSON(http.MethodPost, "/password/forgot", "", gin.H{"email": "ann@example.com"}); w.Code != http.StatusOK {
+		t.Fatalf("forgot: status = %d", w.Code)
+	}
+	token := app.outbox.lastToken(t, "ann@example.com")
+
+	userID, _, _ := strings.Cut(token, ".")
+	if w := app.serveJSON(http.MethodPost, "/password/reset", "", gin.H{"token": userID + ".guess", "newPassword": "Another-Secret-77"}); w.Code != http.StatusBadRequest {
+		t.Errorf("guessed reset token: status = %d, want 400", w.Code)
+	}
+	if w := app.serveJSON(http.MethodPost, "/password/reset", "", gin.H{"token": token, "newPassword": "short"}); w.Code != http.StatusBadRequest {
+		t.Errorf("weak new password: status = %d, want 400", w.Code)
+	}
+
+	w := app.serveJSON(http.MethodPost, "/password/reset", "", gin.H{"token": token, "newPassword": "Another-Secret-77"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := app.serveJSON(http.MethodPost, "/password/reset", "", gin.H{"token": token, "newPassword": "Third-Secret-99"}); w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the reset token: status = %d, want 400", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u_ann", nil), before.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("session from before the reset: status = %d, want 401", w.Code)
+	}
+	app.login(t, "ann@example.com", "Another-Secret-77")
+
+	if n := app.auditCount(services.AuditPasswordReset, services.AuditSuccess); n != 1 {
+		t.Errorf("recorded %d password resets, want 1", n)
+	}
+}
+
+func TestDownloadURLAndQR(t *testing.T) {
+	app := newTestApp(t)
+	tokens := app.addUser(t, "u_ann", "ann@example.com", services.RoleUser)
+
+	w := app.serveForm("/upload", tokens.AccessToken, map[string]string{"shared_secret": "s3cret"}, "report.txt", []byte("numbers"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var uploaded struct {
+		FileID string `json:"fileId"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &uploaded)
+	right := map[string]string{"hashed_secret": uploaded.FileID, "shared_secret": "s3cret"}
+	wrong := map[string]string{"hashed_secret": uploaded.FileID, "shared_secret": "guess"}
+
+	w = app.serveForm("/download/url", tokens.AccessToken, right, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download URL: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var signed struct {
+		URL string `json:"presigned_url"`
+	}
+	if json.Unmarshal(w.Body.Bytes(), &signed); !strings.HasPrefix(signed.URL, "http://files.test/") {
+		t.Errorf("presigned_url = %q, want a link to the blob store", signed.URL)
+	}
+	if w := app.serveForm("/download/url", tokens.AccessToken, wrong, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("download URL with the wrong secret: status = %d, want 401", w.Code)
+	}
+	if w := app.serveForm("/download/url", tokens.AccessToken, map[string]string{"hashed_secret": "missing", "shared_secret": "s3cret"}, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("download URL for a missing file: status = %d, want 404", w.Code)
+	}
+
+	w = app.serveForm("/download/qr", tokens.AccessToken, right, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("download QR: status = %d, Content-Type = %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, err := png.Decode(w.Body); err != nil {
+		t.Errorf("download QR is not a PNG: %v", err)
+	}
+	if w := app.serveForm("/download/qr", tokens.AccessToken, wrong, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("download QR with the wrong secret: status = %d, want 401", w.Code)
+	}
+
+	for _, want := range []struct{ event, outcome string }{
+		{services.AuditDownloadURL, services.AuditSuccess},
+		{services.AuditDownloadURL, services.AuditDenied},
+		{services.AuditDownloadQR, services.AuditSuccess},
+		{services.AuditDownloadQR, services.AuditDenied},
+	} {
+		if app.auditCount(want.event, want.outcome) != 1 {
+			t.Errorf("no %s %s audit event in %+v", want.event, want.outcome, app.audit.Events())
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+)
+
+// registrationMode reads REGISTRATION_MODE. Anything other than "invite" keeps sign-up open.
+func registrationMode() string {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("REGISTRATION_MODE")), RegistrationInvite) {
+		return RegistrationInvite
+	}
+	return RegistrationOpen
+}
+
+// redeemInviteCode takes one use of a "<id>.<secret>" invite code for the given email. It
+// returns nil and a field error when the code can't be used.
+func redeemInviteCode(invites services.InviteCodeRepository, code, email string) (*services.InviteCode, *middlware.FieldError, error) {
+	id, secretHash, ok := middlware.SplitUserToken(strings.TrimSpace(code))
+	if !ok {
+		return nil, &middlware.FieldError{Field: "inviteCode", Code: "invalid", Message: "Invite code is invalid or has expired"}, nil
+	}
+
+	invite, err := invites.Redeem(id, secretHash, email)
+	if errors.Is(err, services.ErrInvalidToken) {
+		return nil, &middlware.FieldError{Field: "inviteCode", Code: "invalid", Message: "Invite code is invalid or has expired"}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return invite, nil, nil
+}
+
+func CreateInviteCodeReq(invites services.InviteCodeRepository, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Role          string `json:"role"`
+			MaxUses       int    `json:"maxUses"`
+			ExpiresInDays int    `json:"expiresInDays"`
+			Email         string `json:"email"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		if req.Role == "" {
+			req.Role = services.RoleUser
+		}
+		if req.Role != services.RoleUser && req.Role != services.RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be 'user' or 'admin'"})
+			return
+		}
+		if req.MaxUses == 0 {
+			req.MaxUses = 1
+		}
+		if req.MaxUses < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "maxUses must be positive"})
+			return
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = 7
+		}
+		if req.ExpiresInDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiresInDays must be positive"})
+			return
+		}
+		req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+		if req.Email != "" && !strings.Contains(req.Email, "@") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email address is required"})
+			return
+		}
+
+		code, secretHash, err := middlware.NewUserToken("ic_" + ShortUUID())
+		if err != nil {
+			log.Printf("Failed to generate invite code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite code"})
+			return
+		}
+		id, _, _ := strings.Cut(code, ".")
+
+		now := time.Now()
+		invite := services.InviteCode{
+			ID:         id,
+			SecretHash: secretHash,
+			Role:       req.Role,
+			MaxUses:    req.MaxUses,
+			Email:      req.Email,
+			CreatedBy:  claims.ID,
+			CreatedAt:  now.Unix(),
+			ExpiresAt:  now.AddDate(0, 0, req.ExpiresInDays).Unix(),
+		}
+
+		if err := invites.Create(invite); err != nil {
+			log.Printf("Failed to store invite code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite code"})
+			return
+		}
+
+		emailed := false
+		if invite.Email != "" {
+			registerURL := FrontendURL() + "/register?inviteCode=" + url.QueryEscape(code)
+			if err := services.SendInviteCode(resendClient, invite.Email, code, registerURL, time.Unix(invite.ExpiresAt, 0)); err != nil {
+				log.Printf("Failed to send invite code email: %v", err)
+			} else {
+				emailed = true
+			}
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Invite code created. Copy it now, it will not be shown again.",
+			"code":    code,
+			"invite":  invite,
+			"emailed": emailed,
+		})
+	}
+}
+
+func ListInviteCodesReq(invites services.InviteCodeRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := invites.List()
+		if err != nil {
+			log.Printf("Failed to list invite codes: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list invite codes"})
+			return
+		}
+		if list == nil {
+			list = []services.InviteCode{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"invites": list})
+	}
+}
+
+func DeleteInviteCodeReq(invites services.InviteCodeRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := invites.Delete(c.Param("id"))
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invite code not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete invite code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite code"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Invite code revoked"})
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+const (
+	accountFailuresBeforeLock = 5
+	ipFailuresBeforeLock      = 20
+	loginLockBase             = 30 * time.Second
+	loginLockMax              = time.Hour
+	loginAttemptWindow        = 24 * time.Hour
+)
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is compared against when no user matches, so unknown emails take as
+// long to reject as wrong passwords. It is made on first use, after InitAuth has loaded
+// the hashing parameters, so it costs the same as real hashes.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = middlware.HashedPassword("congenial-goggles-placeholder")
+	})
+	return dummyHash
+}
+
+// emailPseudonym stands in for an email address in records that outlive the account, so
+// they don't hold the address itself.
+func emailPseudonym(email string) string {
+	return middlware.HashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + emailPseudonym(email)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginPassword reports whether password matches user, doing the same work when user is nil.
+func checkLoginPassword(user *services.User, password string) bool {
+	if user == nil || user.Password == "" {
+		middlware.CheckPasswordHash(password, dummyPasswordHash())
+		return false
+	}
+	return middlware.CheckPasswordHash(password, user.Password)
+}
+
+// lockoutDuration doubles with every failure past threshold, up to loginLockMax.
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	lock := loginLockBase
+	for i := threshold; i < failures && lock < loginLockMax; i++ {
+		lock *= 2
+	}
+	return min(lock, loginLockMax)
+}
+
+// loginLockRemaining returns how long the account or the client IP is still locked out.
+func loginLockRemaining(attempts services.LoginAttemptRepository, email, ip string) time.Duration {
+	var remaining time.Duration
+	for _, key := range []string{accountAttemptKey(email), ipAttemptKey(ip)} {
+		attempt, err := attempts.Get(key)
+		if err != nil {
+			log.Printf("Failed to check login attempts: %v", err)
+			continue
+		}
+		if attempt == nil {
+			continue
+		}
+		if left := time.Until(time.Unix(attempt.LockedUntil, 0)); left > remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+// recordLoginFailure counts a failed attempt against the account and the client IP and
+// locks either once it passes its threshold. The owner is emailed when their account first
+// locks, not again for each longer lock that follows.
+func recordLoginFailure(attempts services.LoginAttemptRepository, audit services.AuditRepository, resendClient *resend.Client, c *gin.Context, email string, user *services.User) {
+	event := services.AuditEvent{Event: services.AuditLogin, Outcome: services.AuditFailure, Target: emailPseudonym(email)}
+	if user != nil {
+		event.ActorID, event.Target = user.ID, user.ID
+	}
+	middlware.Audit(audit, c, event)
+
+	ip := c.ClientIP()
+	account, err := attempts.RecordFailure(accountAttemptKey(email), loginAttemptWindow)
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	} else if lock := lockoutDuration(account.Failures, accountFailuresBeforeLock); lock > 0 {
+		if err := attempts.Lock(account.ID, time.Now().Add(lock)); err != nil {
+			log.Printf("Failed to lock account: %v", err)
+		} else if user != nil && account.Failures == accountFailuresBeforeLock {
+			if err := services.SendAccountLocked(resendClient, user.Email, lock); err != nil {
+				log.Printf("Failed to send lockout email: %v", err)
+			}
+		}
+	}
+
+	addr, err := attempts.RecordFailure(ipAttemptKey(ip), loginAttemptWindow)
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	} else if lock := lockoutDuration(addr.Failures, ipFailuresBeforeLock); lock > 0 {
+		if err := attempts.Lock(addr.ID, time.Now().Add(lock)); err != nil {
+			log.Printf("Failed to lock IP: %v", err)
+		}
+	}
+}
+
+// clearLoginFailures resets the account's counter after a complete sign-in. The IP counter
+// is left alone so one valid account can't be used to reset it.
+func clearLoginFailures(attempts services.LoginAttemptRepository, email string) {
+	if err := attempts.Clear(accountAttemptKey(email)); err != nil {
+		log.Printf("Failed to clear login attempts: %v", err)
+	}
+}
+
+func respondLoginLocked(c *gin.Context, remaining time.Duration) {
+	c.Header("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed sign-in attempts. Try again later."})
+}
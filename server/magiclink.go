@@ -0,0 +1,108 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+func MagicLinkReq(users services.UserRepository, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Email string `json:"email"`
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+			return
+		}
+
+		// Always answer the same way so the endpoint cannot be used to discover accounts.
+		response := gin.H{"message": "If an account exists for that email, a sign-in link has been sent"}
+
+		user, err := users.GetByEmail(req.Email)
+		if err != nil || user == nil {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
+		token, tokenHash, err := middlware.NewUserToken(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sign-in link"})
+			return
+		}
+
+		// Requesting a new link replaces any earlier one.
+		err = users.SetAttributes(user.ID, map[string]interface{}{
+			"magicLinkHash":    middlware.BindTokenHash(tokenHash, user.Email),
+			"magicLinkExpires": time.Now().Add(middlware.MagicLinkTTL).Unix(),
+		})
+		if err != nil {
+			log.Printf("Failed to store magic link: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create sign-in link"})
+			return
+		}
+
+		signInURL := AppURL() + "/login/magic/callback?token=" + url.QueryEscape(token)
+		if err := services.SendMagicLink(resendClient, user.Email, signInURL, middlware.MagicLinkTTL); err != nil {
+			log.Printf("Failed to send magic link email: %v", err)
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func MagicLinkCallbackReq(users services.UserRepository, sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, tokenHash, ok := middlware.SplitUserToken(c.Query("token"))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in link"})
+			return
+		}
+
+		user, err := users.Get(userID)
+		if err != nil {
+			log.Printf("Failed to load user: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in link"})
+			return
+		}
+
+		if remaining := loginLockRemaining(attempts, user.Email, c.ClientIP()); remaining > 0 {
+			respondLoginLocked(c, remaining)
+			return
+		}
+
+		err = users.ConsumeToken(user.ID, "magicLinkHash", "magicLinkExpires", middlware.BindTokenHash(tokenHash, user.Email))
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in link"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to consume magic link: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+
+		// Following the link proves the user controls the address.
+		if !user.Verified {
+			if err := users.SetAttributes(user.ID, map[string]interface{}{"verified": true}); err != nil {
+				log.Printf("Failed to mark email verified: %v", err)
+			} else {
+				user.Verified = true
+			}
+		}
+
+		completeLogin(sessions, attempts, audit, c, user)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "congenial-goggles"
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code.
+func verifySecondFactor(users services.UserRepository, user *services.User, code string) bool {
+	if counter, ok := middlware.ValidateTOTP(user.TOTPSecret, code, user.TOTPLastCounter); ok {
+		err := users.RecordTOTPCounter(user.ID, counter)
+		if err != nil && !errors.Is(err, services.ErrInvalidToken) {
+			log.Printf("Failed to record TOTP counter: %v", err)
+		}
+		return err == nil
+	}
+
+	err := users.ConsumeRecoveryCode(user.ID, middlware.HashRecoveryCode(code))
+	if err != nil && !errors.Is(err, services.ErrInvalidToken) {
+		log.Printf("Failed to consume recovery code: %v", err)
+	}
+	return err == nil
+}
+
+func EnrollTOTPReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := middlware.GenerateTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+
+		if err := users.SetAttributes(user.ID, map[string]interface{}{"totpPendingSecret": secret}); err != nil {
+			log.Printf("Failed to store pending TOTP secret: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+			return
+		}
+
+		uri := middlware.TOTPURI(secret, totpIssuer(), user.Email)
+		png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Scan the QR code and confirm with a code from your authenticator app",
+			"secret":     secret,
+			"otpauthUri": uri,
+			"qrCode":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+func ConfirmTOTPReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if user.TOTPPendingSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No enrollment in progress"})
+			return
+		}
+
+		counter, ok := middlware.ValidateTOTP(user.TOTPPendingSecret, req.Code, 0)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+
+		codes, hashes, err := middlware.GenerateRecoveryCodes()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+			return
+		}
+
+		if err := users.EnableTOTP(user.ID, user.TOTPPendingSecret, counter, hashes); err != nil {
+			log.Printf("Failed to enable TOTP: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Two-factor authentication enabled. Store these recovery codes somewhere safe, they will not be shown again",
+			"recoveryCodes": codes,
+		})
+	}
+}
+
+func DisableTOTPReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password and code are required"})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		if !user.TOTPEnabled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return
+		}
+
+		if !middlware.CheckPasswordHash(req.Password, user.Password) || !verifySecondFactor(users, user, req.Code) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password or code"})
+			return
+		}
+
+		if err := users.DisableTOTP(user.ID); err != nil {
+			log.Printf("Failed to disable TOTP: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+func LoginMFAReq(users services.UserRepository, sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			MFAToken string `json:"mfaToken"`
+			Code     string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "MFA token and code are required"})
+			return
+		}
+
+		claims := middlware.ParseMFAToken(req.MFAToken)
+		if claims == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA challenge"})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil || !user.TOTPEnabled {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA challenge"})
+			return
+		}
+
+		if remaining := loginLockRemaining(attempts, user.Email, c.ClientIP()); remaining > 0 {
+			respondLoginLocked(c, remaining)
+			return
+		}
+
+		if !verifySecondFactor(users, user, req.Code) {
+			recordLoginFailure(attempts, audit, resendClient, c, user.Email, user)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+
+		clearLoginFailures(attempts, user.Email)
+		respondWithSession(sessions, audit, c, user)
+	}
+}
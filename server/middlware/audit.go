@@ -0,0 +1,26 @@
+package middlware
+
+import (
+	"congenial-goggles/server/services"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit appends an event to the audit log, filling in the request's IP, user agent and
+// route, and the signed-in user as actor when none is given. Write failures are logged
+// rather than failing the request.
+func Audit(audit services.AuditRepository, c *gin.Context, event services.AuditEvent) {
+	if event.ActorID == "" {
+		if claims, ok := c.Get("claims"); ok {
+			event.ActorID = claims.(*UserClaims).ID
+		}
+	}
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.Path = c.FullPath()
+
+	if err := audit.Put(event); err != nil {
+		log.Printf("Failed to write audit event %s: %v", event.Event, err)
+	}
+}
@@ -2,43 +2,43 @@ package middlware
 
 import (
 	"congenial-goggles/server/services"
-	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
 	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// HashedPassword hashes with Argon2id using the current PasswordHashing parameters.
 func HashedPassword(password string) (string, error) {
-	hashedPassword, error := bcrypt.GenerateFromPassword([]byte(password), 10)
-	return string(hashedPassword), error
+	return hashArgon2id(password, PasswordHashing)
 }
 
+// CheckPasswordHash accepts Argon2id hashes and legacy bcrypt hashes.
 func CheckPasswordHash(password, hash string) bool {
 	if password == "" || hash == "" {
 		return false
 	}
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	return verifyPasswordHash(password, hash)
 }
 
 var (
 	AccessTokenSecret  string
 	RefreshTokenSecret string
+	EmailTokenSecret   string
 	AccessTokenTTL     = time.Minute * 15
 	RefreshTokenTTL    = time.Hour * 24 * 7
+	PasswordResetTTL   = time.Minute * 30
+	MagicLinkTTL       = time.Minute * 5
+	EmailVerifyTTL     = time.Hour * 24
 )
 
 // Load .env once at startup
@@ -51,15 +51,47 @@ func InitAuth() {
 
 	AccessTokenSecret = os.Getenv("TOKEN_SECRET")
 	RefreshTokenSecret = os.Getenv("REFRESH_TOKEN_SECRET")
+	EmailTokenSecret = os.Getenv("EMAIL_TOKEN_SECRET")
 
-	if AccessTokenSecret == "" || RefreshTokenSecret == "" {
-		log.Fatal("TOKEN_SECRET or REFRESH_TOKEN_SECRET is missing")
+	if keyDir := os.Getenv("JWT_KEYS_DIR"); keyDir != "" {
+		ring, err := LoadKeyRing(keyDir, os.Getenv("JWT_ACTIVE_KID"))
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing keys: %v", err)
+		}
+		Keys = ring
+		log.Printf("Signing access tokens with key %s", ring.active.ID)
+	}
+
+	// TOKEN_SECRET is only needed when there is no key ring, or to accept HS256 tokens
+	// issued before one was configured.
+	if (AccessTokenSecret == "" && Keys == nil) || RefreshTokenSecret == "" || EmailTokenSecret == "" {
+		log.Fatal("TOKEN_SECRET, REFRESH_TOKEN_SECRET or EMAIL_TOKEN_SECRET is missing")
 	}
+
+	InitPasswordPolicy()
+	InitPasswordHashing()
 }
 
 type UserClaims struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	Verified  bool     `json:"verified"`
+	Role      string   `json:"role,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	APIKeyID  string   `json:"-"`
+	TokenType string   `json:"token_type"`
+	jwt.StandardClaims
+}
+
+// RefreshClaims carries the session (token family) ID; StandardClaims.Id is the token's own ID.
+type RefreshClaims struct {
+	SessionID string `json:"sid"`
+	jwt.StandardClaims
+}
+
+type EmailVerificationClaims struct {
 	Email     string `json:"email"`
 	TokenType string `json:"token_type"`
 	jwt.StandardClaims
@@ -67,23 +99,76 @@ type UserClaims struct {
 
 func NewAccessToken(claims UserClaims) (string, error) {
 	claims.TokenType = "access"
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return accessToken.SignedString([]byte(AccessTokenSecret))
+	return signUserClaims(claims)
 }
 
-func NewRefreshToken(claims jwt.StandardClaims) (string, error) {
+func signUserClaims(claims UserClaims) (string, error) {
+	if Keys != nil {
+		return Keys.Sign(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(AccessTokenSecret))
+}
+
+// accessTokenKey picks the verification key: tokens with a kid are checked against the key
+// ring, tokens without one are legacy HS256 tokens signed with TOKEN_SECRET.
+func accessTokenKey(token *jwt.Token) (interface{}, error) {
+	if _, hasKid := token.Header["kid"]; hasKid {
+		if Keys == nil {
+			return nil, fmt.Errorf("token has a kid but no key ring is configured")
+		}
+		return Keys.VerificationKey(token)
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || AccessTokenSecret == "" {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return []byte(AccessTokenSecret), nil
+}
+
+func NewRefreshToken(claims RefreshClaims) (string, error) {
 	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return refreshToken.SignedString([]byte(RefreshTokenSecret))
 }
 
-func ParseAccessToken(accessToken string) *UserClaims {
-	parsedAccessToken, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Ensure correct signing method
+// NewEmailVerificationToken signs a link token binding the user to the address being verified,
+// so a link sent before an email change cannot verify the new address.
+func NewEmailVerificationToken(userID, email string) (string, error) {
+	claims := EmailVerificationClaims{
+		Email:     email,
+		TokenType: "verify_email",
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(EmailVerifyTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Subject:   userID,
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(EmailTokenSecret))
+}
+
+func ParseEmailVerificationToken(verifyToken string) *EmailVerificationClaims {
+	parsed, err := jwt.ParseWithClaims(verifyToken, &EmailVerificationClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(AccessTokenSecret), nil
+		return []byte(EmailTokenSecret), nil
 	})
+	if err != nil || !parsed.Valid {
+		log.Printf("Email verification token failed: %v", err)
+		return nil
+	}
+
+	claims, ok := parsed.Claims.(*EmailVerificationClaims)
+	if !ok || claims.TokenType != "verify_email" {
+		return nil
+	}
+
+	return claims
+}
+
+func ParseAccessToken(accessToken string) *UserClaims {
+	parsedAccessToken, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, accessTokenKey)
 	if err != nil || !parsedAccessToken.Valid {
 		fmt.Println("Token verification failed:", err) // Debugging output
 		return nil
@@ -98,8 +183,8 @@ func ParseAccessToken(accessToken string) *UserClaims {
 	return claims
 }
 
-func ParseRefreshToken(refreshToken string) *jwt.StandardClaims {
-	parsedRefreshToken, err := jwt.ParseWithClaims(refreshToken, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+func ParseRefreshToken(refreshToken string) *RefreshClaims {
+	parsedRefreshToken, err := jwt.ParseWithClaims(refreshToken, &RefreshClaims{}, func(token *jwt.Token) (interface{}, error) {
 		// Ensure correct signing method
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -111,7 +196,7 @@ func ParseRefreshToken(refreshToken string) *jwt.StandardClaims {
 		return nil
 	}
 
-	claims, ok := parsedRefreshToken.Claims.(*jwt.StandardClaims)
+	claims, ok := parsedRefreshToken.Claims.(*RefreshClaims)
 	if !ok {
 		fmt.Println("Failed to cast refresh token claims")
 		return nil
@@ -120,9 +205,12 @@ func ParseRefreshToken(refreshToken string) *jwt.StandardClaims {
 	return claims
 }
 
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(keys services.APIKeyRepository, users services.UserRepository, sessions services.SessionRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			authHeader = "Bearer " + apiKey
+		}
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header missing"})
 			c.Abort()
@@ -136,15 +224,52 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		claims := ParseAccessToken(token)
+		if strings.HasPrefix(token, APIKeyPrefix) {
+			claims := authenticateAPIKey(keys, users, token)
+			if claims == nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+				c.Abort()
+				return
+			}
+			c.Set("claims", claims)
+			c.Next()
+			return
+		}
+
+		claims := authenticateAccessToken(sessions, c, token)
 		if claims == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
+			return
+		}
+		// Tokens issued to OAuth clients are only good for the OIDC endpoints.
+		if claims.Audience != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token was issued to another application"})
+			c.Abort()
+			return
+		}
+
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// UserInfoMiddleware authenticates the OIDC userinfo endpoint: it takes the app's own access
+// tokens and those issued to OAuth clients with the openid scope.
+func UserInfoMiddleware(sessions services.SessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
 			c.Abort()
 			return
 		}
 
-		if claims.TokenType == "refresh" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh tokens cannot be used here"})
+		claims := authenticateAccessToken(sessions, c, token)
+		if claims == nil {
+			return
+		}
+		if claims.Audience != "" && !slices.Contains(claims.Scopes, "openid") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
 			c.Abort()
 			return
 		}
@@ -154,11 +279,58 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// authenticateAccessToken verifies an access token and that its session is still live. On
+// failure it responds and aborts, and returns nil.
+func authenticateAccessToken(sessions services.SessionRepository, c *gin.Context, token string) *UserClaims {
+	claims := ParseAccessToken(token)
+	if claims == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to verify token"})
+		c.Abort()
+		return nil
+	}
+
+	if claims.TokenType != "access" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Only access tokens can be used here"})
+		c.Abort()
+		return nil
+	}
+
+	if claims.SessionID != "" {
+		active, err := SessionActive(sessions, claims.SessionID)
+		if err != nil {
+			log.Printf("Failed to check session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+			c.Abort()
+			return nil
+		}
+		if !active {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been signed out"})
+			c.Abort()
+			return nil
+		}
+	}
+
+	return claims
+}
+
+// RequireVerifiedEmail must run after AuthMiddleware.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, exists := c.Get("claims")
+		if !exists || !claims.(*UserClaims).Verified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Email address must be verified first"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 type RefreshRequest struct {
 	RefreshToken string `json:"refreshToken" binding:"required"`
 }
 
-func RefreshTokenHandler(client *dynamodb.Client) gin.HandlerFunc {
+func RefreshTokenHandler(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req RefreshRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -166,51 +338,24 @@ func RefreshTokenHandler(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		claims := ParseRefreshToken(req.RefreshToken)
-		if claims == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
-			return
-		}
-
-		userID := claims.Subject
-
-		out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-			TableName: aws.String("Users"), // adjust table name
-			Key: map[string]types.AttributeValue{
-				"id": &types.AttributeValueMemberS{Value: userID},
-			},
-		})
-		if err != nil || out.Item == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		_, _, accessToken, refreshToken, err := RedeemRefreshToken(users, sessions, audit, c, req.RefreshToken, "")
+		if errors.Is(err, services.ErrTokenReuse) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, session revoked"})
 			return
 		}
-
-		var user services.User
-		if err := attributevalue.UnmarshalMap(out.Item, &user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unmarshal user"})
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
 			return
 		}
-
-		newClaims := UserClaims{
-			ID:        user.ID,
-			Name:      user.Name,
-			Email:     user.Email,
-			TokenType: "access",
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(AccessTokenTTL).Unix(),
-				IssuedAt:  time.Now().Unix(),
-				Subject:   user.ID,
-			},
-		}
-
-		accessToken, err := NewAccessToken(newClaims)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token"})
+			log.Printf("Token rotation failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"accessToken": accessToken,
+			"accessToken":  accessToken,
+			"refreshToken": refreshToken,
 		})
 	}
 }
@@ -0,0 +1,185 @@
+package middlware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// signingKey is one entry in the key ring. Retired keys have no private half and are only
+// kept so tokens signed before a rotation still verify.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+type KeyRing struct {
+	keys   map[string]*signingKey
+	active *signingKey
+}
+
+// Keys is nil when no key directory is configured, in which case tokens fall back to HS256.
+var Keys *KeyRing
+
+// LoadKeyRing reads every PEM file in dir. "<kid>.pem" holds a private key, "<kid>.pub.pem"
+// a public key for a retired kid. activeKID picks the signing key; when empty the last
+// private key by name is used, so date-based kids rotate by adding a file.
+func LoadKeyRing(dir, activeKID string) (*KeyRing, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys in %s: %w", dir, err)
+	}
+	sort.Strings(paths)
+
+	ring := &KeyRing{keys: make(map[string]*signingKey)}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		publicOnly := strings.HasSuffix(name, ".pub.pem")
+		kid := strings.TrimSuffix(strings.TrimSuffix(name, ".pem"), ".pub")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", path, err)
+		}
+
+		key, err := parseSigningKey(kid, data, publicOnly)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", path, err)
+		}
+
+		if existing, ok := ring.keys[kid]; ok && existing.Private != nil {
+			continue // the private key already carries the public half
+		}
+		ring.keys[kid] = key
+
+		if key.Private != nil && activeKID == "" {
+			ring.active = key
+		}
+	}
+
+	if activeKID != "" {
+		ring.active = ring.keys[activeKID]
+	}
+	if ring.active == nil || ring.active.Private == nil {
+		return nil, fmt.Errorf("no private signing key found for kid %q in %s", activeKID, dir)
+	}
+
+	return ring, nil
+}
+
+func parseSigningKey(kid string, data []byte, publicOnly bool) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if publicOnly {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch pub := pub.(type) {
+		case *rsa.PublicKey:
+			return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Public: pub}, nil
+		case ed25519.PublicKey:
+			return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Public: pub}, nil
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+	}
+
+	var priv interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Private: priv, Public: &priv.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: priv, Public: priv.Public()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+}
+
+// Sign signs claims with the active key and stamps its kid in the header.
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.Private)
+}
+
+// Algorithm is the JWS alg of the active signing key.
+func (k *KeyRing) Algorithm() string {
+	return k.active.Method.Alg()
+}
+
+// VerificationKey returns the public key for the token's kid, refusing an alg that does
+// not match the key so an RSA public key can never be used as an HMAC secret.
+func (k *KeyRing) VerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+	return key.Public, nil
+}
+
+// JWKS renders every public key in the ring as a JSON Web Key Set (RFC 7517).
+func (k *KeyRing) JWKS() map[string]interface{} {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := make([]map[string]string, 0, len(ids))
+	for _, id := range ids {
+		key := k.keys[id]
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": id,
+				"use": "sig",
+				"alg": key.Method.Alg(),
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": id,
+				"use": "sig",
+				"alg": key.Method.Alg(),
+				"x":   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
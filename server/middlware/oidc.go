@@ -0,0 +1,71 @@
+package middlware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	IDTokenTTL          = time.Hour
+	AuthCodeTTL         = time.Minute * 2
+	AuthorizeSessionTTL = time.Hour * 12
+)
+
+// AuthorizeCookie holds the token from NewAuthorizeSession, so a browser sent back to the
+// authorization endpoint by a relying party doesn't have to sign in again.
+const AuthorizeCookie = "cg_authorize"
+
+// authorizeSessionTokenType marks the cookie's token so it can't pass for an access token.
+const authorizeSessionTokenType = "authorize_session"
+
+// IDTokenClaims are the OpenID Connect ID token claims, built from the same user fields
+// as UserClaims.
+type IDTokenClaims struct {
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	Nonce         string `json:"nonce,omitempty"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	jwt.StandardClaims
+}
+
+// NewIDTokenClaims builds the claims for an ID token. authTime is when the user last signed
+// in, not when the token is issued.
+func NewIDTokenClaims(user UserClaims, issuer, audience, nonce string, authTime int64) IDTokenClaims {
+	now := time.Now()
+	return IDTokenClaims{
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.Verified,
+		Nonce:         nonce,
+		AuthTime:      authTime,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Subject:   user.ID,
+			Audience:  audience,
+			ExpiresAt: now.Add(IDTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+		},
+	}
+}
+
+// NewIDToken signs an ID token. Relying parties verify it against the JWKS, so it
+// requires an asymmetric key ring.
+func NewIDToken(claims IDTokenClaims) (string, error) {
+	if Keys == nil {
+		return "", fmt.Errorf("ID tokens require JWT_KEYS_DIR to be configured")
+	}
+	return Keys.Sign(claims)
+}
+
+// ParseAuthorizeSessionToken returns the claims of a token from NewAuthorizeSession, or nil.
+// The caller still has to check that the session is live.
+func ParseAuthorizeSessionToken(token string) *UserClaims {
+	claims := ParseAccessToken(token)
+	if claims == nil || claims.TokenType != authorizeSessionTokenType || claims.SessionID == "" {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,236 @@
+package middlware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError describes one problem with a request field, so clients can show it next to
+// the right input.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordOwner is what rules may compare a password against.
+type PasswordOwner struct {
+	Name  string
+	Email string
+}
+
+// PasswordRule checks one aspect of a candidate password, returning nil when it passes.
+type PasswordRule func(password string, owner PasswordOwner) *FieldError
+
+type PasswordPolicy struct {
+	Rules []PasswordRule
+}
+
+// Passwords is the policy applied on registration, password change and reset.
+var Passwords = &PasswordPolicy{Rules: []PasswordRule{
+	MinLength(10),
+	MaxLength(128),
+	CharacterClasses(3),
+	NotContainingIdentity(),
+}}
+
+// Validate runs every rule and returns all violations, reported against field.
+func (p *PasswordPolicy) Validate(field, password string, owner PasswordOwner) []FieldError {
+	var violations []FieldError
+	for _, rule := range p.Rules {
+		if v := rule(password, owner); v != nil {
+			v.Field = field
+			violations = append(violations, *v)
+		}
+	}
+	return violations
+}
+
+// InitPasswordPolicy builds Passwords from PASSWORD_MIN_LENGTH, PASSWORD_CHARACTER_CLASSES
+// and BREACHED_PASSWORDS_DIR, keeping the defaults for anything unset.
+func InitPasswordPolicy() {
+	minLength, classes := 10, 3
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && v > 0 {
+		minLength = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("PASSWORD_CHARACTER_CLASSES")); err == nil && v >= 0 && v <= 4 {
+		classes = v
+	}
+
+	rules := []PasswordRule{
+		MinLength(minLength),
+		MaxLength(128),
+		CharacterClasses(classes),
+		NotContainingIdentity(),
+	}
+
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		list, err := LoadBreachedPasswords(dir)
+		if err != nil {
+			log.Fatalf("Failed to load breached password list: %v", err)
+		}
+		log.Printf("Checking passwords against %d breached-password range files", list.ranges)
+		rules = append(rules, NotBreached(list))
+	}
+
+	Passwords = &PasswordPolicy{Rules: rules}
+}
+
+func MinLength(n int) PasswordRule {
+	return func(password string, _ PasswordOwner) *FieldError {
+		if utf8.RuneCountInString(password) < n {
+			return &FieldError{Code: "too_short", Message: fmt.Sprintf("Password must be at least %d characters", n)}
+		}
+		return nil
+	}
+}
+
+// MaxLength limits the password in bytes, which keeps hashing cost bounded.
+func MaxLength(n int) PasswordRule {
+	return func(password string, _ PasswordOwner) *FieldError {
+		if len(password) > n {
+			return &FieldError{Code: "too_long", Message: fmt.Sprintf("Password must be at most %d bytes", n)}
+		}
+		return nil
+	}
+}
+
+// CharacterClasses requires at least n of: lowercase, uppercase, digits and symbols.
+func CharacterClasses(n int) PasswordRule {
+	return func(password string, _ PasswordOwner) *FieldError {
+		var lower, upper, digit, other bool
+		for _, r := range password {
+			switch {
+			case unicode.IsLower(r):
+				lower = true
+			case unicode.IsUpper(r):
+				upper = true
+			case unicode.IsDigit(r):
+				digit = true
+			default:
+				other = true
+			}
+		}
+
+		count := 0
+		for _, present := range []bool{lower, upper, digit, other} {
+			if present {
+				count++
+			}
+		}
+		if count < n {
+			return &FieldError{Code: "too_simple", Message: fmt.Sprintf("Password must mix at least %d of lowercase, uppercase, digits and symbols", n)}
+		}
+		return nil
+	}
+}
+
+// NotContainingIdentity rejects passwords containing the user's email, the part before the
+// @, or any word of their name that is three or more characters long.
+func NotContainingIdentity() PasswordRule {
+	return func(password string, owner PasswordOwner) *FieldError {
+		lowered := strings.ToLower(password)
+
+		parts := strings.Fields(strings.ToLower(owner.Name))
+		if email := strings.ToLower(owner.Email); email != "" {
+			local, _, _ := strings.Cut(email, "@")
+			parts = append(parts, email, local)
+		}
+
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= 3 && strings.Contains(lowered, part) {
+				return &FieldError{Code: "contains_identity", Message: "Password must not contain your name or email"}
+			}
+		}
+		return nil
+	}
+}
+
+// BreachedPasswords reads a local copy of a breached-password list in SHA-1 prefix
+// (range) format: one file per five-character hex prefix, named after the prefix with an
+// optional .txt extension, whose lines are "SUFFIX:COUNT". Files are read on demand.
+type BreachedPasswords struct {
+	dir    string
+	ranges int
+}
+
+func LoadBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := 0
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".txt")
+		if !entry.IsDir() && len(name) == 5 {
+			if _, err := hex.DecodeString(name + "0"); err == nil {
+				ranges++
+			}
+		}
+	}
+	if ranges == 0 {
+		return nil, fmt.Errorf("no range files found in %s", dir)
+	}
+
+	return &BreachedPasswords{dir: dir, ranges: ranges}, nil
+}
+
+// Contains reports whether the password appears in the list.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	var f *os.File
+	var err error
+	for _, name := range []string{prefix, prefix + ".txt", strings.ToLower(prefix), strings.ToLower(prefix) + ".txt"} {
+		f, err = os.Open(filepath.Join(b.dir, name))
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(hash, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// NotBreached rejects passwords found in the list. If the list can't be read the password
+// is let through, since the other rules still apply.
+func NotBreached(list *BreachedPasswords) PasswordRule {
+	return func(password string, _ PasswordOwner) *FieldError {
+		found, err := list.Contains(password)
+		if err != nil {
+			log.Printf("Failed to check breached passwords: %v", err)
+			return nil
+		}
+		if found {
+			return &FieldError{Code: "breached", Message: "This password has appeared in a data breach, choose a different one"}
+		}
+		return nil
+	}
+}
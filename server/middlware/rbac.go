@@ -0,0 +1,55 @@
+package middlware
+
+import (
+	"congenial-goggles/server/services"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EffectiveRole treats tokens issued before roles existed as regular users.
+func (c *UserClaims) EffectiveRole() string {
+	if c.Role == "" {
+		return services.RoleUser
+	}
+	return c.Role
+}
+
+func (c *UserClaims) IsAdmin() bool {
+	return c.EffectiveRole() == services.RoleAdmin
+}
+
+// RequireRole must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, exists := c.Get("claims")
+		if !exists || !slices.Contains(roles, claims.(*UserClaims).EffectiveRole()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSelfOrAdmin allows the request when the route parameter names the caller, or the
+// caller is an admin. It must run after AuthMiddleware.
+func RequireSelfOrAdmin(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, exists := c.Get("claims")
+		if !exists {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+
+		userClaims := claims.(*UserClaims)
+		if userClaims.ID != c.Param(param) && !userClaims.IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You can only access your own account"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,53 @@
+package middlware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SCIMContentType = "application/scim+json"
+	SCIMErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// SCIMError writes an error in the SCIM 2.0 format (RFC 7644 section 3.12). scimType may be
+// empty.
+func SCIMError(c *gin.Context, status int, scimType, detail string) {
+	body := gin.H{
+		"schemas": []string{SCIMErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	c.Header("Content-Type", SCIMContentType)
+	c.AbortWithStatusJSON(status, body)
+}
+
+// RequireSCIMToken authenticates the identity provider with the bearer token in
+// SCIM_BEARER_TOKEN. The SCIM endpoints are turned off when it is not set.
+func RequireSCIMToken() gin.HandlerFunc {
+	expected := HashToken(os.Getenv("SCIM_BEARER_TOKEN"))
+	enabled := os.Getenv("SCIM_BEARER_TOKEN") != ""
+
+	return func(c *gin.Context) {
+		if !enabled {
+			SCIMError(c, http.StatusNotFound, "", "SCIM provisioning is not enabled")
+			return
+		}
+
+		token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(expected)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="scim"`)
+			SCIMError(c, http.StatusUnauthorized, "", "Invalid SCIM bearer token")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,200 @@
+package middlware
+
+import (
+	"congenial-goggles/server/services"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// RedeemRefreshToken validates a refresh token against its session and rotates it. clientID
+// is the OAuth client redeeming it, or empty for the app itself; a token issued to anyone
+// else is invalid. If the token was already redeemed the whole session is revoked and
+// services.ErrTokenReuse returned.
+func RedeemRefreshToken(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository, c *gin.Context, refreshToken, clientID string) (*services.User, *services.Session, string, string, error) {
+	claims := ParseRefreshToken(refreshToken)
+	if claims == nil || claims.SessionID == "" || claims.Id == "" {
+		Audit(audit, c, services.AuditEvent{Event: services.AuditTokenRefresh, Outcome: services.AuditFailure, Detail: "invalid token"})
+		return nil, nil, "", "", ErrInvalidRefreshToken
+	}
+
+	user, session, accessToken, newRefreshToken, err := redeemRefreshToken(users, sessions, c, claims, clientID)
+	event := services.AuditEvent{Event: services.AuditTokenRefresh, Outcome: services.AuditSuccess, ActorID: claims.Subject, Target: claims.SessionID}
+	switch {
+	case errors.Is(err, services.ErrTokenReuse):
+		event.Outcome, event.Detail = services.AuditDenied, "refresh token reuse, session revoked"
+	case errors.Is(err, ErrInvalidRefreshToken):
+		event.Outcome, event.Detail = services.AuditFailure, "invalid token"
+	case err != nil:
+		event.Outcome, event.Detail = services.AuditFailure, "server error"
+	}
+	Audit(audit, c, event)
+
+	return user, session, accessToken, newRefreshToken, err
+}
+
+func redeemRefreshToken(users services.UserRepository, sessions services.SessionRepository, c *gin.Context, claims *RefreshClaims, clientID string) (*services.User, *services.Session, string, string, error) {
+	session, err := sessions.Get(claims.SessionID)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	if session == nil || session.Revoked || session.UserID != claims.Subject || session.ClientID != clientID {
+		return nil, nil, "", "", ErrInvalidRefreshToken
+	}
+
+	user, err := users.Get(session.UserID)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	if user == nil || user.Disabled {
+		return nil, nil, "", "", ErrInvalidRefreshToken
+	}
+
+	accessToken, newRefreshToken, err := RotateSessionTokens(sessions, c, *user, *session, claims.Id)
+	if errors.Is(err, services.ErrTokenReuse) {
+		// A token from this family was presented twice, so assume it was stolen.
+		if err := sessions.Revoke(session.ID); err != nil {
+			log.Printf("Failed to revoke session %s: %v", session.ID, err)
+		}
+		return nil, nil, "", "", err
+	}
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+
+	return user, session, accessToken, newRefreshToken, nil
+}
+
+// NewSessionTokens starts a new session (refresh token family) for the user and returns
+// its first access/refresh token pair.
+func NewSessionTokens(sessions services.SessionRepository, c *gin.Context, user services.User) (string, string, error) {
+	return NewClientSessionTokens(sessions, c, user, "", "", time.Now())
+}
+
+// NewClientSessionTokens starts a session on behalf of an OAuth client. Its access tokens
+// carry the client as their audience and only the granted scope, so AuthMiddleware turns
+// them away, and its refresh tokens can only be redeemed by the same client. authTime is
+// when the user signed in to authorize the client.
+func NewClientSessionTokens(sessions services.SessionRepository, c *gin.Context, user services.User, clientID, scope string, authTime time.Time) (string, string, error) {
+	now := time.Now()
+	session := services.Session{
+		ID:           uuid.NewString(),
+		UserID:       user.ID,
+		CurrentToken: uuid.NewString(),
+		UserAgent:    c.Request.UserAgent(),
+		IP:           c.ClientIP(),
+		CreatedAt:    now.Unix(),
+		LastUsedAt:   now.Unix(),
+		ExpiresAt:    now.Add(RefreshTokenTTL).Unix(),
+		ClientID:     clientID,
+		Scope:        scope,
+		AuthTime:     authTime.Unix(),
+	}
+
+	if err := sessions.Create(session); err != nil {
+		return "", "", err
+	}
+
+	return signSessionTokens(user, session, session.CurrentToken, now)
+}
+
+// NewAuthorizeSession starts a session that keeps a browser signed in to the OIDC
+// authorization endpoint, and returns the cookie value that points at it. The session is
+// listed and signed out like any other; it has no refresh token.
+func NewAuthorizeSession(sessions services.SessionRepository, c *gin.Context, user services.User) (string, error) {
+	now := time.Now()
+	session := services.Session{
+		ID:           uuid.NewString(),
+		UserID:       user.ID,
+		CurrentToken: uuid.NewString(),
+		UserAgent:    c.Request.UserAgent(),
+		IP:           c.ClientIP(),
+		CreatedAt:    now.Unix(),
+		LastUsedAt:   now.Unix(),
+		ExpiresAt:    now.Add(AuthorizeSessionTTL).Unix(),
+		AuthTime:     now.Unix(),
+	}
+
+	if err := sessions.Create(session); err != nil {
+		return "", err
+	}
+
+	return signUserClaims(UserClaims{
+		ID:        user.ID,
+		SessionID: session.ID,
+		TokenType: authorizeSessionTokenType,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: session.ExpiresAt,
+			IssuedAt:  now.Unix(),
+			Subject:   user.ID,
+		},
+	})
+}
+
+// RotateSessionTokens redeems the refresh token tokenID and issues its replacement. It
+// returns services.ErrTokenReuse if tokenID has already been redeemed.
+func RotateSessionTokens(sessions services.SessionRepository, c *gin.Context, user services.User, session services.Session, tokenID string) (string, string, error) {
+	now := time.Now()
+	newTokenID := uuid.NewString()
+
+	err := sessions.Rotate(session.ID, tokenID, newTokenID, c.ClientIP(), now.Add(RefreshTokenTTL).Unix())
+	if err != nil {
+		return "", "", err
+	}
+
+	return signSessionTokens(user, session, newTokenID, now)
+}
+
+func signSessionTokens(user services.User, session services.Session, tokenID string, now time.Time) (string, string, error) {
+	accessToken, err := NewAccessToken(UserClaims{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		Verified:  user.Verified,
+		Role:      user.EffectiveRole(),
+		SessionID: session.ID,
+		Scopes:    strings.Fields(session.Scope),
+		StandardClaims: jwt.StandardClaims{
+			Audience:  session.ClientID,
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+			Subject:   user.ID,
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create access token: %w", err)
+	}
+
+	refreshToken, err := NewRefreshToken(RefreshClaims{
+		SessionID: session.ID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			ExpiresAt: now.Add(RefreshTokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
+			Subject:   user.ID,
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// SessionActive reports whether the session behind an access token is still live, so
+// signing out a device takes effect before its access token expires.
+func SessionActive(sessions services.SessionRepository, sessionID string) (bool, error) {
+	session, err := sessions.Get(sessionID)
+	if err != nil {
+		return false, err
+	}
+	return session != nil && !session.Revoked && session.ExpiresAt > time.Now().Unix(), nil
+}
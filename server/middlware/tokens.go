@@ -0,0 +1,49 @@
+package middlware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// NewOpaqueToken returns a random URL-safe token of n random bytes.
+func NewOpaqueToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken is used to store one-time tokens so a leaked table does not leak usable links.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewUserToken returns a token of the form "<userId>.<secret>" and the hash of the secret part.
+func NewUserToken(userID string) (token, hash string, err error) {
+	secret, err := NewOpaqueToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return userID + "." + secret, HashToken(secret), nil
+}
+
+// SplitUserToken reverses NewUserToken, returning the user ID and the hash of the secret part.
+func SplitUserToken(token string) (userID, hash string, ok bool) {
+	userID, secret, found := strings.Cut(token, ".")
+	if !found || userID == "" || secret == "" {
+		return "", "", false
+	}
+	return userID, HashToken(secret), true
+}
+
+// BindTokenHash ties a token hash to an email address, so the token stops matching if the
+// account's email changes before it is used.
+func BindTokenHash(hash, email string) string {
+	return HashToken(hash + ":" + strings.ToLower(email))
+}
@@ -0,0 +1,23 @@
+package middlware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const TusVersion = "1.0.0"
+
+// TusResumable answers every tus request with the protocol version and turns away clients
+// that speak a different one. OPTIONS requests are exempt, since that is how clients ask.
+func TusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", TusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != TusVersion {
+			c.Header("Tus-Version", TusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,580 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+// oidcScopes are the scopes the provider grants; others in a request are ignored.
+var oidcScopes = []string{"openid", "profile", "email"}
+
+// grantedScope keeps the supported scopes of a requested scope string, in request order.
+func grantedScope(requested string) string {
+	var granted []string
+	for _, scope := range strings.Fields(requested) {
+		if slices.Contains(oidcScopes, scope) && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+func OIDCIssuer() string {
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		return strings.TrimRight(issuer, "/")
+	}
+	return AppURL()
+}
+
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+}
+
+func parseAuthorizeRequest(c *gin.Context) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        c.Request.FormValue("response_type"),
+		ClientID:            c.Request.FormValue("client_id"),
+		RedirectURI:         c.Request.FormValue("redirect_uri"),
+		Scope:               c.Request.FormValue("scope"),
+		State:               c.Request.FormValue("state"),
+		Nonce:               c.Request.FormValue("nonce"),
+		CodeChallenge:       c.Request.FormValue("code_challenge"),
+		CodeChallengeMethod: c.Request.FormValue("code_challenge_method"),
+		Prompt:              c.Request.FormValue("prompt"),
+	}
+}
+
+// authorizeSession finds the session a GET to the authorization endpoint is signed in with:
+// the cookie set by an earlier sign-in on our form, or the app's own access token for callers
+// that send one. Tokens issued to OAuth clients don't count.
+func authorizeSession(sessions services.SessionRepository, c *gin.Context) *services.Session {
+	var claims *middlware.UserClaims
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		claims = middlware.ParseAccessToken(strings.TrimPrefix(header, "Bearer "))
+		if claims != nil && (claims.TokenType != "access" || claims.Audience != "") {
+			claims = nil
+		}
+	}
+	if claims == nil {
+		if cookie, err := c.Cookie(middlware.AuthorizeCookie); err == nil {
+			claims = middlware.ParseAuthorizeSessionToken(cookie)
+		}
+	}
+	if claims == nil || claims.SessionID == "" {
+		return nil
+	}
+
+	session, err := sessions.Get(claims.SessionID)
+	if err != nil {
+		log.Printf("Failed to load session: %v", err)
+		return nil
+	}
+	if session == nil || session.Revoked || session.ExpiresAt <= time.Now().Unix() || session.UserID != claims.ID || session.ClientID != "" {
+		return nil
+	}
+	return session
+}
+
+// setAuthorizeCookie keeps the browser signed in to the authorization endpoint. SameSite=Lax
+// still sends it on the top-level redirect from a relying party.
+func setAuthorizeCookie(c *gin.Context, value string) {
+	secure := c.Request.TLS != nil || strings.HasPrefix(OIDCIssuer(), "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(middlware.AuthorizeCookie, value, int(middlware.AuthorizeSessionTTL.Seconds()), "/authorize", "", secure, true)
+}
+
+// redirectWithParams sends the browser back to the client with params added to its redirect URI.
+func redirectWithParams(c *gin.Context, redirectURI string, params map[string]string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "Invalid redirect_uri"})
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	c.Redirect(http.StatusFound, u.String())
+}
+
+var authorizeLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<title>Sign in</title>
+	<style>
+		body {
+			font-family: Arial, sans-serif;
+			background-color: #f9f9f9;
+			display: flex;
+			align-items: center;
+			justify-content: center;
+			height: 100vh;
+			margin: 0;
+		}
+		.container {
+			background: white;
+			padding: 30px;
+			border-radius: 10px;
+			box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+			width: 300px;
+		}
+		input { width: 100%; box-sizing: border-box; margin-bottom: 12px; padding: 8px; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+	<form class="container" method="POST" action="/authorize">
+		<h1>Sign in</h1>
+		<p>to continue to {{.ClientName}}</p>
+		{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+		<input type="email" name="email" placeholder="Email" required>
+		<input type="password" name="password" placeholder="Password" required>
+		<input type="text" name="otp" placeholder="Authenticator code (if enabled)" autocomplete="one-time-code">
+		<input type="hidden" name="response_type" value="{{.Req.ResponseType}}">
+		<input type="hidden" name="client_id" value="{{.Req.ClientID}}">
+		<input type="hidden" name="redirect_uri" value="{{.Req.RedirectURI}}">
+		<input type="hidden" name="scope" value="{{.Req.Scope}}">
+		<input type="hidden" name="state" value="{{.Req.State}}">
+		<input type="hidden" name="nonce" value="{{.Req.Nonce}}">
+		<input type="hidden" name="code_challenge" value="{{.Req.CodeChallenge}}">
+		<input type="hidden" name="code_challenge_method" value="{{.Req.CodeChallengeMethod}}">
+		<button type="submit">Sign in</button>
+	</form>
+</body>
+</html>
+`))
+
+func renderAuthorizeLogin(c *gin.Context, status int, oauthClient *services.OAuthClient, req authorizeRequest, errMsg string) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	err := authorizeLoginPage.Execute(c.Writer, gin.H{
+		"ClientName": oauthClient.Name,
+		"Req":        req,
+		"Error":      errMsg,
+	})
+	if err != nil {
+		log.Printf("Failed to render login page: %v", err)
+	}
+}
+
+func OpenIDConfigurationReq() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middlware.Keys == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OIDC provider requires JWT_KEYS_DIR to be configured"})
+			return
+		}
+
+		issuer := OIDCIssuer()
+		c.JSON(http.StatusOK, gin.H{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/authorize",
+			"token_endpoint":                        issuer + "/token",
+			"userinfo_endpoint":                     issuer + "/userinfo",
+			"jwks_uri":                              issuer + "/.well-known/jwks.json",
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{middlware.Keys.Algorithm()},
+			"scopes_supported":                      oidcScopes,
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "email", "email_verified"},
+		})
+	}
+}
+
+// AuthorizeReq implements the authorization endpoint for both GET (from the relying party)
+// and POST (our sign-in form). Signing in on the form sets a cookie, so a browser that comes
+// back while its session is live skips the form, as does a caller with the app's own access
+// token. There is no consent step: clients are registered by an admin and trusted.
+// prompt=login always shows the form and prompt=none never does.
+func AuthorizeReq(clients services.OAuthClientRepository, codes services.AuthCodeRepository, users services.UserRepository, sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middlware.Keys == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OIDC provider requires JWT_KEYS_DIR to be configured"})
+			return
+		}
+
+		req := parseAuthorizeRequest(c)
+
+		// Never redirect until the client and redirect URI are known to match.
+		oauthClient, err := clients.Get(req.ClientID)
+		if err != nil {
+			log.Printf("Failed to load OAuth client: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+			return
+		}
+		if oauthClient == nil || !slices.Contains(oauthClient.RedirectURIs, req.RedirectURI) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "Unknown client_id or redirect_uri"})
+			return
+		}
+
+		fail := func(code, description string) {
+			redirectWithParams(c, req.RedirectURI, map[string]string{
+				"error":             code,
+				"error_description": description,
+				"state":             req.State,
+			})
+		}
+
+		if req.ResponseType != "code" {
+			fail("unsupported_response_type", "Only the authorization code flow is supported")
+			return
+		}
+		if !slices.Contains(strings.Fields(req.Scope), "openid") {
+			fail("invalid_scope", "The openid scope is required")
+			return
+		}
+		if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+			fail("invalid_request", "PKCE with code_challenge_method=S256 is required")
+			return
+		}
+
+		var (
+			user     *services.User
+			authTime int64
+		)
+		if c.Request.Method == http.MethodGet {
+			if req.Prompt != "login" {
+				if session := authorizeSession(sessions, c); session != nil {
+					user, _ = users.Get(session.UserID)
+					authTime = session.AuthenticatedAt()
+				}
+			}
+			if user == nil || user.Disabled {
+				if req.Prompt == "none" {
+					fail("login_required", "The user is not signed in")
+					return
+				}
+				renderAuthorizeLogin(c, http.StatusOK, oauthClient, req, "")
+				return
+			}
+		} else {
+			email := c.PostForm("email")
+			if remaining := loginLockRemaining(attempts, email, c.ClientIP()); remaining > 0 {
+				c.Header("Retry-After", fmt.Sprintf("%d", int(remaining.Seconds())+1))
+				renderAuthorizeLogin(c, http.StatusTooManyRequests, oauthClient, req, "Too many failed sign-in attempts. Try again later.")
+				return
+			}
+
+			user, err = users.GetByEmail(email)
+			if err != nil {
+				log.Printf("Failed to look up user: %v", err)
+				renderAuthorizeLogin(c, http.StatusInternalServerError, oauthClient, req, "Something went wrong, please try again")
+				return
+			}
+			if !checkLoginPassword(user, c.PostForm("password")) {
+				recordLoginFailure(attempts, audit, resendClient, c, email, user)
+				renderAuthorizeLogin(c, http.StatusUnauthorized, oauthClient, req, "Invalid email or password")
+				return
+			}
+			upgradePasswordHash(users, user, c.PostForm("password"))
+			if user.TOTPEnabled && !verifySecondFactor(users, user, c.PostForm("otp")) {
+				recordLoginFailure(attempts, audit, resendClient, c, email, user)
+				renderAuthorizeLogin(c, http.StatusUnauthorized, oauthClient, req, "Invalid authenticator code")
+				return
+			}
+			if user.Disabled {
+				renderAuthorizeLogin(c, http.StatusForbidden, oauthClient, req, "This account has been disabled")
+				return
+			}
+			clearLoginFailures(attempts, user.Email)
+			middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditLogin, Outcome: services.AuditSuccess, ActorID: user.ID, Target: user.ID, Detail: "oauth client " + oauthClient.ID})
+			authTime = time.Now().Unix()
+
+			if cookie, err := middlware.NewAuthorizeSession(sessions, c, *user); err != nil {
+				log.Printf("Failed to start authorize session: %v", err)
+			} else {
+				setAuthorizeCookie(c, cookie)
+			}
+		}
+
+		code, err := middlware.NewOpaqueToken(32)
+		if err != nil {
+			fail("server_error", "Failed to create authorization code")
+			return
+		}
+
+		err = codes.Create(services.AuthCode{
+			ID:            middlware.HashToken(code),
+			ClientID:      oauthClient.ID,
+			UserID:        user.ID,
+			RedirectURI:   req.RedirectURI,
+			Scope:         grantedScope(req.Scope),
+			Nonce:         req.Nonce,
+			CodeChallenge: req.CodeChallenge,
+			AuthTime:      authTime,
+			ExpiresAt:     time.Now().Add(middlware.AuthCodeTTL).Unix(),
+		})
+		if err != nil {
+			log.Printf("Failed to store authorization code: %v", err)
+			fail("server_error", "Failed to create authorization code")
+			return
+		}
+
+		redirectWithParams(c, req.RedirectURI, map[string]string{
+			"code":  code,
+			"state": req.State,
+		})
+	}
+}
+
+func tokenError(c *gin.Context, status int, code, description string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// authenticateOAuthClient accepts client_secret_basic, client_secret_post, or no secret for public clients.
+func authenticateOAuthClient(clients services.OAuthClientRepository, c *gin.Context) (*services.OAuthClient, bool) {
+	clientID, secret, hasBasic := c.Request.BasicAuth()
+	if !hasBasic {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	oauthClient, err := clients.Get(clientID)
+	if err != nil {
+		log.Printf("Failed to load OAuth client: %v", err)
+		return nil, false
+	}
+	if oauthClient == nil {
+		return nil, false
+	}
+
+	if oauthClient.SecretHash != "" {
+		hash := middlware.HashToken(secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(oauthClient.SecretHash)) != 1 {
+			return nil, false
+		}
+	}
+	return oauthClient, true
+}
+
+// TokenReq exchanges authorization codes and refresh tokens. The tokens it issues belong to
+// the client: they carry its ID as their audience and the granted scope, and only it can
+// refresh them.
+func TokenReq(clients services.OAuthClientRepository, codes services.AuthCodeRepository, users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if middlware.Keys == nil {
+			tokenError(c, http.StatusServiceUnavailable, "server_error", "OIDC provider requires JWT_KEYS_DIR to be configured")
+			return
+		}
+
+		oauthClient, ok := authenticateOAuthClient(clients, c)
+		if !ok {
+			tokenError(c, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+			return
+		}
+
+		var (
+			user         *services.User
+			accessToken  string
+			refreshToken string
+			nonce        string
+			scope        string
+			authTime     int64
+			err          error
+		)
+
+		switch c.PostForm("grant_type") {
+		case "authorization_code":
+			code, err := codes.Consume(middlware.HashToken(c.PostForm("code")))
+			if err != nil {
+				tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+				return
+			}
+			if code.ClientID != oauthClient.ID || code.RedirectURI != c.PostForm("redirect_uri") {
+				tokenError(c, http.StatusBadRequest, "invalid_grant", "Authorization code was issued to another client or redirect_uri")
+				return
+			}
+
+			sum := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+			challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+			if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.CodeChallenge)) != 1 {
+				tokenError(c, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+				return
+			}
+
+			user, err = users.Get(code.UserID)
+			if err != nil || user == nil || user.Disabled {
+				tokenError(c, http.StatusBadRequest, "invalid_grant", "User no longer exists or is disabled")
+				return
+			}
+
+			accessToken, refreshToken, err = middlware.NewClientSessionTokens(sessions, c, *user, oauthClient.ID, code.Scope, time.Unix(code.AuthTime, 0))
+			if err != nil {
+				log.Printf("Token creation failed: %v", err)
+				tokenError(c, http.StatusInternalServerError, "server_error", "Failed to create tokens")
+				return
+			}
+			nonce = code.Nonce
+			scope = code.Scope
+			authTime = code.AuthTime
+
+		case "refresh_token":
+			var session *services.Session
+			user, session, accessToken, refreshToken, err = middlware.RedeemRefreshToken(users, sessions, audit, c, c.PostForm("refresh_token"), oauthClient.ID)
+			if errors.Is(err, services.ErrTokenReuse) || errors.Is(err, middlware.ErrInvalidRefreshToken) {
+				tokenError(c, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+				return
+			}
+			if err != nil {
+				log.Printf("Token rotation failed: %v", err)
+				tokenError(c, http.StatusInternalServerError, "server_error", "Failed to create tokens")
+				return
+			}
+			scope = session.Scope
+			authTime = session.AuthenticatedAt()
+
+		default:
+			tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "Supported grant types are authorization_code and refresh_token")
+			return
+		}
+
+		idToken, err := middlware.NewIDToken(middlware.NewIDTokenClaims(scopedUserClaims(user, strings.Fields(scope)), OIDCIssuer(), oauthClient.ID, nonce, authTime))
+		if err != nil {
+			log.Printf("ID token creation failed: %v", err)
+			tokenError(c, http.StatusInternalServerError, "server_error", "Failed to create ID token")
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"access_token":  accessToken,
+			"token_type":    "Bearer",
+			"expires_in":    int(middlware.AccessTokenTTL.Seconds()),
+			"refresh_token": refreshToken,
+			"id_token":      idToken,
+			"scope":         scope,
+		})
+	}
+}
+
+// scopedUserClaims keeps the user fields the scopes allow a client to see: the name with
+// profile, the email address with email.
+func scopedUserClaims(user *services.User, scopes []string) middlware.UserClaims {
+	claims := middlware.UserClaims{ID: user.ID}
+	if slices.Contains(scopes, "profile") {
+		claims.Name = user.Name
+	}
+	if slices.Contains(scopes, "email") {
+		claims.Email = user.Email
+		claims.Verified = user.Verified
+	}
+	return claims
+}
+
+// UserInfoReq must run after middlware.UserInfoMiddleware. The app's own tokens see every
+// field, a client's only those its scope covers.
+func UserInfoReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+			return
+		}
+
+		scopes := oidcScopes
+		if claims.Audience != "" {
+			scopes = claims.Scopes
+		}
+		resp := gin.H{"sub": user.ID}
+		if slices.Contains(scopes, "profile") {
+			resp["name"] = user.Name
+		}
+		if slices.Contains(scopes, "email") {
+			resp["email"] = user.Email
+			resp["email_verified"] = user.Verified
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func CreateOAuthClientReq(clients services.OAuthClientRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Name         string   `json:"name"`
+			RedirectURIs []string `json:"redirectUris"`
+			Public       bool     `json:"public"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || len(req.RedirectURIs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name and at least one redirect URI are required"})
+			return
+		}
+
+		for _, uri := range req.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Redirect URIs must be absolute and have no fragment"})
+				return
+			}
+		}
+
+		oauthClient := services.OAuthClient{
+			ID:           "c_" + ShortUUID(),
+			Name:         req.Name,
+			RedirectURIs: req.RedirectURIs,
+			CreatedBy:    claims.ID,
+			CreatedAt:    time.Now().Unix(),
+		}
+
+		var secret string
+		if !req.Public {
+			var err error
+			secret, err = middlware.NewOpaqueToken(32)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client secret"})
+				return
+			}
+			oauthClient.SecretHash = middlware.HashToken(secret)
+		}
+
+		if err := clients.Create(oauthClient); err != nil {
+			log.Printf("Failed to create OAuth client: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client"})
+			return
+		}
+
+		response := gin.H{
+			"message":  "Client registered",
+			"clientId": oauthClient.ID,
+		}
+		if secret != "" {
+			response["clientSecret"] = secret
+		}
+		c.JSON(http.StatusCreated, response)
+	}
+}
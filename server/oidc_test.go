@@ -0,0 +1,393 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// useTestKeyRing signs tokens with a fresh Ed25519 key for the length of the test, as the
+// OIDC endpoints need a key ring.
+func useTestKeyRing(t *testing.T) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := middlware.LoadKeyRing(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := middlware.Keys
+	middlware.Keys = ring
+	t.Cleanup(func() { middlware.Keys = keys })
+}
+
+const testRedirectURI = "https://rp.example.com/callback"
+
+// newOIDCTestApp adds the provider endpoints and two confidential clients, c1 and c2, whose
+// secrets are their IDs followed by "-secret".
+func newOIDCTestApp(t *testing.T) *testApp {
+	t.Helper()
+	app := newTestApp(t)
+	useTestKeyRing(t)
+
+	clients := services.NewMemoryOAuthClientRepository()
+	codes := services.NewMemoryAuthCodeRepository()
+	for _, id := range []string{"c1", "c2"} {
+		err := clients.Create(services.OAuthClient{
+			ID:           id,
+			Name:         "Client " + id,
+			SecretHash:   middlware.HashToken(id + "-secret"),
+			RedirectURIs: []string{testRedirectURI},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app.r.GET("/authorize", AuthorizeReq(clients, codes, app.users, app.sessions, app.attempts, app.audit, app.mail))
+	app.r.POST("/authorize", AuthorizeReq(clients, codes, app.users, app.sessions, app.attempts, app.audit, app.mail))
+	app.r.POST("/token", TokenReq(clients, codes, app.users, app.sessions, app.audit))
+	app.r.GET("/userinfo", middlware.UserInfoMiddleware(app.sessions), UserInfoReq(app.users))
+	return app
+}
+
+// serveToken posts a token request authenticated as clientID.
+func (app *testApp) serveToken(clientID string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientID+"-secret")
+	return app.serve(req, "")
+}
+
+// authorizeParams is an authorization request from c1 with a PKCE challenge for verifier.
+func authorizeParams(scope, verifier string) url.Values {
+	challenge := sha256.Sum256([]byte(verifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"c1"},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"state-1"},
+		"nonce":                 {"nonce-1"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// postAuthorize signs in as ann@example.com through the provider's login form.
+func (app *testApp) postAuthorize(scope, verifier string) *httptest.ResponseRecorder {
+	form := authorizeParams(scope, verifier)
+	form.Set("email", "ann@example.com")
+	form.Set("password", testPassword)
+	req := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return app.serve(req, "")
+}
+
+// authorize signs in through the provider's login form and returns the code it redirects with.
+func (app *testApp) authorize(t *testing.T, scope, verifier string) string {
+	t.Helper()
+	return redirectedCode(t, app.postAuthorize(scope, verifier))
+}
+
+// redirectedCode returns the code from an authorization response that redirected to the client.
+func redirectedCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), testRedirectURI) {
+		t.Fatalf("authorize redirected to %q", w.Header().Get("Location"))
+	}
+	if location.Query().Get("state") != "state-1" || location.Query().Get("code") == "" {
+		t.Fatalf("authorize redirect = %s, want a code and the state", location)
+	}
+	return location.Query().Get("code")
+}
+
+// exchangeCode redeems code at the token endpoint as c1.
+func (app *testApp) exchangeCode(t *testing.T, code, verifier string) oidcTokens {
+	t.Helper()
+	return decodeOIDCTokens(t, app.serveToken("c1", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}))
+}
+
+func idTokenAuthTime(t *testing.T, idToken string) int64 {
+	t.Helper()
+	var claims middlware.IDTokenClaims
+	if _, err := jwt.ParseWithClaims(idToken, &claims, middlware.Keys.VerificationKey); err != nil {
+		t.Fatalf("ID token: %v", err)
+	}
+	return claims.AuthTime
+}
+
+type oidcTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	Scope        string `json:"scope"`
+}
+
+func decodeOIDCTokens(t *testing.T, w *httptest.ResponseRecorder) oidcTokens {
+	t.Helper()
+	var tokens oidcTokens
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.IDToken == "" {
+		t.Fatalf("no tokens in %d response %s", w.Code, w.Body.String())
+	}
+	return tokens
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	app := newOIDCTestApp(t)
+	firstParty := app.addUser(t, "u1", "ann@example.com", "")
+
+	code := app.authorize(t, "openid email offline_access", "verifier-0123456789")
+	w := app.serveToken("c1", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"verifier-0123456789"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("token: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	tokens := decodeOIDCTokens(t, w)
+	if tokens.Scope != "openid email" {
+		t.Errorf("scope = %q, want the supported scopes that were asked for", tokens.Scope)
+	}
+
+	var idClaims middlware.IDTokenClaims
+	if _, err := jwt.ParseWithClaims(tokens.IDToken, &idClaims, middlware.Keys.VerificationKey); err != nil {
+		t.Fatalf("ID token: %v", err)
+	}
+	if idClaims.Audience != "c1" || idClaims.Subject != "u1" || idClaims.Nonce != "nonce-1" || idClaims.Email != "ann@example.com" || idClaims.Name != "" {
+		t.Errorf("ID token claims = %+v", idClaims)
+	}
+
+	access := middlware.ParseAccessToken(tokens.AccessToken)
+	if access == nil || access.Audience != "c1" || strings.Join(access.Scopes, " ") != "openid email" {
+		t.Fatalf("access token claims = %+v, want audience c1 and the granted scopes", access)
+	}
+
+	// The client's access token is no good on the app's own routes.
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u1", nil), tokens.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /users/u1 with a client token: status = %d, want 401", w.Code)
+	}
+	if w := app.serveJSON(http.MethodPut, "/users/password", tokens.AccessToken, map[string]string{"oldPassword": testPassword, "newPassword": "Another-Horse-43"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("PUT /users/password with a client token: status = %d, want 401", w.Code)
+	}
+
+	// Nor does it count as being signed in to the provider.
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+url.Values{
+		"response_type": {"code"}, "client_id": {"c1"}, "redirect_uri": {testRedirectURI}, "scope": {"openid"},
+		"code_challenge": {"challenge"}, "code_challenge_method": {"S256"},
+	}.Encode(), nil)
+	if w := app.serve(req, tokens.AccessToken); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("GET /authorize with a client token: status = %d, want the sign-in form", w.Code)
+	}
+
+	w = app.serve(httptest.NewRequest(http.MethodGet, "/userinfo", nil), tokens.AccessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("userinfo: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var info map[string]any
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info["sub"] != "u1" || info["email"] != "ann@example.com" {
+		t.Errorf("userinfo = %v", info)
+	}
+	if _, ok := info["name"]; ok {
+		t.Errorf("userinfo = %v, want no name without the profile scope", info)
+	}
+
+	// The app's own tokens still work at userinfo.
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/userinfo", nil), firstParty.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("userinfo with a first-party token: status = %d", w.Code)
+	}
+
+	w = app.serveToken("c1", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"verifier-0123456789"},
+	})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("reused code: status = %d, body = %s, want invalid_grant", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCRefreshTokenBoundToClient(t *testing.T) {
+	app := newOIDCTestApp(t)
+	firstParty := app.addUser(t, "u1", "ann@example.com", "")
+
+	code := app.authorize(t, "openid profile", "verifier-0123456789")
+	tokens := decodeOIDCTokens(t, app.serveToken("c1", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"verifier-0123456789"},
+	}))
+
+	w := app.serveToken("c2", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("refresh by another client: status = %d, body = %s, want invalid_grant", w.Code, w.Body.String())
+	}
+	if w := app.serveJSON(http.MethodPost, "/refresh-token", "", map[string]string{"refreshToken": tokens.RefreshToken}); w.Code != http.StatusUnauthorized {
+		t.Errorf("client refresh token at /refresh-token: status = %d, want 401", w.Code)
+	}
+	w = app.serveToken("c1", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {firstParty.RefreshToken}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("first-party refresh token at /token: status = %d, body = %s, want invalid_grant", w.Code, w.Body.String())
+	}
+
+	// None of the rejected attempts spent the token.
+	w = app.serveToken("c1", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh by the client: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	refreshed := decodeOIDCTokens(t, w)
+	if refreshed.Scope != "openid profile" {
+		t.Errorf("refreshed scope = %q, want the original grant", refreshed.Scope)
+	}
+	if access := middlware.ParseAccessToken(refreshed.AccessToken); access == nil || access.Audience != "c1" {
+		t.Errorf("refreshed access token claims = %+v, want audience c1", access)
+	}
+
+	// The first-party session was left alone.
+	if w := app.serveJSON(http.MethodPost, "/refresh-token", "", map[string]string{"refreshToken": firstParty.RefreshToken}); w.Code != http.StatusOK {
+		t.Errorf("first-party refresh: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCAuthTimeIsSignInTime(t *testing.T) {
+	app := newOIDCTestApp(t)
+	app.addUser(t, "u1", "ann@example.com", "")
+
+	// An app session that was signed in to an hour ago.
+	now := time.Now()
+	signedIn := now.Add(-time.Hour).Unix()
+	err := app.sessions.Create(services.Session{
+		ID: "s-old", UserID: "u1", CurrentToken: "t", CreatedAt: signedIn, LastUsedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(), AuthTime: signedIn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := middlware.NewAccessToken(middlware.UserClaims{
+		ID:             "u1",
+		SessionID:      "s-old",
+		StandardClaims: jwt.StandardClaims{ExpiresAt: now.Add(time.Minute).Unix(), Subject: "u1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/authorize?"+authorizeParams("openid offline_access", "verifier-0123456789").Encode(), nil)
+	code := redirectedCode(t, app.serve(req, accessToken))
+	tokens := app.exchangeCode(t, code, "verifier-0123456789")
+	if got := idTokenAuthTime(t, tokens.IDToken); got != signedIn {
+		t.Errorf("auth_time = %d, want the sign-in time %d", got, signedIn)
+	}
+
+	w := app.serveToken("c1", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := idTokenAuthTime(t, decodeOIDCTokens(t, w).IDToken); got != signedIn {
+		t.Errorf("auth_time after refresh = %d, want the sign-in time %d", got, signedIn)
+	}
+}
+
+func TestOIDCAuthorizeSessionCookie(t *testing.T) {
+	app := newOIDCTestApp(t)
+	app.addUser(t, "u1", "ann@example.com", "")
+
+	w := app.postAuthorize("openid", "verifier-0123456789")
+	redirectedCode(t, w)
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == middlware.AuthorizeCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.Path != "/authorize" || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("sign-in cookie = %+v, want an HttpOnly, SameSite=Lax cookie for /authorize", cookie)
+	}
+	claims := middlware.ParseAuthorizeSessionToken(cookie.Value)
+	if claims == nil {
+		t.Fatal("sign-in cookie doesn't hold an authorize session token")
+	}
+	session, err := app.sessions.Get(claims.SessionID)
+	if err != nil || session == nil || session.AuthTime == 0 {
+		t.Fatalf("authorize session = %+v, %v", session, err)
+	}
+
+	getAuthorize := func(params url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+		req.AddCookie(cookie)
+		return app.serve(req, "")
+	}
+
+	// Coming back from the relying party skips the form.
+	code := redirectedCode(t, getAuthorize(authorizeParams("openid", "verifier-abcdefghij")))
+	tokens := app.exchangeCode(t, code, "verifier-abcdefghij")
+	if got := idTokenAuthTime(t, tokens.IDToken); got != session.AuthTime {
+		t.Errorf("auth_time = %d, want the form sign-in at %d", got, session.AuthTime)
+	}
+
+	params := authorizeParams("openid", "verifier-abcdefghij")
+	params.Set("prompt", "login")
+	if w := getAuthorize(params); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("prompt=login: status = %d, want the sign-in form", w.Code)
+	}
+
+	// The cookie is not an access token.
+	if w := app.serve(httptest.NewRequest(http.MethodGet, "/users/u1", nil), cookie.Value); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /users/u1 with the cookie token: status = %d, want 401", w.Code)
+	}
+
+	// Signing the session out signs the browser out too.
+	if err := app.sessions.Revoke(claims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if w := getAuthorize(authorizeParams("openid", "verifier-abcdefghij")); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("revoked cookie: status = %d, want the sign-in form", w.Code)
+	}
+	params.Set("prompt", "none")
+	w = getAuthorize(params)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || location == nil || location.Query().Get("error") != "login_required" {
+		t.Errorf("prompt=none signed out: status = %d, location = %q, want login_required", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,494 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/gin-gonic/gin"
+	"github.com/resend/resend-go/v2"
+)
+
+const orgInviteTTL = 7 * 24 * time.Hour
+
+func validOrgRole(role string) bool {
+	return services.OrgRoleRank(role) > 0
+}
+
+// RequireOrgRole loads the caller's membership in the :orgId org and requires at least
+// minRole. Site admins are treated as owners. The role is stored in the context as "orgRole".
+func RequireOrgRole(members services.OrgMemberRepository, minRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		role := ""
+		if claims.IsAdmin() {
+			role = services.OrgRoleOwner
+		} else {
+			member, err := members.Get(c.Param("orgId"), claims.ID)
+			if err != nil {
+				log.Printf("Failed to check org membership: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organization membership"})
+				c.Abort()
+				return
+			}
+			if member == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+				c.Abort()
+				return
+			}
+			role = member.Role
+		}
+
+		if services.OrgRoleRank(role) < services.OrgRoleRank(minRole) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Requires the " + minRole + " role in this organization"})
+			c.Abort()
+			return
+		}
+
+		c.Set("orgRole", role)
+		c.Next()
+	}
+}
+
+// canManageOrgRole reports whether an actor may assign or remove role. Owners can manage
+// anyone; everyone else only manages roles below their own.
+func canManageOrgRole(actorRole, role string) bool {
+	return actorRole == services.OrgRoleOwner || services.OrgRoleRank(role) < services.OrgRoleRank(actorRole)
+}
+
+// isLastOwner reports whether userID is the only owner left in the org.
+func isLastOwner(members services.OrgMemberRepository, orgID, userID string) (bool, error) {
+	list, err := members.ListByOrg(orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, member := range list {
+		if member.Role == services.OrgRoleOwner && member.UserID != userID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func CreateOrgReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Organization name is required"})
+			return
+		}
+
+		now := time.Now().Unix()
+		org := services.Org{
+			ID:        "o_" + ShortUUID(),
+			Name:      strings.TrimSpace(req.Name),
+			CreatedBy: claims.ID,
+			CreatedAt: now,
+		}
+		if err := services.CreateOrg(client, "Orgs", org); err != nil {
+			log.Printf("Failed to create org: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+			return
+		}
+
+		err := members.Put(services.OrgMember{
+			OrgID:    org.ID,
+			UserID:   claims.ID,
+			Role:     services.OrgRoleOwner,
+			JoinedAt: now,
+		})
+		if err != nil {
+			log.Printf("Failed to add org owner: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"message": "Organization created", "org": org})
+	}
+}
+
+func ListMyOrgsReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		memberships, err := members.ListByUser(claims.ID)
+		if err != nil {
+			log.Printf("Failed to list orgs: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list organizations"})
+			return
+		}
+
+		orgs := []gin.H{}
+		for _, membership := range memberships {
+			org, err := services.GetOrg(client, "Orgs", membership.OrgID)
+			if err != nil {
+				log.Printf("Failed to load org %s: %v", membership.OrgID, err)
+				continue
+			}
+			if org == nil {
+				continue
+			}
+			orgs = append(orgs, gin.H{"org": org, "role": membership.Role})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"orgs": orgs})
+	}
+}
+
+func GetOrgReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org, err := services.GetOrg(client, "Orgs", c.Param("orgId"))
+		if err != nil {
+			log.Printf("Failed to load org: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+			return
+		}
+		if org == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+
+		list, err := members.ListByOrg(org.ID)
+		if err != nil {
+			log.Printf("Failed to list org members: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organization"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"org":     org,
+			"role":    c.MustGet("orgRole"),
+			"members": list,
+		})
+	}
+}
+
+// DeleteOrgReq removes the org and its memberships. Its files stay with the users who
+// uploaded them.
+func DeleteOrgReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orgID := c.Param("orgId")
+
+		list, err := members.ListByOrg(orgID)
+		if err != nil {
+			log.Printf("Failed to list org members: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete organization"})
+			return
+		}
+
+		if err := services.DeleteOrg(client, "Orgs", orgID); err != nil {
+			log.Printf("Failed to delete org: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete organization"})
+			return
+		}
+
+		for _, member := range list {
+			if err := members.Delete(orgID, member.UserID); err != nil {
+				log.Printf("Failed to remove org member %s: %v", member.UserID, err)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Organization deleted"})
+	}
+}
+
+func InviteOrgMemberReq(client *dynamodb.Client, resendClient *resend.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		actorRole := c.GetString("orgRole")
+
+		var req struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || !strings.Contains(req.Email, "@") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email is required"})
+			return
+		}
+		if req.Role == "" {
+			req.Role = services.OrgRoleMember
+		}
+		if !validOrgRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, admin, member or viewer"})
+			return
+		}
+		if !canManageOrgRole(actorRole, req.Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot invite members with that role"})
+			return
+		}
+
+		org, err := services.GetOrg(client, "Orgs", c.Param("orgId"))
+		if err != nil || org == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		}
+
+		token, err := middlware.NewOpaqueToken(32)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		email := strings.ToLower(strings.TrimSpace(req.Email))
+		err = services.CreateOrgInvite(client, "OrgInvites", services.OrgInvite{
+			ID:        middlware.HashToken(token),
+			OrgID:     org.ID,
+			Email:     email,
+			Role:      req.Role,
+			InvitedBy: claims.ID,
+			ExpiresAt: time.Now().Add(orgInviteTTL).Unix(),
+		})
+		if err != nil {
+			log.Printf("Failed to store org invite: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
+		}
+
+		acceptURL := FrontendURL() + "/orgs/invites/accept?token=" + url.QueryEscape(token)
+		if err := services.SendOrgInvite(resendClient, email, org.Name, claims.Name, acceptURL, orgInviteTTL); err != nil {
+			log.Printf("Failed to send org invite email: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send invitation email"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"message": "Invitation sent", "email": email, "role": req.Role})
+	}
+}
+
+// AcceptOrgInviteReq takes the invite token from the JSON body or the query string. The
+// caller's verified email must match the address the invite was sent to.
+func AcceptOrgInviteReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Token string `json:"token"`
+		}
+		_ = c.ShouldBindJSON(&req)
+		if req.Token == "" {
+			req.Token = c.Query("token")
+		}
+		if req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invitation token is required"})
+			return
+		}
+
+		inviteID := middlware.HashToken(req.Token)
+		invite, err := services.GetOrgInvite(client, "OrgInvites", inviteID)
+		if err != nil {
+			log.Printf("Failed to load org invite: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+		if invite == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+			return
+		}
+		if !strings.EqualFold(invite.Email, claims.Email) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invitation was sent to a different email address"})
+			return
+		}
+		if !claims.Verified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Email address must be verified first"})
+			return
+		}
+
+		org, err := services.GetOrg(client, "Orgs", invite.OrgID)
+		if err != nil || org == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+			return
+		}
+
+		if err := services.ConsumeOrgInvite(client, "OrgInvites", inviteID); err != nil {
+			if errors.Is(err, services.ErrInvalidToken) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+				return
+			}
+			log.Printf("Failed to consume org invite: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+
+		// Accepting an invite never lowers an existing role.
+		member, err := members.Get(org.ID, claims.ID)
+		if err != nil {
+			log.Printf("Failed to check org membership: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+		if member == nil {
+			member = &services.OrgMember{OrgID: org.ID, UserID: claims.ID, JoinedAt: time.Now().Unix()}
+		}
+		if services.OrgRoleRank(invite.Role) > services.OrgRoleRank(member.Role) {
+			member.Role = invite.Role
+		}
+
+		if err := members.Put(*member); err != nil {
+			log.Printf("Failed to add org member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Joined " + org.Name, "org": org, "role": member.Role})
+	}
+}
+
+func UpdateOrgMemberReq(members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actorRole := c.GetString("orgRole")
+		orgID, userID := c.Param("orgId"), c.Param("userId")
+
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || !validOrgRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be owner, admin, member or viewer"})
+			return
+		}
+
+		member, err := members.Get(orgID, userID)
+		if err != nil {
+			log.Printf("Failed to load org member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+			return
+		}
+		if member == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		if !canManageOrgRole(actorRole, member.Role) || !canManageOrgRole(actorRole, req.Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot assign that role"})
+			return
+		}
+
+		if member.Role == services.OrgRoleOwner && req.Role != services.OrgRoleOwner {
+			last, err := isLastOwner(members, orgID, userID)
+			if err != nil {
+				log.Printf("Failed to list org members: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+				return
+			}
+			if last {
+				c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+				return
+			}
+		}
+
+		member.Role = req.Role
+		if err := members.Put(*member); err != nil {
+			log.Printf("Failed to update org member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Member updated", "member": member})
+	}
+}
+
+// RemoveOrgMemberReq lets admins remove members below them, and anyone leave on their own.
+func RemoveOrgMemberReq(members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		actorRole := c.GetString("orgRole")
+		orgID, userID := c.Param("orgId"), c.Param("userId")
+
+		member, err := members.Get(orgID, userID)
+		if err != nil {
+			log.Printf("Failed to load org member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
+		if member == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		self := userID == claims.ID
+		if !self && (services.OrgRoleRank(actorRole) < services.OrgRoleRank(services.OrgRoleAdmin) || !canManageOrgRole(actorRole, member.Role)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot remove this member"})
+			return
+		}
+
+		if member.Role == services.OrgRoleOwner {
+			last, err := isLastOwner(members, orgID, userID)
+			if err != nil {
+				log.Printf("Failed to list org members: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+				return
+			}
+			if last {
+				c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+				return
+			}
+		}
+
+		if err := members.Delete(orgID, userID); err != nil {
+			log.Printf("Failed to remove org member: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+	}
+}
+
+func ListOrgFilesReq(files services.FileRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := files.ListByOrg(c.Param("orgId"))
+		if err != nil {
+			log.Printf("Failed to list org files: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+			return
+		}
+		active := []services.File{}
+		for _, file := range list {
+			if file.Active() {
+				active = append(active, file)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"files": active})
+	}
+}
+
+// OrgFileURLReq gives org members a presigned download URL without needing the file's shared secret.
+func OrgFileURLReq(audit services.AuditRepository, files services.FileRepository, blobs services.BlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, err := files.Get(c.Param("fileId"))
+		if err != nil {
+			log.Printf("Failed to retrieve file metadata: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file metadata"})
+			return
+		}
+		if file == nil || !file.Active() || file.Org != c.Param("orgId") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		presignedURL, err := blobs.SignedURL(file.BlobKey(), services.DefaultURLExpiry)
+		if err != nil {
+			log.Printf("Failed to generate presigned URL for %v: %v", file.FileName, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate presigned URL"})
+			return
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditDownloadURL, Outcome: services.AuditSuccess, Target: file.ID, Detail: file.FileName})
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Presigned download URL generated",
+			"file_name":      file.FileName,
+			"presigned_url":  presignedURL,
+			"url_expires_in": 300, // 5 minutes
+		})
+	}
+}
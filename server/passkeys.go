@@ -0,0 +1,368 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const webAuthnCeremonyTTL = 5 * time.Minute
+
+var (
+	relyingPartyOnce sync.Once
+	relyingParty     *webauthn.WebAuthn
+	relyingPartyErr  error
+)
+
+// webAuthn returns the relying party configuration. WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS
+// (comma separated) default to the host and origin of APP_URL.
+func webAuthn() (*webauthn.WebAuthn, error) {
+	relyingPartyOnce.Do(func() {
+		appURL, err := url.Parse(AppURL())
+		if err != nil {
+			relyingPartyErr = fmt.Errorf("invalid APP_URL: %w", err)
+			return
+		}
+
+		rpID := os.Getenv("WEBAUTHN_RP_ID")
+		if rpID == "" {
+			rpID = appURL.Hostname()
+		}
+
+		origins := []string{appURL.Scheme + "://" + appURL.Host}
+		if env := os.Getenv("WEBAUTHN_ORIGINS"); env != "" {
+			origins = strings.Split(env, ",")
+		}
+
+		relyingParty, relyingPartyErr = webauthn.New(&webauthn.Config{
+			RPID:          rpID,
+			RPDisplayName: totpIssuer(),
+			RPOrigins:     origins,
+		})
+	})
+	return relyingParty, relyingPartyErr
+}
+
+// passkeyUser adapts a user and their stored passkeys to webauthn.User.
+type passkeyUser struct {
+	user        *services.User
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return []byte(u.user.ID) }
+func (u *passkeyUser) WebAuthnName() string                       { return u.user.Email }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.user.Name }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func loadPasskeyUser(passkeys services.PasskeyRepository, user *services.User) (*passkeyUser, error) {
+	stored, err := passkeys.ListByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	pu := &passkeyUser{user: user}
+	for _, passkey := range stored {
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(passkey.Credential), &credential); err != nil {
+			return nil, fmt.Errorf("failed to decode passkey %s: %w", passkey.ID, err)
+		}
+		pu.credentials = append(pu.credentials, credential)
+	}
+	return pu, nil
+}
+
+// saveCeremony stores the session data between the begin and finish requests and returns its ID.
+func saveCeremony(ceremonies services.WebAuthnSessionRepository, ceremony, userID string, data *webauthn.SessionData) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := middlware.NewOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = ceremonies.Create(services.WebAuthnSession{
+		ID:        middlware.HashToken(id),
+		Ceremony:  ceremony,
+		UserID:    userID,
+		Data:      string(encoded),
+		ExpiresAt: time.Now().Add(webAuthnCeremonyTTL).Unix(),
+	})
+	return id, err
+}
+
+// loadCeremony consumes a stored ceremony, checking it was started for the same purpose.
+func loadCeremony(ceremonies services.WebAuthnSessionRepository, ceremony, id string) (*services.WebAuthnSession, *webauthn.SessionData, error) {
+	session, err := ceremonies.Consume(middlware.HashToken(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.Ceremony != ceremony {
+		return nil, nil, services.ErrInvalidToken
+	}
+
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(session.Data), &data); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode WebAuthn session: %w", err)
+	}
+	return session, &data, nil
+}
+
+func BeginPasskeyRegistrationReq(passkeys services.PasskeyRepository, ceremonies services.WebAuthnSessionRepository, users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		rp, err := webAuthn()
+		if err != nil {
+			log.Printf("WebAuthn is misconfigured: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Passkeys are not available"})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		pu, err := loadPasskeyUser(passkeys, user)
+		if err != nil {
+			log.Printf("Failed to load passkeys: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+			return
+		}
+
+		creation, data, err := rp.BeginRegistration(pu,
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+			webauthn.WithExclusions(webauthn.Credentials(pu.credentials).CredentialDescriptors()),
+		)
+		if err != nil {
+			log.Printf("Failed to begin passkey registration: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+			return
+		}
+
+		ceremonyID, err := saveCeremony(ceremonies, "registration", user.ID, data)
+		if err != nil {
+			log.Printf("Failed to store WebAuthn session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ceremonyId": ceremonyID,
+			"options":    creation,
+		})
+	}
+}
+
+// FinishPasskeyRegistrationReq expects the authenticator's attestation response as the request
+// body, with the ceremonyId and an optional passkey name in the query string.
+func FinishPasskeyRegistrationReq(passkeys services.PasskeyRepository, ceremonies services.WebAuthnSessionRepository, users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		rp, err := webAuthn()
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Passkeys are not available"})
+			return
+		}
+
+		session, data, err := loadCeremony(ceremonies, "registration", c.Query("ceremonyId"))
+		if err != nil || session.UserID != claims.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired passkey registration"})
+			return
+		}
+
+		user, err := users.Get(claims.ID)
+		if err != nil || user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		credential, err := rp.FinishRegistration(&passkeyUser{user: user}, *data, c.Request)
+		if err != nil {
+			log.Printf("Passkey registration failed: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration failed"})
+			return
+		}
+
+		encoded, err := json.Marshal(credential)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save passkey"})
+			return
+		}
+
+		name := strings.TrimSpace(c.Query("name"))
+		if name == "" {
+			name = "Passkey"
+		}
+
+		passkey := services.Passkey{
+			ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+			UserID:     user.ID,
+			Name:       name,
+			Credential: string(encoded),
+			CreatedAt:  time.Now().Unix(),
+		}
+		if err := passkeys.Create(passkey); err != nil {
+			log.Printf("Failed to save passkey: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save passkey"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"message": "Passkey registered", "passkey": passkey})
+	}
+}
+
+func ListPasskeysReq(passkeys services.PasskeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		list, err := passkeys.ListByUser(claims.ID)
+		if err != nil {
+			log.Printf("Failed to list passkeys: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list passkeys"})
+			return
+		}
+		if list == nil {
+			list = []services.Passkey{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"passkeys": list})
+	}
+}
+
+func DeletePasskeyReq(passkeys services.PasskeyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		err := passkeys.Delete(c.Param("id"), claims.ID)
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete passkey: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete passkey"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Passkey removed"})
+	}
+}
+
+func BeginPasskeyLoginReq(ceremonies services.WebAuthnSessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rp, err := webAuthn()
+		if err != nil {
+			log.Printf("WebAuthn is misconfigured: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Passkeys are not available"})
+			return
+		}
+
+		assertion, data, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			log.Printf("Failed to begin passkey login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey sign-in"})
+			return
+		}
+
+		ceremonyID, err := saveCeremony(ceremonies, "login", "", data)
+		if err != nil {
+			log.Printf("Failed to store WebAuthn session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey sign-in"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ceremonyId": ceremonyID,
+			"options":    assertion,
+		})
+	}
+}
+
+// FinishPasskeyLoginReq expects the authenticator's assertion response as the request body and
+// the ceremonyId in the query string. A user-verified passkey satisfies MFA on its own.
+func FinishPasskeyLoginReq(passkeys services.PasskeyRepository, ceremonies services.WebAuthnSessionRepository, users services.UserRepository, sessions services.SessionRepository, attempts services.LoginAttemptRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rp, err := webAuthn()
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Passkeys are not available"})
+			return
+		}
+
+		_, data, err := loadCeremony(ceremonies, "login", c.Query("ceremonyId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired passkey sign-in"})
+			return
+		}
+
+		var user *services.User
+		var passkeyID string
+		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+			passkeyID = base64.RawURLEncoding.EncodeToString(rawID)
+			passkey, err := passkeys.Get(passkeyID)
+			if err != nil {
+				return nil, err
+			}
+			if passkey == nil || passkey.UserID != string(userHandle) {
+				return nil, errors.New("unknown passkey")
+			}
+
+			user, err = users.Get(passkey.UserID)
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				return nil, errors.New("unknown passkey")
+			}
+			return loadPasskeyUser(passkeys, user)
+		}
+
+		credential, err := rp.FinishDiscoverableLogin(handler, *data, c.Request)
+		if err != nil {
+			log.Printf("Passkey sign-in failed: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+			return
+		}
+		if credential.Authenticator.CloneWarning {
+			log.Printf("Passkey %s for user %s reported a sign count regression", passkeyID, user.ID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+			return
+		}
+
+		encoded, err := json.Marshal(credential)
+		if err == nil {
+			err = passkeys.UpdateCredential(passkeyID, string(encoded))
+		}
+		if err != nil {
+			log.Printf("Failed to update passkey: %v", err)
+		}
+
+		// A passkey doesn't lift a lockout from failed passwords, nor clear the failures
+		// that led to it.
+		if remaining := loginLockRemaining(attempts, user.Email, c.ClientIP()); remaining > 0 {
+			respondLoginLocked(c, remaining)
+			return
+		}
+
+		respondWithSession(sessions, audit, c, user)
+	}
+}
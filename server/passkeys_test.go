@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// softAuthenticator is a platform authenticator in software: a P-256 key with "none"
+// attestation that always reports user presence and verification.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	origin, err := url.Parse(AppURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		rpID:         origin.Hostname(),
+		origin:       origin.Scheme + "://" + origin.Host,
+	}
+}
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// authenticatorData lays out the RP ID hash, flags and sign count, followed by attested
+// credential data when there is any.
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create answers navigator.credentials.create with the JSON a browser would send.
+func (a *softAuthenticator) create(t *testing.T, challenge string) []byte {
+	t.Helper()
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := pub.Bytes() // 0x04 || x || y
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: point[1:33],
+		YCoord: point[33:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(flagUserPresent|flagUserVerified|flagAttested, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    b64(a.clientData(t, "webauthn.create", challenge)),
+		"attestationObject": b64(attestation),
+	})
+}
+
+// get answers navigator.credentials.get for the user, bumping the sign count first.
+func (a *softAuthenticator) get(t *testing.T, challenge, userID string) []byte {
+	t.Helper()
+	a.signCount++
+	authData := a.authenticatorData(flagUserPresent|flagUserVerified, nil)
+	clientData := a.clientData(t, "webauthn.get", challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(signature),
+		"userHandle":        b64([]byte(userID)),
+	})
+}
+
+func (a *softAuthenticator) credential(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"id":       b64(a.credentialID),
+		"rawId":    b64(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+type passkeyTestApp struct {
+	*testApp
+	passkeys *services.MemoryPasskeyRepository
+}
+
+func newPasskeyTestApp(t *testing.T) *passkeyTestApp {
+	t.Helper()
+	app := &passkeyTestApp{testApp: newTestApp(t), passkeys: services.NewMemoryPasskeyRepository()}
+	ceremonies := services.NewMemoryWebAuthnSessionRepository()
+
+	r := app.r
+	r.POST("/login/passkey/begin", BeginPasskeyLoginReq(ceremonies))
+	r.POST("/login/passkey/finish", FinishPasskeyLoginReq(app.passkeys, ceremonies, app.users, app.sessions, app.attempts, app.audit))
+	auth := r.Group("/passkeys", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions))
+	auth.POST("/register/begin", BeginPasskeyRegistrationReq(app.passkeys, ceremonies, app.users))
+	auth.POST("/register/finish", FinishPasskeyRegistrationReq(app.passkeys, ceremonies, app.users))
+	auth.GET("", ListPasskeysReq(app.passkeys))
+	return app
+}
+
+// beginCeremony starts a registration or sign-in and returns its ID and challenge.
+func (app *passkeyTestApp) beginCeremony(t *testing.T, path, token string) (string, string) {
+	t.Helper()
+	w := app.serve(httptest.NewRequest(http.MethodPost, path, nil), token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status = %d, body = %s", path, w.Code, w.Body.String())
+	}
+	var resp struct {
+		CeremonyID string `json:"ceremonyId"`
+		Options    struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.CeremonyID == "" || resp.Options.PublicKey.Challenge == "" {
+		t.Fatalf("%s: no ceremony in %s", path, w.Body.String())
+	}
+	return resp.CeremonyID, resp.Options.PublicKey.Challenge
+}
+
+func (app *passkeyTestApp) finishCeremony(path, ceremonyID, token string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path+"?"+url.Values{"ceremonyId": {ceremonyID}, "name": {"Laptop"}}.Encode(), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return app.serve(req, token)
+}
+
+// register adds the authenticator's passkey to the signed-in user.
+func (app *passkeyTestApp) register(t *testing.T, authenticator *softAuthenticator, token string) {
+	t.Helper()
+	ceremonyID, challenge := app.beginCeremony(t, "/passkeys/register/begin", token)
+	w := app.finishCeremony("/passkeys/register/finish", ceremonyID, token, authenticator.create(t, challenge))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPasskeyRegisterAndSignIn(t *testing.T) {
+	app := newPasskeyTestApp(t)
+	tokens := app.addUser(t, "u1", "ann@example.com", "")
+	authenticator := newSoftAuthenticator(t)
+
+	ceremonyID, challenge := app.beginCeremony(t, "/passkeys/register/begin", tokens.AccessToken)
+	attestation := authenticator.create(t, challenge)
+	w := app.finishCeremony("/passkeys/register/finish", ceremonyID, tokens.AccessToken, attestation)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := app.finishCeremony("/passkeys/register/finish", ceremonyID, tokens.AccessToken, attestation); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed registration: status = %d, want 400", w.Code)
+	}
+
+	w = app.serve(httptest.NewRequest(http.MethodGet, "/passkeys", nil), tokens.AccessToken)
+	var list struct {
+		Passkeys []services.Passkey `json:"passkeys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Passkeys) != 1 || list.Passkeys[0].ID != b64(authenticator.credentialID) || list.Passkeys[0].Name != "Laptop" {
+		t.Fatalf("passkeys = %+v", list.Passkeys)
+	}
+
+	ceremonyID, challenge = app.beginCeremony(t, "/login/passkey/begin", "")
+	assertion := authenticator.get(t, challenge, "u1")
+	w = app.finishCeremony("/login/passkey/finish", ceremonyID, "", assertion)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sign in: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if claims := middlware.ParseAccessToken(decodeTokens(t, w).AccessToken); claims == nil || claims.ID != "u1" {
+		t.Errorf("signed in as %+v, want u1", claims)
+	}
+	if app.auditCount(services.AuditLogin, services.AuditSuccess) != 2 {
+		t.Errorf("audit = %+v, want the password and passkey sign-ins", app.audit.Events())
+	}
+
+	passkey, _ := app.passkeys.Get(b64(authenticator.credentialID))
+	var credential webauthn.Credential
+	if err := json.Unmarshal([]byte(passkey.Credential), &credential); err != nil {
+		t.Fatal(err)
+	}
+	if credential.Authenticator.SignCount != 1 || passkey.LastUsedAt == 0 {
+		t.Errorf("after sign-in: sign count = %d, last used = %d; want the new count recorded", credential.Authenticator.SignCount, passkey.LastUsedAt)
+	}
+
+	if w := app.finishCeremony("/login/passkey/finish", ceremonyID, "", assertion); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed assertion: status = %d, want 400", w.Code)
+	}
+}
+
+func TestPasskeySignInRejectsBadAssertions(t *testing.T) {
+	app := newPasskeyTestApp(t)
+	tokens := app.addUser(t, "u1", "ann@example.com", "")
+	app.addUser(t, "u2", "bob@example.com", "")
+	authenticator := newSoftAuthenticator(t)
+	app.register(t, authenticator, tokens.AccessToken)
+
+	impostor := newSoftAuthenticator(t)
+	impostor.credentialID = authenticator.credentialID
+
+	tests := []struct {
+		name      string
+		assertion func(challenge string) []byte
+	}{
+		{"wrong key", func(challenge string) []byte {
+			return impostor.get(t, challenge, "u1")
+		}},
+		{"other user's handle", func(challenge string) []byte {
+			return authenticator.get(t, challenge, "u2")
+		}},
+		{"other challenge", func(string) []byte {
+			return authenticator.get(t, b64([]byte("not the challenge")), "u1")
+		}},
+		{"sign count not increased", func(challenge string) []byte {
+			authenticator.signCount = 0
+			return authenticator.get(t, challenge, "u1")
+		}},
+	}
+
+	// Sign in once so the stored sign count is above zero.
+	ceremonyID, challenge := app.beginCeremony(t, "/login/passkey/begin", "")
+	if w := app.finishCeremony("/login/passkey/finish", ceremonyID, "", authenticator.get(t, challenge, "u1")); w.Code != http.StatusOK {
+		t.Fatalf("sign in: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	for _, tt := range tests {
+		ceremonyID, challenge := app.beginCeremony(t, "/login/passkey/begin", "")
+		if w := app.finishCeremony("/login/passkey/finish", ceremonyID, "", tt.assertion(challenge)); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, body = %s, want 401", tt.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPasskeySignInRespectsLockout(t *testing.T) {
+	app := newPasskeyTestApp(t)
+	tokens := app.addUser(t, "u1", "ann@example.com", "")
+	authenticator := newSoftAuthenticator(t)
+	app.register(t, authenticator, tokens.AccessToken)
+
+	signIn := func() *httptest.ResponseRecorder {
+		ceremonyID, challenge := app.beginCeremony(t, "/login/passkey/begin", "")
+		return app.finishCeremony("/login/passkey/finish", ceremonyID, "", authenticator.get(t, challenge, "u1"))
+	}
+
+	key := accountAttemptKey("ann@example.com")
+	app.attempts.RecordFailure(key, loginAttemptWindow)
+	if w := signIn(); w.Code != http.StatusOK {
+		t.Fatalf("sign in: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if attempt, _ := app.attempts.Get(key); attempt == nil || attempt.Failures != 1 {
+		t.Errorf("a passkey sign-in left password failures at %+v, want them kept", attempt)
+	}
+
+	app.attempts.Lock(key, time.Now().Add(time.Minute))
+	w := signIn()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("sign in while locked: status = %d, Retry-After = %q; want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+}
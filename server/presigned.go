@@ -0,0 +1,347 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Direct uploads: the client reserves a file, PUTs the bytes straight to the blob store with
+// presigned URLs, then asks us to check the object and activate the file. An upload that
+// fails the check ends its reservation, and the client starts again with a new one.
+
+// directMultipartThreshold is the size above which a direct upload is split into parts. It
+// is a variable so tests can reach multipart uploads without 100 MiB bodies.
+var directMultipartThreshold int64 = 100 << 20
+
+const (
+	directPartSize    = 16 << 20
+	directMaxPartSize = 5 << 30
+	directMaxParts    = 10000
+	// directMaxSize is the largest object S3 accepts.
+	directMaxSize = 5 << 40
+	// pendingFileTTL is how long a reservation waits to be completed before it expires.
+	pendingFileTTL = 24 * time.Hour
+)
+
+// uploadURLExpiry reads UPLOAD_URL_EXPIRY, defaulting to an hour. S3 only checks the expiry
+// when a request starts, so a slow upload that began in time still succeeds.
+func uploadURLExpiry() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("UPLOAD_URL_EXPIRY")); err == nil && d > 0 {
+		return d
+	}
+	return time.Hour
+}
+
+// UploadURLReq reserves a pending file and returns presigned URLs to upload it to. Files
+// above directMultipartThreshold get one URL per part, and each part must match the
+// checksum the client gave for it.
+func UploadURLReq(members services.OrgMemberRepository, audit services.AuditRepository, files services.FileRepository, blobs services.PresignedUploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			FileName       string   `json:"fileName"`
+			SharedSecret   string   `json:"sharedSecret"`
+			Size           int64    `json:"size"`
+			ContentType    string   `json:"contentType"`
+			ChecksumSHA256 string   `json:"checksumSha256"`
+			PartSize       int64    `json:"partSize"`
+			PartChecksums  []string `json:"partChecksumsSha256"`
+			Org            string   `json:"org"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		fileName := filepath.Base(req.FileName)
+		if req.FileName == "" || fileName == "." || fileName == "/" || req.SharedSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fileName and sharedSecret are required"})
+			return
+		}
+		if req.Size <= 0 || req.Size > directMaxSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between 1 and %d bytes", int64(directMaxSize))})
+			return
+		}
+
+		multipart := req.Size > directMultipartThreshold
+		checksum := req.ChecksumSHA256
+		partSize := req.PartSize
+		if multipart {
+			if partSize == 0 {
+				partSize = defaultPartSize(req.Size)
+			}
+			if partSize < services.MinPartSize || partSize > directMaxPartSize || (req.Size+partSize-1)/partSize > directMaxParts {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("partSize must be between %d and %d bytes, with at most %d parts", int64(services.MinPartSize), int64(directMaxPartSize), directMaxParts)})
+				return
+			}
+			if int64(len(req.PartChecksums)) != (req.Size+partSize-1)/partSize {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("partChecksumsSha256 must have one checksum for each of the %d parts", (req.Size+partSize-1)/partSize)})
+				return
+			}
+			var err error
+			if checksum, err = compositeChecksum(req.PartChecksums); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "partChecksumsSha256 must be base64 SHA-256 digests"})
+				return
+			}
+		} else if !validChecksum(checksum) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "checksumSha256 must be a base64 SHA-256 digest"})
+			return
+		}
+
+		id := fileID(req.SharedSecret, fileName)
+		if !checkUploadOrg(members, audit, c, req.Org, claims.ID, id) {
+			return
+		}
+
+		// A reservation only ever replaces the caller's own unfinished one; the file being
+		// uploaded is never visible before it has been checked.
+		existing, ok := checkFileOwner(files, c, id, claims.ID)
+		if !ok {
+			return
+		}
+		if existing != nil && existing.Active() {
+			c.JSON(http.StatusConflict, gin.H{"error": "A file with this name and secret already exists"})
+			return
+		}
+		if existing != nil {
+			discardPendingUpload(blobs, existing)
+		}
+
+		file := services.File{
+			ID:          id,
+			FileName:    fileName,
+			User:        claims.ID,
+			Org:         req.Org,
+			Status:      services.FilePending,
+			Size:        req.Size,
+			Checksum:    checksum,
+			ContentType: req.ContentType,
+			ExpiresAt:   time.Now().Add(pendingFileTTL).Unix(),
+			ObjectKey:   newObjectKey(id, req.Org),
+		}
+		expiry := uploadURLExpiry()
+		resp := gin.H{
+			"fileId":         id,
+			"url_expires_in": int(expiry.Seconds()),
+		}
+
+		key := file.ObjectKey
+		if !multipart {
+			url, headers, err := blobs.SignedPutURL(key, req.ContentType, checksum, expiry)
+			if err != nil {
+				log.Printf("Failed to presign upload of %s: %v", fileName, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate upload URL"})
+				return
+			}
+			resp["method"] = http.MethodPut
+			resp["url"] = url
+			resp["headers"] = headers
+		} else {
+			var err error
+			file.UploadID, err = blobs.CreateChecksummedMultipart(key, req.ContentType)
+			if err != nil {
+				log.Printf("Failed to start multipart upload: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+				return
+			}
+
+			parts := make([]gin.H, 0, len(req.PartChecksums))
+			for i, partChecksum := range req.PartChecksums {
+				number := int32(i + 1)
+				url, headers, err := blobs.SignedPartURL(key, file.UploadID, number, partChecksum, expiry)
+				if err != nil {
+					log.Printf("Failed to presign part %d of %s: %v", number, fileName, err)
+					if err := blobs.AbortMultipart(key, file.UploadID); err != nil {
+						log.Printf("Failed to abort upload of %s: %v", id, err)
+					}
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate upload URL"})
+					return
+				}
+				parts = append(parts, gin.H{"number": number, "url": url, "headers": headers})
+			}
+			resp["method"] = http.MethodPut
+			resp["partSize"] = partSize
+			resp["parts"] = parts
+		}
+
+		if err := files.Create(file); err != nil {
+			log.Printf("Failed to save metadata: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// defaultPartSize is the part size for a multipart upload when the client leaves it out.
+func defaultPartSize(size int64) int64 {
+	return max(directPartSize, (size+directMaxParts-1)/directMaxParts)
+}
+
+func validChecksum(checksum string) bool {
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// compositeChecksum is the checksum S3 gives an object built from parts with these
+// checksums: the SHA-256 of the concatenated part digests, followed by the part count.
+func compositeChecksum(partChecksums []string) (string, error) {
+	h := sha256.New()
+	for _, checksum := range partChecksums {
+		sum, err := base64.StdEncoding.DecodeString(checksum)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("invalid part checksum")
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(partChecksums)), nil
+}
+
+// discardPendingUpload removes whatever an unfinished reservation has uploaded so far.
+// Files from before per-file keys are left alone, since others may share their object.
+func discardPendingUpload(blobs services.MultipartBlobStore, file *services.File) {
+	if file.ObjectKey == "" {
+		return
+	}
+	if file.UploadID != "" {
+		if err := blobs.AbortMultipart(file.ObjectKey, file.UploadID); err != nil {
+			log.Printf("Failed to abort previous upload of %s: %v", file.ID, err)
+		}
+	}
+	if err := blobs.Delete(file.ObjectKey); err != nil {
+		log.Printf("Failed to delete previous upload of %s: %v", file.ID, err)
+	}
+}
+
+// CompleteUploadReq checks that a direct upload arrived with the reserved size and checksum
+// and makes the file available. Multipart uploads send the ETag of each part.
+func CompleteUploadReq(audit services.AuditRepository, files services.FileRepository, blobs services.PresignedUploadStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		var req struct {
+			Parts []services.BlobPart `json:"parts"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+				return
+			}
+		}
+
+		file, err := files.Get(c.Param("id"))
+		if err != nil {
+			log.Printf("Failed to retrieve file metadata: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file metadata"})
+			return
+		}
+		if file == nil || file.User != claims.ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if file.Active() {
+			c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "fileId": file.ID, "userId": file.User, "org": file.Org})
+			return
+		}
+		if file.ExpiresAt <= time.Now().Unix() {
+			c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+			return
+		}
+
+		key := file.BlobKey()
+		if file.UploadID != "" {
+			if len(req.Parts) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "parts are required"})
+				return
+			}
+			partChecksums := make([]string, 0, len(req.Parts))
+			for _, part := range req.Parts {
+				partChecksums = append(partChecksums, part.Checksum)
+			}
+			if checksum, err := compositeChecksum(partChecksums); err != nil || checksum != file.Checksum {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "parts must carry the checksums given when the upload was reserved"})
+				return
+			}
+			if err := blobs.CompleteMultipart(key, file.UploadID, req.Parts); err != nil {
+				log.Printf("Failed to complete upload of %s: %v", file.ID, err)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to complete multipart upload"})
+				return
+			}
+			// The parts are gone now, so a retry must go straight to the checks below.
+			file.UploadID = ""
+			if err := files.Create(*file); err != nil {
+				log.Printf("Failed to save metadata: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+				return
+			}
+		}
+
+		info, err := blobs.Head(key)
+		if errors.Is(err, services.ErrBlobNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "File has not been uploaded"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check upload of %s: %v", file.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check upload"})
+			return
+		}
+		// A failed check throws the object and the reservation away. A multipart upload's
+		// parts are already gone, so there is nothing left to upload to either way.
+		if info.Size != file.Size {
+			rejectUpload(audit, c, files, blobs, file, "size mismatch")
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("Uploaded size %d does not match %d", info.Size, file.Size)})
+			return
+		}
+		if info.ChecksumSHA256 != file.Checksum {
+			rejectUpload(audit, c, files, blobs, file, "checksum mismatch")
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Uploaded checksum does not match"})
+			return
+		}
+
+		err = files.Activate(file.ID, info.Size)
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload is no longer pending"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to activate file %s: %v", file.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+			return
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUpload, Outcome: services.AuditSuccess, Target: file.ID, Detail: file.FileName})
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "File uploaded successfully",
+			"fileId":  file.ID,
+			"userId":  file.User,
+			"org":     file.Org,
+		})
+	}
+}
+
+// rejectUpload deletes an upload that failed its checks, along with its reservation, and
+// audits why.
+func rejectUpload(audit services.AuditRepository, c *gin.Context, files services.FileRepository, blobs services.BlobStore, file *services.File, reason string) {
+	if file.ObjectKey != "" {
+		if err := blobs.Delete(file.ObjectKey); err != nil {
+			log.Printf("Failed to delete rejected upload of %s: %v", file.ID, err)
+		}
+	}
+	if err := files.Delete(file.ID); err != nil {
+		log.Printf("Failed to delete reservation of %s: %v", file.ID, err)
+	}
+	middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUpload, Outcome: services.AuditFailure, Target: file.ID, Detail: reason})
+}
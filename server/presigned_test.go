@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newPresignedTestApp adds the direct upload routes, with the local store's /blobs route
+// standing in for S3.
+func newPresignedTestApp(t *testing.T) *testApp {
+	t.Helper()
+	app := newTestApp(t)
+	app.r.PUT("/blobs/*key", LocalBlobUploadReq(app.blobs))
+	auth := app.r.Group("/", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions))
+	auth.POST("/upload/url", UploadURLReq(app.members, app.audit, app.files, app.blobs))
+	auth.POST("/upload/:id/complete", CompleteUploadReq(app.audit, app.files, app.blobs))
+	return app
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// uploadTarget is a presigned URL from a reservation and the headers to send with it.
+type uploadTarget struct {
+	Number  int32             `json:"number"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+type reservation struct {
+	FileID string `json:"fileId"`
+	uploadTarget
+	PartSize int64          `json:"partSize"`
+	Parts    []uploadTarget `json:"parts"`
+}
+
+func (app *testApp) reserve(t *testing.T, token string, req gin.H) reservation {
+	t.Helper()
+	w := app.serveJSON(http.MethodPost, "/upload/url", token, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reserve: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var res reservation
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.FileID == "" {
+		t.Fatalf("reserve: no file ID in %s", w.Body.String())
+	}
+	return res
+}
+
+func (app *testApp) putSigned(target uploadTarget, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, target.URL, bytes.NewReader(body))
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+	return app.serve(req, "")
+}
+
+func (app *testApp) completeUpload(token, id string, parts []services.BlobPart) *httptest.ResponseRecorder {
+	if parts == nil {
+		req := httptest.NewRequest(http.MethodPost, "/upload/"+id+"/complete", nil)
+		return app.serve(req, token)
+	}
+	return app.serveJSON(http.MethodPost, "/upload/"+id+"/complete", token, gin.H{"parts": parts})
+}
+
+func (app *testApp) storedBlob(t *testing.T, key string) []byte {
+	t.Helper()
+	body, _, err := app.blobs.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	return data
+}
+
+func TestDirectUpload(t *testing.T) {
+	app := newPresignedTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	content := []byte("hello, direct upload")
+
+	res := app.reserve(t, ann.AccessToken, gin.H{
+		"fileName": "hello.txt", "sharedSecret": "s3cret", "size": len(content),
+		"checksumSha256": sha256Base64(content), "contentType": "text/plain",
+	})
+	file, _ := app.files.Get(res.FileID)
+	if file == nil || file.Active() || file.User != "u1" {
+		t.Fatalf("reserved file = %+v, want a pending file for u1", file)
+	}
+
+	if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusConflict {
+		t.Errorf("complete before uploading: status = %d, want 409", w.Code)
+	}
+
+	// The store holds the client to the reserved checksum.
+	if w := app.putSigned(res.uploadTarget, []byte("something else entirely")); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with other content: status = %d, want 400", w.Code)
+	}
+	if _, err := app.blobs.Head(file.ObjectKey); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("PUT with other content left an object behind: %v", err)
+	}
+	forged := uploadTarget{URL: res.URL, Headers: map[string]string{"Content-Type": "text/plain", services.LocalChecksumHeader: sha256Base64([]byte("forged"))}}
+	if w := app.putSigned(forged, []byte("forged")); w.Code != http.StatusForbidden {
+		t.Errorf("PUT with another checksum: status = %d, want 403", w.Code)
+	}
+
+	if w := app.putSigned(res.uploadTarget, content); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusOK {
+		t.Fatalf("complete: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if file, _ := app.files.Get(res.FileID); file == nil || !file.Active() {
+		t.Errorf("completed file = %+v, want it active", file)
+	}
+	if got := app.storedBlob(t, file.ObjectKey); !bytes.Equal(got, content) {
+		t.Errorf("stored %q, want %q", got, content)
+	}
+	if n := app.auditCount(services.AuditUpload, services.AuditSuccess); n != 1 {
+		t.Errorf("recorded %d successful uploads, want 1", n)
+	}
+
+	// Completing again is harmless, and the name is now taken.
+	if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusOK {
+		t.Errorf("second complete: status = %d, want 200", w.Code)
+	}
+	w := app.serveJSON(http.MethodPost, "/upload/url", ann.AccessToken, gin.H{
+		"fileName": "hello.txt", "sharedSecret": "s3cret", "size": len(content), "checksumSha256": sha256Base64(content),
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("reserving a finished file: status = %d, want 409", w.Code)
+	}
+}
+
+func TestDirectUploadReservation(t *testing.T) {
+	app := newPresignedTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	bob := app.addUser(t, "u2", "bob@example.com", "")
+	content := []byte("reserved")
+	req := gin.H{"fileName": "r.txt", "sharedSecret": "s", "size": len(content), "checksumSha256": sha256Base64(content)}
+
+	for name, bad := range map[string]gin.H{
+		"no secret":    {"fileName": "r.txt", "size": 1, "checksumSha256": sha256Base64(content)},
+		"no size":      {"fileName": "r.txt", "sharedSecret": "s", "checksumSha256": sha256Base64(content)},
+		"bad checksum": {"fileName": "r.txt", "sharedSecret": "s", "size": 1, "checksumSha256": "not-a-digest"},
+	} {
+		if w := app.serveJSON(http.MethodPost, "/upload/url", ann.AccessToken, bad); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+
+	first := app.reserve(t, ann.AccessToken, req)
+	firstFile, _ := app.files.Get(first.FileID)
+	if w := app.putSigned(first.uploadTarget, content); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d", w.Code)
+	}
+
+	if w := app.serveJSON(http.MethodPost, "/upload/url", bob.AccessToken, req); w.Code != http.StatusConflict {
+		t.Errorf("reserving another user's file: status = %d, want 409", w.Code)
+	}
+	if w := app.completeUpload(bob.AccessToken, first.FileID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("completing another user's upload: status = %d, want 404", w.Code)
+	}
+
+	// Reserving again replaces the unfinished upload and throws away what it had.
+	second := app.reserve(t, ann.AccessToken, req)
+	secondFile, _ := app.files.Get(second.FileID)
+	if second.FileID != first.FileID || secondFile.ObjectKey == firstFile.ObjectKey {
+		t.Errorf("second reservation = %+v, want the same file under a new key", secondFile)
+	}
+	if _, err := app.blobs.Head(firstFile.ObjectKey); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("the replaced upload is still stored: %v", err)
+	}
+
+	// A reservation that has run out can't be completed.
+	secondFile.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	app.files.Create(*secondFile)
+	app.putSigned(second.uploadTarget, content)
+	if w := app.completeUpload(ann.AccessToken, second.FileID, nil); w.Code != http.StatusGone {
+		t.Errorf("complete after expiry: status = %d, want 410", w.Code)
+	}
+}
+
+func TestDirectUploadMultipart(t *testing.T) {
+	threshold := directMultipartThreshold
+	directMultipartThreshold = 8 << 20
+	t.Cleanup(func() { directMultipartThreshold = threshold })
+
+	app := newPresignedTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+
+	content := make([]byte, 11<<20)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	var chunks [][]byte
+	var checksums []string
+	for offset := 0; offset < len(content); offset += services.MinPartSize {
+		chunk := content[offset:min(offset+services.MinPartSize, len(content))]
+		chunks = append(chunks, chunk)
+		checksums = append(checksums, sha256Base64(chunk))
+	}
+
+	res := app.reserve(t, ann.AccessToken, gin.H{
+		"fileName": "big.bin", "sharedSecret": "s", "size": len(content),
+		"partSize": services.MinPartSize, "partChecksumsSha256": checksums,
+	})
+	if res.PartSize != services.MinPartSize || len(res.Parts) != len(chunks) {
+		t.Fatalf("reservation = %+v, want %d parts of %d bytes", res, len(chunks), services.MinPartSize)
+	}
+
+	var parts []services.BlobPart
+	for i, target := range res.Parts {
+		w := app.putSigned(target, chunks[i])
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT part %d: status = %d, body = %s", target.Number, w.Code, w.Body.String())
+		}
+		parts = append(parts, services.BlobPart{Number: target.Number, ETag: w.Header().Get("ETag"), Checksum: checksums[i]})
+	}
+	if w := app.putSigned(res.Parts[0], chunks[1]); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of the wrong part: status = %d, want 400", w.Code)
+	}
+
+	if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("complete without parts: status = %d, want 400", w.Code)
+	}
+	swapped := []services.BlobPart{parts[1], parts[0], parts[2]}
+	swapped[0].Number, swapped[1].Number = 1, 2
+	if w := app.completeUpload(ann.AccessToken, res.FileID, swapped); w.Code != http.StatusBadRequest {
+		t.Errorf("complete with mismatched checksums: status = %d, want 400", w.Code)
+	}
+
+	if w := app.completeUpload(ann.AccessToken, res.FileID, parts); w.Code != http.StatusOK {
+		t.Fatalf("complete: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	file, _ := app.files.Get(res.FileID)
+	if file == nil || !file.Active() || file.UploadID != "" {
+		t.Fatalf("completed file = %+v, want it active", file)
+	}
+	if got := app.storedBlob(t, file.ObjectKey); !bytes.Equal(got, content) {
+		t.Errorf("assembled %d bytes, want the %d uploaded", len(got), len(content))
+	}
+	info, _ := app.blobs.Head(file.ObjectKey)
+	if want, _ := compositeChecksum(checksums); info.ChecksumSHA256 != want {
+		t.Errorf("object checksum = %q, want %q", info.ChecksumSHA256, want)
+	}
+}
+
+func TestDirectUploadRejected(t *testing.T) {
+	content := []byte("the reserved content")
+	for name, stored := range map[string][]byte{
+		"size mismatch":     []byte("short"),
+		"checksum mismatch": []byte("THE RESERVED CONTENT"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			app := newPresignedTestApp(t)
+			ann := app.addUser(t, "u1", "ann@example.com", "")
+			res := app.reserve(t, ann.AccessToken, gin.H{
+				"fileName": "x.txt", "sharedSecret": "s", "size": len(content), "checksumSha256": sha256Base64(content),
+			})
+			file, _ := app.files.Get(res.FileID)
+
+			// S3 would refuse this at the PUT; write it behind the store's back.
+			if err := app.blobs.Put(file.ObjectKey, "text/plain", bytes.NewReader(stored)); err != nil {
+				t.Fatal(err)
+			}
+			if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("complete: status = %d, body = %s, want 422", w.Code, w.Body.String())
+			}
+
+			if _, err := app.blobs.Head(file.ObjectKey); !errors.Is(err, services.ErrBlobNotFound) {
+				t.Errorf("rejected object is still stored: %v", err)
+			}
+			if file, _ := app.files.Get(res.FileID); file != nil {
+				t.Errorf("rejected reservation = %+v, want it gone", file)
+			}
+			if n := app.auditCount(services.AuditUpload, services.AuditFailure); n != 1 {
+				t.Errorf("recorded %d failed uploads, want 1", n)
+			}
+			if w := app.completeUpload(ann.AccessToken, res.FileID, nil); w.Code != http.StatusNotFound {
+				t.Errorf("complete after rejection: status = %d, want 404", w.Code)
+			}
+
+			// The client starts over with a new reservation.
+			again := app.reserve(t, ann.AccessToken, gin.H{
+				"fileName": "x.txt", "sharedSecret": "s", "size": len(content), "checksumSha256": sha256Base64(content),
+			})
+			app.putSigned(again.uploadTarget, content)
+			if w := app.completeUpload(ann.AccessToken, again.FileID, nil); w.Code != http.StatusOK {
+				t.Errorf("complete after starting over: status = %d, body = %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
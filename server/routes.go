@@ -2,33 +2,166 @@ package server
 
 import (
 	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/resend/resend-go/v2"
 )
 
-func AddPublicRoutes(ddbClient *dynamodb.Client, r *gin.Engine) {
+func AddPublicRoutes(ddbClient *dynamodb.Client, resendClient *resend.Client, r *gin.Engine) {
+	users := services.NewDynamoUserRepository(ddbClient, "Users")
+	sessions := services.NewDynamoSessionRepository(ddbClient, "Sessions")
+	members := services.NewDynamoOrgMemberRepository(ddbClient, "OrgMembers")
+	attempts := services.NewDynamoLoginAttemptRepository(ddbClient, "LoginAttempts")
+	audit := services.NewDynamoAuditRepository(ddbClient, "AuditLog")
+	clients := services.NewDynamoOAuthClientRepository(ddbClient, "OAuthClients")
+	codes := services.NewDynamoAuthCodeRepository(ddbClient, "OAuthCodes")
+	passkeys := services.NewDynamoPasskeyRepository(ddbClient, "Passkeys")
+	ceremonies := services.NewDynamoWebAuthnSessionRepository(ddbClient, "WebAuthnSessions")
+	invites := services.NewDynamoInviteCodeRepository(ddbClient, "InviteCodes")
+
 	r.GET("/", Hello())
-	r.POST("/register", CreateNewUserReq(ddbClient))
-	r.POST("/login", AuthUserReq(ddbClient))
-	r.POST("/refresh-token", middlware.RefreshTokenHandler(ddbClient))
+	r.GET("/.well-known/jwks.json", JWKSReq())
+	r.GET("/.well-known/openid-configuration", OpenIDConfigurationReq())
+	r.GET("/authorize", AuthorizeReq(clients, codes, users, sessions, attempts, audit, resendClient))
+	r.POST("/authorize", AuthorizeReq(clients, codes, users, sessions, attempts, audit, resendClient))
+	r.POST("/token", TokenReq(clients, codes, users, sessions, audit))
+	r.GET("/userinfo", middlware.UserInfoMiddleware(sessions), UserInfoReq(users))
+	r.POST("/register", CreateNewUserReq(invites, users, sessions, resendClient))
+	r.POST("/login", AuthUserReq(users, sessions, attempts, audit, resendClient))
+	r.POST("/login/magic", MagicLinkReq(users, resendClient))
+	r.GET("/login/magic/callback", MagicLinkCallbackReq(users, sessions, attempts, audit))
+	r.POST("/login/passkey/begin", BeginPasskeyLoginReq(ceremonies))
+	r.POST("/login/passkey/finish", FinishPasskeyLoginReq(passkeys, ceremonies, users, sessions, attempts, audit))
+	r.POST("/login/mfa", LoginMFAReq(users, sessions, attempts, audit, resendClient))
+	r.POST("/refresh-token", middlware.RefreshTokenHandler(users, sessions, audit))
+	r.POST("/password/forgot", ForgotPasswordReq(users, resendClient))
+	r.POST("/password/reset", ResetPasswordReq(sessions, audit, users))
+	r.GET("/verify-email", VerifyEmailReq(users))
+	r.GET("/erasure-jobs/:id", ErasureJobStatusReq(services.NewDynamoErasureJobRepository(ddbClient, "ErasureJobs")))
+	r.OPTIONS("/files/tus/", middlware.TusResumable(), TusOptionsReq())
+
+	scim := r.Group("/scim/v2", middlware.RequireSCIMToken())
+	{
+		scim.GET("/ServiceProviderConfig", SCIMServiceProviderConfigReq())
+		scim.GET("/Users", SCIMListUsersReq(users))
+		scim.POST("/Users", SCIMCreateUserReq(users, audit))
+		scim.GET("/Users/:id", SCIMGetUserReq(users))
+		scim.PUT("/Users/:id", SCIMReplaceUserReq(users, sessions, audit))
+		scim.PATCH("/Users/:id", SCIMPatchUserReq(users, sessions, audit))
+		scim.DELETE("/Users/:id", SCIMDeleteUserReq(users, sessions, audit))
+		scim.GET("/Groups", SCIMListGroupsReq(ddbClient, members))
+		scim.POST("/Groups", SCIMCreateGroupReq(ddbClient, users, members))
+		scim.GET("/Groups/:id", SCIMGetGroupReq(ddbClient, members))
+		scim.PUT("/Groups/:id", SCIMReplaceGroupReq(ddbClient, users, members))
+		scim.PATCH("/Groups/:id", SCIMPatchGroupReq(ddbClient, users, members))
+		scim.DELETE("/Groups/:id", SCIMDeleteGroupReq(ddbClient, members))
+	}
 }
 
-func AddDProtectedRoutes(ddbClient *dynamodb.Client, resendClient *resend.Client, s3Client *s3.Client, r *gin.Engine) {
-	auth := r.Group("/", middlware.AuthMiddleware())
+func AddDProtectedRoutes(ddbClient *dynamodb.Client, resendClient *resend.Client, blobs services.BlobStore, r *gin.Engine) {
+	users := services.NewDynamoUserRepository(ddbClient, "Users")
+	files := services.NewDynamoFileRepository(ddbClient, "Files")
+	sessions := services.NewDynamoSessionRepository(ddbClient, "Sessions")
+	members := services.NewDynamoOrgMemberRepository(ddbClient, "OrgMembers")
+	audit := services.NewDynamoAuditRepository(ddbClient, "AuditLog")
+	passkeys := services.NewDynamoPasskeyRepository(ddbClient, "Passkeys")
+	ceremonies := services.NewDynamoWebAuthnSessionRepository(ddbClient, "WebAuthnSessions")
+	apiKeys := services.NewDynamoAPIKeyRepository(ddbClient, "APIKeys")
+	invites := services.NewDynamoInviteCodeRepository(ddbClient, "InviteCodes")
+	tusUploads := services.NewDynamoTusUploadRepository(ddbClient, "TusUploads")
+	data := accountData{
+		users:    users,
+		files:    files,
+		passkeys: passkeys,
+		apiKeys:  apiKeys,
+		posts:    services.NewDynamoPostRepository(ddbClient, "BlogPosts"),
+		sessions: sessions,
+		members:  members,
+		attempts: services.NewDynamoLoginAttemptRepository(ddbClient, "LoginAttempts"),
+		audit:    audit,
+		erasures: services.NewDynamoErasureJobRepository(ddbClient, "ErasureJobs"),
+	}
+
+	auth := r.Group("/", middlware.AuthMiddleware(apiKeys, users, sessions), middlware.RequireRole(services.RoleUser, services.RoleAdmin))
+	{
+		// Reachable with an API key that carries the matching scope.
+		auth.GET("/users", middlware.RequireScope(services.ScopeUsersRead), middlware.RequireRole(services.RoleAdmin), GetAllUsersReq(users))
+		auth.GET("/users/:id", middlware.RequireScope(services.ScopeUsersRead), middlware.RequireSelfOrAdmin("id"), GetUserByIDReq(users))
+		auth.GET("/users/:id/avatar", middlware.RequireScope(services.ScopeUsersRead), GetAvatarReq(users, members, blobs))
+		auth.POST("/upload", middlware.RequireScope(services.ScopeFilesWrite), middlware.RequireVerifiedEmail(), Upload(members, audit, files, blobs))
+		auth.POST("/download/direct", middlware.RequireScope(services.ScopeFilesRead), Download(audit, files, blobs))
+		auth.POST("/download/url", middlware.RequireScope(services.ScopeFilesRead), DownloadURL(audit, files, blobs))
+		auth.POST("/download/qr", middlware.RequireScope(services.ScopeFilesRead), DownloadQR(audit, files, blobs))
+		auth.GET("/orgs/:orgId/files", middlware.RequireScope(services.ScopeFilesRead), RequireOrgRole(members, services.OrgRoleViewer), ListOrgFilesReq(files))
+		auth.GET("/orgs/:orgId/files/:fileId/url", middlware.RequireScope(services.ScopeFilesRead), RequireOrgRole(members, services.OrgRoleViewer), OrgFileURLReq(audit, files, blobs))
+	}
+
+	if store, ok := blobs.(services.MultipartBlobStore); ok {
+		tus := auth.Group("/files/tus", middlware.RequireScope(services.ScopeFilesWrite), middlware.RequireVerifiedEmail(), middlware.TusResumable())
+		{
+			tus.POST("/", TusCreateReq(tusUploads, members, audit, files, store))
+			tus.HEAD("/:id", TusHeadReq(tusUploads, store))
+			tus.PATCH("/:id", TusPatchReq(tusUploads, audit, files, store))
+			tus.DELETE("/:id", TusDeleteReq(tusUploads, store))
+		}
+	}
+
+	if store, ok := blobs.(services.PresignedUploadStore); ok {
+		direct := auth.Group("/upload", middlware.RequireScope(services.ScopeFilesWrite), middlware.RequireVerifiedEmail())
+		{
+			direct.POST("/url", UploadURLReq(members, audit, files, store))
+			direct.POST("/:id/complete", CompleteUploadReq(audit, files, store))
+		}
+	}
+
+	interactive := auth.Group("/", middlware.RequireInteractive())
 	{
-		auth.GET("/users", GetAllUsersReq(ddbClient))
-		auth.GET("/users/:id", GetUserByIDReq(ddbClient))
-		auth.PUT("/users", UpdateUserReq(ddbClient))
-		auth.PUT("/users/password", UpdatePasswordReq(ddbClient))
-		auth.DELETE("/users/:id", DeleteUserReq(ddbClient))
-		auth.POST("/upload", Upload(s3Client))
-		auth.POST("/download/direct", Download(s3Client))
-		auth.POST("/download/url", DownloadURL(s3Client))
-		auth.POST("/download/qr", DownloadQR(s3Client))
-		auth.POST("/send_url", SendURLViaResend(resendClient))
-		auth.POST("/send_qr", SendQRViaResend(resendClient))
+		interactive.PUT("/users", UpdateUserReq(audit, users, resendClient))
+		interactive.PUT("/users/password", UpdatePasswordReq(sessions, audit, users))
+		interactive.PUT("/users/me/avatar", UploadAvatarReq(users, blobs))
+		interactive.PUT("/users/:id/role", middlware.RequireRole(services.RoleAdmin), SetUserRoleReq(sessions, audit, users))
+		interactive.GET("/users/me/export", ExportUserDataReq(data, blobs))
+		interactive.DELETE("/users/me", EraseMyAccountReq(data, blobs, resendClient))
+		interactive.DELETE("/users/:id", middlware.RequireRole(services.RoleAdmin), DeleteUserReq(data, blobs, resendClient))
+		interactive.POST("/logout", LogoutReq(sessions))
+		interactive.POST("/oauth/clients", middlware.RequireRole(services.RoleAdmin), CreateOAuthClientReq(services.NewDynamoOAuthClientRepository(ddbClient, "OAuthClients")))
+		interactive.POST("/admin/invites", middlware.RequireRole(services.RoleAdmin), CreateInviteCodeReq(invites, resendClient))
+		interactive.GET("/admin/invites", middlware.RequireRole(services.RoleAdmin), ListInviteCodesReq(invites))
+		interactive.DELETE("/admin/invites/:id", middlware.RequireRole(services.RoleAdmin), DeleteInviteCodeReq(invites))
+		interactive.GET("/admin/audit", middlware.RequireRole(services.RoleAdmin), ListAuditEventsReq(ddbClient))
+		interactive.GET("/sessions", ListSessionsReq(sessions))
+		interactive.DELETE("/sessions", DeleteOtherSessionsReq(sessions))
+		interactive.DELETE("/sessions/:id", DeleteSessionReq(sessions))
+		interactive.POST("/api-keys", CreateAPIKeyReq(apiKeys))
+		interactive.GET("/api-keys", ListAPIKeysReq(apiKeys))
+		interactive.DELETE("/api-keys/:id", DeleteAPIKeyReq(apiKeys))
+		interactive.POST("/passkeys/register/begin", BeginPasskeyRegistrationReq(passkeys, ceremonies, users))
+		interactive.POST("/passkeys/register/finish", FinishPasskeyRegistrationReq(passkeys, ceremonies, users))
+		interactive.GET("/passkeys", ListPasskeysReq(passkeys))
+		interactive.DELETE("/passkeys/:id", DeletePasskeyReq(passkeys))
+		interactive.POST("/orgs", CreateOrgReq(ddbClient, members))
+		interactive.GET("/orgs", ListMyOrgsReq(ddbClient, members))
+		interactive.POST("/orgs/invites/accept", AcceptOrgInviteReq(ddbClient, members))
+		interactive.GET("/orgs/:orgId", RequireOrgRole(members, services.OrgRoleViewer), GetOrgReq(ddbClient, members))
+		interactive.DELETE("/orgs/:orgId", RequireOrgRole(members, services.OrgRoleOwner), DeleteOrgReq(ddbClient, members))
+		interactive.POST("/orgs/:orgId/invites", RequireOrgRole(members, services.OrgRoleAdmin), InviteOrgMemberReq(ddbClient, resendClient))
+		interactive.PUT("/orgs/:orgId/members/:userId", RequireOrgRole(members, services.OrgRoleAdmin), UpdateOrgMemberReq(members))
+		interactive.DELETE("/orgs/:orgId/members/:userId", RequireOrgRole(members, services.OrgRoleViewer), RemoveOrgMemberReq(members))
+		interactive.POST("/verify-email/resend", ResendVerificationReq(users, resendClient))
+		interactive.POST("/mfa/totp/enroll", EnrollTOTPReq(users))
+		interactive.POST("/mfa/totp/confirm", ConfirmTOTPReq(users))
+		interactive.POST("/mfa/totp/disable", DisableTOTPReq(users))
+		interactive.POST("/send_url", middlware.RequireVerifiedEmail(), SendURLViaResend(resendClient))
+		interactive.POST("/send_qr", middlware.RequireVerifiedEmail(), SendQRViaResend(resendClient))
+	}
+}
+
+// AddBlobRoutes serves signed URLs for the local-disk store. S3 serves its own.
+func AddBlobRoutes(blobs services.BlobStore, r *gin.Engine) {
+	if store, ok := blobs.(*services.LocalBlobStore); ok {
+		r.GET("/blobs/*key", LocalBlobReq(store))
+		r.PUT("/blobs/*key", LocalBlobUploadReq(store))
 	}
 }
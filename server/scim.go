@@ -0,0 +1,621 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+
+	scimDefaultCount = 100
+	scimMaxCount     = 200
+
+	// scimActor is the audit actor for changes made by the identity provider.
+	scimActor = "scim"
+)
+
+// errSCIMInvalidValue and errSCIMUniqueness carry a detail message back to the client.
+var (
+	errSCIMInvalidValue = errors.New("invalidValue")
+	errSCIMUniqueness   = errors.New("uniqueness")
+)
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// scimUser is the SCIM view of a User. userName is the account's email address, and the
+// single name on the account is exposed as displayName and name.formatted.
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Password    string      `json:"password,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// scimEqFilter matches the one filter form we support: `<attribute> eq "<value>"`.
+var scimEqFilter = regexp.MustCompile(`(?i)^\s*([a-z.]+)\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+func scimJSON(c *gin.Context, status int, body any) {
+	c.Header("Content-Type", middlware.SCIMContentType)
+	c.JSON(status, body)
+}
+
+// scimErrorFor maps an error from the update helpers to a SCIM error response.
+func scimErrorFor(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errSCIMInvalidValue):
+		middlware.SCIMError(c, http.StatusBadRequest, "invalidValue", strings.TrimPrefix(err.Error(), "invalidValue: "))
+	case errors.Is(err, errSCIMUniqueness):
+		middlware.SCIMError(c, http.StatusConflict, "uniqueness", strings.TrimPrefix(err.Error(), "uniqueness: "))
+	default:
+		log.Printf("SCIM request failed: %v", err)
+		middlware.SCIMError(c, http.StatusInternalServerError, "", "Internal error")
+	}
+}
+
+// scimFilter parses the filter query parameter, returning the lower-cased attribute and
+// the value. ok is false when there is a filter we don't support.
+func scimFilter(c *gin.Context) (attr, value string, ok bool) {
+	filter := c.Query("filter")
+	if filter == "" {
+		return "", "", true
+	}
+	m := scimEqFilter.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", false
+	}
+	value, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.ToLower(m[1]), value, true
+}
+
+// scimPage reads startIndex (1-based) and count, returning the slice bounds into a list of
+// total resources.
+func scimPage(c *gin.Context, total int) (startIndex, from, to int) {
+	startIndex, err := strconv.Atoi(c.Query("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil || count < 0 {
+		count = scimDefaultCount
+	}
+	count = min(count, scimMaxCount)
+
+	from = min(startIndex-1, total)
+	to = min(from+count, total)
+	return startIndex, from, to
+}
+
+func scimListResponse(c *gin.Context, total, startIndex int, resources any, n int) {
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": n,
+		"Resources":    resources,
+	})
+}
+
+func toSCIMUser(user *services.User) scimUser {
+	given, family, _ := strings.Cut(user.Name, " ")
+	active := !user.Disabled
+	return scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          user.ID,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		Name:        scimName{Formatted: user.Name, GivenName: given, FamilyName: family},
+		DisplayName: user.Name,
+		Emails:      []scimEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta:        &scimMeta{ResourceType: "User", Location: AppURL() + "/scim/v2/Users/" + user.ID},
+	}
+}
+
+// resolve returns the email and name a SCIM user resource describes.
+func (u scimUser) resolve() (email, name string) {
+	email = u.UserName
+	for _, e := range u.Emails {
+		if e.Primary || !strings.Contains(email, "@") {
+			email = e.Value
+		}
+	}
+
+	name = u.DisplayName
+	if name == "" {
+		name = u.Name.Formatted
+	}
+	if name == "" {
+		name = strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+	}
+
+	return strings.ToLower(strings.TrimSpace(email)), strings.TrimSpace(name)
+}
+
+// setName keeps displayName and name in step, since the account only has one name.
+func (u *scimUser) setName(name string) {
+	given, family, _ := strings.Cut(name, " ")
+	u.DisplayName = name
+	u.Name = scimName{Formatted: name, GivenName: given, FamilyName: family}
+}
+
+// parseSCIMBool accepts JSON booleans and the "True"/"False" strings some IdPs send.
+func parseSCIMBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("%w: expected a boolean", errSCIMInvalidValue)
+}
+
+func parseSCIMString(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("%w: expected a string", errSCIMInvalidValue)
+	}
+	return s, nil
+}
+
+// applyUserPatch applies one PATCH operation. Attributes we don't store are ignored.
+func applyUserPatch(u *scimUser, op, path string, value json.RawMessage) error {
+	op = strings.ToLower(op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("%w: unsupported op %q", errSCIMInvalidValue, op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return fmt.Errorf("%w: remove needs a path", errSCIMInvalidValue)
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return fmt.Errorf("%w: expected an object", errSCIMInvalidValue)
+		}
+		for attr, v := range attrs {
+			if err := applyUserPatch(u, op, attr, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	remove := op == "remove"
+	lower := strings.ToLower(path)
+	switch {
+	case lower == "active":
+		if remove {
+			return nil
+		}
+		active, err := parseSCIMBool(value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+
+	case lower == "username":
+		if remove {
+			return fmt.Errorf("%w: userName is required", errSCIMInvalidValue)
+		}
+		email, err := parseSCIMString(value)
+		if err != nil {
+			return err
+		}
+		u.UserName, u.Emails = email, nil
+
+	case lower == "externalid":
+		if remove {
+			u.ExternalID = ""
+			return nil
+		}
+		id, err := parseSCIMString(value)
+		if err != nil {
+			return err
+		}
+		u.ExternalID = id
+
+	case lower == "displayname", lower == "name.formatted":
+		if remove {
+			return nil
+		}
+		name, err := parseSCIMString(value)
+		if err != nil {
+			return err
+		}
+		u.setName(name)
+
+	case lower == "name.givenname", lower == "name.familyname":
+		if remove {
+			return nil
+		}
+		part, err := parseSCIMString(value)
+		if err != nil {
+			return err
+		}
+		if lower == "name.givenname" {
+			u.Name.GivenName = part
+		} else {
+			u.Name.FamilyName = part
+		}
+		u.setName(strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName))
+
+	case lower == "name":
+		if remove {
+			return nil
+		}
+		var name scimName
+		if err := json.Unmarshal(value, &name); err != nil {
+			return fmt.Errorf("%w: expected a name object", errSCIMInvalidValue)
+		}
+		if name.Formatted == "" {
+			name.Formatted = strings.TrimSpace(name.GivenName + " " + name.FamilyName)
+		}
+		u.setName(name.Formatted)
+
+	case strings.HasPrefix(lower, "emails"):
+		if remove {
+			return nil
+		}
+		var emails []scimEmail
+		if err := json.Unmarshal(value, &emails); err == nil {
+			u.Emails = emails
+			return nil
+		}
+		// emails[type eq "work"].value and similar paths carry the address itself.
+		email, err := parseSCIMString(value)
+		if err != nil {
+			return err
+		}
+		u.UserName, u.Emails = email, nil
+	}
+
+	return nil
+}
+
+// saveSCIMUser writes the attributes in desired onto the existing account. Deactivating an
+// account signs it out everywhere.
+func saveSCIMUser(users services.UserRepository, sessions services.SessionRepository, existing *services.User, desired scimUser) error {
+	email, name := desired.resolve()
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("%w: userName must be an email address", errSCIMInvalidValue)
+	}
+	if name == "" {
+		name = existing.Name
+	}
+
+	if email != existing.Email {
+		other, err := users.GetByEmail(email)
+		if err != nil {
+			return err
+		}
+		if other != nil && other.ID != existing.ID {
+			return fmt.Errorf("%w: %s is already in use", errSCIMUniqueness, email)
+		}
+	}
+
+	if email != existing.Email || name != existing.Name {
+		if err := users.Update(services.User{ID: existing.ID, Name: name, Email: email}); err != nil {
+			return err
+		}
+	}
+
+	attrs := map[string]interface{}{}
+	if email != existing.Email {
+		// The IdP owns the address, so there is nothing for the user to verify.
+		attrs["verified"] = true
+	}
+	if desired.ExternalID != existing.ExternalID {
+		attrs["externalId"] = desired.ExternalID
+	}
+	disabled := desired.Active != nil && !*desired.Active
+	if desired.Active != nil && disabled != existing.Disabled {
+		attrs["disabled"] = disabled
+	}
+	if len(attrs) > 0 {
+		if err := users.SetAttributes(existing.ID, attrs); err != nil {
+			return err
+		}
+	}
+
+	if disabled && !existing.Disabled {
+		if _, err := revokeUserSessions(sessions, existing.ID, ""); err != nil {
+			log.Printf("Failed to revoke sessions for disabled user %s: %v", existing.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func SCIMServiceProviderConfigReq() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scimJSON(c, http.StatusOK, gin.H{
+			"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+			"patch":          gin.H{"supported": true},
+			"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         gin.H{"supported": true, "maxResults": scimMaxCount},
+			"changePassword": gin.H{"supported": false},
+			"sort":           gin.H{"supported": false},
+			"etag":           gin.H{"supported": false},
+			"authenticationSchemes": []gin.H{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer token",
+				"description": "The token configured in SCIM_BEARER_TOKEN",
+				"primary":     true,
+			}},
+		})
+	}
+}
+
+func SCIMListUsersReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attr, value, ok := scimFilter(c)
+		if !ok || (attr != "" && attr != "username") {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidFilter", `Only filters of the form userName eq "value" are supported`)
+			return
+		}
+
+		var list []services.User
+		if attr == "username" {
+			user, err := users.GetByEmail(value)
+			if err != nil {
+				scimErrorFor(c, err)
+				return
+			}
+			if user != nil {
+				list = append(list, *user)
+			}
+		} else {
+			var err error
+			if list, err = users.List(); err != nil {
+				scimErrorFor(c, err)
+				return
+			}
+			slices.SortFunc(list, func(a, b services.User) int { return strings.Compare(a.ID, b.ID) })
+		}
+
+		startIndex, from, to := scimPage(c, len(list))
+		resources := make([]scimUser, 0, to-from)
+		for i := from; i < to; i++ {
+			resources = append(resources, toSCIMUser(&list[i]))
+		}
+
+		scimListResponse(c, len(list), startIndex, resources, len(resources))
+	}
+}
+
+func SCIMGetUserReq(users services.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := users.Get(c.Param("id"))
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if user == nil {
+			middlware.SCIMError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		scimJSON(c, http.StatusOK, toSCIMUser(user))
+	}
+}
+
+func SCIMCreateUserReq(users services.UserRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req scimUser
+		if err := c.ShouldBindJSON(&req); err != nil {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+			return
+		}
+
+		email, name := req.resolve()
+		if !strings.Contains(email, "@") {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+			return
+		}
+		if name == "" {
+			name = email
+		}
+
+		existing, err := users.GetByEmail(email)
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if existing != nil {
+			middlware.SCIMError(c, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+			return
+		}
+
+		// Provisioned users normally sign in through the IdP, so without a password they get
+		// a random one that nobody knows.
+		password := req.Password
+		if password != "" {
+			if fields := middlware.Passwords.Validate("password", password, middlware.PasswordOwner{Name: name, Email: email}); len(fields) > 0 {
+				middlware.SCIMError(c, http.StatusBadRequest, "invalidValue", fields[0].Message)
+				return
+			}
+		} else if password, err = middlware.NewOpaqueToken(32); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		hashedPassword, err := middlware.HashedPassword(password)
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+
+		user := services.User{
+			ID:         "u_" + ShortUUID(),
+			Name:       name,
+			Email:      email,
+			Password:   hashedPassword,
+			Verified:   true,
+			Role:       services.RoleUser,
+			Disabled:   req.Active != nil && !*req.Active,
+			ExternalID: req.ExternalID,
+		}
+
+		if err := users.Create(user); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUserCreate, Outcome: services.AuditSuccess, ActorID: scimActor, Target: user.ID})
+
+		c.Header("Location", AppURL()+"/scim/v2/Users/"+user.ID)
+		scimJSON(c, http.StatusCreated, toSCIMUser(&user))
+	}
+}
+
+func SCIMReplaceUserReq(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, err := users.Get(c.Param("id"))
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if existing == nil {
+			middlware.SCIMError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		var req scimUser
+		if err := c.ShouldBindJSON(&req); err != nil {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+			return
+		}
+
+		respondSCIMUserSaved(users, sessions, audit, c, existing, req)
+	}
+}
+
+func SCIMPatchUserReq(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, err := users.Get(c.Param("id"))
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if existing == nil {
+			middlware.SCIMError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		var req scimPatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil || !slices.Contains(req.Schemas, scimPatchSchema) {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Expected a PatchOp request")
+			return
+		}
+
+		desired := toSCIMUser(existing)
+		for _, op := range req.Operations {
+			if err := applyUserPatch(&desired, op.Op, op.Path, op.Value); err != nil {
+				scimErrorFor(c, err)
+				return
+			}
+		}
+
+		respondSCIMUserSaved(users, sessions, audit, c, existing, desired)
+	}
+}
+
+// respondSCIMUserSaved saves a PUT or PATCH and responds with the updated resource.
+func respondSCIMUserSaved(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository, c *gin.Context, existing *services.User, desired scimUser) {
+	if err := saveSCIMUser(users, sessions, existing, desired); err != nil {
+		scimErrorFor(c, err)
+		return
+	}
+
+	event := services.AuditEvent{Event: services.AuditUserUpdate, Outcome: services.AuditSuccess, ActorID: scimActor, Target: existing.ID}
+	if desired.Active != nil && *desired.Active == existing.Disabled {
+		event.Detail = "active=" + strconv.FormatBool(*desired.Active)
+	}
+	middlware.Audit(audit, c, event)
+
+	updated, err := users.Get(existing.ID)
+	if err != nil || updated == nil {
+		scimErrorFor(c, fmt.Errorf("failed to reload user %s: %v", existing.ID, err))
+		return
+	}
+	scimJSON(c, http.StatusOK, toSCIMUser(updated))
+}
+
+func SCIMDeleteUserReq(users services.UserRepository, sessions services.SessionRepository, audit services.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		user, err := users.Get(id)
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if user == nil {
+			middlware.SCIMError(c, http.StatusNotFound, "", "User not found")
+			return
+		}
+
+		if err := users.Delete(id); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if _, err := revokeUserSessions(sessions, id, ""); err != nil {
+			log.Printf("Failed to revoke sessions for deleted user %s: %v", id, err)
+		}
+		middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUserDelete, Outcome: services.AuditSuccess, ActorID: scimActor, Target: id})
+
+		c.Status(http.StatusNoContent)
+	}
+}
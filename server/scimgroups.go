@@ -0,0 +1,391 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/gin-gonic/gin"
+)
+
+// scimGroupMember is a member reference; value is the user ID.
+type scimGroupMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+// scimGroup is the SCIM view of an organization. Members added through SCIM join with the
+// member role; existing members keep whatever role they already have.
+type scimGroup struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id,omitempty"`
+	DisplayName string            `json:"displayName"`
+	Members     []scimGroupMember `json:"members"`
+	Meta        *scimMeta         `json:"meta,omitempty"`
+}
+
+// scimMemberFilter matches member paths such as members[value eq "u_123"].
+var scimMemberFilter = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]+)"\s*\]$`)
+
+func toSCIMGroup(org *services.Org, members []services.OrgMember) scimGroup {
+	group := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          org.ID,
+		DisplayName: org.Name,
+		Members:     []scimGroupMember{},
+		Meta:        &scimMeta{ResourceType: "Group", Location: AppURL() + "/scim/v2/Groups/" + org.ID},
+	}
+	for _, member := range members {
+		group.Members = append(group.Members, scimGroupMember{Value: member.UserID})
+	}
+	return group
+}
+
+func memberIDs(members []scimGroupMember) []string {
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.Value)
+	}
+	return ids
+}
+
+// addGroupMembers adds users to the org as members, leaving existing memberships alone.
+func addGroupMembers(users services.UserRepository, members services.OrgMemberRepository, orgID string, current []services.OrgMember, userIDs []string) error {
+	for _, userID := range userIDs {
+		if slices.ContainsFunc(current, func(m services.OrgMember) bool { return m.UserID == userID }) {
+			continue
+		}
+
+		user, err := users.Get(userID)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("%w: no user with id %s", errSCIMInvalidValue, userID)
+		}
+
+		member := services.OrgMember{OrgID: orgID, UserID: userID, Role: services.OrgRoleMember, JoinedAt: time.Now().Unix()}
+		if err := members.Put(member); err != nil {
+			return err
+		}
+		current = append(current, member)
+	}
+	return nil
+}
+
+// removeGroupMembers removes users from the org. The IdP has no idea who owns an org, so
+// like the org API it refuses to remove the last owner.
+func removeGroupMembers(members services.OrgMemberRepository, orgID string, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	list, err := members.ListByOrg(orgID)
+	if err != nil {
+		return err
+	}
+	owners, removesOwner := 0, false
+	for _, member := range list {
+		if member.Role != services.OrgRoleOwner {
+			continue
+		}
+		if slices.Contains(userIDs, member.UserID) {
+			removesOwner = true
+		} else {
+			owners++
+		}
+	}
+	if removesOwner && owners == 0 {
+		return fmt.Errorf("%w: an organization needs at least one owner", errSCIMInvalidValue)
+	}
+
+	for _, userID := range userIDs {
+		if err := members.Delete(orgID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGroupMembers makes the org's membership exactly userIDs.
+func setGroupMembers(users services.UserRepository, members services.OrgMemberRepository, orgID string, current []services.OrgMember, userIDs []string) error {
+	var stale []string
+	for _, member := range current {
+		if !slices.Contains(userIDs, member.UserID) {
+			stale = append(stale, member.UserID)
+		}
+	}
+	if err := removeGroupMembers(members, orgID, stale); err != nil {
+		return err
+	}
+	return addGroupMembers(users, members, orgID, current, userIDs)
+}
+
+// applyGroupPatch applies one PATCH operation to the org directly.
+func applyGroupPatch(client *dynamodb.Client, users services.UserRepository, members services.OrgMemberRepository, org *services.Org, op scimPatchOp) error {
+	kind := strings.ToLower(op.Op)
+	path := strings.ToLower(op.Path)
+
+	if path == "" {
+		if kind == "remove" {
+			return fmt.Errorf("%w: remove needs a path", errSCIMInvalidValue)
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return fmt.Errorf("%w: expected an object", errSCIMInvalidValue)
+		}
+		for attr, value := range attrs {
+			if err := applyGroupPatch(client, users, members, org, scimPatchOp{Op: op.Op, Path: attr, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if path == "displayname" {
+		if kind == "remove" {
+			return fmt.Errorf("%w: displayName is required", errSCIMInvalidValue)
+		}
+		name, err := parseSCIMString(op.Value)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("%w: displayName is required", errSCIMInvalidValue)
+		}
+		org.Name = strings.TrimSpace(name)
+		return services.RenameOrg(client, "Orgs", org.ID, org.Name)
+	}
+
+	if m := scimMemberFilter.FindStringSubmatch(op.Path); m != nil && kind == "remove" {
+		return removeGroupMembers(members, org.ID, []string{m[1]})
+	}
+
+	if path != "members" {
+		return nil
+	}
+
+	var requested []scimGroupMember
+	if len(op.Value) > 0 {
+		if err := json.Unmarshal(op.Value, &requested); err != nil {
+			return fmt.Errorf("%w: expected a list of members", errSCIMInvalidValue)
+		}
+	}
+
+	current, err := members.ListByOrg(org.ID)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "add":
+		return addGroupMembers(users, members, org.ID, current, memberIDs(requested))
+	case "replace":
+		return setGroupMembers(users, members, org.ID, current, memberIDs(requested))
+	case "remove":
+		if len(requested) == 0 {
+			return setGroupMembers(users, members, org.ID, current, nil)
+		}
+		return removeGroupMembers(members, org.ID, memberIDs(requested))
+	}
+	return fmt.Errorf("%w: unsupported op %q", errSCIMInvalidValue, op.Op)
+}
+
+// loadSCIMGroup fetches an org for a /Groups/:id request, responding 404 if it is missing.
+func loadSCIMGroup(client *dynamodb.Client, c *gin.Context) *services.Org {
+	org, err := services.GetOrg(client, "Orgs", c.Param("id"))
+	if err != nil {
+		scimErrorFor(c, err)
+		return nil
+	}
+	if org == nil {
+		middlware.SCIMError(c, http.StatusNotFound, "", "Group not found")
+		return nil
+	}
+	return org
+}
+
+func respondSCIMGroup(members services.OrgMemberRepository, c *gin.Context, status int, org *services.Org) {
+	list, err := members.ListByOrg(org.ID)
+	if err != nil {
+		scimErrorFor(c, err)
+		return
+	}
+	scimJSON(c, status, toSCIMGroup(org, list))
+}
+
+func SCIMListGroupsReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attr, value, ok := scimFilter(c)
+		if !ok || (attr != "" && attr != "displayname") {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidFilter", `Only filters of the form displayName eq "value" are supported`)
+			return
+		}
+
+		orgs, err := services.ListOrgs(client, "Orgs")
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if attr == "displayname" {
+			orgs = slices.DeleteFunc(orgs, func(o services.Org) bool { return o.Name != value })
+		}
+		slices.SortFunc(orgs, func(a, b services.Org) int { return strings.Compare(a.ID, b.ID) })
+
+		withMembers := !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members")
+
+		startIndex, from, to := scimPage(c, len(orgs))
+		resources := make([]scimGroup, 0, to-from)
+		for i := from; i < to; i++ {
+			var list []services.OrgMember
+			if withMembers {
+				if list, err = members.ListByOrg(orgs[i].ID); err != nil {
+					scimErrorFor(c, err)
+					return
+				}
+			}
+			resources = append(resources, toSCIMGroup(&orgs[i], list))
+		}
+
+		scimListResponse(c, len(orgs), startIndex, resources, len(resources))
+	}
+}
+
+func SCIMGetGroupReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if org := loadSCIMGroup(client, c); org != nil {
+			respondSCIMGroup(members, c, http.StatusOK, org)
+		}
+	}
+}
+
+func SCIMCreateGroupReq(client *dynamodb.Client, users services.UserRepository, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req scimGroup
+		if err := c.ShouldBindJSON(&req); err != nil {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+			return
+		}
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		if req.DisplayName == "" {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+			return
+		}
+
+		org := services.Org{
+			ID:        "o_" + ShortUUID(),
+			Name:      req.DisplayName,
+			CreatedBy: scimActor,
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := services.CreateOrg(client, "Orgs", org); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if err := addGroupMembers(users, members, org.ID, nil, memberIDs(req.Members)); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+
+		c.Header("Location", AppURL()+"/scim/v2/Groups/"+org.ID)
+		respondSCIMGroup(members, c, http.StatusCreated, &org)
+	}
+}
+
+func SCIMReplaceGroupReq(client *dynamodb.Client, users services.UserRepository, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org := loadSCIMGroup(client, c)
+		if org == nil {
+			return
+		}
+
+		var req scimGroup
+		if err := c.ShouldBindJSON(&req); err != nil {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+			return
+		}
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		if req.DisplayName == "" {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+			return
+		}
+
+		current, err := members.ListByOrg(org.ID)
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if err := setGroupMembers(users, members, org.ID, current, memberIDs(req.Members)); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+
+		if req.DisplayName != org.Name {
+			if err := services.RenameOrg(client, "Orgs", org.ID, req.DisplayName); err != nil {
+				scimErrorFor(c, err)
+				return
+			}
+			org.Name = req.DisplayName
+		}
+
+		respondSCIMGroup(members, c, http.StatusOK, org)
+	}
+}
+
+func SCIMPatchGroupReq(client *dynamodb.Client, users services.UserRepository, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org := loadSCIMGroup(client, c)
+		if org == nil {
+			return
+		}
+
+		var req scimPatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil || !slices.Contains(req.Schemas, scimPatchSchema) {
+			middlware.SCIMError(c, http.StatusBadRequest, "invalidSyntax", "Expected a PatchOp request")
+			return
+		}
+
+		for _, op := range req.Operations {
+			if err := applyGroupPatch(client, users, members, org, op); err != nil {
+				scimErrorFor(c, err)
+				return
+			}
+		}
+
+		respondSCIMGroup(members, c, http.StatusOK, org)
+	}
+}
+
+func SCIMDeleteGroupReq(client *dynamodb.Client, members services.OrgMemberRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org := loadSCIMGroup(client, c)
+		if org == nil {
+			return
+		}
+
+		list, err := members.ListByOrg(org.ID)
+		if err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		if err := services.DeleteOrg(client, "Orgs", org.ID); err != nil {
+			scimErrorFor(c, err)
+			return
+		}
+		for _, member := range list {
+			if err := members.Delete(org.ID, member.UserID); err != nil {
+				log.Printf("Failed to remove org member %s: %v", member.UserID, err)
+			}
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -8,14 +8,13 @@ import (
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/resend/resend-go/v2"
 )
 
 type AppServices struct {
 	ResendClient *resend.Client
-	S3Client     *s3.Client
+	Blobs        services.BlobStore
 	DynamoClient *dynamodb.Client
 }
 
@@ -23,6 +22,7 @@ func ServeGin() {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	r.Use(middlware.RateLimitMiddleware())
+	middlware.InitAuth()
 
 	var (
 		appServices AppServices
@@ -40,13 +40,13 @@ func ServeGin() {
 
 	go func() {
 		defer wg.Done()
-		s3Client, err := services.ConnectS3()
+		blobs, err := services.NewBlobStore(AppURL())
 		if err != nil {
 			errChan <- err
 			return
 		}
-		appServices.S3Client = s3Client
-		log.Println("S3 client initialized")
+		appServices.Blobs = blobs
+		log.Println("Blob store initialized")
 	}()
 
 	go func() {
@@ -67,6 +67,66 @@ func ServeGin() {
 			errChan <- err
 			return
 		}
+		if err := services.CreateSessionsTable(ddbClient, "Sessions"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateOAuthClientsTable(ddbClient, "OAuthClients"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateOAuthCodesTable(ddbClient, "OAuthCodes"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateAPIKeysTable(ddbClient, "APIKeys"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateLoginAttemptsTable(ddbClient, "LoginAttempts"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreatePasskeysTable(ddbClient, "Passkeys"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateWebAuthnSessionsTable(ddbClient, "WebAuthnSessions"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateOrgsTable(ddbClient, "Orgs"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateOrgMembersTable(ddbClient, "OrgMembers"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateOrgInvitesTable(ddbClient, "OrgInvites"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateInviteCodesTable(ddbClient, "InviteCodes"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateAuditLogTable(ddbClient, "AuditLog"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateBlogPostTable(ddbClient, "BlogPosts"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateErasureJobsTable(ddbClient, "ErasureJobs"); err != nil {
+			errChan <- err
+			return
+		}
+		if err := services.CreateTusUploadsTable(ddbClient, "TusUploads"); err != nil {
+			errChan <- err
+			return
+		}
 		log.Println("DynamoDB tables created")
 	}()
 
@@ -79,8 +139,12 @@ func ServeGin() {
 		}
 	}
 
-	AddPublicRoutes(appServices.DynamoClient, r)
-	AddDProtectedRoutes(appServices.DynamoClient, appServices.ResendClient, appServices.S3Client, r)
+	AddPublicRoutes(appServices.DynamoClient, appServices.ResendClient, r)
+	AddDProtectedRoutes(appServices.DynamoClient, appServices.ResendClient, appServices.Blobs, r)
+	AddBlobRoutes(appServices.Blobs, r)
+	if store, ok := appServices.Blobs.(*services.LocalBlobStore); ok {
+		go pruneLocalTusUploads(store)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
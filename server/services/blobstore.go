@@ -0,0 +1,136 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultURLExpiry is how long signed download URLs stay valid.
+const DefaultURLExpiry = 5 * time.Minute
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrChecksumMismatch means an upload did not have the checksum it was signed for.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// BlobInfo describes a stored object. Size is always the size of the whole object, even
+// for range reads.
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// ChecksumSHA256 is the base64 SHA-256 of the content, when the backend stored one. For
+	// an object built from checksummed parts it is the SHA-256 of the part digests followed
+	// by "-" and the number of parts.
+	ChecksumSHA256 string
+}
+
+// BlobStore is where uploaded files and avatars are kept. Missing objects are reported as
+// ErrBlobNotFound.
+type BlobStore interface {
+	Put(key, contentType string, body io.Reader) error
+	Get(key string) (io.ReadCloser, *BlobInfo, error)
+	// GetRange reads length bytes starting at offset; a negative length reads to the end.
+	GetRange(key string, offset, length int64) (io.ReadCloser, *BlobInfo, error)
+	Head(key string) (*BlobInfo, error)
+	Delete(key string) error
+	SignedURL(key string, expires time.Duration) (string, error)
+}
+
+// PrefixBlobStore is a BlobStore that can delete every object under a prefix at once.
+type PrefixBlobStore interface {
+	BlobStore
+	// DeletePrefix deletes the objects under prefix, which must end in "/", and returns how
+	// many it deleted.
+	DeletePrefix(prefix string) (int, error)
+}
+
+// MinPartSize is the smallest part a multipart upload accepts, other than its last part.
+const MinPartSize = 5 << 20
+
+// BlobPart is one stored part of a multipart upload.
+type BlobPart struct {
+	Number int32  `json:"number" dynamodbav:"number"`
+	ETag   string `json:"etag" dynamodbav:"etag"`
+	// Checksum is the base64 SHA-256 of the part, for uploads that checksum their parts.
+	Checksum string `json:"checksumSha256,omitempty" dynamodbav:"checksum,omitempty"`
+}
+
+// MultipartBlobStore is a BlobStore that can also build an object from parts uploaded one
+// at a time, so a large upload survives the connection dropping part way through.
+type MultipartBlobStore interface {
+	BlobStore
+	CreateMultipart(key, contentType string) (string, error)
+	UploadPart(key, uploadID string, number int32, data []byte) (BlobPart, error)
+	CompleteMultipart(key, uploadID string, parts []BlobPart) error
+	// AbortMultipart discards the parts. Aborting an unknown upload is not an error.
+	AbortMultipart(key, uploadID string) error
+}
+
+// PresignedUploadStore is a MultipartBlobStore that clients can upload to directly, without
+// the bytes passing through this server.
+type PresignedUploadStore interface {
+	MultipartBlobStore
+	// SignedPutURL returns a URL for a single PUT of key and the headers the client must send
+	// with it. A non-empty checksum (base64 SHA-256) is enforced by the store.
+	SignedPutURL(key, contentType, checksum string, expires time.Duration) (string, map[string]string, error)
+	// CreateChecksummedMultipart starts a multipart upload whose parts must each carry a
+	// SHA-256 checksum, so the finished object has a checksum of the part checksums.
+	CreateChecksummedMultipart(key, contentType string) (string, error)
+	// SignedPartURL returns a URL for one part and the headers the client must send with it.
+	// The part is only accepted if its SHA-256 matches checksum.
+	SignedPartURL(key, uploadID string, number int32, checksum string, expires time.Duration) (string, map[string]string, error)
+}
+
+// NewBlobStore picks the backend from STORAGE_BACKEND: "s3" (the default) or "local".
+// baseURL is the public URL of this server, used for the local backend's signed URLs.
+func NewBlobStore(baseURL string) (BlobStore, error) {
+	switch backend := strings.ToLower(os.Getenv("STORAGE_BACKEND")); backend {
+	case "", "s3":
+		client, err := ConnectS3()
+		if err != nil {
+			return nil, err
+		}
+		return NewS3BlobStore(client, os.Getenv("AWS_BUCKET")), nil
+
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+		if len(secret) == 0 {
+			log.Println("LOCAL_STORAGE_SECRET is not set, signed URLs will stop working on restart")
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, fmt.Errorf("failed to generate storage secret: %w", err)
+			}
+		}
+		return NewLocalBlobStore(dir, secret, baseURL)
+
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+func contentTypeOrDefault(contentType string) string {
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+var (
+	_ PresignedUploadStore = (*S3BlobStore)(nil)
+	_ PresignedUploadStore = (*LocalBlobStore)(nil)
+	_ PrefixBlobStore      = (*S3BlobStore)(nil)
+	_ PrefixBlobStore      = (*LocalBlobStore)(nil)
+)
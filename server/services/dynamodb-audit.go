@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Audit event types.
+const (
+	AuditLogin          = "login"
+	AuditTokenRefresh   = "token.refresh"
+	AuditPasswordChange = "password.change"
+	AuditPasswordReset  = "password.reset"
+	AuditUserUpdate     = "user.update"
+	AuditUserRole       = "user.role"
+	AuditUserCreate     = "user.create"
+	AuditUserDelete     = "user.delete"
+	AuditUserErase      = "user.erase"
+	AuditDataExport     = "user.export"
+	AuditUpload         = "file.upload"
+	AuditDownload       = "file.download"
+	AuditDownloadURL    = "file.download_url"
+	AuditDownloadQR     = "file.download_qr"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// auditTimeLayout is fixed width so sort keys order the same as the times they hold.
+const auditTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// AuditEvent is one entry in the append-only audit log. Entries are partitioned by UTC day
+// and sorted by TS, which is the event time followed by a random suffix.
+type AuditEvent struct {
+	Day       string `json:"-" dynamodbav:"day"`
+	TS        string `json:"id" dynamodbav:"ts"`
+	Time      int64  `json:"time" dynamodbav:"time"`
+	Event     string `json:"event" dynamodbav:"event"`
+	Outcome   string `json:"outcome" dynamodbav:"outcome"`
+	ActorID   string `json:"actorId,omitempty" dynamodbav:"actorId,omitempty"`
+	Target    string `json:"target,omitempty" dynamodbav:"target,omitempty"`
+	IP        string `json:"ip" dynamodbav:"ip"`
+	UserAgent string `json:"userAgent" dynamodbav:"userAgent"`
+	Path      string `json:"path" dynamodbav:"path"`
+	Detail    string `json:"detail,omitempty" dynamodbav:"detail,omitempty"`
+}
+
+// AuditQuery filters the audit log. From and To bound the event time; Before is the id of
+// the last event of the previous page.
+type AuditQuery struct {
+	ActorID string
+	Event   string
+	From    time.Time
+	To      time.Time
+	Before  string
+	Limit   int
+}
+
+func auditSortKey(t time.Time) string {
+	return t.UTC().Format(auditTimeLayout)
+}
+
+func CreateAuditLogTable(client *dynamodb.Client, tableName string) error {
+
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("AuditLog table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("day"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("ts"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("actorId"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("event"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("day"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("ts"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("actor-index"),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("actorId"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("ts"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+			{
+				IndexName: aws.String("event-index"),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("event"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("ts"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create AuditLog table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for AuditLog table to become active: %w", err)
+	}
+
+	fmt.Println("AuditLog table created and active.")
+	return nil
+}
+
+// PutAuditEvent appends an event, filling in its day and sort key from the current time.
+// Existing entries are never overwritten.
+func PutAuditEvent(client *dynamodb.Client, tableName string, event AuditEvent) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("failed to generate audit id: %w", err)
+	}
+
+	now := time.Now().UTC()
+	event.Day = now.Format(time.DateOnly)
+	event.TS = auditSortKey(now) + "#" + hex.EncodeToString(suffix)
+	event.Time = now.Unix()
+
+	item, err := attributevalue.MarshalMap(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(ts)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+
+	return nil
+}
+
+// QueryAuditEvents returns up to q.Limit events, newest first. Filtering by actor or event
+// uses the matching index; otherwise each day in the range is read in turn.
+func QueryAuditEvents(client *dynamodb.Client, tableName string, q AuditQuery) ([]AuditEvent, error) {
+	lower := auditSortKey(q.From)
+	upper := auditSortKey(q.To) + "~"
+	if q.Before != "" && q.Before < upper {
+		upper = q.Before
+	}
+	if upper <= lower {
+		return nil, nil
+	}
+
+	switch {
+	case q.ActorID != "":
+		return queryAuditPartition(client, tableName, aws.String("actor-index"), "actorId", q.ActorID, q.Event, lower, upper, q.Limit)
+	case q.Event != "":
+		return queryAuditPartition(client, tableName, aws.String("event-index"), "event", q.Event, "", lower, upper, q.Limit)
+	}
+
+	var events []AuditEvent
+	first := q.From.UTC().Truncate(24 * time.Hour)
+	for day := q.To.UTC().Truncate(24 * time.Hour); !day.Before(first) && len(events) < q.Limit; day = day.AddDate(0, 0, -1) {
+		page, err := queryAuditPartition(client, tableName, nil, "day", day.Format(time.DateOnly), "", lower, upper, q.Limit-len(events))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+	}
+
+	return events, nil
+}
+
+// queryAuditPartition reads one partition of the table or an index newest first, keeping
+// sort keys in [lower, upper). The exclusive upper bound is what makes Before cursors work.
+func queryAuditPartition(client *dynamodb.Client, tableName string, indexName *string, keyName, keyValue, event, lower, upper string, limit int) ([]AuditEvent, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              indexName,
+		KeyConditionExpression: aws.String("#k = :k AND #ts BETWEEN :lower AND :upper"),
+		ExpressionAttributeNames: map[string]string{
+			"#k":  keyName,
+			"#ts": "ts",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k":     &types.AttributeValueMemberS{Value: keyValue},
+			":lower": &types.AttributeValueMemberS{Value: lower},
+			":upper": &types.AttributeValueMemberS{Value: upper},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if event != "" {
+		input.FilterExpression = aws.String("#event = :event")
+		input.ExpressionAttributeNames["#event"] = "event"
+		input.ExpressionAttributeValues[":event"] = &types.AttributeValueMemberS{Value: event}
+	}
+
+	var events []AuditEvent
+	for len(events) < limit {
+		out, err := client.Query(context.TODO(), input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query audit log: %w", err)
+		}
+
+		var page []AuditEvent
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit events: %w", err)
+		}
+		for _, e := range page {
+			if e.TS != upper && len(events) < limit {
+				events = append(events, e)
+			}
+		}
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return events, nil
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Erasure job states.
+const (
+	ErasurePending   = "pending"
+	ErasureRunning   = "running"
+	ErasureCompleted = "completed"
+	ErasureFailed    = "failed"
+)
+
+// ErasureJob tracks the deletion of an account and everything it owns. ID holds the hash
+// of the token handed to the user, since they can no longer sign in to check on it.
+type ErasureJob struct {
+	ID         string         `json:"-" dynamodbav:"id"`
+	UserID     string         `json:"userId" dynamodbav:"userId"`
+	Status     string         `json:"status" dynamodbav:"status"`
+	Deleted    map[string]int `json:"deleted" dynamodbav:"deleted"`
+	Errors     []string       `json:"errors,omitempty" dynamodbav:"errors,omitempty"`
+	CreatedAt  int64          `json:"createdAt" dynamodbav:"createdAt"`
+	FinishedAt int64          `json:"finishedAt,omitempty" dynamodbav:"finishedAt,omitempty"`
+	ExpiresAt  int64          `json:"-" dynamodbav:"expiresAt"`
+}
+
+func CreateErasureJobsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "ErasureJobs", "expiresAt")
+}
+
+// SaveErasureJob creates or overwrites the job record.
+func SaveErasureJob(client *dynamodb.Client, tableName string, job ErasureJob) error {
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal erasure job: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save erasure job: %w", err)
+	}
+
+	return nil
+}
+
+func GetErasureJob(client *dynamodb.Client, tableName, id string) (*ErasureJob, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get erasure job: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var job ErasureJob
+	if err := attributevalue.UnmarshalMap(out.Item, &job); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal erasure job: %w", err)
+	}
+
+	return &job, nil
+}
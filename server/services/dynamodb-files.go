@@ -7,17 +7,72 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// File states. Records written before states existed have none and count as active.
+const (
+	FilePending = "pending"
+	FileActive  = "active"
+)
+
+// File is the metadata record for an upload. Org is set when the file belongs to an
+// organization rather than only to the user who uploaded it. A pending file has been
+// reserved for a direct upload that has not been completed yet; it expires at ExpiresAt.
+type File struct {
+	ID          string `json:"id" dynamodbav:"id"`
+	FileName    string `json:"fileName" dynamodbav:"fileName"`
+	User        string `json:"user" dynamodbav:"user"`
+	Org         string `json:"org,omitempty" dynamodbav:"org,omitempty"`
+	Status      string `json:"status,omitempty" dynamodbav:"status,omitempty"`
+	Size        int64  `json:"size,omitempty" dynamodbav:"size,omitempty"`
+	Checksum    string `json:"-" dynamodbav:"checksum,omitempty"`
+	ContentType string `json:"-" dynamodbav:"contentType,omitempty"`
+	UploadID    string `json:"-" dynamodbav:"uploadId,omitempty"`
+	ExpiresAt   int64  `json:"-" dynamodbav:"expiresAt,omitempty"`
+	// ObjectKey is the blob holding the contents. Files uploaded before keys were stored
+	// per file have none and share uploads/<fileName> with any other file of that name.
+	ObjectKey string `json:"-" dynamodbav:"objectKey,omitempty"`
+}
+
+func (f File) Active() bool {
+	return f.Status == "" || f.Status == FileActive
+}
+
+// BlobKey is where the file's contents are stored.
+func (f File) BlobKey() string {
+	if f.ObjectKey != "" {
+		return f.ObjectKey
+	}
+	return "uploads/" + f.FileName
+}
+
+// orgIndex lets org members list the org's files.
+var orgIndex = types.GlobalSecondaryIndex{
+	IndexName: aws.String("org-index"),
+	KeySchema: []types.KeySchemaElement{
+		{
+			AttributeName: aws.String("org"),
+			KeyType:       types.KeyTypeHash,
+		},
+	},
+	Projection: &types.Projection{
+		ProjectionType: types.ProjectionTypeAll,
+	},
+}
+
 func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 
-	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+	desc, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
 	})
 	if err == nil {
-		return nil
+		if err := ensureFilesOrgIndex(client, tableName, desc.Table); err != nil {
+			return err
+		}
+		return ensureFilesTTL(client, tableName)
 	}
 
 	var notFound *types.ResourceNotFoundException
@@ -42,6 +97,10 @@ func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 				AttributeName: aws.String("user"),
 				AttributeType: types.ScalarAttributeTypeS,
 			},
+			{
+				AttributeName: aws.String("org"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
@@ -74,6 +133,7 @@ func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 					ProjectionType: types.ProjectionTypeAll, // include all attributes
 				},
 			},
+			orgIndex,
 		},
 		BillingMode: types.BillingModePayPerRequest,
 	})
@@ -89,32 +149,138 @@ func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 		return fmt.Errorf("failed waiting for Files table to become active: %w", err)
 	}
 
+	if err := ensureFilesTTL(client, tableName); err != nil {
+		return err
+	}
+
 	fmt.Println("Files table created and active.")
 	return nil
 }
 
-func CreateFile(client *dynamodb.Client, tableName, id, fileName, user string) error {
-	_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+// ensureFilesTTL turns on expiry of pending files for tables created before they existed.
+func ensureFilesTTL(client *dynamodb.Client, tableName string) error {
+	out, err := client.DescribeTimeToLive(context.TODO(), &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return fmt.Errorf("error checking Files TTL: %w", err)
+	}
+	if desc := out.TimeToLiveDescription; desc != nil && desc.TimeToLiveStatus != types.TimeToLiveStatusDisabled {
+		return nil
+	}
+
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
 		TableName: aws.String(tableName),
-		Item: map[string]types.AttributeValue{
-			"id":       &types.AttributeValueMemberS{Value: id},
-			"fileName": &types.AttributeValueMemberS{Value: fileName},
-			"user":     &types.AttributeValueMemberS{Value: user},
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
 		},
 	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on Files table: %w", err)
+	}
+
+	return nil
+}
+
+// ensureFilesOrgIndex adds the org-index to Files tables created before orgs existed.
+func ensureFilesOrgIndex(client *dynamodb.Client, tableName string, table *types.TableDescription) error {
+	for _, index := range table.GlobalSecondaryIndexes {
+		if aws.ToString(index.IndexName) == aws.ToString(orgIndex.IndexName) {
+			return nil
+		}
+	}
+
+	fmt.Println("Files table has no org-index — adding it now...")
+
+	_, err := client.UpdateTable(context.TODO(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("org"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  orgIndex.IndexName,
+					KeySchema:  orgIndex.KeySchema,
+					Projection: orgIndex.Projection,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add org-index to Files table: %w", err)
+	}
+
+	// The index backfills in the background; org file listings fill in once it is active.
+	fmt.Println("Files org-index is being created.")
+	return nil
+}
+
+// CreateFile records an upload. org may be empty for files owned only by the user.
+func CreateFile(client *dynamodb.Client, tableName, id, fileName, user, org string) error {
+	return PutFile(client, tableName, File{ID: id, FileName: fileName, User: user, Org: org})
+}
+
+// PutFile creates or overwrites a file record.
+func PutFile(client *dynamodb.Client, tableName string, file File) error {
+	item, err := attributevalue.MarshalMap(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to insert file: %w", err)
 	}
 
-	fmt.Println("File created:", id)
+	fmt.Println("File created:", file.ID)
 	return nil
 }
 
-func GetFile(client *dynamodb.Client, tableName, id string) (map[string]types.AttributeValue, error) {
+// ActivateFile marks a pending file as uploaded. It returns ErrInvalidToken if the file is
+// missing or not pending.
+func ActivateFile(client *dynamodb.Client, tableName, id string, size int64) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET #status = :active, #size = :size REMOVE expiresAt, uploadId"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+			"#size":   "size",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active":  &types.AttributeValueMemberS{Value: FileActive},
+			":pending": &types.AttributeValueMemberS{Value: FilePending},
+			":size":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", size)},
+		},
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("failed to activate file: %w", err)
+	}
+
+	return nil
+}
+
+// GetFile returns the file record, or nil if there is none.
+func GetFile(client *dynamodb.Client, tableName, id string) (*File, error) {
 	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
-			"fileId": &types.AttributeValueMemberS{Value: id},
+			"id": &types.AttributeValueMemberS{Value: id},
 		},
 	})
 	if err != nil {
@@ -122,20 +288,26 @@ func GetFile(client *dynamodb.Client, tableName, id string) (map[string]types.At
 	}
 
 	if out.Item == nil {
-		return nil, fmt.Errorf("file not found: %s", id)
+		return nil, nil
+	}
+
+	var file File
+	if err := attributevalue.UnmarshalMap(out.Item, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file: %w", err)
 	}
 
-	return out.Item, nil
+	return &file, nil
 }
 
 func UpdateFileName(client *dynamodb.Client, tableName, fileId, newFileName string) error {
 	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
-			"fileId": &types.AttributeValueMemberS{Value: fileId},
+			"id": &types.AttributeValueMemberS{Value: fileId},
 		},
 		UpdateExpression:          aws.String("SET fileName = :n"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{":n": &types.AttributeValueMemberS{Value: newFileName}},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
 		ReturnValues:              types.ReturnValueUpdatedNew,
 	})
 	if err != nil {
@@ -150,7 +322,7 @@ func DeleteFile(client *dynamodb.Client, tableName, fileId string) error {
 	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
-			"fileId": &types.AttributeValueMemberS{Value: fileId},
+			"id": &types.AttributeValueMemberS{Value: fileId},
 		},
 	})
 	if err != nil {
@@ -171,3 +343,103 @@ func ListFiles(client *dynamodb.Client, tableName string) ([]map[string]types.At
 
 	return out.Items, nil
 }
+
+// ListLegacyFilesByName finds files named fileName that are stored at the shared
+// uploads/<fileName> key rather than a key of their own.
+func ListLegacyFilesByName(client *dynamodb.Client, tableName, fileName string) ([]File, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(tableName),
+		FilterExpression: aws.String("fileName = :n AND attribute_not_exists(objectKey)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n": &types.AttributeValueMemberS{Value: fileName},
+		},
+	}
+
+	var files []File
+	for {
+		out, err := client.Scan(context.TODO(), input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+
+		var page []File
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal files: %w", err)
+		}
+		files = append(files, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return files, nil
+}
+
+// DisownFile removes the uploader from a file, leaving it to its org.
+func DisownFile(client *dynamodb.Client, tableName, fileId string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: fileId},
+		},
+		UpdateExpression:         aws.String("REMOVE #u"),
+		ConditionExpression:      aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames: map[string]string{"#u": "user"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disown file: %w", err)
+	}
+
+	return nil
+}
+
+func ListFilesByUser(client *dynamodb.Client, tableName, user string) ([]File, error) {
+	return queryFiles(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("user-index"),
+		KeyConditionExpression: aws.String("#u = :u"),
+		ExpressionAttributeNames: map[string]string{
+			"#u": "user",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":u": &types.AttributeValueMemberS{Value: user},
+		},
+	})
+}
+
+func ListFilesByOrg(client *dynamodb.Client, tableName, org string) ([]File, error) {
+	return queryFiles(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              orgIndex.IndexName,
+		KeyConditionExpression: aws.String("org = :o"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":o": &types.AttributeValueMemberS{Value: org},
+		},
+	})
+}
+
+func queryFiles(client *dynamodb.Client, input *dynamodb.QueryInput) ([]File, error) {
+	var files []File
+
+	for {
+		out, err := client.Query(context.TODO(), input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+
+		var page []File
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal files: %w", err)
+		}
+		files = append(files, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return files, nil
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// InviteCode allows registration while REGISTRATION_MODE=invite. The code handed out is
+// "<id>.<secret>"; only a hash of the secret is stored.
+type InviteCode struct {
+	ID         string `json:"id" dynamodbav:"id"`
+	SecretHash string `json:"-" dynamodbav:"secretHash"`
+	Role       string `json:"role" dynamodbav:"role"`
+	MaxUses    int    `json:"maxUses" dynamodbav:"maxUses"`
+	Uses       int    `json:"uses" dynamodbav:"uses"`
+	Email      string `json:"email,omitempty" dynamodbav:"email,omitempty"`
+	CreatedBy  string `json:"createdBy" dynamodbav:"createdBy"`
+	CreatedAt  int64  `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt  int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+func CreateInviteCodesTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "InviteCodes", "expiresAt")
+}
+
+func CreateInviteCode(client *dynamodb.Client, tableName string, code InviteCode) error {
+	item, err := attributevalue.MarshalMap(code)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invite code: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create invite code: %w", err)
+	}
+
+	return nil
+}
+
+func ListInviteCodes(client *dynamodb.Client, tableName string) ([]InviteCode, error) {
+	var codes []InviteCode
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := client.Scan(context.TODO(), &dynamodb.ScanInput{
+			TableName:         aws.String(tableName),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list invite codes: %w", err)
+		}
+
+		var page []InviteCode
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal invite codes: %w", err)
+		}
+		codes = append(codes, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	return codes, nil
+}
+
+func DeleteInviteCode(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("failed to delete invite code: %w", err)
+	}
+
+	return nil
+}
+
+// RedeemInviteCode uses up one use of the code, atomically checking the secret, expiry,
+// remaining uses and, for codes issued to an address, the registering email. It returns
+// ErrInvalidToken if the code can't be used.
+func RedeemInviteCode(client *dynamodb.Client, tableName, id, secretHash, email string) (*InviteCode, error) {
+	out, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("ADD uses :one"),
+		ConditionExpression: aws.String("secretHash = :h AND expiresAt > :now AND uses < maxUses AND (attribute_not_exists(email) OR email = :e)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":h":   &types.AttributeValueMemberS{Value: secretHash},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+			":e":   &types.AttributeValueMemberS{Value: email},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to redeem invite code: %w", err)
+	}
+
+	var code InviteCode
+	if err := attributevalue.UnmarshalMap(out.Attributes, &code); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal invite code: %w", err)
+	}
+
+	return &code, nil
+}
+
+// ReleaseInviteCode gives back a use taken by RedeemInviteCode when registration fails.
+func ReleaseInviteCode(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("ADD uses :minus"),
+		ConditionExpression: aws.String("uses > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minus": &types.AttributeValueMemberN{Value: "-1"},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release invite code: %w", err)
+	}
+
+	return nil
+}
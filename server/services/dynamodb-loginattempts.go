@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// LoginAttempt counts recent failed sign-ins for one key, either "account:<email>" or
+// "ip:<address>". Records expire on their own once the window passes without failures.
+type LoginAttempt struct {
+	ID          string `json:"id" dynamodbav:"id"`
+	Failures    int    `json:"failures" dynamodbav:"failures"`
+	LockedUntil int64  `json:"lockedUntil,omitempty" dynamodbav:"lockedUntil,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+func CreateLoginAttemptsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "LoginAttempts", "expiresAt")
+}
+
+func GetLoginAttempt(client *dynamodb.Client, tableName, id string) (*LoginAttempt, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login attempts: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var attempt LoginAttempt
+	if err := attributevalue.UnmarshalMap(out.Item, &attempt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal login attempts: %w", err)
+	}
+
+	return &attempt, nil
+}
+
+// RecordLoginFailure atomically increments the failure count for id and returns the new record.
+func RecordLoginFailure(client *dynamodb.Client, tableName, id string, window time.Duration) (*LoginAttempt, error) {
+	out, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("ADD failures :one SET expiresAt = :exp"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":exp": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Add(window).Unix())},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record login failure: %w", err)
+	}
+
+	var attempt LoginAttempt
+	if err := attributevalue.UnmarshalMap(out.Attributes, &attempt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal login attempts: %w", err)
+	}
+
+	return &attempt, nil
+}
+
+func LockLoginAttempts(client *dynamodb.Client, tableName, id string, until time.Time) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET lockedUntil = :until"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", until.Unix())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lock login: %w", err)
+	}
+
+	return nil
+}
+
+func ClearLoginAttempts(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear login attempts: %w", err)
+	}
+
+	return nil
+}
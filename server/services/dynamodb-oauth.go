@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// OAuthClient is an application registered to sign users in through the OIDC provider.
+// Public clients (SPAs, mobile apps) have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	ID           string   `json:"id" dynamodbav:"id"`
+	Name         string   `json:"name" dynamodbav:"name"`
+	SecretHash   string   `json:"-" dynamodbav:"secretHash,omitempty"`
+	RedirectURIs []string `json:"redirectUris" dynamodbav:"redirectUris"`
+	CreatedBy    string   `json:"createdBy" dynamodbav:"createdBy"`
+	CreatedAt    int64    `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// AuthCode is a pending authorization code. ID holds the hash of the code.
+type AuthCode struct {
+	ID            string `dynamodbav:"id"`
+	ClientID      string `dynamodbav:"clientId"`
+	UserID        string `dynamodbav:"userId"`
+	RedirectURI   string `dynamodbav:"redirectUri"`
+	Scope         string `dynamodbav:"scope"`
+	Nonce         string `dynamodbav:"nonce,omitempty"`
+	CodeChallenge string `dynamodbav:"codeChallenge"`
+	AuthTime      int64  `dynamodbav:"authTime"`
+	ExpiresAt     int64  `dynamodbav:"expiresAt"`
+}
+
+func createSimpleTable(client *dynamodb.Client, tableName, label, ttlAttribute string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Printf("%s table not found — creating now...\n", label)
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("id"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create %s table: %w", label, err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for %s table to become active: %w", label, err)
+	}
+
+	if ttlAttribute != "" {
+		_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(tableName),
+			TimeToLiveSpecification: &types.TimeToLiveSpecification{
+				AttributeName: aws.String(ttlAttribute),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable TTL on %s table: %w", label, err)
+		}
+	}
+
+	fmt.Printf("%s table created and active.\n", label)
+	return nil
+}
+
+func CreateOAuthClientsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "OAuthClients", "")
+}
+
+func CreateOAuthCodesTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "OAuthCodes", "expiresAt")
+}
+
+func CreateOAuthClient(client *dynamodb.Client, tableName string, oauthClient OAuthClient) error {
+	item, err := attributevalue.MarshalMap(oauthClient)
+	if err != nil {
+		return fmt.Errorf("failed to marshal client: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+
+	return nil
+}
+
+func GetOAuthClient(client *dynamodb.Client, tableName, id string) (*OAuthClient, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var oauthClient OAuthClient
+	if err := attributevalue.UnmarshalMap(out.Item, &oauthClient); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal client: %w", err)
+	}
+
+	return &oauthClient, nil
+}
+
+func CreateAuthCode(client *dynamodb.Client, tableName string, code AuthCode) error {
+	item, err := attributevalue.MarshalMap(code)
+	if err != nil {
+		return fmt.Errorf("failed to marshal authorization code: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store authorization code: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeAuthCode deletes the code and returns what was stored, so each code can only be
+// exchanged once. It returns ErrInvalidToken if the code is unknown or expired.
+func ConsumeAuthCode(client *dynamodb.Client, tableName, id string) (*AuthCode, error) {
+	out, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to consume authorization code: %w", err)
+	}
+
+	var code AuthCode
+	if err := attributevalue.UnmarshalMap(out.Attributes, &code); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal authorization code: %w", err)
+	}
+	if code.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidToken
+	}
+
+	return &code, nil
+}
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Roles within an organization, from most to least privileged.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+	OrgRoleViewer = "viewer"
+)
+
+// OrgRoleRank orders org roles so they can be compared; unknown roles rank 0.
+func OrgRoleRank(role string) int {
+	switch role {
+	case OrgRoleOwner:
+		return 4
+	case OrgRoleAdmin:
+		return 3
+	case OrgRoleMember:
+		return 2
+	case OrgRoleViewer:
+		return 1
+	}
+	return 0
+}
+
+type Org struct {
+	ID        string `json:"id" dynamodbav:"id"`
+	Name      string `json:"name" dynamodbav:"name"`
+	CreatedBy string `json:"createdBy" dynamodbav:"createdBy"`
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// OrgMember is keyed on (orgId, userId) with a user-index GSI to list a user's orgs.
+type OrgMember struct {
+	OrgID    string `json:"orgId" dynamodbav:"orgId"`
+	UserID   string `json:"userId" dynamodbav:"userId"`
+	Role     string `json:"role" dynamodbav:"role"`
+	JoinedAt int64  `json:"joinedAt" dynamodbav:"joinedAt"`
+}
+
+// OrgInvite is a pending email invitation. ID holds the hash of the invite token.
+type OrgInvite struct {
+	ID        string `dynamodbav:"id"`
+	OrgID     string `dynamodbav:"orgId"`
+	Email     string `dynamodbav:"email"`
+	Role      string `dynamodbav:"role"`
+	InvitedBy string `dynamodbav:"invitedBy"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+}
+
+func CreateOrgsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "Orgs", "")
+}
+
+func CreateOrgInvitesTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "OrgInvites", "expiresAt")
+}
+
+func CreateOrgMembersTable(client *dynamodb.Client, tableName string) error {
+
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("OrgMembers table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("orgId"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("userId"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("orgId"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("userId"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("user-index"),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("userId"),
+						KeyType:       types.KeyTypeHash,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create OrgMembers table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for OrgMembers table to become active: %w", err)
+	}
+
+	fmt.Println("OrgMembers table created and active.")
+	return nil
+}
+
+func CreateOrg(client *dynamodb.Client, tableName string, org Org) error {
+	item, err := attributevalue.MarshalMap(org)
+	if err != nil {
+		return fmt.Errorf("failed to marshal org: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create org: %w", err)
+	}
+
+	return nil
+}
+
+func GetOrg(client *dynamodb.Client, tableName, id string) (*Org, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get org: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var org Org
+	if err := attributevalue.UnmarshalMap(out.Item, &org); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal org: %w", err)
+	}
+
+	return &org, nil
+}
+
+func ListOrgs(client *dynamodb.Client, tableName string) ([]Org, error) {
+	var orgs []Org
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := client.Scan(context.TODO(), &dynamodb.ScanInput{
+			TableName:         aws.String(tableName),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list orgs: %w", err)
+		}
+
+		var page []Org
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal orgs: %w", err)
+		}
+		orgs = append(orgs, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	return orgs, nil
+}
+
+func RenameOrg(client *dynamodb.Client, tableName, id, name string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:          aws.String("SET #n = :n"),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames:  map[string]string{"#n": "name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":n": &types.AttributeValueMemberS{Value: name}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename org: %w", err)
+	}
+
+	return nil
+}
+
+func DeleteOrg(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete org: %w", err)
+	}
+
+	return nil
+}
+
+// PutOrgMember adds a member or changes their role.
+func PutOrgMember(client *dynamodb.Client, tableName string, member OrgMember) error {
+	item, err := attributevalue.MarshalMap(member)
+	if err != nil {
+		return fmt.Errorf("failed to marshal org member: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save org member: %w", err)
+	}
+
+	return nil
+}
+
+func GetOrgMember(client *dynamodb.Client, tableName, orgID, userID string) (*OrgMember, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"orgId":  &types.AttributeValueMemberS{Value: orgID},
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get org member: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var member OrgMember
+	if err := attributevalue.UnmarshalMap(out.Item, &member); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal org member: %w", err)
+	}
+
+	return &member, nil
+}
+
+func ListOrgMembers(client *dynamodb.Client, tableName, orgID string) ([]OrgMember, error) {
+	return queryOrgMembers(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("orgId = :o"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":o": &types.AttributeValueMemberS{Value: orgID},
+		},
+	})
+}
+
+// ListUserOrgs returns every membership the user holds.
+func ListUserOrgs(client *dynamodb.Client, tableName, userID string) ([]OrgMember, error) {
+	return queryOrgMembers(client, &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("user-index"),
+		KeyConditionExpression: aws.String("userId = :u"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":u": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+}
+
+func queryOrgMembers(client *dynamodb.Client, input *dynamodb.QueryInput) ([]OrgMember, error) {
+	var members []OrgMember
+
+	for {
+		out, err := client.Query(context.TODO(), input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list org members: %w", err)
+		}
+
+		var page []OrgMember
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal org members: %w", err)
+		}
+		members = append(members, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return members, nil
+}
+
+func DeleteOrgMember(client *dynamodb.Client, tableName, orgID, userID string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"orgId":  &types.AttributeValueMemberS{Value: orgID},
+			"userId": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete org member: %w", err)
+	}
+
+	return nil
+}
+
+func CreateOrgInvite(client *dynamodb.Client, tableName string, invite OrgInvite) error {
+	item, err := attributevalue.MarshalMap(invite)
+	if err != nil {
+		return fmt.Errorf("failed to marshal org invite: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create org invite: %w", err)
+	}
+
+	return nil
+}
+
+// GetOrgInvite returns the invite without using it up, or nil if it is unknown or expired.
+func GetOrgInvite(client *dynamodb.Client, tableName, id string) (*OrgInvite, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get org invite: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var invite OrgInvite
+	if err := attributevalue.UnmarshalMap(out.Item, &invite); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal org invite: %w", err)
+	}
+	if invite.ExpiresAt <= time.Now().Unix() {
+		return nil, nil
+	}
+
+	return &invite, nil
+}
+
+// ConsumeOrgInvite deletes the invite, returning ErrInvalidToken if it was already used.
+func ConsumeOrgInvite(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("failed to consume org invite: %w", err)
+	}
+
+	return nil
+}
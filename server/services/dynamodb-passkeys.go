@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Passkey is a registered WebAuthn credential. ID is the base64url credential ID and
+// Credential holds the JSON-encoded credential record (public key, sign count, flags).
+type Passkey struct {
+	ID         string `json:"id" dynamodbav:"id"`
+	UserID     string `json:"userId" dynamodbav:"userId"`
+	Name       string `json:"name" dynamodbav:"name"`
+	Credential string `json:"-" dynamodbav:"credential"`
+	CreatedAt  int64  `json:"createdAt" dynamodbav:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt,omitempty" dynamodbav:"lastUsedAt,omitempty"`
+}
+
+// WebAuthnSession holds the challenge for a registration or login ceremony between its
+// begin and finish requests. Data is the JSON-encoded session data.
+type WebAuthnSession struct {
+	ID        string `dynamodbav:"id"`
+	Ceremony  string `dynamodbav:"ceremony"`
+	UserID    string `dynamodbav:"userId,omitempty"`
+	Data      string `dynamodbav:"data"`
+	ExpiresAt int64  `dynamodbav:"expiresAt"`
+}
+
+func CreatePasskeysTable(client *dynamodb.Client, tableName string) error {
+	return createUserIndexedTable(client, tableName, "Passkeys")
+}
+
+func CreateWebAuthnSessionsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "WebAuthnSessions", "expiresAt")
+}
+
+func CreatePasskey(client *dynamodb.Client, tableName string, passkey Passkey) error {
+	item, err := attributevalue.MarshalMap(passkey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal passkey: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create passkey: %w", err)
+	}
+
+	return nil
+}
+
+func GetPasskey(client *dynamodb.Client, tableName, id string) (*Passkey, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get passkey: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var passkey Passkey
+	if err := attributevalue.UnmarshalMap(out.Item, &passkey); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal passkey: %w", err)
+	}
+
+	return &passkey, nil
+}
+
+func ListPasskeysByUser(client *dynamodb.Client, tableName, userID string) ([]Passkey, error) {
+	var passkeys []Passkey
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := client.Query(context.TODO(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("user-index"),
+			KeyConditionExpression: aws.String("userId = :u"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":u": &types.AttributeValueMemberS{Value: userID},
+			},
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list passkeys: %w", err)
+		}
+
+		var page []Passkey
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal passkeys: %w", err)
+		}
+		passkeys = append(passkeys, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	return passkeys, nil
+}
+
+// UpdatePasskeyCredential stores the credential record after a login (the sign count changes).
+func UpdatePasskeyCredential(client *dynamodb.Client, tableName, id, credential string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET credential = :c, lastUsedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":c":   &types.AttributeValueMemberS{Value: credential},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePasskey only deletes the passkey if it belongs to userID; it returns ErrInvalidToken otherwise.
+func DeletePasskey(client *dynamodb.Client, tableName, id, userID string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("userId = :u"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":u": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+
+	return nil
+}
+
+func CreateWebAuthnSession(client *dynamodb.Client, tableName string, session WebAuthnSession) error {
+	item, err := attributevalue.MarshalMap(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WebAuthn session: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create WebAuthn session: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeWebAuthnSession deletes and returns the ceremony session, so each challenge is answered once.
+func ConsumeWebAuthnSession(client *dynamodb.Client, tableName, id string) (*WebAuthnSession, error) {
+	out, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to consume WebAuthn session: %w", err)
+	}
+
+	var session WebAuthnSession
+	if err := attributevalue.UnmarshalMap(out.Attributes, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal WebAuthn session: %w", err)
+	}
+	if session.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidToken
+	}
+
+	return &session, nil
+}
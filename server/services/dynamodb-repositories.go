@@ -0,0 +1,502 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// DynamoUserRepository is a UserRepository backed by a DynamoDB table.
+type DynamoUserRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoUserRepository(client *dynamodb.Client, tableName string) *DynamoUserRepository {
+	return &DynamoUserRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoUserRepository) Create(user User) error {
+	item, err := attributevalue.MarshalMap(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user: %w", err)
+	}
+	return CreateUser(r.client, r.tableName, item)
+}
+
+func (r *DynamoUserRepository) Get(id string) (*User, error) {
+	item, err := GetUserById(r.client, r.tableName, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(item, &user); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user: %w", err)
+	}
+	return &user, nil
+}
+
+func (r *DynamoUserRepository) GetByEmail(email string) (*User, error) {
+	return GetUserByEmail(r.client, r.tableName, email)
+}
+
+func (r *DynamoUserRepository) List() ([]User, error) {
+	items, err := GetAllUsers(r.client, r.tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	var users []User
+	if err := attributevalue.UnmarshalListOfMaps(items, &users); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal users: %w", err)
+	}
+	return users, nil
+}
+
+func (r *DynamoUserRepository) Update(user User) error {
+	return UpdateUser(r.client, r.tableName, user)
+}
+
+func (r *DynamoUserRepository) UpdatePassword(id, passwordHash string) error {
+	return UpdatePassword(r.client, r.tableName, User{ID: id, Password: passwordHash})
+}
+
+func (r *DynamoUserRepository) Delete(id string) error {
+	return DeleteUser(r.client, r.tableName, id)
+}
+
+func (r *DynamoUserRepository) SetAttributes(id string, attrs map[string]interface{}) error {
+	return SetUserAttributes(r.client, r.tableName, id, attrs)
+}
+
+func (r *DynamoUserRepository) ReplacePasswordHash(id, oldHash, newHash string) error {
+	return ReplacePasswordHash(r.client, r.tableName, id, oldHash, newHash)
+}
+
+func (r *DynamoUserRepository) ConsumeToken(id, hashAttr, expiresAttr, tokenHash string) error {
+	return ConsumeUserToken(r.client, r.tableName, id, hashAttr, expiresAttr, tokenHash)
+}
+
+func (r *DynamoUserRepository) EnableTOTP(id, secret string, counter int64, recoveryHashes []string) error {
+	return EnableTOTP(r.client, r.tableName, id, secret, counter, recoveryHashes)
+}
+
+func (r *DynamoUserRepository) DisableTOTP(id string) error {
+	return DisableTOTP(r.client, r.tableName, id)
+}
+
+func (r *DynamoUserRepository) RecordTOTPCounter(id string, counter int64) error {
+	return RecordTOTPCounter(r.client, r.tableName, id, counter)
+}
+
+func (r *DynamoUserRepository) ConsumeRecoveryCode(id, codeHash string) error {
+	return ConsumeRecoveryCode(r.client, r.tableName, id, codeHash)
+}
+
+// DynamoFileRepository is a FileRepository backed by a DynamoDB table.
+type DynamoFileRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoFileRepository(client *dynamodb.Client, tableName string) *DynamoFileRepository {
+	return &DynamoFileRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoFileRepository) Create(file File) error {
+	return PutFile(r.client, r.tableName, file)
+}
+
+func (r *DynamoFileRepository) Get(id string) (*File, error) {
+	return GetFile(r.client, r.tableName, id)
+}
+
+func (r *DynamoFileRepository) Rename(id, fileName string) error {
+	return UpdateFileName(r.client, r.tableName, id, fileName)
+}
+
+func (r *DynamoFileRepository) Activate(id string, size int64) error {
+	return ActivateFile(r.client, r.tableName, id, size)
+}
+
+func (r *DynamoFileRepository) Disown(id string) error {
+	return DisownFile(r.client, r.tableName, id)
+}
+
+func (r *DynamoFileRepository) Delete(id string) error {
+	return DeleteFile(r.client, r.tableName, id)
+}
+
+func (r *DynamoFileRepository) List() ([]File, error) {
+	items, err := ListFiles(r.client, r.tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	if err := attributevalue.UnmarshalListOfMaps(items, &files); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal files: %w", err)
+	}
+	return files, nil
+}
+
+func (r *DynamoFileRepository) ListByUser(user string) ([]File, error) {
+	return ListFilesByUser(r.client, r.tableName, user)
+}
+
+func (r *DynamoFileRepository) ListByOrg(org string) ([]File, error) {
+	return ListFilesByOrg(r.client, r.tableName, org)
+}
+
+func (r *DynamoFileRepository) ListLegacyByName(fileName string) ([]File, error) {
+	return ListLegacyFilesByName(r.client, r.tableName, fileName)
+}
+
+// DynamoPostRepository is a PostRepository backed by a DynamoDB table.
+type DynamoPostRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoPostRepository(client *dynamodb.Client, tableName string) *DynamoPostRepository {
+	return &DynamoPostRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoPostRepository) Create(post BlogPost) error {
+	item, err := attributevalue.MarshalMap(post)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blog post: %w", err)
+	}
+	return CreateBlogPost(r.client, r.tableName, item)
+}
+
+func (r *DynamoPostRepository) List() ([]BlogPost, error) {
+	items, err := GetAllBlogPosts(r.client, r.tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blog posts: %w", err)
+	}
+
+	var posts []BlogPost
+	if err := attributevalue.UnmarshalListOfMaps(items, &posts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blog posts: %w", err)
+	}
+	return posts, nil
+}
+
+func (r *DynamoPostRepository) ListByAuthor(author string) ([]BlogPost, error) {
+	return GetBlogPostByAuthor(r.client, r.tableName, author)
+}
+
+func (r *DynamoPostRepository) Update(post BlogPost) error {
+	return UpdateBlogPost(r.client, r.tableName, post)
+}
+
+func (r *DynamoPostRepository) Delete(id string) error {
+	return DeleteBlogPost(r.client, r.tableName, id)
+}
+
+// DynamoSessionRepository is a SessionRepository backed by a DynamoDB table.
+type DynamoSessionRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoSessionRepository(client *dynamodb.Client, tableName string) *DynamoSessionRepository {
+	return &DynamoSessionRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoSessionRepository) Create(session Session) error {
+	return CreateSession(r.client, r.tableName, session)
+}
+
+func (r *DynamoSessionRepository) Get(id string) (*Session, error) {
+	return GetSession(r.client, r.tableName, id)
+}
+
+func (r *DynamoSessionRepository) ListByUser(userID string) ([]Session, error) {
+	return ListSessionsByUser(r.client, r.tableName, userID)
+}
+
+func (r *DynamoSessionRepository) Rotate(id, oldToken, newToken, ip string, expiresAt int64) error {
+	return RotateSession(r.client, r.tableName, id, oldToken, newToken, ip, expiresAt)
+}
+
+func (r *DynamoSessionRepository) Revoke(id string) error {
+	return RevokeSession(r.client, r.tableName, id)
+}
+
+func (r *DynamoSessionRepository) Delete(id string) error {
+	return DeleteSession(r.client, r.tableName, id)
+}
+
+// DynamoAuditRepository is an AuditRepository backed by a DynamoDB table.
+type DynamoAuditRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoAuditRepository(client *dynamodb.Client, tableName string) *DynamoAuditRepository {
+	return &DynamoAuditRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoAuditRepository) Put(event AuditEvent) error {
+	return PutAuditEvent(r.client, r.tableName, event)
+}
+
+// DynamoOrgMemberRepository is an OrgMemberRepository backed by a DynamoDB table.
+type DynamoOrgMemberRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoOrgMemberRepository(client *dynamodb.Client, tableName string) *DynamoOrgMemberRepository {
+	return &DynamoOrgMemberRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoOrgMemberRepository) Put(member OrgMember) error {
+	return PutOrgMember(r.client, r.tableName, member)
+}
+
+func (r *DynamoOrgMemberRepository) Get(orgID, userID string) (*OrgMember, error) {
+	return GetOrgMember(r.client, r.tableName, orgID, userID)
+}
+
+func (r *DynamoOrgMemberRepository) ListByOrg(orgID string) ([]OrgMember, error) {
+	return ListOrgMembers(r.client, r.tableName, orgID)
+}
+
+func (r *DynamoOrgMemberRepository) ListByUser(userID string) ([]OrgMember, error) {
+	return ListUserOrgs(r.client, r.tableName, userID)
+}
+
+func (r *DynamoOrgMemberRepository) Delete(orgID, userID string) error {
+	return DeleteOrgMember(r.client, r.tableName, orgID, userID)
+}
+
+// DynamoLoginAttemptRepository is a LoginAttemptRepository backed by a DynamoDB table.
+type DynamoLoginAttemptRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoLoginAttemptRepository(client *dynamodb.Client, tableName string) *DynamoLoginAttemptRepository {
+	return &DynamoLoginAttemptRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoLoginAttemptRepository) Get(id string) (*LoginAttempt, error) {
+	return GetLoginAttempt(r.client, r.tableName, id)
+}
+
+func (r *DynamoLoginAttemptRepository) RecordFailure(id string, window time.Duration) (*LoginAttempt, error) {
+	return RecordLoginFailure(r.client, r.tableName, id, window)
+}
+
+func (r *DynamoLoginAttemptRepository) Lock(id string, until time.Time) error {
+	return LockLoginAttempts(r.client, r.tableName, id, until)
+}
+
+func (r *DynamoLoginAttemptRepository) Clear(id string) error {
+	return ClearLoginAttempts(r.client, r.tableName, id)
+}
+
+// DynamoOAuthClientRepository is an OAuthClientRepository backed by a DynamoDB table.
+type DynamoOAuthClientRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoOAuthClientRepository(client *dynamodb.Client, tableName string) *DynamoOAuthClientRepository {
+	return &DynamoOAuthClientRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoOAuthClientRepository) Create(oauthClient OAuthClient) error {
+	return CreateOAuthClient(r.client, r.tableName, oauthClient)
+}
+
+func (r *DynamoOAuthClientRepository) Get(id string) (*OAuthClient, error) {
+	return GetOAuthClient(r.client, r.tableName, id)
+}
+
+// DynamoAuthCodeRepository is an AuthCodeRepository backed by a DynamoDB table.
+type DynamoAuthCodeRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoAuthCodeRepository(client *dynamodb.Client, tableName string) *DynamoAuthCodeRepository {
+	return &DynamoAuthCodeRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoAuthCodeRepository) Create(code AuthCode) error {
+	return CreateAuthCode(r.client, r.tableName, code)
+}
+
+func (r *DynamoAuthCodeRepository) Consume(id string) (*AuthCode, error) {
+	return ConsumeAuthCode(r.client, r.tableName, id)
+}
+
+// DynamoPasskeyRepository is a PasskeyRepository backed by a DynamoDB table.
+type DynamoPasskeyRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoPasskeyRepository(client *dynamodb.Client, tableName string) *DynamoPasskeyRepository {
+	return &DynamoPasskeyRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoPasskeyRepository) Create(passkey Passkey) error {
+	return CreatePasskey(r.client, r.tableName, passkey)
+}
+
+func (r *DynamoPasskeyRepository) Get(id string) (*Passkey, error) {
+	return GetPasskey(r.client, r.tableName, id)
+}
+
+func (r *DynamoPasskeyRepository) ListByUser(userID string) ([]Passkey, error) {
+	return ListPasskeysByUser(r.client, r.tableName, userID)
+}
+
+func (r *DynamoPasskeyRepository) UpdateCredential(id, credential string) error {
+	return UpdatePasskeyCredential(r.client, r.tableName, id, credential)
+}
+
+func (r *DynamoPasskeyRepository) Delete(id, userID string) error {
+	return DeletePasskey(r.client, r.tableName, id, userID)
+}
+
+// DynamoWebAuthnSessionRepository is a WebAuthnSessionRepository backed by a DynamoDB table.
+type DynamoWebAuthnSessionRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoWebAuthnSessionRepository(client *dynamodb.Client, tableName string) *DynamoWebAuthnSessionRepository {
+	return &DynamoWebAuthnSessionRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoWebAuthnSessionRepository) Create(session WebAuthnSession) error {
+	return CreateWebAuthnSession(r.client, r.tableName, session)
+}
+
+func (r *DynamoWebAuthnSessionRepository) Consume(id string) (*WebAuthnSession, error) {
+	return ConsumeWebAuthnSession(r.client, r.tableName, id)
+}
+
+// DynamoAPIKeyRepository is an APIKeyRepository backed by a DynamoDB table.
+type DynamoAPIKeyRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoAPIKeyRepository(client *dynamodb.Client, tableName string) *DynamoAPIKeyRepository {
+	return &DynamoAPIKeyRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoAPIKeyRepository) Create(key APIKey) error {
+	return CreateAPIKey(r.client, r.tableName, key)
+}
+
+func (r *DynamoAPIKeyRepository) Get(id string) (*APIKey, error) {
+	return GetAPIKey(r.client, r.tableName, id)
+}
+
+func (r *DynamoAPIKeyRepository) ListByUser(userID string) ([]APIKey, error) {
+	return ListAPIKeysByUser(r.client, r.tableName, userID)
+}
+
+func (r *DynamoAPIKeyRepository) Touch(id string) error {
+	return TouchAPIKey(r.client, r.tableName, id)
+}
+
+func (r *DynamoAPIKeyRepository) Delete(id, userID string) error {
+	return DeleteAPIKey(r.client, r.tableName, id, userID)
+}
+
+// DynamoInviteCodeRepository is an InviteCodeRepository backed by a DynamoDB table.
+type DynamoInviteCodeRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoInviteCodeRepository(client *dynamodb.Client, tableName string) *DynamoInviteCodeRepository {
+	return &DynamoInviteCodeRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoInviteCodeRepository) Create(code InviteCode) error {
+	return CreateInviteCode(r.client, r.tableName, code)
+}
+
+func (r *DynamoInviteCodeRepository) List() ([]InviteCode, error) {
+	return ListInviteCodes(r.client, r.tableName)
+}
+
+func (r *DynamoInviteCodeRepository) Delete(id string) error {
+	return DeleteInviteCode(r.client, r.tableName, id)
+}
+
+func (r *DynamoInviteCodeRepository) Redeem(id, secretHash, email string) (*InviteCode, error) {
+	return RedeemInviteCode(r.client, r.tableName, id, secretHash, email)
+}
+
+func (r *DynamoInviteCodeRepository) Release(id string) error {
+	return ReleaseInviteCode(r.client, r.tableName, id)
+}
+
+// DynamoErasureJobRepository is an ErasureJobRepository backed by a DynamoDB table.
+type DynamoErasureJobRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoErasureJobRepository(client *dynamodb.Client, tableName string) *DynamoErasureJobRepository {
+	return &DynamoErasureJobRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoErasureJobRepository) Save(job ErasureJob) error {
+	return SaveErasureJob(r.client, r.tableName, job)
+}
+
+func (r *DynamoErasureJobRepository) Get(id string) (*ErasureJob, error) {
+	return GetErasureJob(r.client, r.tableName, id)
+}
+
+// DynamoTusUploadRepository is a TusUploadRepository backed by a DynamoDB table.
+type DynamoTusUploadRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoTusUploadRepository(client *dynamodb.Client, tableName string) *DynamoTusUploadRepository {
+	return &DynamoTusUploadRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoTusUploadRepository) Create(upload TusUpload) error {
+	return CreateTusUpload(r.client, r.tableName, upload)
+}
+
+func (r *DynamoTusUploadRepository) Get(id string) (*TusUpload, error) {
+	return GetTusUpload(r.client, r.tableName, id)
+}
+
+func (r *DynamoTusUploadRepository) Lock(id string, offset int64, token string, until time.Time) error {
+	return LockTusUpload(r.client, r.tableName, id, offset, token, until)
+}
+
+func (r *DynamoTusUploadRepository) RenewLock(id, token string, until time.Time) error {
+	return RenewTusUploadLock(r.client, r.tableName, id, token, until)
+}
+
+func (r *DynamoTusUploadRepository) SaveProgress(upload TusUpload, token string) error {
+	return SaveTusUploadProgress(r.client, r.tableName, upload, token)
+}
+
+func (r *DynamoTusUploadRepository) Delete(id string) error {
+	return DeleteTusUpload(r.client, r.tableName, id)
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Session is one login. Its ID doubles as the refresh token family ID: every rotated
+// refresh token carries it, and only the token recorded in CurrentToken may be redeemed.
+type Session struct {
+	ID           string `json:"id" dynamodbav:"id"`
+	UserID       string `json:"userId" dynamodbav:"userId"`
+	CurrentToken string `json:"-" dynamodbav:"currentToken"`
+	UserAgent    string `json:"userAgent" dynamodbav:"userAgent"`
+	IP           string `json:"ip" dynamodbav:"ip"`
+	Revoked      bool   `json:"revoked" dynamodbav:"revoked"`
+	CreatedAt    int64  `json:"createdAt" dynamodbav:"createdAt"`
+	LastUsedAt   int64  `json:"lastUsedAt" dynamodbav:"lastUsedAt"`
+	ExpiresAt    int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+	// ClientID and Scope are set on sessions started for an OAuth client through the OIDC
+	// provider, and empty on the app's own sign-ins.
+	ClientID string `json:"clientId,omitempty" dynamodbav:"clientId,omitempty"`
+	Scope    string `json:"scope,omitempty" dynamodbav:"scope,omitempty"`
+	// AuthTime is when the user signed in, which for a client's session can be well before
+	// the session was created. Refreshing a session doesn't change it.
+	AuthTime int64 `json:"authTime,omitempty" dynamodbav:"authTime,omitempty"`
+}
+
+// AuthenticatedAt returns AuthTime. Sessions from before it was recorded began with a
+// sign-in, so their creation time stands in for it.
+func (s Session) AuthenticatedAt() int64 {
+	if s.AuthTime != 0 {
+		return s.AuthTime
+	}
+	return s.CreatedAt
+}
+
+var ErrTokenReuse = errors.New("refresh token has already been used")
+
+func CreateSessionsTable(client *dynamodb.Client, tableName string) error {
+
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Sessions table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("userId"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("id"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("user-index"),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("userId"),
+						KeyType:       types.KeyTypeHash,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Sessions table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for Sessions table to become active: %w", err)
+	}
+
+	// Let DynamoDB clean up expired sessions on its own.
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on Sessions table: %w", err)
+	}
+
+	fmt.Println("Sessions table created and active.")
+	return nil
+}
+
+func CreateSession(client *dynamodb.Client, tableName string, session Session) error {
+	item, err := attributevalue.MarshalMap(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return nil
+}
+
+func GetSession(client *dynamodb.Client, tableName, id string) (*Session, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var session Session
+	if err := attributevalue.UnmarshalMap(out.Item, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+
+	return &session, nil
+}
+
+func ListSessionsByUser(client *dynamodb.Client, tableName, userID string) ([]Session, error) {
+	var sessions []Session
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := client.Query(context.TODO(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("user-index"),
+			KeyConditionExpression: aws.String("userId = :u"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":u": &types.AttributeValueMemberS{Value: userID},
+			},
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sessions: %w", err)
+		}
+
+		var page []Session
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sessions: %w", err)
+		}
+		sessions = append(sessions, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	return sessions, nil
+}
+
+// RotateSession swaps the current refresh token ID from oldToken to newToken. It returns
+// ErrTokenReuse if oldToken is no longer current or the session has been revoked.
+func RotateSession(client *dynamodb.Client, tableName, id, oldToken, newToken, ip string, expiresAt int64) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET currentToken = :new, lastUsedAt = :now, expiresAt = :exp, ip = :ip"),
+		ConditionExpression: aws.String("currentToken = :old AND revoked = :false"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":new":   &types.AttributeValueMemberS{Value: newToken},
+			":old":   &types.AttributeValueMemberS{Value: oldToken},
+			":now":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+			":exp":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiresAt)},
+			":ip":    &types.AttributeValueMemberS{Value: ip},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrTokenReuse
+		}
+		return fmt.Errorf("failed to rotate session: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteSession removes the session record outright, which also ends it.
+func DeleteSession(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeSession revokes every refresh token in the session's family.
+func RevokeSession(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET revoked = :true"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	return nil
+}
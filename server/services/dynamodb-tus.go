@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// TusUpload is a resumable upload in progress. Bytes are stored as multipart parts of
+// PartSize bytes; anything short of a full part is kept in a separate pending object
+// until more arrives. Offset is always the parts plus the pending bytes. Finished is set
+// once the object is assembled and the Files record exists. A request writing bytes holds
+// LockToken until LockExpires, so no other request writes the same parts.
+type TusUpload struct {
+	ID          string     `dynamodbav:"id"`
+	UserID      string     `dynamodbav:"userId"`
+	FileID      string     `dynamodbav:"fileId"`
+	FileName    string     `dynamodbav:"fileName"`
+	Org         string     `dynamodbav:"org,omitempty"`
+	ContentType string     `dynamodbav:"contentType"`
+	Metadata    string     `dynamodbav:"metadata,omitempty"`
+	Length      int64      `dynamodbav:"length"`
+	Offset      int64      `dynamodbav:"offset"`
+	PartSize    int64      `dynamodbav:"partSize"`
+	PendingSize int64      `dynamodbav:"pendingSize"`
+	MultipartID string     `dynamodbav:"multipartId"`
+	Parts       []BlobPart `dynamodbav:"parts"`
+	Finished    bool       `dynamodbav:"finished"`
+	CreatedAt   int64      `dynamodbav:"createdAt"`
+	ExpiresAt   int64      `dynamodbav:"expiresAt"`
+	ObjectKey   string     `dynamodbav:"objectKey,omitempty"`
+	LockToken   string     `dynamodbav:"lockToken,omitempty"`
+	LockExpires int64      `dynamodbav:"lockExpires,omitempty"`
+}
+
+// BlobKey is where the finished file is assembled. Uploads started before per-file keys
+// have none and use uploads/<fileName>.
+func (u TusUpload) BlobKey() string {
+	if u.ObjectKey != "" {
+		return u.ObjectKey
+	}
+	return "uploads/" + u.FileName
+}
+
+func CreateTusUploadsTable(client *dynamodb.Client, tableName string) error {
+	return createSimpleTable(client, tableName, "TusUploads", "expiresAt")
+}
+
+func CreateTusUpload(client *dynamodb.Client, tableName string, upload TusUpload) error {
+	item, err := attributevalue.MarshalMap(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+
+	return nil
+}
+
+// GetTusUpload returns the upload, or nil if there is none.
+func GetTusUpload(client *dynamodb.Client, tableName, id string) (*TusUpload, error) {
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var upload TusUpload
+	if err := attributevalue.UnmarshalMap(out.Item, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload: %w", err)
+	}
+
+	return &upload, nil
+}
+
+// LockTusUpload claims the upload for one request, as long as it is still at offset and
+// nobody else holds an unexpired lock. It returns ErrInvalidToken otherwise.
+func LockTusUpload(client *dynamodb.Client, tableName, id string, offset int64, token string, until time.Time) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET lockToken = :token, lockExpires = :until"),
+		ConditionExpression: aws.String("attribute_exists(id) AND #offset = :offset AND (attribute_not_exists(lockToken) OR lockExpires < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#offset": "offset",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token":  &types.AttributeValueMemberS{Value: token},
+			":until":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", until.Unix())},
+			":offset": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", offset)},
+			":now":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+		},
+	})
+	return tusLockError(err, "lock")
+}
+
+// RenewTusUploadLock extends a lock the caller still holds. It returns ErrInvalidToken if
+// the lock has been taken over.
+func RenewTusUploadLock(client *dynamodb.Client, tableName, id, token string, until time.Time) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET lockExpires = :until"),
+		ConditionExpression: aws.String("lockToken = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: token},
+			":until": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", until.Unix())},
+		},
+	})
+	return tusLockError(err, "renew lock on")
+}
+
+func tusLockError(err error, action string) error {
+	if err == nil {
+		return nil
+	}
+	var condFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &condFailed) {
+		return ErrInvalidToken
+	}
+	return fmt.Errorf("failed to %s upload: %w", action, err)
+}
+
+// SaveTusUploadProgress stores the upload and releases the lock, but only if lockToken
+// still holds it, so two requests writing the same upload cannot both succeed. It returns
+// ErrInvalidToken if the lock was lost.
+func SaveTusUploadProgress(client *dynamodb.Client, tableName string, upload TusUpload, lockToken string) error {
+	upload.LockToken, upload.LockExpires = "", 0
+	item, err := attributevalue.MarshalMap(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %w", err)
+	}
+
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("lockToken = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: lockToken},
+		},
+	})
+	return tusLockError(err, "save")
+}
+
+func DeleteTusUpload(client *dynamodb.Client, tableName, id string) error {
+	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -14,10 +15,39 @@ import (
 )
 
 type User struct {
-	ID       string `json:"id" dynamodbav:"id"`
-	Name     string `json:"name" dynamodbav:"name"`
-	Email    string `json:"email" dynamodbav:"email"`
-	Password string `json:"password" dynamodbav:"password"`
+	ID                string   `json:"id" dynamodbav:"id"`
+	Name              string   `json:"name" dynamodbav:"name"`
+	Email             string   `json:"email" dynamodbav:"email"`
+	Password          string   `json:"-" dynamodbav:"password"`
+	Verified          bool     `json:"verified" dynamodbav:"verified"`
+	Role              string   `json:"role" dynamodbav:"role"`
+	AvatarKey         string   `json:"avatarKey,omitempty" dynamodbav:"avatarKey,omitempty"`
+	Disabled          bool     `json:"disabled,omitempty" dynamodbav:"disabled,omitempty"`
+	ExternalID        string   `json:"-" dynamodbav:"externalId,omitempty"`
+	ResetTokenHash    string   `json:"-" dynamodbav:"resetTokenHash,omitempty"`
+	ResetTokenExpires int64    `json:"-" dynamodbav:"resetTokenExpires,omitempty"`
+	MagicLinkHash     string   `json:"-" dynamodbav:"magicLinkHash,omitempty"`
+	MagicLinkExpires  int64    `json:"-" dynamodbav:"magicLinkExpires,omitempty"`
+	TOTPEnabled       bool     `json:"totpEnabled" dynamodbav:"totpEnabled"`
+	TOTPSecret        string   `json:"-" dynamodbav:"totpSecret,omitempty"`
+	TOTPPendingSecret string   `json:"-" dynamodbav:"totpPendingSecret,omitempty"`
+	TOTPLastCounter   int64    `json:"-" dynamodbav:"totpLastCounter,omitempty"`
+	RecoveryCodes     []string `json:"-" dynamodbav:"recoveryCodes,omitempty,stringset"`
+}
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// EffectiveRole treats accounts created before roles existed as regular users.
+func (u User) EffectiveRole() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
 }
 
 func CreateUsersTable(client *dynamodb.Client, tableName string) error {
@@ -188,7 +218,13 @@ func UpdateUser(client *dynamodb.Client, tableName string, user User) error {
 		return fmt.Errorf("user with ID %s not found", user.ID)
 	}
 
-	if user.Email != "" {
+	var existing User
+	if err := attributevalue.UnmarshalMap(getOut.Item, &existing); err != nil {
+		return fmt.Errorf("error decoding user: %w", err)
+	}
+
+	user.Email = strings.ToLower(user.Email)
+	if user.Email != "" && user.Email != existing.Email {
 		expr, err := expression.NewBuilder().
 			WithFilter(expression.Name("email").Equal(expression.Value(user.Email))).
 			Build()
@@ -212,6 +248,11 @@ func UpdateUser(client *dynamodb.Client, tableName string, user User) error {
 			}
 		}
 
+		// A new address has to be verified again.
+		updateBuilder = updateBuilder.Set(expression.Name("email"), expression.Value(user.Email)).
+			Set(expression.Name("verified"), expression.Value(false))
+		updatedFields++
+	} else if user.Email != "" {
 		updateBuilder = updateBuilder.Set(expression.Name("email"), expression.Value(user.Email))
 		updatedFields++
 	}
@@ -301,3 +342,210 @@ func DeleteUser(client *dynamodb.Client, tableName, id string) error {
 	})
 	return err
 }
+
+// SetUserAttributes sets arbitrary attributes on an existing user record.
+func SetUserAttributes(client *dynamodb.Client, tableName, id string, attrs map[string]interface{}) error {
+	if id == "" || len(attrs) == 0 {
+		return fmt.Errorf("missing user ID or attributes")
+	}
+
+	updateBuilder := expression.UpdateBuilder{}
+	for name, value := range attrs {
+		updateBuilder = updateBuilder.Set(expression.Name(name), expression.Value(value))
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(updateBuilder).Build()
+	if err != nil {
+		return fmt.Errorf("error in expression builder: %w", err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("error updating user attributes: %w", err)
+	}
+
+	return nil
+}
+
+// ReplacePasswordHash swaps in a re-hashed password, but only if the stored hash is still
+// oldHash, so it never overwrites a password changed in the meantime.
+func ReplacePasswordHash(client *dynamodb.Client, tableName, id, oldHash, newHash string) error {
+	cond := expression.Name("password").Equal(expression.Value(oldHash))
+	update := expression.Set(expression.Name("password"), expression.Value(newHash))
+
+	expr, err := expression.NewBuilder().WithCondition(cond).WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("error in expression builder: %w", err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return nil
+		}
+		return fmt.Errorf("error replacing password hash: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeUserToken removes a one-time token from the user record, but only if the stored
+// hash matches and has not expired. The conditional update makes the token single-use.
+func ConsumeUserToken(client *dynamodb.Client, tableName, id, hashAttr, expiresAttr, tokenHash string) error {
+	cond := expression.Name(hashAttr).Equal(expression.Value(tokenHash)).
+		And(expression.Name(expiresAttr).GreaterThan(expression.Value(time.Now().Unix())))
+	update := expression.Remove(expression.Name(hashAttr)).Remove(expression.Name(expiresAttr))
+
+	expr, err := expression.NewBuilder().WithCondition(cond).WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("error in expression builder: %w", err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("error consuming token: %w", err)
+	}
+
+	return nil
+}
+
+// EnableTOTP promotes the pending secret and stores the hashed recovery codes.
+func EnableTOTP(client *dynamodb.Client, tableName, id, secret string, counter int64, recoveryHashes []string) error {
+	update := expression.Set(expression.Name("totpSecret"), expression.Value(secret)).
+		Set(expression.Name("totpEnabled"), expression.Value(true)).
+		Set(expression.Name("totpLastCounter"), expression.Value(counter)).
+		Set(expression.Name("recoveryCodes"), expression.Value(&types.AttributeValueMemberSS{Value: recoveryHashes})).
+		Remove(expression.Name("totpPendingSecret"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("error in expression builder: %w", err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("error enabling TOTP: %w", err)
+	}
+
+	return nil
+}
+
+func DisableTOTP(client *dynamodb.Client, tableName, id string) error {
+	update := expression.Set(expression.Name("totpEnabled"), expression.Value(false)).
+		Remove(expression.Name("totpSecret")).
+		Remove(expression.Name("totpPendingSecret")).
+		Remove(expression.Name("totpLastCounter")).
+		Remove(expression.Name("recoveryCodes"))
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("error in expression builder: %w", err)
+	}
+
+	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("error disabling TOTP: %w", err)
+	}
+
+	return nil
+}
+
+// RecordTOTPCounter stores the last accepted time step; it fails if a newer or equal step
+// was already used, which stops the same code being accepted twice.
+func RecordTOTPCounter(client *dynamodb.Client, tableName, id string, counter int64) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET totpLastCounter = :c"),
+		ConditionExpression: aws.String("attribute_not_exists(totpLastCounter) OR totpLastCounter < :c"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":c": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", counter)},
+		},
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("error recording TOTP counter: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode atomically removes a hashed recovery code from the user's set.
+func ConsumeRecoveryCode(client *dynamodb.Client, tableName, id, codeHash string) error {
+	_, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("DELETE recoveryCodes :set"),
+		ConditionExpression: aws.String("contains(recoveryCodes, :code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":set":  &types.AttributeValueMemberSS{Value: []string{codeHash}},
+			":code": &types.AttributeValueMemberS{Value: codeHash},
+		},
+	})
+	if err != nil {
+		var condFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &condFailed) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("error consuming recovery code: %w", err)
+	}
+
+	return nil
+}
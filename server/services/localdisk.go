@@ -0,0 +1,545 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalBlobStore keeps objects on the local disk, under root/objects, with their content
+// type, ETag and checksum alongside in root/meta. Signed URLs point back at this server's
+// /blobs route and carry an HMAC of the key and expiry time; upload URLs also sign the
+// checksum the upload must have.
+type LocalBlobStore struct {
+	root    string
+	secret  []byte
+	baseURL string
+}
+
+type localBlobMeta struct {
+	ContentType    string `json:"contentType"`
+	ETag           string `json:"etag"`
+	ChecksumSHA256 string `json:"checksumSha256,omitempty"`
+}
+
+// LocalChecksumHeader carries the base64 SHA-256 of an upload to a signed upload URL.
+const LocalChecksumHeader = "X-Checksum-Sha256"
+
+func NewLocalBlobStore(root string, secret []byte, baseURL string) (*LocalBlobStore, error) {
+	for _, dir := range []string{"objects", "meta"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+	}
+	return &LocalBlobStore{root: root, secret: secret, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+// path maps a key into dir, refusing keys that would escape it.
+func (s *LocalBlobStore) path(dir, key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(s.root, dir, filepath.FromSlash(key)), nil
+}
+
+// writeFile writes through a temporary file so readers never see a partial object. check,
+// if not nil, runs once body has been written and can stop the file from being kept.
+func writeFile(path string, body io.Reader, check func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkSHA256 returns a check for writeFile that body, hashed into sum, matched want.
+func checkSHA256(sum hash.Hash, want string) func() error {
+	if want == "" {
+		return nil
+	}
+	return func() error {
+		if base64.StdEncoding.EncodeToString(sum.Sum(nil)) != want {
+			return ErrChecksumMismatch
+		}
+		return nil
+	}
+}
+
+func (s *LocalBlobStore) Put(key, contentType string, body io.Reader) error {
+	return s.put(key, contentType, body, "", "")
+}
+
+// PutChecksummed stores body under key only if its base64 SHA-256 is checksum, and returns
+// ErrChecksumMismatch otherwise.
+func (s *LocalBlobStore) PutChecksummed(key, contentType, checksum string, body io.Reader) error {
+	return s.put(key, contentType, body, checksum, "")
+}
+
+// put writes an object, keeping it only if its SHA-256 matches want when that is set. The
+// object's checksum is recorded as checksum, or as the SHA-256 of body when that is empty.
+func (s *LocalBlobStore) put(key, contentType string, body io.Reader, want, checksum string) error {
+	objectPath, err := s.path("objects", key)
+	if err != nil {
+		return err
+	}
+	metaPath, err := s.path("meta", key)
+	if err != nil {
+		return err
+	}
+
+	etag, sum := md5.New(), sha256.New()
+	if err := writeFile(objectPath, io.TeeReader(body, io.MultiWriter(etag, sum)), checkSHA256(sum, want)); errors.Is(err, ErrChecksumMismatch) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if checksum == "" {
+		checksum = base64.StdEncoding.EncodeToString(sum.Sum(nil))
+	}
+
+	meta, err := json.Marshal(localBlobMeta{
+		ContentType:    contentTypeOrDefault(contentType),
+		ETag:           `"` + hex.EncodeToString(etag.Sum(nil)) + `"`,
+		ChecksumSHA256: checksum,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal blob metadata: %w", err)
+	}
+	if err := writeFile(metaPath+".json", strings.NewReader(string(meta)), nil); err != nil {
+		return fmt.Errorf("failed to write blob metadata: %w", err)
+	}
+
+	return nil
+}
+
+func (s *LocalBlobStore) Head(key string) (*BlobInfo, error) {
+	objectPath, err := s.path("objects", key)
+	if err != nil {
+		return nil, err
+	}
+	metaPath, err := s.path("meta", key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat blob: %w", err)
+	}
+
+	var meta localBlobMeta
+	if raw, err := os.ReadFile(metaPath + ".json"); err == nil {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal blob metadata: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read blob metadata: %w", err)
+	}
+
+	return &BlobInfo{
+		Key:            key,
+		Size:           stat.Size(),
+		ContentType:    contentTypeOrDefault(meta.ContentType),
+		ETag:           meta.ETag,
+		LastModified:   stat.ModTime(),
+		ChecksumSHA256: meta.ChecksumSHA256,
+	}, nil
+}
+
+func (s *LocalBlobStore) Get(key string) (io.ReadCloser, *BlobInfo, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+func (s *LocalBlobStore) GetRange(key string, offset, length int64) (io.ReadCloser, *BlobInfo, error) {
+	info, err := s.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectPath, _ := s.path("objects", key)
+
+	file, err := os.Open(objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	if offset == 0 && length < 0 {
+		return file, info, nil
+	}
+
+	if length < 0 {
+		length = info.Size - offset
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, length), file}, info, nil
+}
+
+// Delete removes the object and its metadata. Deleting a missing key is not an error.
+func (s *LocalBlobStore) Delete(key string) error {
+	objectPath, err := s.path("objects", key)
+	if err != nil {
+		return err
+	}
+	metaPath, err := s.path("meta", key)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{objectPath, metaPath + ".json"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *LocalBlobStore) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalBlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(expires).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expiresAt, 10))
+	query.Set("signature", s.signature(key, expiresAt))
+
+	return s.baseURL + "/blobs/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// VerifySignature checks the expires and signature parameters of a URL made by SignedURL.
+func (s *LocalBlobStore) VerifySignature(key, expires, signature string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.signature(key, expiresAt)))
+}
+
+// multipartDir is where the parts of one multipart upload are kept until it completes.
+func (s *LocalBlobStore) multipartDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	return filepath.Join(s.root, "multipart", uploadID), nil
+}
+
+// uploadSignature signs an upload of key, or of one part of a multipart upload, together
+// with the content type and checksum it has to be sent with.
+func (s *LocalBlobStore) uploadSignature(key, uploadID, partNumber, contentType, checksum string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join([]string{"PUT", key, uploadID, partNumber, contentType, checksum, strconv.FormatInt(expires, 10)}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalBlobStore) signedUploadURL(key, uploadID, partNumber, contentType, checksum string, expires time.Duration) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(expires).Unix()
+	query := url.Values{}
+	if uploadID != "" {
+		query.Set("uploadId", uploadID)
+		query.Set("partNumber", partNumber)
+	}
+	query.Set("expires", strconv.FormatInt(expiresAt, 10))
+	query.Set("signature", s.uploadSignature(key, uploadID, partNumber, contentType, checksum, expiresAt))
+
+	return s.baseURL + "/blobs/" + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+func (s *LocalBlobStore) SignedPutURL(key, contentType, checksum string, expires time.Duration) (string, map[string]string, error) {
+	contentType = contentTypeOrDefault(contentType)
+	signed, err := s.signedUploadURL(key, "", "", contentType, checksum, expires)
+	if err != nil {
+		return "", nil, err
+	}
+
+	headers := map[string]string{"Content-Type": contentType}
+	if checksum != "" {
+		headers[LocalChecksumHeader] = checksum
+	}
+	return signed, headers, nil
+}
+
+func (s *LocalBlobStore) SignedPartURL(key, uploadID string, number int32, checksum string, expires time.Duration) (string, map[string]string, error) {
+	if _, err := s.multipartDir(uploadID); err != nil {
+		return "", nil, err
+	}
+	signed, err := s.signedUploadURL(key, uploadID, strconv.Itoa(int(number)), "", checksum, expires)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, map[string]string{LocalChecksumHeader: checksum}, nil
+}
+
+// VerifyUploadSignature checks a request to a URL made by SignedPutURL or SignedPartURL.
+// Part uploads have no content type of their own, so pass "" for them.
+func (s *LocalBlobStore) VerifyUploadSignature(key, uploadID, partNumber, contentType, checksum, expires, signature string) bool {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.uploadSignature(key, uploadID, partNumber, contentType, checksum, expiresAt)))
+}
+
+func (s *LocalBlobStore) CreateMultipart(key, contentType string) (string, error) {
+	return s.createMultipart(key, contentType, false)
+}
+
+// CreateChecksummedMultipart starts a multipart upload whose parts are only accepted with
+// the checksum they were signed for. As on S3, the finished object's checksum is the
+// SHA-256 of the part digests followed by "-" and the number of parts.
+func (s *LocalBlobStore) CreateChecksummedMultipart(key, contentType string) (string, error) {
+	return s.createMultipart(key, contentType, true)
+}
+
+func (s *LocalBlobStore) createMultipart(key, contentType string, checksummed bool) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate upload id: %w", err)
+	}
+	uploadID := hex.EncodeToString(id)
+
+	dir, _ := s.multipartDir(uploadID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "content-type"), []byte(contentTypeOrDefault(contentType)), 0o640); err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	if checksummed {
+		if err := os.WriteFile(filepath.Join(dir, "checksummed"), nil, 0o640); err != nil {
+			return "", fmt.Errorf("failed to create multipart upload: %w", err)
+		}
+	}
+
+	return uploadID, nil
+}
+
+func (s *LocalBlobStore) UploadPart(key, uploadID string, number int32, data []byte) (BlobPart, error) {
+	return s.uploadPart(uploadID, number, bytes.NewReader(data), "")
+}
+
+// UploadChecksummedPart stores one part of a multipart upload only if its base64 SHA-256 is
+// checksum, and returns ErrChecksumMismatch otherwise.
+func (s *LocalBlobStore) UploadChecksummedPart(key, uploadID string, number int32, checksum string, body io.Reader) (BlobPart, error) {
+	return s.uploadPart(uploadID, number, body, checksum)
+}
+
+func (s *LocalBlobStore) uploadPart(uploadID string, number int32, body io.Reader, want string) (BlobPart, error) {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return BlobPart{}, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return BlobPart{}, fmt.Errorf("unknown multipart upload %s: %w", uploadID, err)
+	}
+	if number < 1 {
+		return BlobPart{}, fmt.Errorf("invalid part number %d", number)
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(int(number)))
+	etag, sum := md5.New(), sha256.New()
+	if err := writeFile(path, io.TeeReader(body, io.MultiWriter(etag, sum)), checkSHA256(sum, want)); errors.Is(err, ErrChecksumMismatch) {
+		return BlobPart{}, err
+	} else if err != nil {
+		return BlobPart{}, fmt.Errorf("failed to write part %d: %w", number, err)
+	}
+	checksum := base64.StdEncoding.EncodeToString(sum.Sum(nil))
+	if err := writeFile(path+".sha256", strings.NewReader(checksum), nil); err != nil {
+		return BlobPart{}, fmt.Errorf("failed to write part %d: %w", number, err)
+	}
+
+	part := BlobPart{Number: number, ETag: `"` + hex.EncodeToString(etag.Sum(nil)) + `"`}
+	if want != "" {
+		part.Checksum = checksum
+	}
+	return part, nil
+}
+
+func (s *LocalBlobStore) CompleteMultipart(key, uploadID string, parts []BlobPart) error {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+	contentType, err := os.ReadFile(filepath.Join(dir, "content-type"))
+	if err != nil {
+		return fmt.Errorf("unknown multipart upload %s: %w", uploadID, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "checksummed"))
+	checksummed := err == nil
+
+	digests := sha256.New()
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		path := filepath.Join(dir, strconv.Itoa(int(part.Number)))
+		if checksummed {
+			stored, err := os.ReadFile(path + ".sha256")
+			if err != nil {
+				return fmt.Errorf("missing part %d: %w", part.Number, err)
+			}
+			if part.Checksum != string(stored) {
+				return fmt.Errorf("part %d: %w", part.Number, ErrChecksumMismatch)
+			}
+			digest, _ := base64.StdEncoding.DecodeString(string(stored))
+			digests.Write(digest)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("missing part %d: %w", part.Number, err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	checksum := ""
+	if checksummed {
+		checksum = fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(digests.Sum(nil)), len(parts))
+	}
+	if err := s.put(key, string(contentType), io.MultiReader(readers...), "", checksum); err != nil {
+		return err
+	}
+
+	return s.AbortMultipart(key, uploadID)
+}
+
+func (s *LocalBlobStore) AbortMultipart(key, uploadID string) error {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+	return nil
+}
+
+// PruneMultipart removes multipart uploads that have had no part written since cutoff,
+// which are left behind by uploads that were abandoned. It returns how many it removed.
+func (s *LocalBlobStore) PruneMultipart(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, "multipart"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to list multipart uploads: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := s.AbortMultipart("", entry.Name()); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PruneObjects deletes the objects under prefix that were last written before cutoff. It
+// returns how many it deleted.
+func (s *LocalBlobStore) PruneObjects(prefix string, cutoff time.Time) (int, error) {
+	return s.deleteObjects(prefix, func(info fs.FileInfo) bool { return info.ModTime().Before(cutoff) })
+}
+
+func (s *LocalBlobStore) DeletePrefix(prefix string) (int, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		return 0, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	return s.deleteObjects(prefix, func(fs.FileInfo) bool { return true })
+}
+
+// deleteObjects deletes the objects under prefix that match, returning how many it deleted.
+func (s *LocalBlobStore) deleteObjects(prefix string, match func(fs.FileInfo) bool) (int, error) {
+	dir, err := s.path("objects", strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil || !match(info) {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Join(s.root, "objects"), path)
+		if err != nil {
+			return err
+		}
+		if err := s.Delete(filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to delete objects: %w", err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,374 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStore(t *testing.T) (*LocalBlobStore, string) {
+	t.Helper()
+	root := t.TempDir()
+	store, err := NewLocalBlobStore(filepath.Join(root, "store"), []byte("secret"), "http://files.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, root
+}
+
+func TestLocalBlobStorePathRejectsTraversal(t *testing.T) {
+	store, root := newTestLocalStore(t)
+
+	for _, key := range []string{
+		"",
+		"../escape",
+		"files/../../escape",
+		"files/..",
+		"/etc/passwd",
+		"files//double",
+		"files/./dot",
+		`files\..\escape`,
+		"files/",
+	} {
+		if _, err := store.path("objects", key); err == nil {
+			t.Errorf("path(%q) succeeded, want an error", key)
+		}
+		if err := store.Put(key, "text/plain", strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if _, err := store.SignedURL(key, time.Minute); err == nil {
+			t.Errorf("SignedURL(%q) succeeded, want an error", key)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "escape")); err == nil {
+		t.Error("a key escaped the store")
+	}
+
+	path, err := store.path("objects", "files/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "store", "objects", "files", "a", "b.txt"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+}
+
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	if err := store.Put("files/a/1", "text/plain", strings.NewReader("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Head("files/a/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.ContentType != "text/plain" || info.ETag == "" {
+		t.Errorf("Head = %+v", info)
+	}
+
+	body, _, err := store.GetRange("files/a/1", 7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != "wor" {
+		t.Errorf("GetRange(7, 3) = %q, want %q", got, "wor")
+	}
+
+	body, _, err = store.GetRange("files/a/1", 7, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(body)
+	body.Close()
+	if string(got) != "world" {
+		t.Errorf("GetRange(7, -1) = %q, want %q", got, "world")
+	}
+
+	if err := store.Delete("files/a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Head("files/a/1"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Head after Delete: err = %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete("files/a/1"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+// signedParams splits a URL made by SignedURL into its key, expires and signature.
+func signedParams(t *testing.T, signed string) (string, string, string) {
+	t.Helper()
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := strings.CutPrefix(u.Path, "/blobs/")
+	if !ok {
+		t.Fatalf("signed URL %q is not under /blobs/", signed)
+	}
+	return key, u.Query().Get("expires"), u.Query().Get("signature")
+}
+
+func TestLocalBlobStoreVerifySignature(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	signed, err := store.SignedURL("files/a/report 1.pdf", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "http://files.test/blobs/") {
+		t.Errorf("signed URL = %q", signed)
+	}
+	key, expires, signature := signedParams(t, signed)
+	if key != "files/a/report 1.pdf" {
+		t.Errorf("key = %q", key)
+	}
+	if !store.VerifySignature(key, expires, signature) {
+		t.Fatal("a fresh signature was rejected")
+	}
+
+	expiresAt, _ := strconv.ParseInt(expires, 10, 64)
+	later := strconv.FormatInt(expiresAt+3600, 10)
+	other, _ := NewLocalBlobStore(t.TempDir(), []byte("other secret"), "http://files.test")
+	otherSigned, _ := other.SignedURL(key, time.Minute)
+	_, otherExpires, otherSignature := signedParams(t, otherSigned)
+
+	tests := []struct {
+		name                    string
+		key, expires, signature string
+	}{
+		{"other key", "files/a/other.pdf", expires, signature},
+		{"extended expiry", key, later, signature},
+		{"changed signature", key, expires, strings.Repeat("0", len(signature))},
+		{"missing signature", key, expires, ""},
+		{"missing expiry", key, "", signature},
+		{"garbled expiry", key, "soon", signature},
+		{"other secret", key, otherExpires, otherSignature},
+	}
+	for _, tt := range tests {
+		if store.VerifySignature(tt.key, tt.expires, tt.signature) {
+			t.Errorf("%s: signature accepted", tt.name)
+		}
+	}
+}
+
+func TestLocalBlobStoreVerifySignatureExpired(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	signed, err := store.SignedURL("files/a/1", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, expires, signature := signedParams(t, signed)
+	if store.VerifySignature(key, expires, signature) {
+		t.Error("an expired signature was accepted")
+	}
+
+	// Signed correctly, but for a moment that has passed.
+	past := time.Now().Add(-time.Second).Unix()
+	if store.VerifySignature(key, strconv.FormatInt(past, 10), store.signature(key, past)) {
+		t.Error("a signature for a past expiry was accepted")
+	}
+}
+
+func TestLocalBlobStoreMultipart(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	id, err := store.CreateMultipart("files/a/big", "application/zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []BlobPart
+	for i, data := range []string{"first-", "second-", "third"} {
+		part, err := store.UploadPart("files/a/big", id, int32(i+1), []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+	if err := store.CompleteMultipart("files/a/big", id, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	body, info, err := store.Get("files/a/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != "first-second-third" || info.ContentType != "application/zip" {
+		t.Errorf("assembled %q as %s", got, info.ContentType)
+	}
+	if _, err := store.UploadPart("files/a/big", id, 4, []byte("late")); err == nil {
+		t.Error("UploadPart after CompleteMultipart succeeded")
+	}
+	if _, err := store.UploadPart("files/a/big", "../../objects", 1, []byte("x")); err == nil {
+		t.Error("UploadPart accepted an upload ID outside the multipart directory")
+	}
+}
+
+func TestLocalBlobStoreSignedUploads(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+	checksum := "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" // sha256("hello")
+
+	signed, headers, err := store.SignedPutURL("files/a/1", "text/plain", checksum, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers["Content-Type"] != "text/plain" || headers[LocalChecksumHeader] != checksum {
+		t.Errorf("headers = %v", headers)
+	}
+	key, expires, signature := signedParams(t, signed)
+	if !store.VerifyUploadSignature(key, "", "", "text/plain", checksum, expires, signature) {
+		t.Fatal("a fresh upload signature was rejected")
+	}
+	if store.VerifyUploadSignature(key, "", "", "text/html", checksum, expires, signature) {
+		t.Error("upload signature accepted for another content type")
+	}
+	if store.VerifyUploadSignature(key, "", "", "text/plain", "AAAA", expires, signature) {
+		t.Error("upload signature accepted for another checksum")
+	}
+	if store.VerifySignature(key, expires, signature) {
+		t.Error("an upload signature works as a download signature")
+	}
+
+	if err := store.PutChecksummed("files/a/1", "text/plain", checksum, strings.NewReader("goodbye")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("PutChecksummed with other content: err = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := store.Head("files/a/1"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("a rejected upload was kept: %v", err)
+	}
+	if err := store.PutChecksummed("files/a/1", "text/plain", checksum, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := store.Head("files/a/1"); info.ChecksumSHA256 != checksum {
+		t.Errorf("checksum = %q, want %q", info.ChecksumSHA256, checksum)
+	}
+}
+
+func TestLocalBlobStoreChecksummedMultipart(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+	checksums := map[int32]string{
+		1: "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", // sha256("hello")
+		2: "SG6kYiTRu0+2gPNPfJrZao8k7Ii+c+qOWmxlJg6cuKc=", // sha256("world")
+	}
+
+	id, err := store.CreateChecksummedMultipart("files/a/big", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, headers, err := store.SignedPartURL("files/a/big", id, 2, checksums[2], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	if u.Query().Get("uploadId") != id || u.Query().Get("partNumber") != "2" || headers[LocalChecksumHeader] != checksums[2] {
+		t.Errorf("part URL = %s, headers = %v", signed, headers)
+	}
+	if !store.VerifyUploadSignature("files/a/big", id, "2", "", checksums[2], u.Query().Get("expires"), u.Query().Get("signature")) {
+		t.Error("a fresh part signature was rejected")
+	}
+	if store.VerifyUploadSignature("files/a/big", id, "1", "", checksums[2], u.Query().Get("expires"), u.Query().Get("signature")) {
+		t.Error("part signature accepted for another part")
+	}
+
+	if _, err := store.UploadChecksummedPart("files/a/big", id, 1, checksums[1], strings.NewReader("world")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("part with other content: err = %v, want ErrChecksumMismatch", err)
+	}
+	var parts []BlobPart
+	for i, data := range []string{"hello", "world"} {
+		part, err := store.UploadChecksummedPart("files/a/big", id, int32(i+1), checksums[int32(i+1)], strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part)
+	}
+
+	tampered := []BlobPart{parts[0], {Number: 2, ETag: parts[1].ETag, Checksum: checksums[1]}}
+	if err := store.CompleteMultipart("files/a/big", id, tampered); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("CompleteMultipart with a wrong part checksum: err = %v, want ErrChecksumMismatch", err)
+	}
+	if err := store.CompleteMultipart("files/a/big", id, parts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Head("files/a/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checksum of the part digests, as S3 reports it.
+	if info.Size != 10 || !strings.HasSuffix(info.ChecksumSHA256, "-2") {
+		t.Errorf("assembled object = %+v", info)
+	}
+}
+
+func TestLocalBlobStorePrune(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	stale, _ := store.CreateMultipart("files/a/stale", "")
+	fresh, _ := store.CreateMultipart("files/a/fresh", "")
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(store.root, "multipart", stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := store.PruneMultipart(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("PruneMultipart = %d, %v; want 1 removed", n, err)
+	}
+	if _, err := store.UploadPart("files/a/stale", stale, 1, []byte("x")); err == nil {
+		t.Error("the stale upload survived")
+	}
+	if _, err := store.UploadPart("files/a/fresh", fresh, 1, []byte("x")); err != nil {
+		t.Errorf("the fresh upload was pruned: %v", err)
+	}
+
+	store.Put("tus/old.pending", "", strings.NewReader("x"))
+	store.Put("tus/new.pending", "", strings.NewReader("x"))
+	store.Put("files/a/keep", "", strings.NewReader("x"))
+	for _, key := range []string{"tus/old.pending", "files/a/keep"} {
+		path, _ := store.path("objects", key)
+		os.Chtimes(path, old, old)
+	}
+
+	if n, err := store.PruneObjects("tus/", time.Now().Add(-24*time.Hour)); err != nil || n != 1 {
+		t.Fatalf("PruneObjects = %d, %v; want 1 removed", n, err)
+	}
+	for key, want := range map[string]bool{"tus/old.pending": false, "tus/new.pending": true, "files/a/keep": true} {
+		if _, err := store.Head(key); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", key, err == nil, want)
+		}
+	}
+}
+
+func TestLocalBlobStoreDeletePrefix(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+	for _, key := range []string{"avatars/u1/1/64.png", "avatars/u1/2/64.png", "avatars/u10/1/64.png"} {
+		if err := store.Put(key, "image/png", strings.NewReader("png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.DeletePrefix("avatars/u1"); err == nil {
+		t.Error("DeletePrefix accepted a prefix without a trailing slash")
+	}
+	n, err := store.DeletePrefix("avatars/u1/")
+	if err != nil || n != 2 {
+		t.Fatalf("DeletePrefix = %d, %v; want 2 deleted", n, err)
+	}
+	if _, err := store.Head("avatars/u10/1/64.png"); err != nil {
+		t.Errorf("DeletePrefix reached past its prefix: %v", err)
+	}
+	if n, err := store.DeletePrefix("avatars/nobody/"); err != nil || n != 0 {
+		t.Errorf("DeletePrefix of an empty prefix = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,1119 @@
+package services
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MemoryUserRepository is a UserRepository kept in memory, for tests and local runs. It
+// follows the same rules as the DynamoDB table, including unique emails.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[string]User{}}
+}
+
+func cloneUser(user User) *User {
+	user.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	return &user
+}
+
+func (r *MemoryUserRepository) emailTaken(email, exceptID string) bool {
+	for _, user := range r.users {
+		if user.Email == email && user.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// update applies fn to the stored user with the given ID. A missing user is an error.
+func (r *MemoryUserRepository) update(id string, fn func(user *User) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("user with ID %s not found", id)
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	r.users[id] = user
+	return nil
+}
+
+// updateItem applies fn to the user's DynamoDB item, so attributes can be addressed by
+// name the same way the table does.
+func (r *MemoryUserRepository) updateItem(id string, fn func(item map[string]types.AttributeValue) error) error {
+	return r.update(id, func(user *User) error {
+		item, err := attributevalue.MarshalMap(user)
+		if err != nil {
+			return fmt.Errorf("failed to marshal user: %w", err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+
+		var updated User
+		if err := attributevalue.UnmarshalMap(item, &updated); err != nil {
+			return fmt.Errorf("failed to unmarshal user: %w", err)
+		}
+		*user = updated
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Create(user User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailTaken(user.Email, "") {
+		return fmt.Errorf("user with email %s already exists", user.Email)
+	}
+	r.users[user.ID] = *cloneUser(user)
+	return nil
+}
+
+func (r *MemoryUserRepository) Get(id string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return cloneUser(user), nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	email = strings.ToLower(email)
+	for _, user := range r.users {
+		if user.Email == email {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MemoryUserRepository) List() ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, *cloneUser(user))
+	}
+	slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.ID, b.ID) })
+	return users, nil
+}
+
+func (r *MemoryUserRepository) Update(user User) error {
+	email := strings.ToLower(user.Email)
+	if email == "" && user.Name == "" {
+		return fmt.Errorf("must update at least one field")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.users[user.ID]
+	if !ok {
+		return fmt.Errorf("user with ID %s not found", user.ID)
+	}
+	if email != "" && email != existing.Email {
+		if r.emailTaken(email, user.ID) {
+			return fmt.Errorf("email %s is already in use", email)
+		}
+		existing.Email = email
+		existing.Verified = false
+	}
+	if user.Name != "" {
+		existing.Name = user.Name
+	}
+	r.users[user.ID] = existing
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdatePassword(id, passwordHash string) error {
+	if id == "" || passwordHash == "" {
+		return fmt.Errorf("missing user ID or password")
+	}
+	return r.update(id, func(user *User) error {
+		user.Password = passwordHash
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.users, id)
+	return nil
+}
+
+func (r *MemoryUserRepository) SetAttributes(id string, attrs map[string]interface{}) error {
+	if id == "" || len(attrs) == 0 {
+		return fmt.Errorf("missing user ID or attributes")
+	}
+	return r.updateItem(id, func(item map[string]types.AttributeValue) error {
+		for name, value := range attrs {
+			av, err := attributevalue.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("failed to marshal attribute %s: %w", name, err)
+			}
+			item[name] = av
+		}
+		return nil
+	})
+}
+
+// ReplacePasswordHash does nothing if the password has changed since oldHash was read.
+func (r *MemoryUserRepository) ReplacePasswordHash(id, oldHash, newHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[id]; ok && user.Password == oldHash {
+		user.Password = newHash
+		r.users[id] = user
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) ConsumeToken(id, hashAttr, expiresAttr, tokenHash string) error {
+	// A missing user fails the condition, as it does in DynamoDB.
+	if user, _ := r.Get(id); user == nil {
+		return ErrInvalidToken
+	}
+	return r.updateItem(id, func(item map[string]types.AttributeValue) error {
+		hash, _ := item[hashAttr].(*types.AttributeValueMemberS)
+		expires, _ := item[expiresAttr].(*types.AttributeValueMemberN)
+		if hash == nil || expires == nil || hash.Value != tokenHash {
+			return ErrInvalidToken
+		}
+		if n, err := strconv.ParseInt(expires.Value, 10, 64); err != nil || n <= time.Now().Unix() {
+			return ErrInvalidToken
+		}
+
+		delete(item, hashAttr)
+		delete(item, expiresAttr)
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) EnableTOTP(id, secret string, counter int64, recoveryHashes []string) error {
+	return r.update(id, func(user *User) error {
+		user.TOTPSecret = secret
+		user.TOTPEnabled = true
+		user.TOTPLastCounter = counter
+		user.RecoveryCodes = slices.Clone(recoveryHashes)
+		user.TOTPPendingSecret = ""
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) DisableTOTP(id string) error {
+	return r.update(id, func(user *User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastCounter = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) RecordTOTPCounter(id string, counter int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || (user.TOTPLastCounter != 0 && user.TOTPLastCounter >= counter) {
+		return ErrInvalidToken
+	}
+	user.TOTPLastCounter = counter
+	r.users[id] = user
+	return nil
+}
+
+func (r *MemoryUserRepository) ConsumeRecoveryCode(id, codeHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || !slices.Contains(user.RecoveryCodes, codeHash) {
+		return ErrInvalidToken
+	}
+	user.RecoveryCodes = slices.DeleteFunc(slices.Clone(user.RecoveryCodes), func(h string) bool { return h == codeHash })
+	r.users[id] = user
+	return nil
+}
+
+// MemoryFileRepository is a FileRepository kept in memory.
+type MemoryFileRepository struct {
+	mu    sync.RWMutex
+	files map[string]File
+}
+
+func NewMemoryFileRepository() *MemoryFileRepository {
+	return &MemoryFileRepository{files: map[string]File{}}
+}
+
+func (r *MemoryFileRepository) Create(file File) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files[file.ID] = file
+	return nil
+}
+
+func (r *MemoryFileRepository) Get(id string) (*File, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return nil, nil
+	}
+	return &file, nil
+}
+
+func (r *MemoryFileRepository) Rename(id, fileName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return fmt.Errorf("file with ID %s not found", id)
+	}
+	file.FileName = fileName
+	r.files[id] = file
+	return nil
+}
+
+func (r *MemoryFileRepository) Activate(id string, size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[id]
+	if !ok || file.Status != FilePending {
+		return ErrInvalidToken
+	}
+	file.Status, file.Size = FileActive, size
+	file.ExpiresAt, file.UploadID = 0, ""
+	r.files[id] = file
+	return nil
+}
+
+func (r *MemoryFileRepository) Disown(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return fmt.Errorf("file with ID %s not found", id)
+	}
+	file.User = ""
+	r.files[id] = file
+	return nil
+}
+
+func (r *MemoryFileRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.files, id)
+	return nil
+}
+
+func (r *MemoryFileRepository) list(match func(File) bool) []File {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var files []File
+	for _, file := range r.files {
+		if match(file) {
+			files = append(files, file)
+		}
+	}
+	slices.SortFunc(files, func(a, b File) int { return strings.Compare(a.ID, b.ID) })
+	return files
+}
+
+func (r *MemoryFileRepository) List() ([]File, error) {
+	return r.list(func(File) bool { return true }), nil
+}
+
+func (r *MemoryFileRepository) ListByUser(user string) ([]File, error) {
+	return r.list(func(f File) bool { return f.User == user }), nil
+}
+
+func (r *MemoryFileRepository) ListByOrg(org string) ([]File, error) {
+	return r.list(func(f File) bool { return f.Org == org }), nil
+}
+
+func (r *MemoryFileRepository) ListLegacyByName(fileName string) ([]File, error) {
+	return r.list(func(f File) bool { return f.FileName == fileName && f.ObjectKey == "" }), nil
+}
+
+// MemoryPostRepository is a PostRepository kept in memory.
+type MemoryPostRepository struct {
+	mu    sync.RWMutex
+	posts map[string]BlogPost
+}
+
+func NewMemoryPostRepository() *MemoryPostRepository {
+	return &MemoryPostRepository{posts: map[string]BlogPost{}}
+}
+
+func clonePost(post BlogPost) BlogPost {
+	post.Paragraphs = slices.Clone(post.Paragraphs)
+	post.Images = slices.Clone(post.Images)
+	return post
+}
+
+func (r *MemoryPostRepository) Create(post BlogPost) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.posts[post.ID] = clonePost(post)
+	return nil
+}
+
+func (r *MemoryPostRepository) list(match func(BlogPost) bool) []BlogPost {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	posts := []BlogPost{}
+	for _, post := range r.posts {
+		if match(post) {
+			posts = append(posts, clonePost(post))
+		}
+	}
+	slices.SortFunc(posts, func(a, b BlogPost) int { return strings.Compare(a.ID, b.ID) })
+	return posts
+}
+
+func (r *MemoryPostRepository) List() ([]BlogPost, error) {
+	return r.list(func(BlogPost) bool { return true }), nil
+}
+
+func (r *MemoryPostRepository) ListByAuthor(author string) ([]BlogPost, error) {
+	return r.list(func(p BlogPost) bool { return p.Author == author }), nil
+}
+
+func (r *MemoryPostRepository) Update(post BlogPost) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.posts[post.ID]
+	if !ok {
+		return fmt.Errorf("blog post with ID %s not found", post.ID)
+	}
+
+	updated := false
+	if post.Title != "" {
+		existing.Title, updated = post.Title, true
+	}
+	if post.Paragraphs != nil {
+		existing.Paragraphs, updated = slices.Clone(post.Paragraphs), true
+	}
+	if post.Images != nil {
+		existing.Images, updated = slices.Clone(post.Images), true
+	}
+	if post.Author != "" {
+		existing.Author, updated = post.Author, true
+	}
+	if !post.DateUpdated.IsZero() {
+		existing.DateUpdated, updated = post.DateUpdated, true
+	}
+	if !updated {
+		return fmt.Errorf("must update at least one field")
+	}
+
+	r.posts[post.ID] = existing
+	return nil
+}
+
+func (r *MemoryPostRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.posts, id)
+	return nil
+}
+
+// MemorySessionRepository is a SessionRepository kept in memory.
+type MemorySessionRepository struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{sessions: map[string]Session{}}
+}
+
+func (r *MemorySessionRepository) Create(session Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[session.ID]; ok {
+		return fmt.Errorf("session with ID %s already exists", session.ID)
+	}
+	r.sessions[session.ID] = session
+	return nil
+}
+
+func (r *MemorySessionRepository) Get(id string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (r *MemorySessionRepository) ListByUser(userID string) ([]Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sessions []Session
+	for _, session := range r.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b Session) int { return strings.Compare(a.ID, b.ID) })
+	return sessions, nil
+}
+
+func (r *MemorySessionRepository) Rotate(id, oldToken, newToken, ip string, expiresAt int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok || session.CurrentToken != oldToken || session.Revoked {
+		return ErrTokenReuse
+	}
+	session.CurrentToken, session.IP = newToken, ip
+	session.LastUsedAt, session.ExpiresAt = time.Now().Unix(), expiresAt
+	r.sessions[id] = session
+	return nil
+}
+
+func (r *MemorySessionRepository) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return fmt.Errorf("session with ID %s not found", id)
+	}
+	session.Revoked = true
+	r.sessions[id] = session
+	return nil
+}
+
+func (r *MemorySessionRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, id)
+	return nil
+}
+
+// MemoryAuditRepository is an AuditRepository kept in memory.
+type MemoryAuditRepository struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+func NewMemoryAuditRepository() *MemoryAuditRepository {
+	return &MemoryAuditRepository{}
+}
+
+func (r *MemoryAuditRepository) Put(event AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	event.Day = now.Format(time.DateOnly)
+	event.TS = auditSortKey(now) + "#" + strconv.Itoa(len(r.events))
+	event.Time = now.Unix()
+	r.events = append(r.events, event)
+	return nil
+}
+
+// Events returns everything recorded so far, oldest first.
+func (r *MemoryAuditRepository) Events() []AuditEvent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return slices.Clone(r.events)
+}
+
+// MemoryOrgMemberRepository is an OrgMemberRepository kept in memory.
+type MemoryOrgMemberRepository struct {
+	mu      sync.RWMutex
+	members map[[2]string]OrgMember
+}
+
+func NewMemoryOrgMemberRepository() *MemoryOrgMemberRepository {
+	return &MemoryOrgMemberRepository{members: map[[2]string]OrgMember{}}
+}
+
+func (r *MemoryOrgMemberRepository) Put(member OrgMember) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.members[[2]string{member.OrgID, member.UserID}] = member
+	return nil
+}
+
+func (r *MemoryOrgMemberRepository) Get(orgID, userID string) (*OrgMember, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	member, ok := r.members[[2]string{orgID, userID}]
+	if !ok {
+		return nil, nil
+	}
+	return &member, nil
+}
+
+func (r *MemoryOrgMemberRepository) list(match func(OrgMember) bool) []OrgMember {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var members []OrgMember
+	for _, member := range r.members {
+		if match(member) {
+			members = append(members, member)
+		}
+	}
+	slices.SortFunc(members, func(a, b OrgMember) int {
+		return strings.Compare(a.OrgID+"\x00"+a.UserID, b.OrgID+"\x00"+b.UserID)
+	})
+	return members
+}
+
+func (r *MemoryOrgMemberRepository) ListByOrg(orgID string) ([]OrgMember, error) {
+	return r.list(func(m OrgMember) bool { return m.OrgID == orgID }), nil
+}
+
+func (r *MemoryOrgMemberRepository) ListByUser(userID string) ([]OrgMember, error) {
+	return r.list(func(m OrgMember) bool { return m.UserID == userID }), nil
+}
+
+func (r *MemoryOrgMemberRepository) Delete(orgID, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.members, [2]string{orgID, userID})
+	return nil
+}
+
+// MemoryLoginAttemptRepository is a LoginAttemptRepository kept in memory.
+type MemoryLoginAttemptRepository struct {
+	mu       sync.RWMutex
+	attempts map[string]LoginAttempt
+}
+
+func NewMemoryLoginAttemptRepository() *MemoryLoginAttemptRepository {
+	return &MemoryLoginAttemptRepository{attempts: map[string]LoginAttempt{}}
+}
+
+func (r *MemoryLoginAttemptRepository) Get(id string) (*LoginAttempt, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	attempt, ok := r.attempts[id]
+	if !ok {
+		return nil, nil
+	}
+	return &attempt, nil
+}
+
+func (r *MemoryLoginAttemptRepository) RecordFailure(id string, window time.Duration) (*LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt := r.attempts[id]
+	attempt.ID = id
+	attempt.Failures++
+	attempt.ExpiresAt = time.Now().Add(window).Unix()
+	r.attempts[id] = attempt
+	return &attempt, nil
+}
+
+func (r *MemoryLoginAttemptRepository) Lock(id string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.attempts[id]
+	if !ok {
+		return fmt.Errorf("login attempts for %s not found", id)
+	}
+	attempt.LockedUntil = until.Unix()
+	r.attempts[id] = attempt
+	return nil
+}
+
+func (r *MemoryLoginAttemptRepository) Clear(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, id)
+	return nil
+}
+
+// MemoryOAuthClientRepository is an OAuthClientRepository kept in memory.
+type MemoryOAuthClientRepository struct {
+	mu      sync.RWMutex
+	clients map[string]OAuthClient
+}
+
+func NewMemoryOAuthClientRepository() *MemoryOAuthClientRepository {
+	return &MemoryOAuthClientRepository{clients: map[string]OAuthClient{}}
+}
+
+func (r *MemoryOAuthClientRepository) Create(oauthClient OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[oauthClient.ID]; ok {
+		return fmt.Errorf("client with ID %s already exists", oauthClient.ID)
+	}
+	oauthClient.RedirectURIs = slices.Clone(oauthClient.RedirectURIs)
+	r.clients[oauthClient.ID] = oauthClient
+	return nil
+}
+
+func (r *MemoryOAuthClientRepository) Get(id string) (*OAuthClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	oauthClient, ok := r.clients[id]
+	if !ok {
+		return nil, nil
+	}
+	oauthClient.RedirectURIs = slices.Clone(oauthClient.RedirectURIs)
+	return &oauthClient, nil
+}
+
+// MemoryAuthCodeRepository is an AuthCodeRepository kept in memory.
+type MemoryAuthCodeRepository struct {
+	mu    sync.Mutex
+	codes map[string]AuthCode
+}
+
+func NewMemoryAuthCodeRepository() *MemoryAuthCodeRepository {
+	return &MemoryAuthCodeRepository{codes: map[string]AuthCode{}}
+}
+
+func (r *MemoryAuthCodeRepository) Create(code AuthCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.codes[code.ID] = code
+	return nil
+}
+
+func (r *MemoryAuthCodeRepository) Consume(id string) (*AuthCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code, ok := r.codes[id]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	delete(r.codes, id)
+	if code.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidToken
+	}
+	return &code, nil
+}
+
+// MemoryPasskeyRepository is a PasskeyRepository kept in memory.
+type MemoryPasskeyRepository struct {
+	mu       sync.RWMutex
+	passkeys map[string]Passkey
+}
+
+func NewMemoryPasskeyRepository() *MemoryPasskeyRepository {
+	return &MemoryPasskeyRepository{passkeys: map[string]Passkey{}}
+}
+
+func (r *MemoryPasskeyRepository) Create(passkey Passkey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.passkeys[passkey.ID]; ok {
+		return fmt.Errorf("passkey with ID %s already exists", passkey.ID)
+	}
+	r.passkeys[passkey.ID] = passkey
+	return nil
+}
+
+func (r *MemoryPasskeyRepository) Get(id string) (*Passkey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	passkey, ok := r.passkeys[id]
+	if !ok {
+		return nil, nil
+	}
+	return &passkey, nil
+}
+
+func (r *MemoryPasskeyRepository) ListByUser(userID string) ([]Passkey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var passkeys []Passkey
+	for _, passkey := range r.passkeys {
+		if passkey.UserID == userID {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	slices.SortFunc(passkeys, func(a, b Passkey) int { return strings.Compare(a.ID, b.ID) })
+	return passkeys, nil
+}
+
+func (r *MemoryPasskeyRepository) UpdateCredential(id, credential string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	passkey, ok := r.passkeys[id]
+	if !ok {
+		return fmt.Errorf("passkey with ID %s not found", id)
+	}
+	passkey.Credential = credential
+	passkey.LastUsedAt = time.Now().Unix()
+	r.passkeys[id] = passkey
+	return nil
+}
+
+func (r *MemoryPasskeyRepository) Delete(id, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if passkey, ok := r.passkeys[id]; !ok || passkey.UserID != userID {
+		return ErrInvalidToken
+	}
+	delete(r.passkeys, id)
+	return nil
+}
+
+// MemoryWebAuthnSessionRepository is a WebAuthnSessionRepository kept in memory.
+type MemoryWebAuthnSessionRepository struct {
+	mu       sync.Mutex
+	sessions map[string]WebAuthnSession
+}
+
+func NewMemoryWebAuthnSessionRepository() *MemoryWebAuthnSessionRepository {
+	return &MemoryWebAuthnSessionRepository{sessions: map[string]WebAuthnSession{}}
+}
+
+func (r *MemoryWebAuthnSessionRepository) Create(session WebAuthnSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[session.ID] = session
+	return nil
+}
+
+func (r *MemoryWebAuthnSessionRepository) Consume(id string) (*WebAuthnSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	delete(r.sessions, id)
+	if session.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidToken
+	}
+	return &session, nil
+}
+
+// MemoryAPIKeyRepository is an APIKeyRepository kept in memory.
+type MemoryAPIKeyRepository struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{keys: map[string]APIKey{}}
+}
+
+func (r *MemoryAPIKeyRepository) Create(key APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[key.ID]; ok {
+		return fmt.Errorf("API key with ID %s already exists", key.ID)
+	}
+	key.Scopes = slices.Clone(key.Scopes)
+	r.keys[key.ID] = key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) Get(id string) (*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, nil
+	}
+	key.Scopes = slices.Clone(key.Scopes)
+	return &key, nil
+}
+
+func (r *MemoryAPIKeyRepository) ListByUser(userID string) ([]APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []APIKey
+	for _, key := range r.keys {
+		if key.UserID == userID {
+			key.Scopes = slices.Clone(key.Scopes)
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return strings.Compare(a.ID, b.ID) })
+	return keys, nil
+}
+
+func (r *MemoryAPIKeyRepository) Touch(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.keys[id]
+	if !ok {
+		return fmt.Errorf("API key with ID %s not found", id)
+	}
+	key.LastUsedAt = time.Now().Unix()
+	r.keys[id] = key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) Delete(id, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if key, ok := r.keys[id]; !ok || key.UserID != userID {
+		return ErrInvalidToken
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+// MemoryInviteCodeRepository is an InviteCodeRepository kept in memory.
+type MemoryInviteCodeRepository struct {
+	mu    sync.Mutex
+	codes map[string]InviteCode
+}
+
+func NewMemoryInviteCodeRepository() *MemoryInviteCodeRepository {
+	return &MemoryInviteCodeRepository{codes: map[string]InviteCode{}}
+}
+
+func (r *MemoryInviteCodeRepository) Create(code InviteCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.codes[code.ID]; ok {
+		return fmt.Errorf("invite code with ID %s already exists", code.ID)
+	}
+	r.codes[code.ID] = code
+	return nil
+}
+
+func (r *MemoryInviteCodeRepository) List() ([]InviteCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	codes := make([]InviteCode, 0, len(r.codes))
+	for _, code := range r.codes {
+		codes = append(codes, code)
+	}
+	slices.SortFunc(codes, func(a, b InviteCode) int { return strings.Compare(a.ID, b.ID) })
+	return codes, nil
+}
+
+func (r *MemoryInviteCodeRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.codes[id]; !ok {
+		return ErrInvalidToken
+	}
+	delete(r.codes, id)
+	return nil
+}
+
+func (r *MemoryInviteCodeRepository) Redeem(id, secretHash, email string) (*InviteCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code, ok := r.codes[id]
+	if !ok || code.SecretHash != secretHash || code.ExpiresAt <= time.Now().Unix() || code.Uses >= code.MaxUses {
+		return nil, ErrInvalidToken
+	}
+	if code.Email != "" && code.Email != email {
+		return nil, ErrInvalidToken
+	}
+	code.Uses++
+	r.codes[id] = code
+	return &code, nil
+}
+
+func (r *MemoryInviteCodeRepository) Release(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code, ok := r.codes[id]
+	if !ok || code.Uses <= 0 {
+		return fmt.Errorf("invite code with ID %s has no use to release", id)
+	}
+	code.Uses--
+	r.codes[id] = code
+	return nil
+}
+
+// MemoryErasureJobRepository is an ErasureJobRepository kept in memory.
+type MemoryErasureJobRepository struct {
+	mu   sync.RWMutex
+	jobs map[string]ErasureJob
+}
+
+func NewMemoryErasureJobRepository() *MemoryErasureJobRepository {
+	return &MemoryErasureJobRepository{jobs: map[string]ErasureJob{}}
+}
+
+func cloneErasureJob(job ErasureJob) ErasureJob {
+	job.Deleted = maps.Clone(job.Deleted)
+	job.Errors = slices.Clone(job.Errors)
+	return job
+}
+
+func (r *MemoryErasureJobRepository) Save(job ErasureJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.jobs[job.ID] = cloneErasureJob(job)
+	return nil
+}
+
+func (r *MemoryErasureJobRepository) Get(id string) (*ErasureJob, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	job = cloneErasureJob(job)
+	return &job, nil
+}
+
+// MemoryTusUploadRepository is a TusUploadRepository kept in memory.
+type MemoryTusUploadRepository struct {
+	mu      sync.Mutex
+	uploads map[string]TusUpload
+}
+
+func NewMemoryTusUploadRepository() *MemoryTusUploadRepository {
+	return &MemoryTusUploadRepository{uploads: map[string]TusUpload{}}
+}
+
+func (r *MemoryTusUploadRepository) Create(upload TusUpload) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.uploads[upload.ID]; ok {
+		return fmt.Errorf("upload with ID %s already exists", upload.ID)
+	}
+	upload.Parts = slices.Clone(upload.Parts)
+	r.uploads[upload.ID] = upload
+	return nil
+}
+
+func (r *MemoryTusUploadRepository) Get(id string) (*TusUpload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	upload, ok := r.uploads[id]
+	if !ok {
+		return nil, nil
+	}
+	upload.Parts = slices.Clone(upload.Parts)
+	return &upload, nil
+}
+
+func (r *MemoryTusUploadRepository) Lock(id string, offset int64, token string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	upload, ok := r.uploads[id]
+	if !ok || upload.Offset != offset || (upload.LockToken != "" && upload.LockExpires >= time.Now().Unix()) {
+		return ErrInvalidToken
+	}
+	upload.LockToken, upload.LockExpires = token, until.Unix()
+	r.uploads[id] = upload
+	return nil
+}
+
+func (r *MemoryTusUploadRepository) RenewLock(id, token string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	upload, ok := r.uploads[id]
+	if !ok || upload.LockToken != token {
+		return ErrInvalidToken
+	}
+	upload.LockExpires = until.Unix()
+	r.uploads[id] = upload
+	return nil
+}
+
+func (r *MemoryTusUploadRepository) SaveProgress(upload TusUpload, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored, ok := r.uploads[upload.ID]; !ok || stored.LockToken != token {
+		return ErrInvalidToken
+	}
+	upload.LockToken, upload.LockExpires = "", 0
+	upload.Parts = slices.Clone(upload.Parts)
+	r.uploads[upload.ID] = upload
+	return nil
+}
+
+func (r *MemoryTusUploadRepository) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.uploads, id)
+	return nil
+}
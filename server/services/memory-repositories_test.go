@@ -0,0 +1,521 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserRepository(t *testing.T) {
+	users := NewMemoryUserRepository()
+
+	if err := users.Create(User{ID: "u1", Name: "Ann", Email: "ann@example.com", Password: "h1", Verified: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(User{ID: "u2", Name: "Other", Email: "ann@example.com"}); err == nil {
+		t.Error("created a second user with the same email")
+	}
+
+	user, err := users.GetByEmail("ANN@example.com")
+	if err != nil || user == nil || user.ID != "u1" {
+		t.Fatalf("GetByEmail = %+v, %v", user, err)
+	}
+	if missing, err := users.Get("nobody"); missing != nil || err != nil {
+		t.Errorf("Get(missing) = %+v, %v; want nil, nil", missing, err)
+	}
+
+	if err := users.Update(User{ID: "u1", Email: "ann@new.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = users.Get("u1")
+	if user.Email != "ann@new.example.com" || user.Verified || user.Name != "Ann" {
+		t.Errorf("after Update: %+v, want the new email unverified and the name kept", user)
+	}
+
+	if err := users.SetAttributes("u1", map[string]interface{}{"disabled": true, "avatarKey": "avatars/u1"}); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = users.Get("u1")
+	if !user.Disabled || user.AvatarKey != "avatars/u1" {
+		t.Errorf("after SetAttributes: %+v", user)
+	}
+
+	users.ReplacePasswordHash("u1", "stale", "h2")
+	if user, _ = users.Get("u1"); user.Password != "h1" {
+		t.Error("ReplacePasswordHash replaced a hash that had changed")
+	}
+	users.ReplacePasswordHash("u1", "h1", "h2")
+	if user, _ = users.Get("u1"); user.Password != "h2" {
+		t.Error("ReplacePasswordHash kept the old hash")
+	}
+
+	users.Delete("u1")
+	if user, _ = users.Get("u1"); user != nil {
+		t.Error("user survived Delete")
+	}
+}
+
+func TestMemoryUserRepositoryConsumeToken(t *testing.T) {
+	users := NewMemoryUserRepository()
+	users.Create(User{ID: "u1", Email: "ann@example.com"})
+	users.SetAttributes("u1", map[string]interface{}{
+		"resetTokenHash":    "hash",
+		"resetTokenExpires": time.Now().Add(time.Hour).Unix(),
+	})
+
+	if err := users.ConsumeToken("u1", "resetTokenHash", "resetTokenExpires", "wrong"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong token: err = %v, want ErrInvalidToken", err)
+	}
+	if err := users.ConsumeToken("u1", "resetTokenHash", "resetTokenExpires", "hash"); err != nil {
+		t.Fatalf("ConsumeToken: %v", err)
+	}
+	if err := users.ConsumeToken("u1", "resetTokenHash", "resetTokenExpires", "hash"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second use: err = %v, want ErrInvalidToken", err)
+	}
+	if err := users.ConsumeToken("nobody", "resetTokenHash", "resetTokenExpires", "hash"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("missing user: err = %v, want ErrInvalidToken", err)
+	}
+
+	users.SetAttributes("u1", map[string]interface{}{
+		"magicLinkHash":    "hash",
+		"magicLinkExpires": time.Now().Add(-time.Minute).Unix(),
+	})
+	if err := users.ConsumeToken("u1", "magicLinkHash", "magicLinkExpires", "hash"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired token: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestMemoryUserRepositoryTOTP(t *testing.T) {
+	users := NewMemoryUserRepository()
+	users.Create(User{ID: "u1", Email: "ann@example.com"})
+
+	if err := users.EnableTOTP("u1", "secret", 10, []string{"r1", "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.RecordTOTPCounter("u1", 10); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("replayed counter: err = %v, want ErrInvalidToken", err)
+	}
+	if err := users.RecordTOTPCounter("u1", 11); err != nil {
+		t.Errorf("next counter: %v", err)
+	}
+	if err := users.ConsumeRecoveryCode("u1", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ConsumeRecoveryCode("u1", "r1"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("reused recovery code: err = %v, want ErrInvalidToken", err)
+	}
+
+	users.DisableTOTP("u1")
+	user, _ := users.Get("u1")
+	if user.TOTPEnabled || user.TOTPSecret != "" || len(user.RecoveryCodes) != 0 {
+		t.Errorf("after DisableTOTP: %+v", user)
+	}
+}
+
+func TestMemoryFileRepository(t *testing.T) {
+	files := NewMemoryFileRepository()
+	files.Create(File{ID: "f1", FileName: "a.txt", User: "u1", Status: FilePending, UploadID: "up"})
+	files.Create(File{ID: "f2", FileName: "a.txt", User: "u2", Org: "o1"})
+	files.Create(File{ID: "f3", FileName: "a.txt", User: "u1", ObjectKey: "files/f3/x"})
+
+	if err := files.Activate("f1", 42); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := files.Get("f1")
+	if !file.Active() || file.Size != 42 || file.UploadID != "" {
+		t.Errorf("after Activate: %+v", file)
+	}
+	if err := files.Activate("f1", 42); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("activating twice: err = %v, want ErrInvalidToken", err)
+	}
+
+	if mine, _ := files.ListByUser("u1"); len(mine) != 2 {
+		t.Errorf("ListByUser = %d files, want 2", len(mine))
+	}
+	if org, _ := files.ListByOrg("o1"); len(org) != 1 || org[0].ID != "f2" {
+		t.Errorf("ListByOrg = %+v", org)
+	}
+	if legacy, _ := files.ListLegacyByName("a.txt"); len(legacy) != 2 {
+		t.Errorf("ListLegacyByName = %d files, want the 2 without an object key", len(legacy))
+	}
+
+	if err := files.Disown("f2"); err != nil {
+		t.Fatal(err)
+	}
+	if file, _ = files.Get("f2"); file.User != "" || file.Org != "o1" {
+		t.Errorf("after Disown: %+v", file)
+	}
+	if err := files.Rename("f3", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	files.Delete("f3")
+	if file, _ = files.Get("f3"); file != nil {
+		t.Error("file survived Delete")
+	}
+}
+
+func TestMemoryPostRepository(t *testing.T) {
+	posts := NewMemoryPostRepository()
+	posts.Create(BlogPost{ID: "p1", Title: "One", Author: "u1", Paragraphs: []string{"a"}})
+	posts.Create(BlogPost{ID: "p2", Title: "Two", Author: "u2"})
+
+	if err := posts.Update(BlogPost{ID: "p1", Title: "Uno"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := posts.Update(BlogPost{ID: "p1"}); err == nil {
+		t.Error("an empty update succeeded")
+	}
+	mine, _ := posts.ListByAuthor("u1")
+	if len(mine) != 1 || mine[0].Title != "Uno" || len(mine[0].Paragraphs) != 1 {
+		t.Errorf("ListByAuthor = %+v", mine)
+	}
+
+	mine[0].Paragraphs[0] = "changed"
+	if again, _ := posts.ListByAuthor("u1"); again[0].Paragraphs[0] != "a" {
+		t.Error("a listed post shares its paragraphs with the repository")
+	}
+
+	posts.Delete("p1")
+	if all, _ := posts.List(); len(all) != 1 || all[0].ID != "p2" {
+		t.Errorf("after Delete: %+v", all)
+	}
+}
+
+func TestMemorySessionRepository(t *testing.T) {
+	sessions := NewMemorySessionRepository()
+	sessions.Create(Session{ID: "s1", UserID: "u1", CurrentToken: "t1"})
+	sessions.Create(Session{ID: "s2", UserID: "u1", CurrentToken: "t1"})
+	if err := sessions.Create(Session{ID: "s1", UserID: "u2"}); err == nil {
+		t.Error("created a session over an existing one")
+	}
+
+	if err := sessions.Rotate("s1", "t1", "t2", "10.0.0.1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Rotate("s1", "t1", "t3", "10.0.0.1", 100); !errors.Is(err, ErrTokenReuse) {
+		t.Errorf("rotating a spent token: err = %v, want ErrTokenReuse", err)
+	}
+	session, _ := sessions.Get("s1")
+	if session.CurrentToken != "t2" || session.IP != "10.0.0.1" || session.ExpiresAt != 100 {
+		t.Errorf("after Rotate: %+v", session)
+	}
+
+	if err := sessions.Revoke("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Rotate("s2", "t1", "t2", "", 100); !errors.Is(err, ErrTokenReuse) {
+		t.Errorf("rotating a revoked session: err = %v, want ErrTokenReuse", err)
+	}
+	if err := sessions.Revoke("missing"); err == nil {
+		t.Error("revoking a missing session succeeded")
+	}
+	if list, _ := sessions.ListByUser("u1"); len(list) != 2 {
+		t.Errorf("ListByUser = %d sessions, want 2", len(list))
+	}
+
+	if err := sessions.Delete("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := sessions.Get("s2"); session != nil {
+		t.Error("session survived Delete")
+	}
+}
+
+func TestMemoryAuditRepository(t *testing.T) {
+	audit := NewMemoryAuditRepository()
+	audit.Put(AuditEvent{Event: AuditLogin, Outcome: AuditSuccess})
+	audit.Put(AuditEvent{Event: AuditLogin, Outcome: AuditFailure})
+
+	events := audit.Events()
+	if len(events) != 2 {
+		t.Fatalf("Events = %d, want 2", len(events))
+	}
+	if events[0].Day == "" || events[0].Time == 0 || events[0].TS == events[1].TS {
+		t.Errorf("Put did not stamp the events: %+v", events)
+	}
+	if events[1].Outcome != AuditFailure {
+		t.Errorf("Events are out of order: %+v", events)
+	}
+}
+
+func TestMemoryOrgMemberRepository(t *testing.T) {
+	members := NewMemoryOrgMemberRepository()
+	members.Put(OrgMember{OrgID: "o1", UserID: "u1", Role: OrgRoleOwner})
+	members.Put(OrgMember{OrgID: "o1", UserID: "u2", Role: OrgRoleMember})
+	members.Put(OrgMember{OrgID: "o2", UserID: "u1", Role: OrgRoleViewer})
+
+	member, _ := members.Get("o1", "u2")
+	if member == nil || member.Role != OrgRoleMember {
+		t.Fatalf("Get = %+v", member)
+	}
+	members.Put(OrgMember{OrgID: "o1", UserID: "u2", Role: OrgRoleAdmin})
+	if member, _ = members.Get("o1", "u2"); member.Role != OrgRoleAdmin {
+		t.Errorf("Put did not replace the membership: %+v", member)
+	}
+
+	if list, _ := members.ListByOrg("o1"); len(list) != 2 {
+		t.Errorf("ListByOrg = %d, want 2", len(list))
+	}
+	if list, _ := members.ListByUser("u1"); len(list) != 2 {
+		t.Errorf("ListByUser = %d, want 2", len(list))
+	}
+
+	members.Delete("o1", "u2")
+	if member, _ = members.Get("o1", "u2"); member != nil {
+		t.Error("membership survived Delete")
+	}
+}
+
+func TestMemoryLoginAttemptRepository(t *testing.T) {
+	attempts := NewMemoryLoginAttemptRepository()
+
+	if err := attempts.Lock("email#a", time.Now()); err == nil {
+		t.Error("locked a record with no failures")
+	}
+	for i := 1; i <= 3; i++ {
+		attempt, err := attempts.RecordFailure("email#a", time.Hour)
+		if err != nil || attempt.Failures != i {
+			t.Fatalf("RecordFailure #%d = %+v, %v", i, attempt, err)
+		}
+	}
+
+	until := time.Now().Add(time.Minute)
+	if err := attempts.Lock("email#a", until); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, _ := attempts.Get("email#a"); attempt.LockedUntil != until.Unix() {
+		t.Errorf("after Lock: %+v", attempt)
+	}
+
+	attempts.Clear("email#a")
+	if attempt, _ := attempts.Get("email#a"); attempt != nil {
+		t.Error("attempts survived Clear")
+	}
+}
+
+func TestMemoryOAuthClientRepository(t *testing.T) {
+	clients := NewMemoryOAuthClientRepository()
+	if err := clients.Create(OAuthClient{ID: "c1", RedirectURIs: []string{"https://app.example.com/cb"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Create(OAuthClient{ID: "c1"}); err == nil {
+		t.Error("created a client over an existing one")
+	}
+
+	client, _ := clients.Get("c1")
+	client.RedirectURIs[0] = "https://evil.example.com/cb"
+	if again, _ := clients.Get("c1"); again.RedirectURIs[0] != "https://app.example.com/cb" {
+		t.Error("a client shares its redirect URIs with the repository")
+	}
+	if missing, err := clients.Get("c2"); missing != nil || err != nil {
+		t.Errorf("Get(missing) = %+v, %v; want nil, nil", missing, err)
+	}
+}
+
+func TestMemoryAuthCodeRepository(t *testing.T) {
+	codes := NewMemoryAuthCodeRepository()
+	codes.Create(AuthCode{ID: "a", ClientID: "c1", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	codes.Create(AuthCode{ID: "b", ClientID: "c1", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	code, err := codes.Consume("a")
+	if err != nil || code.ClientID != "c1" {
+		t.Fatalf("Consume = %+v, %v", code, err)
+	}
+	if _, err := codes.Consume("a"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second use: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := codes.Consume("b"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired code: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestMemoryPasskeyRepository(t *testing.T) {
+	passkeys := NewMemoryPasskeyRepository()
+	passkeys.Create(Passkey{ID: "k1", UserID: "u1", Credential: "old"})
+	passkeys.Create(Passkey{ID: "k2", UserID: "u2"})
+	if err := passkeys.Create(Passkey{ID: "k1", UserID: "u2"}); err == nil {
+		t.Error("created a passkey over an existing one")
+	}
+
+	if err := passkeys.UpdateCredential("k1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	passkey, _ := passkeys.Get("k1")
+	if passkey.Credential != "new" || passkey.LastUsedAt == 0 {
+		t.Errorf("after UpdateCredential: %+v", passkey)
+	}
+	if list, _ := passkeys.ListByUser("u1"); len(list) != 1 || list[0].ID != "k1" {
+		t.Errorf("ListByUser = %+v", list)
+	}
+
+	if err := passkeys.Delete("k1", "u2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("deleting another user's passkey: err = %v, want ErrInvalidToken", err)
+	}
+	if err := passkeys.Delete("k1", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if passkey, _ = passkeys.Get("k1"); passkey != nil {
+		t.Error("passkey survived Delete")
+	}
+}
+
+func TestMemoryWebAuthnSessionRepository(t *testing.T) {
+	ceremonies := NewMemoryWebAuthnSessionRepository()
+	ceremonies.Create(WebAuthnSession{ID: "a", Ceremony: "login", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	ceremonies.Create(WebAuthnSession{ID: "b", Ceremony: "login", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+
+	session, err := ceremonies.Consume("a")
+	if err != nil || session.Ceremony != "login" {
+		t.Fatalf("Consume = %+v, %v", session, err)
+	}
+	if _, err := ceremonies.Consume("a"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second use: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := ceremonies.Consume("b"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired session: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestMemoryAPIKeyRepository(t *testing.T) {
+	keys := NewMemoryAPIKeyRepository()
+	keys.Create(APIKey{ID: "k1", UserID: "u1", Scopes: []string{ScopeFilesRead}})
+	keys.Create(APIKey{ID: "k2", UserID: "u2"})
+	if err := keys.Create(APIKey{ID: "k1", UserID: "u2"}); err == nil {
+		t.Error("created an API key over an existing one")
+	}
+
+	if err := keys.Touch("k1"); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keys.Get("k1")
+	if key.LastUsedAt == 0 || key.Scopes[0] != ScopeFilesRead {
+		t.Errorf("after Touch: %+v", key)
+	}
+	if list, _ := keys.ListByUser("u1"); len(list) != 1 || list[0].ID != "k1" {
+		t.Errorf("ListByUser = %+v", list)
+	}
+
+	if err := keys.Delete("k1", "u2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("deleting another user's key: err = %v, want ErrInvalidToken", err)
+	}
+	if err := keys.Delete("k1", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ = keys.Get("k1"); key != nil {
+		t.Error("API key survived Delete")
+	}
+}
+
+func TestMemoryInviteCodeRepository(t *testing.T) {
+	codes := NewMemoryInviteCodeRepository()
+	expires := time.Now().Add(time.Hour).Unix()
+	codes.Create(InviteCode{ID: "a", SecretHash: "h", MaxUses: 1, ExpiresAt: expires})
+	codes.Create(InviteCode{ID: "b", SecretHash: "h", MaxUses: 5, Email: "ann@example.com", ExpiresAt: expires})
+	codes.Create(InviteCode{ID: "c", SecretHash: "h", MaxUses: 5, ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+
+	if _, err := codes.Redeem("a", "wrong", "ann@example.com"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong secret: err = %v, want ErrInvalidToken", err)
+	}
+	if code, err := codes.Redeem("a", "h", "ann@example.com"); err != nil || code.Uses != 1 {
+		t.Fatalf("Redeem = %+v, %v", code, err)
+	}
+	if _, err := codes.Redeem("a", "h", "bob@example.com"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("used-up code: err = %v, want ErrInvalidToken", err)
+	}
+	if err := codes.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := codes.Redeem("a", "h", "bob@example.com"); err != nil {
+		t.Errorf("released code: err = %v", err)
+	}
+
+	if _, err := codes.Redeem("b", "h", "bob@example.com"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("code for another address: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := codes.Redeem("c", "h", "ann@example.com"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expired code: err = %v, want ErrInvalidToken", err)
+	}
+
+	if err := codes.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := codes.Delete("b"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("deleting a missing code: err = %v, want ErrInvalidToken", err)
+	}
+	if list, _ := codes.List(); len(list) != 2 {
+		t.Errorf("List = %+v, want a and c", list)
+	}
+}
+
+func TestMemoryErasureJobRepository(t *testing.T) {
+	jobs := NewMemoryErasureJobRepository()
+	job := ErasureJob{ID: "j1", UserID: "u1", Status: ErasurePending, Deleted: map[string]int{}}
+	jobs.Save(job)
+
+	job.Deleted["files"] = 2
+	if stored, _ := jobs.Get("j1"); stored.Deleted["files"] != 0 {
+		t.Error("a saved job shares its counts with the caller")
+	}
+
+	job.Status = ErasureCompleted
+	jobs.Save(job)
+	if stored, err := jobs.Get("j1"); err != nil || stored.Status != ErasureCompleted || stored.Deleted["files"] != 2 {
+		t.Errorf("after a second Save: %+v, %v", stored, err)
+	}
+	if missing, err := jobs.Get("j2"); missing != nil || err != nil {
+		t.Errorf("Get(missing) = %+v, %v; want nil, nil", missing, err)
+	}
+}
+
+func TestMemoryTusUploadRepository(t *testing.T) {
+	uploads := NewMemoryTusUploadRepository()
+	now := time.Now()
+	if err := uploads.Create(TusUpload{ID: "tus_1", UserID: "u1", Length: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploads.Create(TusUpload{ID: "tus_1"}); err == nil {
+		t.Error("Create over an existing upload succeeded")
+	}
+
+	if err := uploads.Lock("tus_1", 5, "a", now.Add(time.Minute)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Lock at the wrong offset: err = %v, want ErrInvalidToken", err)
+	}
+	if err := uploads.Lock("tus_1", 0, "a", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploads.Lock("tus_1", 0, "b", now.Add(time.Minute)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Lock while held: err = %v, want ErrInvalidToken", err)
+	}
+	if err := uploads.RenewLock("tus_1", "b", now.Add(time.Minute)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("RenewLock by another token: err = %v, want ErrInvalidToken", err)
+	}
+	if err := uploads.RenewLock("tus_1", "a", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock has run out, so another request can take the upload over.
+	if err := uploads.Lock("tus_1", 0, "b", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Lock after expiry: %v", err)
+	}
+	progress := TusUpload{ID: "tus_1", UserID: "u1", Length: 10, Offset: 4, Parts: []BlobPart{{Number: 1}}}
+	if err := uploads.SaveProgress(progress, "a"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("SaveProgress with a lost lock: err = %v, want ErrInvalidToken", err)
+	}
+	if err := uploads.SaveProgress(progress, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	progress.Parts[0].Number = 9
+	stored, err := uploads.Get("tus_1")
+	if err != nil || stored.Offset != 4 || stored.LockToken != "" || stored.Parts[0].Number != 1 {
+		t.Errorf("after SaveProgress: %+v, %v; want offset 4, unlocked, with its own parts", stored, err)
+	}
+	if err := uploads.Lock("tus_1", 4, "c", now.Add(time.Minute)); err != nil {
+		t.Errorf("Lock after SaveProgress released it: %v", err)
+	}
+
+	uploads.Delete("tus_1")
+	if missing, err := uploads.Get("tus_1"); missing != nil || err != nil {
+		t.Errorf("Get after Delete = %+v, %v; want nil, nil", missing, err)
+	}
+}
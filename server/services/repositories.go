@@ -0,0 +1,197 @@
+package services
+
+import "time"
+
+// UserRepository stores user accounts. Get and GetByEmail return nil when there is no
+// match. Conditional operations report a failed condition as ErrInvalidToken, like the
+// functions they wrap.
+type UserRepository interface {
+	Create(user User) error
+	Get(id string) (*User, error)
+	GetByEmail(email string) (*User, error)
+	List() ([]User, error)
+	// Update changes the name and email of an existing user; a new email is unverified.
+	Update(user User) error
+	UpdatePassword(id, passwordHash string) error
+	Delete(id string) error
+	SetAttributes(id string, attrs map[string]interface{}) error
+	ReplacePasswordHash(id, oldHash, newHash string) error
+	ConsumeToken(id, hashAttr, expiresAttr, tokenHash string) error
+	EnableTOTP(id, secret string, counter int64, recoveryHashes []string) error
+	DisableTOTP(id string) error
+	RecordTOTPCounter(id string, counter int64) error
+	ConsumeRecoveryCode(id, codeHash string) error
+}
+
+// FileRepository stores upload metadata. Get returns nil when there is no match.
+type FileRepository interface {
+	Create(file File) error
+	Get(id string) (*File, error)
+	Rename(id, fileName string) error
+	// Activate marks a pending file as uploaded, returning ErrInvalidToken if it is not pending.
+	Activate(id string, size int64) error
+	// Disown removes the uploader from a file that stays with its org.
+	Disown(id string) error
+	Delete(id string) error
+	List() ([]File, error)
+	ListByUser(user string) ([]File, error)
+	ListByOrg(org string) ([]File, error)
+	// ListLegacyByName finds files from before per-file keys stored as uploads/<fileName>.
+	ListLegacyByName(fileName string) ([]File, error)
+}
+
+// PostRepository stores blog posts.
+type PostRepository interface {
+	Create(post BlogPost) error
+	List() ([]BlogPost, error)
+	ListByAuthor(author string) ([]BlogPost, error)
+	// Update sets the non-empty fields of post on the existing post with the same ID.
+	Update(post BlogPost) error
+	Delete(id string) error
+}
+
+// SessionRepository stores sign-in sessions. Get returns nil when there is no match.
+type SessionRepository interface {
+	Create(session Session) error
+	Get(id string) (*Session, error)
+	ListByUser(userID string) ([]Session, error)
+	// Rotate swaps the current refresh token from oldToken to newToken, returning
+	// ErrTokenReuse if oldToken is no longer current or the session has been revoked.
+	Rotate(id, oldToken, newToken, ip string, expiresAt int64) error
+	Revoke(id string) error
+	Delete(id string) error
+}
+
+// AuditRepository is where audit events are appended. Put fills in the event's time.
+type AuditRepository interface {
+	Put(event AuditEvent) error
+}
+
+// OrgMemberRepository stores organization memberships. Get returns nil when there is no
+// match.
+type OrgMemberRepository interface {
+	Put(member OrgMember) error
+	Get(orgID, userID string) (*OrgMember, error)
+	ListByOrg(orgID string) ([]OrgMember, error)
+	ListByUser(userID string) ([]OrgMember, error)
+	Delete(orgID, userID string) error
+}
+
+// LoginAttemptRepository counts failed sign-ins. Get returns nil when there is no match.
+type LoginAttemptRepository interface {
+	Get(id string) (*LoginAttempt, error)
+	// RecordFailure adds a failure and keeps the record for another window.
+	RecordFailure(id string, window time.Duration) (*LoginAttempt, error)
+	Lock(id string, until time.Time) error
+	Clear(id string) error
+}
+
+// OAuthClientRepository stores applications registered with the OIDC provider. Get returns
+// nil when there is no match.
+type OAuthClientRepository interface {
+	Create(client OAuthClient) error
+	Get(id string) (*OAuthClient, error)
+}
+
+// AuthCodeRepository stores pending authorization codes.
+type AuthCodeRepository interface {
+	Create(code AuthCode) error
+	// Consume deletes the code and returns it, or ErrInvalidToken if it is unknown or expired.
+	Consume(id string) (*AuthCode, error)
+}
+
+// PasskeyRepository stores registered WebAuthn credentials. Get returns nil when there is
+// no match, and Delete returns ErrInvalidToken unless the passkey belongs to userID.
+type PasskeyRepository interface {
+	Create(passkey Passkey) error
+	Get(id string) (*Passkey, error)
+	ListByUser(userID string) ([]Passkey, error)
+	UpdateCredential(id, credential string) error
+	Delete(id, userID string) error
+}
+
+// WebAuthnSessionRepository stores ceremonies between their begin and finish requests.
+type WebAuthnSessionRepository interface {
+	Create(session WebAuthnSession) error
+	// Consume deletes the session and returns it, or ErrInvalidToken if it is unknown or expired.
+	Consume(id string) (*WebAuthnSession, error)
+}
+
+// APIKeyRepository stores API keys. Get returns nil when there is no match, and Delete
+// returns ErrInvalidToken unless the key belongs to userID.
+type APIKeyRepository interface {
+	Create(key APIKey) error
+	Get(id string) (*APIKey, error)
+	ListByUser(userID string) ([]APIKey, error)
+	// Touch records that the key was just used.
+	Touch(id string) error
+	Delete(id, userID string) error
+}
+
+// InviteCodeRepository stores registration invite codes. Delete returns ErrInvalidToken
+// when there is no match.
+type InviteCodeRepository interface {
+	Create(code InviteCode) error
+	List() ([]InviteCode, error)
+	Delete(id string) error
+	// Redeem uses up one use of the code, returning ErrInvalidToken if the secret, expiry,
+	// remaining uses or addressed email rule it out.
+	Redeem(id, secretHash, email string) (*InviteCode, error)
+	// Release gives back a use taken by Redeem.
+	Release(id string) error
+}
+
+// ErasureJobRepository stores account erasure jobs. Get returns nil when there is no match.
+type ErasureJobRepository interface {
+	// Save creates or overwrites the job.
+	Save(job ErasureJob) error
+	Get(id string) (*ErasureJob, error)
+}
+
+// TusUploadRepository stores resumable uploads in progress. Get returns nil when there is
+// no match. Writers take a lock on an upload before storing bytes; Lock, RenewLock and
+// SaveProgress return ErrInvalidToken when the lock is not theirs to take or keep.
+type TusUploadRepository interface {
+	Create(upload TusUpload) error
+	Get(id string) (*TusUpload, error)
+	// Lock claims the upload while it is still at offset and nobody holds an unexpired lock.
+	Lock(id string, offset int64, token string, until time.Time) error
+	RenewLock(id, token string, until time.Time) error
+	// SaveProgress stores the upload and releases the lock held by token.
+	SaveProgress(upload TusUpload, token string) error
+	Delete(id string) error
+}
+
+var (
+	_ UserRepository = (*DynamoUserRepository)(nil)
+	_ UserRepository = (*MemoryUserRepository)(nil)
+	_ FileRepository = (*DynamoFileRepository)(nil)
+	_ FileRepository = (*MemoryFileRepository)(nil)
+	_ PostRepository = (*DynamoPostRepository)(nil)
+	_ PostRepository = (*MemoryPostRepository)(nil)
+
+	_ SessionRepository         = (*DynamoSessionRepository)(nil)
+	_ SessionRepository         = (*MemorySessionRepository)(nil)
+	_ AuditRepository           = (*DynamoAuditRepository)(nil)
+	_ AuditRepository           = (*MemoryAuditRepository)(nil)
+	_ OrgMemberRepository       = (*DynamoOrgMemberRepository)(nil)
+	_ OrgMemberRepository       = (*MemoryOrgMemberRepository)(nil)
+	_ LoginAttemptRepository    = (*DynamoLoginAttemptRepository)(nil)
+	_ LoginAttemptRepository    = (*MemoryLoginAttemptRepository)(nil)
+	_ OAuthClientRepository     = (*DynamoOAuthClientRepository)(nil)
+	_ OAuthClientRepository     = (*MemoryOAuthClientRepository)(nil)
+	_ AuthCodeRepository        = (*DynamoAuthCodeRepository)(nil)
+	_ AuthCodeRepository        = (*MemoryAuthCodeRepository)(nil)
+	_ PasskeyRepository         = (*DynamoPasskeyRepository)(nil)
+	_ PasskeyRepository         = (*MemoryPasskeyRepository)(nil)
+	_ WebAuthnSessionRepository = (*DynamoWebAuthnSessionRepository)(nil)
+	_ WebAuthnSessionRepository = (*MemoryWebAuthnSessionRepository)(nil)
+	_ APIKeyRepository          = (*DynamoAPIKeyRepository)(nil)
+	_ APIKeyRepository          = (*MemoryAPIKeyRepository)(nil)
+	_ InviteCodeRepository      = (*DynamoInviteCodeRepository)(nil)
+	_ InviteCodeRepository      = (*MemoryInviteCodeRepository)(nil)
+	_ ErasureJobRepository      = (*DynamoErasureJobRepository)(nil)
+	_ ErasureJobRepository      = (*MemoryErasureJobRepository)(nil)
+	_ TusUploadRepository       = (*DynamoTusUploadRepository)(nil)
+	_ TusUploadRepository       = (*MemoryTusUploadRepository)(nil)
+)
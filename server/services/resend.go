@@ -1,8 +1,11 @@
 package services
 
 import (
+	"fmt"
+	"html"
 	"log"
 	"os"
+	"time"
 
 	"github.com/resend/resend-go/v2"
 )
@@ -12,6 +15,143 @@ func InitResendClient() *resend.Client {
 	return resend.NewClient(apiKey)
 }
 
+func senderAddress() string {
+	if from := os.Getenv("RESEND_FROM"); from != "" {
+		return from
+	}
+	return "Acme <onboarding@peterjohnbishop.com>"
+}
+
+func SendPasswordReset(client *resend.Client, toEmail, resetURL string, expiresIn time.Duration) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "Reset your password",
+		Html: fmt.Sprintf(`<p>We received a request to reset your password.</p>
+<p><a href="%s">Choose a new password</a></p>
+<p>This link expires in %d minutes and can only be used once. If you did not request a reset, you can ignore this email.</p>`, html.EscapeString(resetURL), int(expiresIn.Minutes())),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Password reset email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendEmailVerification(client *resend.Client, toEmail, verifyURL string) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "Verify your email address",
+		Html: fmt.Sprintf(`<p>Please confirm this is your email address.</p>
+<p><a href="%s">Verify email</a></p>
+<p>If you did not create an account or change your email, you can ignore this message.</p>`, html.EscapeString(verifyURL)),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Verification email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendMagicLink(client *resend.Client, toEmail, signInURL string, expiresIn time.Duration) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "Your sign-in link",
+		Html: fmt.Sprintf(`<p>Use the link below to sign in without a password.</p>
+<p><a href="%s">Sign in</a></p>
+<p>This link expires in %d minutes and can only be used once. If you did not ask to sign in, you can ignore this email.</p>`, html.EscapeString(signInURL), int(expiresIn.Minutes())),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Magic link email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendAccountLocked(client *resend.Client, toEmail string, lockedFor time.Duration) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "Sign-in temporarily locked",
+		Html: fmt.Sprintf(`<p>We blocked sign-ins to your account for %s after several failed attempts.</p>
+<p>If this was you, wait and try again. If not, consider resetting your password.</p>`, html.EscapeString(lockedFor.Round(time.Second).String())),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Account lockout email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendOrgInvite(client *resend.Client, toEmail, orgName, inviterName, acceptURL string, expiresIn time.Duration) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: fmt.Sprintf("You've been invited to join %s", orgName),
+		Html: fmt.Sprintf(`<p>%s invited you to join <strong>%s</strong>.</p>
+<p><a href="%s">Accept the invitation</a></p>
+<p>This invitation expires in %d days. Sign in with this email address to accept it.</p>`,
+			html.EscapeString(inviterName), html.EscapeString(orgName), html.EscapeString(acceptURL), int(expiresIn.Hours()/24)),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Org invite email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendInviteCode(client *resend.Client, toEmail, code, registerURL string, expiresAt time.Time) error {
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "You're invited to create an account",
+		Html: fmt.Sprintf(`<p>You've been invited to create an account.</p>
+<p>Your invite code is <code>%s</code>. <a href="%s">Register here</a> and enter it when asked.</p>
+<p>The code expires on %s.</p>`, html.EscapeString(code), html.EscapeString(registerURL), expiresAt.UTC().Format("January 2, 2006")),
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Invite code email sent with ID: %s", sent.Id)
+	return nil
+}
+
+func SendErasureComplete(client *resend.Client, toEmail string, job ErasureJob) error {
+	body := "<p>Your account and the data stored with it have been deleted.</p>"
+	if job.Status != ErasureCompleted {
+		body = "<p>We disabled your account, but some of your data could not be removed " +
+			"automatically. Reply to this email and we will finish removing it.</p>"
+	}
+
+	params := &resend.SendEmailRequest{
+		From:    senderAddress(),
+		To:      []string{toEmail},
+		Subject: "Your account has been deleted",
+		Html:    body,
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+	log.Printf("Erasure email sent with ID: %s", sent.Id)
+	return nil
+}
+
 func SendURL(client *resend.Client, toEmail []string, presignedURL string) error {
 	// Implementation for sending email via Resend API
 	params := &resend.SendEmailRequest{
@@ -1,17 +1,20 @@
 package services
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
-	"os"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/gin-gonic/gin"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type UserFile struct {
@@ -21,63 +24,305 @@ type UserFile struct {
 	Uploaded int64  `dynamodbav:"uploaded"`
 }
 
-func StreamUploadFile(client *s3.Client, fileName string, fileContent multipart.File) error {
-	bucketName := os.Getenv("AWS_BUCKET")
+// S3BlobStore keeps objects in one S3 bucket.
+type S3BlobStore struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3BlobStore(client *s3.Client, bucket string) *S3BlobStore {
+	return &S3BlobStore{client: client, bucket: bucket}
+}
 
-	fileKey := "uploads/" + fileName
+// s3NotFound reports whether err is S3 saying the key does not exist.
+func s3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound) ||
+		(errors.As(err, &respErr) && respErr.HTTPStatusCode() == 404)
+}
 
-	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
-		Body:   fileContent,
+func (s *S3BlobStore) Put(key, contentType string, body io.Reader) error {
+	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentTypeOrDefault(contentType)),
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to put S3 object: %w", err)
 	}
 
 	return nil
 }
 
-func StreamDownloadFile(c *gin.Context, client *s3.Client, fileName string) error {
-	bucketName := os.Getenv("AWS_BUCKET")
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, *BlobInfo, error) {
+	return s.get(key, nil)
+}
 
-	fileKey := "uploads/" + fileName
+func (s *S3BlobStore) GetRange(key string, offset, length int64) (io.ReadCloser, *BlobInfo, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	return s.get(key, aws.String(byteRange))
+}
 
-	resp, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
+func (s *S3BlobStore) get(key string, byteRange *string) (io.ReadCloser, *BlobInfo, error) {
+	resp, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  byteRange,
 	})
+	if s3NotFound(err) {
+		return nil, nil, ErrBlobNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get S3 object: %w", err)
+		return nil, nil, fmt.Errorf("failed to get S3 object: %w", err)
 	}
-	defer resp.Body.Close()
 
-	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Header("Content-Type", *resp.ContentType)
-	c.Header("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	info := &BlobInfo{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  contentTypeOrDefault(aws.ToString(resp.ContentType)),
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+	// For range reads the total size is after the slash in "bytes 0-99/1234".
+	if _, total, ok := strings.Cut(aws.ToString(resp.ContentRange), "/"); ok {
+		if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+			info.Size = n
+		}
+	}
 
-	_, err = io.Copy(c.Writer, resp.Body)
+	return resp.Body, info, nil
+}
+
+func (s *S3BlobStore) Head(key string) (*BlobInfo, error) {
+	resp, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if s3NotFound(err) {
+		return nil, ErrBlobNotFound
+	}
 	if err != nil {
-		log.Println("Error streaming S3 object:", err)
-		return fmt.Errorf("failed to stream file")
+		return nil, fmt.Errorf("failed to head S3 object: %w", err)
+	}
+
+	info := &BlobInfo{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  contentTypeOrDefault(aws.ToString(resp.ContentType)),
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+	info.ChecksumSHA256 = aws.ToString(resp.ChecksumSHA256)
+
+	return info, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete S3 object: %w", err)
 	}
 
 	return nil
 }
 
-func GeneratePresignedDownloadURL(client *s3.Client, fileKey string) (string, error) {
-	bucketName := os.Getenv("AWS_BUCKET")
+func (s *S3BlobStore) DeletePrefix(prefix string) (int, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		return 0, fmt.Errorf("invalid prefix %q", prefix)
+	}
+
+	deleted := 0
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+		}
+		out, err := s.client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete S3 objects: %w", err)
+		}
+		deleted += len(objects) - len(out.Errors)
+		if len(out.Errors) > 0 {
+			return deleted, fmt.Errorf("failed to delete S3 object %s: %s", aws.ToString(out.Errors[0].Key), aws.ToString(out.Errors[0].Message))
+		}
+	}
+
+	return deleted, nil
+}
 
-	presignClient := s3.NewPresignClient(client)
-	expiration := 5 * time.Minute
+func (s *S3BlobStore) SignedURL(key string, expires time.Duration) (string, error) {
+	presignClient := s3.NewPresignClient(s.client)
 
 	req, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
-	}, s3.WithPresignExpires(expiration))
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
 	}
 
 	return req.URL, nil
 }
+
+func (s *S3BlobStore) SignedPutURL(key, contentType, checksum string, expires time.Duration) (string, map[string]string, error) {
+	presignClient := s3.NewPresignClient(s.client)
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentTypeOrDefault(contentType)),
+	}
+	if checksum != "" {
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+
+	req, err := presignClient.PresignPutObject(context.TODO(), input, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate presigned upload URL: %w", err)
+	}
+
+	headers := signedHeaders(req.SignedHeader)
+	if _, ok := headers["Content-Type"]; !ok {
+		headers["Content-Type"] = contentTypeOrDefault(contentType)
+	}
+
+	return req.URL, headers, nil
+}
+
+func (s *S3BlobStore) SignedPartURL(key, uploadID string, number int32, checksum string, expires time.Duration) (string, map[string]string, error) {
+	presignClient := s3.NewPresignClient(s.client)
+
+	req, err := presignClient.PresignUploadPart(context.TODO(), &s3.UploadPartInput{
+		Bucket:         aws.String(s.bucket),
+		Key:            aws.String(key),
+		UploadId:       aws.String(uploadID),
+		PartNumber:     aws.Int32(number),
+		ChecksumSHA256: aws.String(checksum),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate presigned part URL: %w", err)
+	}
+
+	return req.URL, signedHeaders(req.SignedHeader), nil
+}
+
+// signedHeaders lists the headers a client has to send with a presigned request. Host is
+// left out since every HTTP client sets it from the URL.
+func signedHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name := range header {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		headers[name] = header.Get(name)
+	}
+	return headers
+}
+
+func (s *S3BlobStore) CreateMultipart(key, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentTypeOrDefault(contentType)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3BlobStore) CreateChecksummedMultipart(key, contentType string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		ContentType:       aws.String(contentTypeOrDefault(contentType)),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3BlobStore) UploadPart(key, uploadID string, number int32, data []byte) (BlobPart, error) {
+	out, err := s.client.UploadPart(context.TODO(), &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	if err != nil {
+		return BlobPart{}, fmt.Errorf("failed to upload part %d: %w", number, err)
+	}
+
+	return BlobPart{Number: number, ETag: aws.ToString(out.ETag)}, nil
+}
+
+func (s *S3BlobStore) CompleteMultipart(key, uploadID string, parts []BlobPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedPart := types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.Number),
+		}
+		if part.Checksum != "" {
+			completedPart.ChecksumSHA256 = aws.String(part.Checksum)
+		}
+		completed = append(completed, completedPart)
+	}
+
+	_, err := s.client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return nil
+}
+
+func (s *S3BlobStore) AbortMultipart(key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if err != nil && !errors.As(err, &noSuchUpload) {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func LogoutReq(sessions services.SessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		if claims.SessionID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token is not bound to a session"})
+			return
+		}
+
+		if err := sessions.Revoke(claims.SessionID); err != nil {
+			log.Printf("Failed to revoke session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	}
+}
+
+// revokeUserSessions signs the user out everywhere except the session keep (which may be empty).
+func revokeUserSessions(sessions services.SessionRepository, userID, keep string) (int, error) {
+	list, err := sessions.ListByUser(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range list {
+		if session.ID == keep || session.Revoked {
+			continue
+		}
+		if err := sessions.Revoke(session.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func ListSessionsReq(sessions services.SessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		list, err := sessions.ListByUser(claims.ID)
+		if err != nil {
+			log.Printf("Failed to list sessions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+			return
+		}
+
+		now := time.Now().Unix()
+		active := []gin.H{}
+		for _, session := range list {
+			if session.Revoked || session.ExpiresAt <= now {
+				continue
+			}
+			active = append(active, gin.H{
+				"id":         session.ID,
+				"userAgent":  session.UserAgent,
+				"ip":         session.IP,
+				"createdAt":  session.CreatedAt,
+				"lastUsedAt": session.LastUsedAt,
+				"current":    session.ID == claims.SessionID,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Sessions Found!",
+			"sessions": active,
+		})
+	}
+}
+
+func DeleteSessionReq(sessions services.SessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+		id := c.Param("id")
+
+		session, err := sessions.Get(id)
+		if err != nil {
+			log.Printf("Failed to load session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load session"})
+			return
+		}
+		if session == nil || session.UserID != claims.ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+
+		if err := sessions.Revoke(id); err != nil {
+			log.Printf("Failed to revoke session: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out session"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Session signed out"})
+	}
+}
+
+func DeleteOtherSessionsReq(sessions services.SessionRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		revoked, err := revokeUserSessions(sessions, claims.ID, claims.SessionID)
+		if err != nil {
+			log.Printf("Failed to revoke sessions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out other sessions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Other sessions signed out",
+			"revoked": revoked,
+		})
+	}
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tus 1.0 resumable uploads (https://tus.io/protocols/resumable-upload), with the creation,
+// termination and expiration extensions. Bytes go straight into a multipart upload on the
+// blob store, so whatever has arrived survives a dropped connection.
+
+const (
+	tusExtensions = "creation,termination,expiration"
+	// tusPartSize is the smallest part written to the blob store. Bigger uploads use bigger
+	// parts to stay within S3's 10,000 part limit.
+	tusPartSize = 8 << 20
+	tusMaxParts = 10000
+	// tusLockTTL is how long a request may go without storing a part before another
+	// request can take the upload over.
+	tusLockTTL = 5 * time.Minute
+)
+
+// tusMaxSize reads TUS_MAX_SIZE in bytes, defaulting to 50 GiB.
+func tusMaxSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("TUS_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 50 << 30
+}
+
+// tusExpiry reads TUS_UPLOAD_EXPIRY, defaulting to a day. Unfinished uploads are discarded
+// once it has passed.
+func tusExpiry() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("TUS_UPLOAD_EXPIRY")); err == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// tusPendingKey holds the tail of an upload that does not fill a part yet.
+func tusPendingKey(id string) string {
+	return "tus/" + id + ".pending"
+}
+
+// pruneLocalTusUploads removes, every hour, the parts and pending bytes of uploads on the
+// local backend that have not been written to for longer than any upload can last. With
+// S3, lifecycle rules do the same.
+func pruneLocalTusUploads(store *services.LocalBlobStore) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		cutoff := time.Now().Add(-tusExpiry())
+		if n, err := store.PruneMultipart(cutoff); err != nil {
+			log.Printf("Failed to prune abandoned multipart uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d abandoned multipart uploads", n)
+		}
+		if n, err := store.PruneObjects("tus/", cutoff); err != nil {
+			log.Printf("Failed to prune abandoned tus uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d abandoned tus uploads", n)
+		}
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header. It also returns the header without
+// the shared secret, which is all that gets stored.
+func parseTusMetadata(header string) (map[string]string, string, bool) {
+	meta := map[string]string{}
+	var kept []string
+	if strings.TrimSpace(header) == "" {
+		return meta, "", true
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		key, value, _ := strings.Cut(pair, " ")
+		if key == "" {
+			return nil, "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, "", false
+		}
+		meta[key] = string(decoded)
+		if key != "shared_secret" {
+			kept = append(kept, pair)
+		}
+	}
+
+	return meta, strings.Join(kept, ","), true
+}
+
+func setTusExpiry(c *gin.Context, upload *services.TusUpload) {
+	if !upload.Finished {
+		c.Header("Upload-Expires", time.Unix(upload.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	}
+}
+
+// discardTusUpload drops the stored parts and the upload record.
+func discardTusUpload(uploads services.TusUploadRepository, blobs services.MultipartBlobStore, upload *services.TusUpload) error {
+	if upload.MultipartID != "" {
+		if err := blobs.AbortMultipart(upload.BlobKey(), upload.MultipartID); err != nil {
+			return err
+		}
+	}
+	if err := blobs.Delete(tusPendingKey(upload.ID)); err != nil {
+		return err
+	}
+	return uploads.Delete(upload.ID)
+}
+
+// loadTusUpload fetches the caller's upload for a /files/tus/:id request. It responds 404
+// for other users' uploads and 410 once an upload has expired, discarding it.
+func loadTusUpload(uploads services.TusUploadRepository, blobs services.MultipartBlobStore, c *gin.Context) *services.TusUpload {
+	claims := c.MustGet("claims").(*middlware.UserClaims)
+
+	upload, err := uploads.Get(c.Param("id"))
+	if err != nil {
+		log.Printf("Failed to load upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return nil
+	}
+	if upload == nil || upload.UserID != claims.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil
+	}
+
+	if time.Now().Unix() > upload.ExpiresAt {
+		if !upload.Finished {
+			if err := discardTusUpload(uploads, blobs, upload); err != nil {
+				log.Printf("Failed to discard expired upload %s: %v", upload.ID, err)
+			}
+		}
+		c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+		return nil
+	}
+
+	return upload
+}
+
+// lockTusUpload claims the upload for this request before any bytes are written. It
+// responds 423 and returns "" while another request holds it.
+func lockTusUpload(uploads services.TusUploadRepository, c *gin.Context, upload *services.TusUpload) string {
+	token := ShortUUID()
+	err := uploads.Lock(upload.ID, upload.Offset, token, time.Now().Add(tusLockTTL))
+	if errors.Is(err, services.ErrInvalidToken) {
+		c.JSON(http.StatusLocked, gin.H{"error": "The upload is being written by another request"})
+		return ""
+	}
+	if err != nil {
+		log.Printf("Failed to lock upload %s: %v", upload.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return ""
+	}
+	return token
+}
+
+// writeTusChunk appends body to the upload, storing a part each time PartSize bytes have
+// built up. Whatever is left over, including everything read before a client disconnects,
+// is kept as the pending object. renew is called before every write and stops the write
+// if the lock has been lost. The upload's offset always matches what was stored, even
+// when an error is returned.
+func writeTusChunk(blobs services.MultipartBlobStore, upload *services.TusUpload, body io.Reader, renew func() error) error {
+	key := upload.BlobKey()
+	stored := upload.Offset - upload.PendingSize
+	buf := make([]byte, upload.PartSize)
+	n := 0
+
+	if upload.PendingSize > 0 {
+		pending, _, err := blobs.Get(tusPendingKey(upload.ID))
+		if err != nil {
+			return fmt.Errorf("failed to open pending bytes: %w", err)
+		}
+		n, err = io.ReadFull(pending, buf[:upload.PendingSize])
+		pending.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read pending bytes: %w", err)
+		}
+	}
+
+	for {
+		m, readErr := io.ReadFull(body, buf[n:])
+		n += m
+
+		last := stored+int64(n) == upload.Length
+		if n == len(buf) || (last && n > 0) {
+			if err := renew(); err != nil {
+				return err
+			}
+			part, err := blobs.UploadPart(key, upload.MultipartID, int32(len(upload.Parts)+1), buf[:n])
+			if err != nil {
+				return err
+			}
+			upload.Parts = append(upload.Parts, part)
+			stored += int64(n)
+			upload.Offset, upload.PendingSize, n = stored, 0, 0
+			if last {
+				return nil
+			}
+		}
+
+		// EOF, or the client went away; either way keep what did arrive.
+		if readErr != nil {
+			break
+		}
+	}
+
+	if n > 0 {
+		if err := renew(); err != nil {
+			return err
+		}
+		if err := blobs.Put(tusPendingKey(upload.ID), "application/octet-stream", bytes.NewReader(buf[:n])); err != nil {
+			return err
+		}
+	}
+	upload.Offset, upload.PendingSize = stored+int64(n), int64(n)
+	return nil
+}
+
+// finishTusUpload assembles the object and records the file, exactly as Upload does.
+func finishTusUpload(audit services.AuditRepository, files services.FileRepository, blobs services.MultipartBlobStore, c *gin.Context, upload *services.TusUpload) error {
+	previous, err := files.Get(upload.FileID)
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.User != upload.UserID {
+		return fmt.Errorf("file %s belongs to another user", upload.FileID)
+	}
+
+	if upload.MultipartID != "" {
+		if err := blobs.CompleteMultipart(upload.BlobKey(), upload.MultipartID, upload.Parts); err != nil {
+			return err
+		}
+		upload.MultipartID, upload.Parts = "", nil
+	}
+
+	file := services.File{ID: upload.FileID, FileName: upload.FileName, User: upload.UserID, Org: upload.Org, ObjectKey: upload.ObjectKey}
+	if err := saveFile(files, blobs, previous, file); err != nil {
+		return err
+	}
+	upload.Finished = true
+	if err := blobs.Delete(tusPendingKey(upload.ID)); err != nil {
+		log.Printf("Failed to delete pending bytes of upload %s: %v", upload.ID, err)
+	}
+
+	middlware.Audit(audit, c, services.AuditEvent{Event: services.AuditUpload, Outcome: services.AuditSuccess, Target: upload.FileID, Detail: upload.FileName})
+	return nil
+}
+
+func TusOptionsReq() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Version", middlware.TusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		c.Header("Tus-Max-Size", strconv.FormatInt(tusMaxSize(), 10))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TusCreateReq starts an upload. Upload-Metadata must carry filename and shared_secret,
+// which give the file the same ID as Upload; org and filetype are optional.
+func TusCreateReq(uploads services.TusUploadRepository, members services.OrgMemberRepository, audit services.AuditRepository, files services.FileRepository, blobs services.MultipartBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*middlware.UserClaims)
+
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length is required"})
+			return
+		}
+		if length > tusMaxSize() {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Uploads must be at most %d bytes", tusMaxSize())})
+			return
+		}
+
+		meta, storedMeta, ok := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata"})
+			return
+		}
+		fileName := filepath.Base(meta["filename"])
+		if meta["filename"] == "" || fileName == "." || fileName == "/" || meta["shared_secret"] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must include filename and shared_secret"})
+			return
+		}
+
+		id := fileID(meta["shared_secret"], fileName)
+		if !checkUploadOrg(members, audit, c, meta["org"], claims.ID, id) {
+			return
+		}
+		if _, ok := checkFileOwner(files, c, id, claims.ID); !ok {
+			return
+		}
+
+		now := time.Now()
+		upload := services.TusUpload{
+			ID:          "tus_" + ShortUUID(),
+			UserID:      claims.ID,
+			FileID:      id,
+			FileName:    fileName,
+			Org:         meta["org"],
+			ContentType: meta["filetype"],
+			Metadata:    storedMeta,
+			Length:      length,
+			PartSize:    max(tusPartSize, (length+tusMaxParts-1)/tusMaxParts),
+			CreatedAt:   now.Unix(),
+			ExpiresAt:   now.Add(tusExpiry()).Unix(),
+			ObjectKey:   newObjectKey(id, meta["org"]),
+		}
+
+		if length == 0 {
+			if err := blobs.Put(upload.BlobKey(), upload.ContentType, bytes.NewReader(nil)); err != nil {
+				log.Printf("Upload failed: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+				return
+			}
+			if err := finishTusUpload(audit, files, blobs, c, &upload); err != nil {
+				log.Printf("Failed to finish upload %s: %v", upload.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+				return
+			}
+			c.Header("File-Id", upload.FileID)
+		} else {
+			upload.MultipartID, err = blobs.CreateMultipart(upload.BlobKey(), upload.ContentType)
+			if err != nil {
+				log.Printf("Failed to start multipart upload: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+				return
+			}
+		}
+
+		if err := uploads.Create(upload); err != nil {
+			log.Printf("Failed to store upload: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+			return
+		}
+
+		c.Header("Location", AppURL()+"/files/tus/"+upload.ID)
+		setTusExpiry(c, &upload)
+		c.Status(http.StatusCreated)
+	}
+}
+
+func TusHeadReq(uploads services.TusUploadRepository, blobs services.MultipartBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		upload := loadTusUpload(uploads, blobs, c)
+		if upload == nil {
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Metadata != "" {
+			c.Header("Upload-Metadata", upload.Metadata)
+		}
+		if upload.Finished {
+			c.Header("File-Id", upload.FileID)
+		}
+		setTusExpiry(c, upload)
+		c.Status(http.StatusOK)
+	}
+}
+
+func TusPatchReq(uploads services.TusUploadRepository, audit services.AuditRepository, files services.FileRepository, blobs services.MultipartBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.ContentType() != "application/offset+octet-stream" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset is required"})
+			return
+		}
+
+		upload := loadTusUpload(uploads, blobs, c)
+		if upload == nil {
+			return
+		}
+		if offset != upload.Offset {
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the upload"})
+			return
+		}
+		remaining := upload.Length - upload.Offset
+		if c.Request.ContentLength > remaining {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is longer than the rest of the upload"})
+			return
+		}
+
+		lock := lockTusUpload(uploads, c, upload)
+		if lock == "" {
+			return
+		}
+		renew := func() error {
+			return uploads.RenewLock(upload.ID, lock, time.Now().Add(tusLockTTL))
+		}
+		writeErr := writeTusChunk(blobs, upload, io.LimitReader(c.Request.Body, remaining), renew)
+		// A finished upload whose Files record failed is retried by sending an empty PATCH.
+		if writeErr == nil && upload.Offset == upload.Length && !upload.Finished {
+			if writeErr = renew(); writeErr == nil {
+				writeErr = finishTusUpload(audit, files, blobs, c, upload)
+			}
+		}
+
+		// Save whatever was stored, even if the rest failed, so the client can resume from it.
+		err = uploads.SaveProgress(*upload, lock)
+		if errors.Is(err, services.ErrInvalidToken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The upload was changed by another request"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to save upload %s: %v", upload.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save upload"})
+			return
+		}
+		if writeErr != nil {
+			log.Printf("Failed to write upload %s: %v", upload.ID, writeErr)
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+			return
+		}
+
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		if upload.Finished {
+			c.Header("File-Id", upload.FileID)
+		}
+		setTusExpiry(c, upload)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TusDeleteReq terminates an upload. Finished uploads only lose their tus record; the file
+// itself stays.
+func TusDeleteReq(uploads services.TusUploadRepository, blobs services.MultipartBlobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		upload := loadTusUpload(uploads, blobs, c)
+		if upload == nil {
+			return
+		}
+		if lockTusUpload(uploads, c, upload) == "" {
+			return
+		}
+
+		if err := discardTusUpload(uploads, blobs, upload); err != nil {
+			log.Printf("Failed to terminate upload %s: %v", upload.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to terminate upload"})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"congenial-goggles/server/middlware"
+	"congenial-goggles/server/services"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTusTestApp adds the tus routes, with their uploads kept in the returned repository.
+func newTusTestApp(t *testing.T) (*testApp, *services.MemoryTusUploadRepository) {
+	t.Helper()
+	app := newTestApp(t)
+	uploads := services.NewMemoryTusUploadRepository()
+	tus := app.r.Group("/files/tus", middlware.AuthMiddleware(app.apiKeys, app.users, app.sessions), middlware.TusResumable())
+	tus.POST("/", TusCreateReq(uploads, app.members, app.audit, app.files, app.blobs))
+	tus.HEAD("/:id", TusHeadReq(uploads, app.blobs))
+	tus.PATCH("/:id", TusPatchReq(uploads, app.audit, app.files, app.blobs))
+	tus.DELETE("/:id", TusDeleteReq(uploads, app.blobs))
+	return app, uploads
+}
+
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", middlware.TusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req
+}
+
+// createTusUpload starts an upload of length bytes named name and returns its ID.
+func (app *testApp) createTusUpload(t *testing.T, token, name string, length int) string {
+	t.Helper()
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte(name)) + ",shared_secret " + base64.StdEncoding.EncodeToString([]byte("s3cret"))
+	w := app.serve(tusRequest(http.MethodPost, "/files/tus/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": meta,
+	}), token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	return path.Base(w.Header().Get("Location"))
+}
+
+func (app *testApp) patchTus(token, id string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return app.serve(tusRequest(http.MethodPatch, "/files/tus/"+id, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}), token)
+}
+
+func (app *testApp) headTus(token, id string) *httptest.ResponseRecorder {
+	return app.serve(tusRequest(http.MethodHead, "/files/tus/"+id, nil, nil), token)
+}
+
+// tusContent is length bytes that differ from one part to the next.
+func tusContent(length int) []byte {
+	content := make([]byte, length)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	return content
+}
+
+func TestTusUpload(t *testing.T) {
+	app, uploads := newTusTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	bob := app.addUser(t, "u2", "bob@example.com", "")
+
+	// One full part and a bit, so the upload goes through a part, the pending bytes and a
+	// short last part.
+	content := tusContent(tusPartSize + 3<<20)
+	id := app.createTusUpload(t, ann.AccessToken, "video.mp4", len(content))
+
+	w := app.headTus(ann.AccessToken, id)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" || w.Header().Get("Upload-Length") != strconv.Itoa(len(content)) || w.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("HEAD: status = %d, headers = %v", w.Code, w.Header())
+	}
+	if meta := w.Header().Get("Upload-Metadata"); !strings.HasPrefix(meta, "filename ") || strings.Contains(meta, "shared_secret") {
+		t.Errorf("HEAD Upload-Metadata = %q, want the filename without the secret", meta)
+	}
+	if w := app.headTus(bob.AccessToken, id); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD by another user: status = %d, want 404", w.Code)
+	}
+	if w := app.serve(httptest.NewRequest(http.MethodHead, "/files/tus/"+id, nil), ann.AccessToken); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("HEAD without Tus-Resumable: status = %d, want 412", w.Code)
+	}
+
+	// Less than a part is held back as pending bytes.
+	first := 3 << 20
+	if w := app.patchTus(ann.AccessToken, id, 0, content[:first]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(first) {
+		t.Fatalf("PATCH 1: status = %d, offset = %q, body = %s", w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+	}
+	if upload, _ := uploads.Get(id); len(upload.Parts) != 0 || upload.PendingSize != int64(first) {
+		t.Errorf("after PATCH 1: %d parts and %d pending bytes, want 0 and %d", len(upload.Parts), upload.PendingSize, first)
+	}
+
+	w = app.patchTus(ann.AccessToken, id, 0, content[:first])
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != strconv.Itoa(first) {
+		t.Errorf("PATCH at a stale offset: status = %d, offset = %q, want 409 and the real offset", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = app.serve(tusRequest(http.MethodPatch, "/files/tus/"+id, content[first:], map[string]string{"Upload-Offset": strconv.Itoa(first)}), ann.AccessToken)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PATCH without the tus content type: status = %d, want 415", w.Code)
+	}
+
+	// Filling a part writes it out, with the pending bytes at its start.
+	second := tusPartSize + 1<<20
+	if w := app.patchTus(ann.AccessToken, id, first, content[first:second]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(second) {
+		t.Fatalf("PATCH 2: status = %d, offset = %q, body = %s", w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+	}
+	if upload, _ := uploads.Get(id); len(upload.Parts) != 1 || upload.PendingSize != 1<<20 {
+		t.Errorf("after PATCH 2: %d parts and %d pending bytes, want 1 and %d", len(upload.Parts), upload.PendingSize, 1<<20)
+	}
+
+	w = app.patchTus(ann.AccessToken, id, second, content[second:])
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(len(content)) {
+		t.Fatalf("PATCH 3: status = %d, offset = %q, body = %s", w.Code, w.Header().Get("Upload-Offset"), w.Body.String())
+	}
+	fileID := w.Header().Get("File-Id")
+	file, _ := app.files.Get(fileID)
+	if fileID == "" || file == nil || file.FileName != "video.mp4" || file.User != "u1" {
+		t.Fatalf("finished file %q = %+v", fileID, file)
+	}
+	if got := app.storedBlob(t, file.BlobKey()); !bytes.Equal(got, content) {
+		t.Errorf("assembled %d bytes, want the %d uploaded", len(got), len(content))
+	}
+	if _, err := app.blobs.Head(tusPendingKey(id)); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("pending bytes left behind: %v", err)
+	}
+	if w := app.headTus(ann.AccessToken, id); w.Header().Get("File-Id") != fileID || w.Header().Get("Upload-Expires") != "" {
+		t.Errorf("HEAD after finishing: headers = %v, want the File-Id and no expiry", w.Header())
+	}
+	if n := app.auditCount(services.AuditUpload, services.AuditSuccess); n != 1 {
+		t.Errorf("recorded %d successful uploads, want 1", n)
+	}
+}
+
+func TestTusUploadEmpty(t *testing.T) {
+	app, _ := newTusTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+
+	id := app.createTusUpload(t, ann.AccessToken, "empty.txt", 0)
+	w := app.headTus(ann.AccessToken, id)
+	file, _ := app.files.Get(w.Header().Get("File-Id"))
+	if file == nil || len(app.storedBlob(t, file.BlobKey())) != 0 {
+		t.Errorf("empty upload: HEAD headers = %v, file = %+v", w.Header(), file)
+	}
+}
+
+func TestTusUploadLocked(t *testing.T) {
+	app, uploads := newTusTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	id := app.createTusUpload(t, ann.AccessToken, "a.bin", 10)
+
+	// Another request is writing the upload.
+	if err := uploads.Lock(id, 0, "other", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if w := app.patchTus(ann.AccessToken, id, 0, []byte("hello")); w.Code != http.StatusLocked {
+		t.Errorf("PATCH while locked: status = %d, want 423", w.Code)
+	}
+	if w := app.serve(tusRequest(http.MethodDelete, "/files/tus/"+id, nil, nil), ann.AccessToken); w.Code != http.StatusLocked {
+		t.Errorf("DELETE while locked: status = %d, want 423", w.Code)
+	}
+
+	// Once that request has stalled past its lock, the next one takes over.
+	if err := uploads.RenewLock(id, "other", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if w := app.patchTus(ann.AccessToken, id, 0, []byte("hello")); w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH after the lock expired: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if err := uploads.RenewLock(id, "other", time.Now().Add(time.Minute)); !errors.Is(err, services.ErrInvalidToken) {
+		t.Errorf("the stalled request kept its lock: err = %v", err)
+	}
+	if upload, _ := uploads.Get(id); upload.LockToken != "" || upload.Offset != 5 {
+		t.Errorf("after PATCH: %+v, want offset 5 and no lock", upload)
+	}
+}
+
+func TestTusUploadTermination(t *testing.T) {
+	app, uploads := newTusTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	bob := app.addUser(t, "u2", "bob@example.com", "")
+	id := app.createTusUpload(t, ann.AccessToken, "a.bin", 10)
+	app.patchTus(ann.AccessToken, id, 0, []byte("hello"))
+
+	if w := app.serve(tusRequest(http.MethodDelete, "/files/tus/"+id, nil, nil), bob.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE by another user: status = %d, want 404", w.Code)
+	}
+	if w := app.serve(tusRequest(http.MethodDelete, "/files/tus/"+id, nil, nil), ann.AccessToken); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if upload, _ := uploads.Get(id); upload != nil {
+		t.Errorf("terminated upload = %+v, want it gone", upload)
+	}
+	if _, err := app.blobs.Head(tusPendingKey(id)); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("pending bytes left behind: %v", err)
+	}
+	if w := app.headTus(ann.AccessToken, id); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: status = %d, want 404", w.Code)
+	}
+}
+
+func TestTusUploadExpiry(t *testing.T) {
+	app, uploads := newTusTestApp(t)
+	ann := app.addUser(t, "u1", "ann@example.com", "")
+	id := app.createTusUpload(t, ann.AccessToken, "a.bin", 10)
+	app.patchTus(ann.AccessToken, id, 0, []byte("hello"))
+
+	upload, _ := uploads.Get(id)
+	upload.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	if err := uploads.Lock(id, upload.Offset, "t", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploads.SaveProgress(*upload, "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := app.patchTus(ann.AccessToken, id, 5, []byte("world")); w.Code != http.StatusGone {
+		t.Errorf("PATCH after expiry: status = %d, want 410", w.Code)
+	}
+	if upload, _ := uploads.Get(id); upload != nil {
+		t.Errorf("expired upload = %+v, want it discarded", upload)
+	}
+	if _, err := app.blobs.Head(tusPendingKey(id)); !errors.Is(err, services.ErrBlobNotFound) {
+		t.Errorf("pending bytes left behind: %v", err)
+	}
+}